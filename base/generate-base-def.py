@@ -191,6 +191,8 @@ assignments = [
     [Statement.SIMPLE_STR, "TOPIC_OPTIONS",  "net.options"],
     [Statement.SIMPLE_STR, "TOPIC_DEVICE_INVENTORY",  "net.device_inventory"],
     [Statement.SIMPLE_STR, "TOPIC_PUBLIC_LOG", "net.publiclog"],
+    [Statement.SIMPLE_STR, "TOPIC_STEER", "net.steer"],
+    [Statement.SIMPLE_STR, "TOPIC_SCAN_CHANGE", "net.scan_change"],
 
     [Statement.COMMENT, "Diagnostic client HTTP ports"],
     [Statement.SIMPLE_PORT, "BROKERD_DIAG_PORT", 3200],
@@ -221,6 +223,7 @@ assignments = [
     [Statement.SIMPLE_PORT, "CLCONFIGD_GRPC_PORT", 4431],
 
     [Statement.SIMPLE_NUM, "WIREGUARD_PORT", 51820],
+    [Statement.SIMPLE_NUM, "WIREGUARD_MESH_PORT", 51821],
 
     [Statement.COMMENT, "API related definitions"],
     [Statement.SIMPLE_STR, "API_URL", "https://api.brightgate.com"],
@@ -233,6 +236,7 @@ assignments = [
     [Statement.SIMPLE_STR, "CEF_DEVICE_UNENROLLED", "device-unenrolled"],
     [Statement.SIMPLE_STR, "CEF_LOGIN_EAP_SUCCESS", "login-eap-successful"],
     [Statement.SIMPLE_STR, "CEF_LOGIN_FAILURE", "login-failure"],
+    [Statement.SIMPLE_STR, "CEF_GEO_BLOCKED", "geo-blocked"],
 
     [Statement.SECTION, ")"],
     [Statement.FOOTER, None],
@@ -264,6 +264,7 @@ class AppliancePackage(Package):
         "dnsutils",
         "ethtool",
         "iproute2",
+        "ipset",
         "iptables",
         "iptables-persistent",
         "iw",
@@ -286,6 +287,7 @@ class AppliancePackage(Package):
         "chrony",
         "curl",
         "ethtool",
+        "ipset",
         "iw-full",
         "logrotate",
         "nmap-ssl",
@@ -302,6 +302,21 @@ const mockFeatures = {
 const mockHealth = {
   'heartbeatProblem': true,
   'configProblem': true,
+  'rogueAPProblem': true,
+  'rogueAPs': [
+    {
+      'bssid': '02:1a:2b:3c:4d:5e',
+      'kind': 'evil_twin',
+      'ssid': 'dunder-device',
+      'vap': 'psk',
+      'node': '001-201901BB-000001',
+      'band': '2.4GHz',
+      'channel': 6,
+      'signal': -52,
+      'firstSeen': '2020-03-04T10:02:00Z',
+      'lastSeen': '2020-03-04T17:02:00Z',
+    },
+  ],
 };
 
 const mockConfig = {
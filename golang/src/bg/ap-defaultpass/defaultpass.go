@@ -49,7 +49,7 @@ var (
 	dpPath      = flag.String("f", "", "credentials path (required except in reset mode)")
 	ipAddr      = flag.String("i", "", "target ip address (required)")
 	verbose     = flag.Bool("v", false, "verbose output (optional)")
-	testsToRun  = flag.String("t", "http:80.ftp:21.ssh:22", "format, dot-separated = test:(starting index:)port(,more,ports)")
+	testsToRun  = flag.String("t", "http:80.ftp:21.ssh:22.telnet:23.rtsp:554.snmp:161", "format, dot-separated = test:(starting index:)port(,more,ports)")
 	reset       = flag.String("r", "", "reset mode, service:port:user:password, e.g. ssh:22:admin:password (optional)")
 	newUsername = flag.String("u", "", "new username (reset mode only)")
 	humanPass   = flag.Bool("human-password", false, "generate human-friendly password (reset mode only)")
@@ -59,9 +59,12 @@ var (
 )
 
 var testMap = map[string]probefunc{
-	"http": httpProbe,
-	"ftp":  ftpProbe,
-	"ssh":  sshProbe,
+	"http":   httpProbe,
+	"ftp":    ftpProbe,
+	"ssh":    sshProbe,
+	"telnet": telnetProbe,
+	"rtsp":   rtspProbe,
+	"snmp":   snmpProbe,
 }
 
 func fetchDefaults(defaultsPath string) ([]apvuln.DPcredentials, error) {
@@ -104,29 +107,30 @@ func httpProbe(clist []apvuln.DPcredentials, startfrom int, vulnports *apvuln.Vu
 	// Must read the body and close it; limit read as a defensive measure.
 	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, megaByte))
 	resp.Body.Close()
-	if len(resp.Header["Www-Authenticate"]) == 0 {
-		return 0
-	}
 
-	// Check for basic auth
-	var basicAuth bool
-	for _, authstr := range resp.Header["Www-Authenticate"] {
-		if strings.Contains(strings.ToLower(authstr), "basic") { // case insensitive matching
-			basicAuth = true
-			break
-		}
+	// Check for basic or digest auth
+	var challenge *digestChallenge
+	scheme := authScheme(resp.Header["Www-Authenticate"])
+	if scheme == "digest" {
+		challenge = parseDigestChallenge(resp.Header["Www-Authenticate"])
 	}
-	if !basicAuth {
+	if scheme == "" || (scheme == "digest" && challenge == nil) {
 		return 0
 	}
+	schemeName := strings.Title(scheme)
 	if *verbose {
-		fmt.Printf("HTTP Basic Auth detected, probing...\n")
+		fmt.Printf("HTTP %s Auth detected, probing...\n", schemeName)
 	}
 	for i, creds := range clist[startfrom:] {
 		if *verbose {
-			fmt.Printf("HTTP Basic Auth test: [ %d / %d ]\n", i+startfrom+1, len(clist))
+			fmt.Printf("HTTP %s Auth test: [ %d / %d ]\n", schemeName, i+startfrom+1, len(clist))
+		}
+		if challenge != nil {
+			req.Header.Set("Authorization", challenge.authorization("GET",
+				req.URL.RequestURI(), creds))
+		} else {
+			req.SetBasicAuth(creds.Username, creds.Password)
 		}
-		req.SetBasicAuth(creds.Username, creds.Password)
 		probeResp, err := httpclient.Do(req)
 		if err != nil {
 			if strings.Contains(err.Error(), "connection refused") {
@@ -140,11 +144,18 @@ func httpProbe(clist []apvuln.DPcredentials, startfrom int, vulnports *apvuln.Vu
 		_, _ = io.Copy(ioutil.Discard, io.LimitReader(probeResp.Body, megaByte))
 		probeResp.Body.Close()
 		if probeResp.StatusCode != 200 {
+			// Each rejection carries a fresh digest challenge
+			if challenge != nil {
+				hdrs := probeResp.Header["Www-Authenticate"]
+				if c := parseDigestChallenge(hdrs); c != nil {
+					challenge = c
+				}
+			}
 			continue
 		}
 		// vulnerable
 		if *verbose {
-			fmt.Printf("%s is vulnerable on port %d to HTTP Basic Auth default username/password\n", ip.String(), p)
+			fmt.Printf("%s is vulnerable on port %d to HTTP %s Auth default username/password\n", ip.String(), p, schemeName)
 		}
 		*vulnports = append(*vulnports,
 			apvuln.DPvulnerability{
@@ -152,6 +163,7 @@ func httpProbe(clist []apvuln.DPcredentials, startfrom int, vulnports *apvuln.Vu
 				Protocol:    "tcp",
 				Service:     "http",
 				Port:        strconv.Itoa(p),
+				Auth:        scheme,
 				Credentials: creds,
 			})
 		break
@@ -332,8 +344,40 @@ func resetSSH() {
 		aputil.Errorf("-u not supported for ssh; using %s\n", username)
 	}
 
+	newPass := newPassword()
+	err := SSHResetPassword(address, username, oldPass, newPass)
+	if err != nil {
+		aputil.Fatalf("SSHResetPassword() failed: %v\n", err)
+	}
+	fmt.Printf("success %s:%s\n", username, newPass)
+}
+
+// Reset a telnet password
+func resetTelnet() {
+	resetData := strings.SplitN(*reset, ":", 4)
+	if len(resetData) < 4 {
+		aputil.Fatalf("-r for telnet requires telnet:<port>:<user>:<pass>\n")
+	}
+	address := fmt.Sprintf("%s:%s", *ipAddr, resetData[1])
+	username := resetData[2]
+	oldPass := resetData[3]
+	if *newUsername != "" {
+		aputil.Errorf("-u not supported for telnet; using %s\n", username)
+	}
+
+	newPass := newPassword()
+	err := TelnetResetPassword(address, username, oldPass, newPass)
+	if err != nil {
+		aputil.Fatalf("TelnetResetPassword() failed: %v\n", err)
+	}
+	fmt.Printf("success %s:%s\n", username, newPass)
+}
+
+// Generate or prompt for the new password for a reset
+func newPassword() string {
 	var newPass string
 	var err error
+
 	if *humanPass {
 		if newPass, err = passwordgen.HumanPassword(passwordgen.HumanPasswordSpec); err != nil {
 			aputil.Fatalf("HumanPassword() failed: %v\n", err)
@@ -350,12 +394,7 @@ func resetSSH() {
 			aputil.Fatalf("New passwords do not match\n")
 		}
 	}
-
-	err = SSHResetPassword(address, username, oldPass, newPass)
-	if err != nil {
-		aputil.Fatalf("SSHResetPassword() failed: %v\n", err)
-	}
-	fmt.Printf("success %s:%s\n", username, newPass)
+	return newPass
 }
 
 // resetMode handles the default password reset mode
@@ -370,7 +409,9 @@ func resetMode() {
 	switch service {
 	case "ssh":
 		resetSSH()
-	// additional cases could be resetTelnet, resetHTTP, etc.
+	case "telnet":
+		resetTelnet()
+	// additional cases could be resetHTTP, etc.
 	default:
 		aputil.Fatalf("-r: unsupported service %v\n", service)
 	}
@@ -10,9 +10,12 @@
 package main
 
 import (
+	"bufio"
 	"log"
 	"net"
 	"net/http"
+	"net/textproto"
+	"strings"
 	"testing"
 
 	"bg/ap_common/apvuln"
@@ -157,6 +160,232 @@ func TestFalsePositive(t *testing.T) {
 	}
 }
 
+func runHTTPDigest(listener net.Listener) {
+	const realm = "TEST"
+	const nonce = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Digest ") {
+			p := authParams(auth[7:])
+			ha1 := md5Hex("testuser:" + realm + ":testpass")
+			ha2 := md5Hex(r.Method + ":" + p["uri"])
+			expected := md5Hex(ha1 + ":" + nonce + ":" + p["nc"] +
+				":" + p["cnonce"] + ":" + p["qop"] + ":" + ha2)
+			if p["username"] == "testuser" && p["response"] == expected {
+				return
+			}
+		}
+		w.Header().Set("WWW-Authenticate", `Digest realm="`+realm+
+			`", qop="auth,auth-int", nonce="`+nonce+`"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+	http.Serve(listener, mux)
+}
+
+// A BusyBox-like telnetd, which supports changing the password
+func runTelnet(listener net.Listener, user, pass string) {
+	readLine := func(rdr *bufio.Reader) string {
+		line, _ := rdr.ReadString('\n')
+		// Drop the client's option negotiation
+		return strings.TrimFunc(line, func(r rune) bool {
+			return r < ' ' || r > '~'
+		})
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func(conn net.Conn) {
+			defer conn.Close()
+
+			rdr := bufio.NewReader(conn)
+			conn.Write([]byte{telnetIAC, telnetDO, 1})
+			conn.Write([]byte("\r\ntestcam login: "))
+			u := readLine(rdr)
+			conn.Write([]byte("Password: "))
+			p := readLine(rdr)
+			if u != user || p != pass {
+				conn.Write([]byte("\r\nLogin incorrect\r\ntestcam login: "))
+				return
+			}
+
+			conn.Write([]byte("\r\n\r\nBusyBox v1.19.4 built-in shell (ash)\r\n~ # "))
+			if cmd := readLine(rdr); cmd != "passwd" {
+				return
+			}
+			conn.Write([]byte("Changing password for " + user + "\r\nNew password: "))
+			p1 := readLine(rdr)
+			conn.Write([]byte("\r\nRetype password: "))
+			p2 := readLine(rdr)
+			if p1 == p2 {
+				pass = p1
+				conn.Write([]byte("\r\npasswd: password for " + user + " changed by " + user + "\r\n~ # "))
+			} else {
+				conn.Write([]byte("\r\npasswd: passwords do not match\r\n~ # "))
+			}
+			readLine(rdr)
+		}(conn)
+	}
+}
+
+func runRTSP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		rdr := textproto.NewReader(bufio.NewReader(conn))
+		if _, err = rdr.ReadLine(); err == nil {
+			hdr, _ := rdr.ReadMIMEHeader()
+			creds := apvuln.DPcredentials{
+				Username: "testuser",
+				Password: "testpass",
+			}
+			if hdr.Get("Authorization") == basicAuthorization(creds) {
+				conn.Write([]byte("RTSP/1.0 200 OK\r\nCSeq: 1\r\n\r\n"))
+			} else {
+				conn.Write([]byte("RTSP/1.0 401 Unauthorized\r\nCSeq: 1\r\n" +
+					"WWW-Authenticate: Basic realm=\"TEST\"\r\n\r\n"))
+			}
+		}
+		conn.Close()
+	}
+}
+
+// An SNMP agent which answers requests with the given community
+func runSNMP(conn net.PacketConn, community string) {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		_, msg, _, _ := berNext(buf[:n])
+		_, version, msg, _ := berNext(msg)
+		_, c, msg, _ := berNext(msg)
+		_, pdu, _, _ := berNext(msg)
+		_, reqID, _, _ := berNext(pdu)
+		if string(c) != community {
+			continue
+		}
+
+		resp := berTLV(berInteger, version)
+		resp = append(resp, berTLV(berOctetString, c)...)
+		body := append(berTLV(berInteger, reqID), berInt(0)...)
+		body = append(body, berInt(0)...)
+		resp = append(resp, berTLV(snmpGetResponse, body)...)
+		conn.WriteTo(berTLV(berSequence, resp), addr)
+	}
+}
+
+func checkDPVuln(t *testing.T, dpvuln apvuln.Vulnerabilities, service,
+	user, pass string) {
+
+	if len(dpvuln) != 1 {
+		t.Fatalf("%s test failed. Single vulnerability not found: %v\n",
+			service, dpvuln)
+	}
+	if v, ok := dpvuln[0].(apvuln.DPvulnerability); ok {
+		if v.Service != service || v.Credentials.Username != user ||
+			v.Credentials.Password != pass {
+			t.Errorf("%s test failed. Credentials not found.\n%v\n",
+				service, v)
+		}
+	} else {
+		t.Errorf("%s test failed; returned wrong type.\n", service)
+	}
+}
+
+func TestHTTPDigest(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0") // get an open port
+	if err != nil {
+		t.Fatalf("Error getting open port: %s\n", err)
+	}
+	go runHTTPDigest(listener) // start the service
+	defer listener.Close()
+
+	var dpvuln apvuln.Vulnerabilities
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	httpProbe(clist, 0, &dpvuln, localhost, port) // probe for vulnerability
+
+	checkDPVuln(t, dpvuln, "http", "testuser", "testpass")
+	if v := dpvuln[0].(apvuln.DPvulnerability); v.Auth != "digest" {
+		t.Errorf("HTTP Digest test failed. Wrong auth: %s\n", v.Auth)
+	}
+}
+
+func TestTelnet(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0") // get an open port
+	if err != nil {
+		t.Fatalf("Error getting open port: %s\n", err)
+	}
+	go runTelnet(listener, "testuser2", "testpass2") // start the service
+	defer listener.Close()
+
+	var dpvuln apvuln.Vulnerabilities
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	telnetProbe(clist, 0, &dpvuln, localhost, port) // probe for vulnerability
+
+	checkDPVuln(t, dpvuln, "telnet", "testuser2", "testpass2")
+
+	// Repair the vulnerability
+	addr := listener.Addr().String()
+	if err = TelnetResetPassword(addr, "testuser2", "testpass2",
+		"newpass"); err != nil {
+		t.Errorf("Telnet password reset failed: %v\n", err)
+	}
+
+	dpvuln = nil
+	telnetProbe(clist, 0, &dpvuln, localhost, port)
+	if len(dpvuln) != 0 {
+		t.Errorf("Telnet still vulnerable after reset: %v\n", dpvuln)
+	}
+}
+
+func TestRTSP(t *testing.T) {
+	listener, err := net.Listen("tcp", ":0") // get an open port
+	if err != nil {
+		t.Fatalf("Error getting open port: %s\n", err)
+	}
+	go runRTSP(listener) // start the service
+	defer listener.Close()
+
+	var dpvuln apvuln.Vulnerabilities
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	rtspProbe(clist, 0, &dpvuln, localhost, port) // probe for vulnerability
+
+	checkDPVuln(t, dpvuln, "rtsp", "testuser", "testpass")
+}
+
+func TestSNMP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error getting open port: %s\n", err)
+	}
+	go runSNMP(conn, "private") // start the service
+	defer conn.Close()
+
+	var dpvuln apvuln.Vulnerabilities
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+
+	snmpProbe(clist, 0, &dpvuln, localhost, port) // probe for vulnerability
+
+	checkDPVuln(t, dpvuln, "snmp", "", "private")
+	if v := dpvuln[0].(apvuln.DPvulnerability); v.Auth != "v2c" {
+		t.Errorf("SNMP test failed. Wrong version: %s\n", v.Auth)
+	}
+}
+
 // TestDefaultsFile tests successful and unsuccessful parsing of the
 // test fixtures files.
 func TestDefaultsFile(t *testing.T) {
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"bg/ap_common/apvuln"
+)
+
+// digestChallenge holds the parameters of a "WWW-Authenticate: Digest"
+// challenge (RFC 2617), as issued by both HTTP and RTSP servers.
+type digestChallenge struct {
+	realm     string
+	nonce     string
+	opaque    string
+	algorithm string
+	qop       string
+	nc        int
+}
+
+// Split the parameters of an authentication challenge, honoring quoted strings
+func authParams(s string) map[string]string {
+	params := make(map[string]string)
+
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				val, s = s[1:], ""
+			} else {
+				val, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma >= 0 {
+			val, s = strings.TrimSpace(s[:comma]), s[comma+1:]
+		} else {
+			val, s = strings.TrimSpace(s), ""
+		}
+		params[key] = val
+	}
+
+	return params
+}
+
+// authScheme returns the scheme we'll use to respond to a set of
+// WWW-Authenticate headers: "basic", "digest", or "" if neither is offered.
+// Basic is preferred, as it's cheaper to probe.
+func authScheme(hdrs []string) string {
+	var scheme string
+
+	for _, h := range hdrs {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if strings.HasPrefix(h, "basic") {
+			return "basic"
+		} else if strings.HasPrefix(h, "digest") {
+			scheme = "digest"
+		}
+	}
+	return scheme
+}
+
+// parseDigestChallenge extracts the first digest challenge from a set of
+// WWW-Authenticate headers.  Returns nil if there isn't one.
+func parseDigestChallenge(hdrs []string) *digestChallenge {
+	for _, h := range hdrs {
+		h = strings.TrimSpace(h)
+		if len(h) < 6 || !strings.EqualFold(h[:6], "digest") {
+			continue
+		}
+
+		p := authParams(h[6:])
+		c := &digestChallenge{
+			realm:     p["realm"],
+			nonce:     p["nonce"],
+			opaque:    p["opaque"],
+			algorithm: p["algorithm"],
+		}
+		for _, q := range strings.Split(p["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		if c.nonce != "" {
+			return c
+		}
+	}
+
+	return nil
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authorization computes the Authorization header value answering the
+// challenge for a single request.
+func (c *digestChallenge) authorization(method, uri string,
+	creds apvuln.DPcredentials) string {
+
+	c.nc++
+	nc := fmt.Sprintf("%08x", c.nc)
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	cnonce := hex.EncodeToString(b)
+
+	ha1 := md5Hex(creds.Username + ":" + c.realm + ":" + creds.Password)
+	if strings.EqualFold(c.algorithm, "MD5-sess") {
+		ha1 = md5Hex(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := md5Hex(method + ":" + uri)
+
+	var response string
+	if c.qop != "" {
+		response = md5Hex(ha1 + ":" + c.nonce + ":" + nc + ":" +
+			cnonce + ":" + c.qop + ":" + ha2)
+	} else {
+		response = md5Hex(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", `+
+		`uri="%s", response="%s"`, creds.Username, c.realm, c.nonce,
+		uri, response)
+	if c.algorithm != "" {
+		auth += ", algorithm=" + c.algorithm
+	}
+	if c.opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, c.opaque)
+	}
+	if c.qop != "" {
+		auth += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, c.qop, nc,
+			cnonce)
+	}
+
+	return auth
+}
+
+func basicAuthorization(creds apvuln.DPcredentials) string {
+	token := creds.Username + ":" + creds.Password
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(token))
+}
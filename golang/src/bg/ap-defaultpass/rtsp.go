@@ -0,0 +1,137 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"bg/ap_common/apvuln"
+)
+
+// Send a single RTSP DESCRIBE request, returning the response's status code and
+// headers.  A new connection is used for each request, as many cameras close
+// the connection after rejecting a request.
+func rtspDescribe(address, uri, auth string) (int, textproto.MIMEHeader, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := "DESCRIBE " + uri + " RTSP/1.0\r\n" +
+		"CSeq: 1\r\n" +
+		"Accept: application/sdp\r\n"
+	if auth != "" {
+		req += "Authorization: " + auth + "\r\n"
+	}
+	req += "\r\n"
+	if _, err = conn.Write([]byte(req)); err != nil {
+		return 0, nil, err
+	}
+
+	rdr := textproto.NewReader(bufio.NewReader(conn))
+	status, err := rdr.ReadLine()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// We expect a status line like "RTSP/1.0 401 Unauthorized"
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "RTSP/") {
+		return 0, nil, fmt.Errorf("not an RTSP response: %s", status)
+	}
+	code, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("bad RTSP status: %s", status)
+	}
+
+	hdr, err := rdr.ReadMIMEHeader()
+	if err != nil && len(hdr) == 0 {
+		return 0, nil, err
+	}
+
+	return code, hdr, nil
+}
+
+func rtspProbe(clist []apvuln.DPcredentials, startfrom int, vulnports *apvuln.Vulnerabilities, ip net.IP, p int) int {
+	address := fmt.Sprintf("%s:%d", ip.String(), p)
+	uri := "rtsp://" + address + "/"
+
+	code, hdr, err := rtspDescribe(address, uri, "")
+	if err != nil || code != 401 {
+		// Either not RTSP, or the stream doesn't need credentials
+		return 0
+	}
+
+	var challenge *digestChallenge
+	scheme := authScheme(hdr["Www-Authenticate"])
+	if scheme == "digest" {
+		challenge = parseDigestChallenge(hdr["Www-Authenticate"])
+	}
+	if scheme == "" || (scheme == "digest" && challenge == nil) {
+		return 0
+	}
+	schemeName := strings.Title(scheme)
+	if *verbose {
+		fmt.Printf("RTSP %s Auth detected, probing...\n", schemeName)
+	}
+
+	for i, creds := range clist[startfrom:] {
+		var auth string
+
+		if *verbose {
+			fmt.Printf("RTSP %s Auth test: [ %d / %d ]\n", schemeName, i+startfrom+1, len(clist))
+		}
+		if challenge != nil {
+			auth = challenge.authorization("DESCRIBE", uri, creds)
+		} else {
+			auth = basicAuthorization(creds)
+		}
+
+		code, hdr, err = rtspDescribe(address, uri, auth)
+		if err != nil {
+			if strings.Contains(err.Error(), "connection refused") {
+				fmt.Printf("Banned. Will resume probing this service during the next scan.\n")
+				return i + startfrom
+			}
+			continue
+		}
+		if code != 200 {
+			if challenge != nil {
+				if c := parseDigestChallenge(hdr["Www-Authenticate"]); c != nil {
+					challenge = c
+				}
+			}
+			continue
+		}
+
+		if *verbose {
+			fmt.Printf("%s is vulnerable on port %d to RTSP %s Auth default username/password\n", ip.String(), p, schemeName)
+		}
+		*vulnports = append(*vulnports,
+			apvuln.DPvulnerability{
+				IP:          ip.String(),
+				Protocol:    "tcp",
+				Service:     "rtsp",
+				Port:        strconv.Itoa(p),
+				Auth:        scheme,
+				Credentials: creds,
+			})
+		break
+	}
+	return 0
+}
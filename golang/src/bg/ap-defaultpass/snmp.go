@@ -0,0 +1,260 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+
+	"bg/ap_common/apvuln"
+)
+
+// ASN.1 BER tags used by SNMP v1/v2c messages
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+
+	snmpGetRequest  = 0xa0
+	snmpGetResponse = 0xa2
+)
+
+var (
+	// The encoded OID of sysDescr.0: 1.3.6.1.2.1.1.1.0
+	snmpSysDescr = []byte{0x2b, 6, 1, 2, 1, 1, 1, 0}
+
+	// The SNMP versions we try, with their on-the-wire values
+	snmpVersions = []struct {
+		name  string
+		value int
+	}{
+		{"v2c", 1},
+		{"v1", 0},
+	}
+
+	// Communities tried in addition to those from the credentials list
+	snmpCommunities = []string{"public", "private"}
+)
+
+const snmpTimeout = time.Second
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	rval := append([]byte{tag}, berLength(len(value))...)
+	return append(rval, value...)
+}
+
+func berInt(n int) []byte {
+	var b []byte
+
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 && b[0]&0x80 == 0 {
+			break
+		}
+	}
+	return berTLV(berInteger, b)
+}
+
+// Split off the first TLV in a buffer, returning its tag, its value, and the
+// remainder of the buffer.
+func berNext(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, fmt.Errorf("short BER element")
+	}
+
+	tag := b[0]
+	l := int(b[1])
+	b = b[2:]
+	if l&0x80 != 0 {
+		cnt := l & 0x7f
+		if cnt == 0 || cnt > 4 || len(b) < cnt {
+			return 0, nil, nil, fmt.Errorf("bad BER length")
+		}
+		l = 0
+		for _, x := range b[:cnt] {
+			l = l<<8 | int(x)
+		}
+		b = b[cnt:]
+	}
+	if l > len(b) {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+
+	return tag, b[:l], b[l:], nil
+}
+
+func berGetInt(value []byte) int {
+	var n int
+
+	for i, x := range value {
+		if i == 0 && x&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int(x)
+	}
+	return n
+}
+
+// snmpGet builds a GetRequest for sysDescr.0
+func snmpGet(version int, community string, reqID int) []byte {
+	varbind := berTLV(berSequence,
+		append(berTLV(berOID, snmpSysDescr), berTLV(berNull, nil)...))
+
+	pdu := berInt(reqID)
+	pdu = append(pdu, berInt(0)...) // error-status
+	pdu = append(pdu, berInt(0)...) // error-index
+	pdu = append(pdu, berTLV(berSequence, varbind)...)
+
+	msg := berInt(version)
+	msg = append(msg, berTLV(berOctetString, []byte(community))...)
+	msg = append(msg, berTLV(snmpGetRequest, pdu)...)
+
+	return berTLV(berSequence, msg)
+}
+
+// snmpCheckResponse verifies that a message is the GetResponse to our request.
+// An agent silently drops requests with the wrong community, so any response
+// means the community was accepted.
+func snmpCheckResponse(msg []byte, community string, reqID int) bool {
+	tag, body, _, err := berNext(msg)
+	if err != nil || tag != berSequence {
+		return false
+	}
+
+	// version
+	if tag, _, body, err = berNext(body); err != nil || tag != berInteger {
+		return false
+	}
+
+	var val []byte
+	tag, val, body, err = berNext(body)
+	if err != nil || tag != berOctetString || string(val) != community {
+		return false
+	}
+
+	tag, body, _, err = berNext(body)
+	if err != nil || tag != snmpGetResponse {
+		return false
+	}
+
+	tag, val, _, err = berNext(body)
+	if err != nil || tag != berInteger {
+		return false
+	}
+	return berGetInt(val) == reqID
+}
+
+func snmpTry(address string, version int, community string) (bool, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	reqID := rand.Int31()
+	if _, err = conn.Write(snmpGet(version, community, int(reqID))); err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, 4096)
+	deadline := time.Now().Add(snmpTimeout)
+	for {
+		conn.SetReadDeadline(deadline)
+		n, err := conn.Read(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return false, nil
+			}
+			// Most likely an ICMP port unreachable
+			return false, err
+		}
+		if snmpCheckResponse(buf[:n], community, int(reqID)) {
+			return true, nil
+		}
+	}
+}
+
+// snmpProbe tries the well-known communities, along with any password-only
+// entries in the credentials list.  Rather than stopping at the first
+// community that works, we report all of them, since "private" is
+// conventionally the read-write community.  We only read sysDescr.0, so we
+// don't verify that a community actually has write access.  UDP gives the
+// agent no way to ban us, so the probe always runs to completion.
+func snmpProbe(clist []apvuln.DPcredentials, startfrom int, vulnports *apvuln.Vulnerabilities, ip net.IP, p int) int {
+	address := fmt.Sprintf("%s:%d", ip.String(), p)
+
+	seen := make(map[string]bool)
+	communities := make([]string, 0)
+	for _, c := range snmpCommunities {
+		seen[c] = true
+		communities = append(communities, c)
+	}
+	for _, creds := range clist {
+		if creds.Username == "" && creds.Password != "" &&
+			!seen[creds.Password] {
+			seen[creds.Password] = true
+			communities = append(communities, creds.Password)
+		}
+	}
+
+	if *verbose {
+		fmt.Printf("SNMP probing %d communities...\n", len(communities))
+	}
+	for i, community := range communities {
+		if *verbose {
+			fmt.Printf("SNMP test: [ %d / %d ]\n", i+1, len(communities))
+		}
+		for _, v := range snmpVersions {
+			ok, err := snmpTry(address, v.value, community)
+			if err != nil {
+				// Nothing listening
+				return 0
+			}
+			if !ok {
+				continue
+			}
+
+			if *verbose {
+				fmt.Printf("%s is vulnerable on port %d to SNMP %s default community\n", ip.String(), p, v.name)
+			}
+			*vulnports = append(*vulnports,
+				apvuln.DPvulnerability{
+					IP:       ip.String(),
+					Protocol: "udp",
+					Service:  "snmp",
+					Port:     strconv.Itoa(p),
+					Auth:     v.name,
+					Credentials: apvuln.DPcredentials{
+						Password: community,
+					},
+				})
+			break
+		}
+	}
+	return 0
+}
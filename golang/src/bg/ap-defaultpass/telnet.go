@@ -0,0 +1,352 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"bg/ap_common/apvuln"
+)
+
+// Telnet command bytes (RFC 854)
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+const (
+	telnetTimeout = 5 * time.Second
+)
+
+// Prompts and messages that indicate how a login attempt is progressing.
+// These are matched case-insensitively.
+var (
+	telnetUserPrompts = []string{"login:", "username:", "user name:"}
+	telnetPassPrompts = []string{"password:"}
+	telnetShellSuffix = []string{"#", "$", ">", "%"}
+)
+
+// telnetConn is a minimal telnet client, sufficient to log in to the telnet
+// daemons found on embedded devices.  Every option the server proposes is
+// refused, so the session stays in plain NVT mode.
+type telnetConn struct {
+	conn   net.Conn
+	output string // text received since the last prompt was matched
+
+	cmd  byte // the command in progress
+	iac  bool // an IAC was the last byte seen
+	sub  bool // in the middle of option subnegotiation
+	opt  bool // waiting for an option byte
+	wbuf []byte
+}
+
+func telnetDial(address string) (*telnetConn, error) {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &telnetConn{conn: conn}, nil
+}
+
+func (t *telnetConn) Close() {
+	t.conn.Close()
+}
+
+// Strip the telnet commands out of a buffer of received data, queueing up our
+// refusals of any options the server asks for.
+func (t *telnetConn) filter(in []byte) []byte {
+	out := make([]byte, 0, len(in))
+
+	for _, b := range in {
+		switch {
+		case t.opt:
+			t.opt = false
+			if t.cmd == telnetDO {
+				t.wbuf = append(t.wbuf, telnetIAC, telnetWONT, b)
+			} else if t.cmd == telnetWILL {
+				t.wbuf = append(t.wbuf, telnetIAC, telnetDONT, b)
+			}
+		case t.iac:
+			t.iac = false
+			switch b {
+			case telnetIAC:
+				if !t.sub {
+					out = append(out, b)
+				}
+			case telnetSB:
+				t.sub = true
+			case telnetSE:
+				t.sub = false
+			case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+				t.cmd = b
+				t.opt = true
+			}
+		case b == telnetIAC:
+			t.iac = true
+		case !t.sub && b != 0:
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// Read whatever data is available, answering any option negotiation.
+func (t *telnetConn) read(deadline time.Time) error {
+	buf := make([]byte, 1024)
+
+	t.conn.SetReadDeadline(deadline)
+	n, err := t.conn.Read(buf)
+	if n > 0 {
+		t.output += string(t.filter(buf[:n]))
+		if len(t.wbuf) > 0 {
+			t.conn.Write(t.wbuf)
+			t.wbuf = t.wbuf[:0]
+		}
+	}
+
+	return err
+}
+
+func (t *telnetConn) sendLine(line string) error {
+	line = strings.Replace(line, "\xff", "\xff\xff", -1)
+	if _, err := t.conn.Write([]byte(line + "\r\n")); err != nil {
+		return SendLineError{fmt.Sprintf("Write error: %v", err)}
+	}
+	return nil
+}
+
+// readPrompt reads from the connection until the output contains one of the
+// success or failure strings, or the timeout expires.  It returns the matched
+// success string, a PromptFailureError, or a PromptTimeoutError.
+func (t *telnetConn) readPrompt(success, failure []string,
+	timeout time.Duration) (string, error) {
+
+	deadline := time.Now().Add(timeout)
+	for {
+		lower := strings.ToLower(t.output)
+		for _, fail := range failure {
+			if strings.Contains(lower, fail) {
+				t.output = ""
+				return "", PromptFailureError{fail}
+			}
+		}
+		for _, succ := range success {
+			if strings.Contains(lower, succ) {
+				t.output = ""
+				return succ, nil
+			}
+		}
+
+		if err := t.read(deadline); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return "", PromptTimeoutError{}
+			}
+			return "", PromptNotFoundError{}
+		}
+	}
+}
+
+// Determine whether a login attempt has left us at a shell prompt.  Once the
+// output stops changing, we look at its last line: a shell prompt means we're
+// in, and another login prompt means we were rejected.  The rest of the output
+// is ignored, since a successful login can print all sorts of things (e.g.,
+// "Last login:" or a count of failed attempts).
+func (t *telnetConn) loggedIn(timeout time.Duration) bool {
+	reprompts := append(telnetUserPrompts, telnetPassPrompts...)
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		err := t.read(time.Now().Add(500 * time.Millisecond))
+		if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+			if err != nil {
+				return false
+			}
+			continue
+		}
+
+		lines := strings.Split(strings.TrimSpace(t.output), "\n")
+		last := strings.ToLower(strings.TrimSpace(lines[len(lines)-1]))
+		for _, s := range reprompts {
+			if strings.HasSuffix(last, s) {
+				return false
+			}
+		}
+		for _, s := range telnetShellSuffix {
+			if strings.HasSuffix(last, s) {
+				t.output = ""
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// telnetLogin attempts to log in with a single set of credentials.  It returns
+// true if we reached a shell.  An error means that the server never prompted
+// for credentials, so probably isn't a telnet login service.
+func telnetLogin(t *telnetConn, creds apvuln.DPcredentials) (bool, error) {
+	prompts := append(telnetUserPrompts, telnetPassPrompts...)
+	p, err := t.readPrompt(prompts, nil, telnetTimeout)
+	if err != nil {
+		return false, err
+	}
+
+	// Some devices only ask for a password
+	if p != telnetPassPrompts[0] {
+		if err = t.sendLine(creds.Username); err != nil {
+			return false, err
+		}
+		if _, err = t.readPrompt(telnetPassPrompts, nil,
+			telnetTimeout); err != nil {
+			// Logged in without a password, or rejected outright
+			return t.loggedIn(telnetTimeout), nil
+		}
+	}
+
+	if err = t.sendLine(creds.Password); err != nil {
+		return false, err
+	}
+	return t.loggedIn(telnetTimeout), nil
+}
+
+func telnetProbe(clist []apvuln.DPcredentials, startfrom int, vulnports *apvuln.Vulnerabilities, ip net.IP, p int) int {
+	validtelnetport := false
+	address := fmt.Sprintf("%s:%d", ip.String(), p)
+
+	for i, creds := range clist[startfrom:] {
+		t, err := telnetDial(address)
+		if err != nil {
+			if validtelnetport {
+				fmt.Printf("Banned. Will resume probing this service during the next scan.\n")
+				return i + startfrom
+			}
+			break
+		}
+
+		ok, err := telnetLogin(t, creds)
+		t.Close()
+		if err != nil {
+			if validtelnetport {
+				// Stopped prompting us; most likely a ban
+				fmt.Printf("Banned. Will resume probing this service during the next scan.\n")
+				return i + startfrom
+			}
+			break // not a telnet login
+		}
+		if *verbose {
+			if !validtelnetport {
+				fmt.Println("Telnet detected, probing... ")
+			}
+			fmt.Printf("Telnet test: [ %d / %d ]\n", i+startfrom+1, len(clist))
+		}
+		validtelnetport = true
+
+		if ok {
+			if *verbose {
+				fmt.Printf("%s is vulnerable on port %d to Telnet default username/password\n", ip.String(), p)
+			}
+			*vulnports = append(*vulnports,
+				apvuln.DPvulnerability{
+					IP:          ip.String(),
+					Protocol:    "tcp",
+					Service:     "telnet",
+					Port:        strconv.Itoa(p),
+					Credentials: creds})
+			break
+		}
+	}
+	return 0
+}
+
+// Prompts from the passwd implementations we've seen on devices with telnet
+// (BusyBox and GNU/Linux).  These are matched case-insensitively.
+var (
+	telnetOldPassPrompts = []string{"(current)", "old password:",
+		"current password:"}
+	telnetNewPassPrompts = []string{"new password:", "new unix password:"}
+	telnetRetypePrompts  = []string{"retype", "re-enter", "again"}
+	telnetPasswdSuccess  = []string{"changed", "successfully", "updated"}
+	telnetPasswdFailure  = []string{"authentication token manipulation",
+		"do not match", "incorrect", "unchanged", "failure"}
+)
+
+// TelnetResetPassword resets a foreign host's account by logging in over
+// telnet and running passwd.
+// address: "host:port" -- see net.Dial
+// user:    username
+// oldPass: old password (current, and to be changed)
+// newPass: new password (to be changed to)
+//
+func TelnetResetPassword(address, user, oldPass, newPass string) error {
+	t, err := telnetDial(address)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	creds := apvuln.DPcredentials{Username: user, Password: oldPass}
+	if ok, err := telnetLogin(t, creds); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("telnet login as %s failed", user)
+	}
+
+	if err = t.sendLine("passwd"); err != nil {
+		return err
+	}
+
+	// BusyBox passwd doesn't ask for the old password when run by root
+	prompts := append(telnetOldPassPrompts, telnetNewPassPrompts...)
+	p, err := t.readPrompt(prompts, telnetPasswdFailure, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	for _, old := range telnetOldPassPrompts {
+		if p != old {
+			continue
+		}
+		if err = t.sendLine(oldPass); err != nil {
+			return err
+		}
+		if _, err = t.readPrompt(telnetNewPassPrompts,
+			telnetPasswdFailure, 5*time.Second); err != nil {
+			return err
+		}
+		break
+	}
+
+	if err = t.sendLine(newPass); err != nil {
+		return err
+	}
+	if _, err = t.readPrompt(telnetRetypePrompts, telnetPasswdFailure,
+		5*time.Second); err != nil {
+		return err
+	}
+	if err = t.sendLine(newPass); err != nil {
+		return err
+	}
+	if _, err = t.readPrompt(telnetPasswdSuccess, telnetPasswdFailure,
+		5*time.Second); err != nil {
+		return err
+	}
+
+	return nil // yay!
+}
@@ -17,6 +17,7 @@ import (
 	"io/ioutil"
 	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -32,24 +33,19 @@ const (
 	bannerTimeout = 10 * time.Second
 )
 
+var errNoMatch = fmt.Errorf("banner not recognized")
+
 var (
 	help       = flag.Bool("h", false, "get help")
 	ipaddr     = flag.String("i", "", "IP to inspect")
 	listProbes = flag.Bool("l", false, "list supported probes")
+	vulnDB     = flag.String("d", "", "vulnerability database")
 	probeName  = flag.String("n", "", "probe type")
 	outfile    = flag.String("o", "", "output file")
 	portList   = flag.String("p", "", "port list")
 	verbose    = flag.Bool("v", false, "verbose output")
 )
 
-type probeFunc func(net.IP, []int)
-
-var probes = map[string]probeFunc{
-	"CVE-2018-6789":  eximProbe2018,
-	"CVE-2019-10149": eximProbe2019_10149,
-	"CVE-2019-15846": eximProbe2019_15846,
-}
-
 func outputResults(v *apvuln.InspectVulnProbe) error {
 	jsonVuln, err := json.Marshal(v)
 	if err != nil {
@@ -67,39 +63,78 @@ func outputResults(v *apvuln.InspectVulnProbe) error {
 	return err
 }
 
-func getBanner(ip net.IP, port int) (string, error) {
+// Connect to the port, send the probe's string (if any), and read lines until
+// we find the expected banner.  Returns the version captured from the banner.
+func getBanner(ip net.IP, port int, probe *apvuln.InspectProbe,
+	re *regexp.Regexp) (string, error) {
+
 	var (
-		conn   net.Conn
-		banner string
-		err    error
+		conn net.Conn
+		err  error
 	)
 
+	proto := probe.Protocol
+	if proto == "" {
+		proto = "tcp"
+	}
+
 	if ip != nil {
 		addr := fmt.Sprintf("%v:%d", ip, port)
-		conn, err = net.DialTimeout("tcp", addr, time.Second)
+		conn, err = net.DialTimeout(proto, addr, time.Second)
 	} else {
 		err = fmt.Errorf("missing IP address")
 	}
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(bannerTimeout))
+	if probe.Send != "" {
+		if _, err = conn.Write([]byte(probe.Send)); err != nil {
+			return "", fmt.Errorf("network write failed: %v", err)
+		}
+	}
+
+	lines := probe.Lines
+	if lines < 1 {
+		lines = 1
+	}
 
-	if conn != nil {
-		conn.SetReadDeadline(time.Now().Add(bannerTimeout))
-		banner, err = bufio.NewReader(conn).ReadString('\n')
+	rdr := bufio.NewReader(conn)
+	for i := 0; i < lines; i++ {
+		line, err := rdr.ReadString('\n')
+		if m := re.FindStringSubmatch(line); m != nil {
+			return m[1], nil
+		}
 		if err != nil {
-			err = fmt.Errorf("network read failed: %v", err)
+			if len(line) > 0 {
+				break
+			}
+			return "", fmt.Errorf("network read failed: %v", err)
 		}
 	}
 
-	return banner, err
+	return "", errNoMatch
 }
 
-func inRange(test, min, max *version.Version) bool {
-	if test.LessThan(min) || test.GreaterThan(max) {
-		return false
+func inRange(test *version.Version, r apvuln.InspectVersionRange) bool {
+	if r.Min != "" {
+		min, err := version.NewVersion(r.Min)
+		if err != nil || test.LessThan(min) {
+			return false
+		}
+	}
+	if r.Max != "" {
+		max, err := version.NewVersion(r.Max)
+		if err != nil || test.GreaterThan(max) {
+			return false
+		}
 	}
 	return true
 }
 
-// Try to extract the exim release version, stripping off any distro-specific
+// Try to extract the release version, stripping off any distro-specific
 // annotations.
 func getVersion(v string) (*version.Version, error) {
 	// A prefix ending with a ':' indicates a debian epoch
@@ -118,87 +153,100 @@ func getVersion(v string) (*version.Version, error) {
 	return version.NewVersion(v)
 }
 
-// (note: we are just checking Exim's self-reported version number here; we
-//  aren't probing for the vulnerability directly.)
+// (note: we are just checking the program's self-reported version number here;
+//  we aren't probing for the vulnerability directly.)
 //
-func eximProbe(ip net.IP, ports []int, cve, minBad, maxBad string) {
-	minBadVer, _ := version.NewVersion(minBad)
-	maxBadVer, _ := version.NewVersion(maxBad)
-	result := apvuln.InspectVulnProbe{
+func runProbe(ip net.IP, ports []int, name string,
+	probe *apvuln.InspectProbe) *apvuln.InspectVulnProbe {
+
+	result := &apvuln.InspectVulnProbe{
 		Vulnerable: false,
 		Vulns:      make(apvuln.Vulnerabilities, 0),
 	}
 
+	proto := probe.Protocol
+	if proto == "" {
+		proto = "tcp"
+	}
+
 	if len(ports) == 0 {
-		if smtp, _ := net.LookupPort("tcp", "smtp"); smtp != 0 {
-			ports = []int{smtp}
+		if p, _ := net.LookupPort(proto, probe.Service); p != 0 {
+			ports = []int{p}
 		}
 	}
 
+	re, err := regexp.Compile(probe.Banner)
+	if err != nil || re.NumSubexp() < 1 {
+		aputil.Errorf("%s: bad banner pattern '%s'\n", name, probe.Banner)
+		return result
+	}
+
 	for _, p := range ports {
 		msg := ""
-		banner, err := getBanner(ip, p)
-		if err != nil {
+		v, err := getBanner(ip, p, probe, re)
+		if err == errNoMatch {
+			msg = "found a non-" + probe.Program + " " + probe.Service +
+				" server"
+		} else if err != nil {
 			// An error here is actually OK, as it likely just means
 			// the target has nothing running on this port,
 			continue
-		}
-
-		// We're looking for a banner like:
-		//     220 hostname ESMTP Exim 4.80 Tue, 13 Mar 2018 15:16:40 -0700
-		fields := strings.Fields(banner)
-		if len(fields) < 6 {
-			msg = "unrecognized SMTP banner"
-		} else if fields[0] != "220" {
-			msg = "SMTP server returned status: " + fields[0]
-		} else if fields[3] != "Exim" {
-			msg = "found a non-Exim mail server"
+		} else if testVersion, err := getVersion(v); err != nil {
+			msg = fmt.Sprintf("bad version # '%s': %v", v, err)
 		} else {
-			v := fields[4]
+			for _, r := range probe.Vulnerable {
+				if !inRange(testVersion, r) {
+					continue
+				}
 
-			testVersion, err := getVersion(v)
-			if err != nil {
-				msg = fmt.Sprintf("bad version # '%s': %v",
-					v, err)
-
-			} else if inRange(testVersion, minBadVer, maxBadVer) {
-				msg = fmt.Sprintf("exim %s is vulnerable to %s",
-					v, cve)
+				msg = fmt.Sprintf("%s %s is vulnerable to %s",
+					probe.Program, v, name)
 				dv := apvuln.InspectVulnerability{
-					Identifier: cve, IP: ip.String(),
-					Protocol: "tcp", Service: "smtp",
+					Identifier: name, IP: ip.String(),
+					Protocol: proto, Service: probe.Service,
 					Port:    strconv.Itoa(p),
-					Program: "exim", ProgramVer: v}
+					Program: probe.Program, ProgramVer: v}
 				result.Vulnerable = true
 				result.Vulns = append(result.Vulns, dv)
+				break
 			}
 		}
 		if *verbose && len(msg) > 0 {
-			aputil.Errorf("eximProbe of %v:%d: %s\n", ip, p, msg)
+			aputil.Errorf("probe of %v:%d: %s\n", ip, p, msg)
 		}
 	}
 
-	outputResults(&result)
+	return result
 }
 
-// Check for CVE-2018-6789, which is a buffer overflow in Exim 4.90 and earlier
-func eximProbe2018(ip net.IP, ports []int) {
-	eximProbe(ip, ports, "CVE-2018-6789", "0", "4.90")
-}
+// Load the probe definitions from the vulnerability database.  Entries without
+// a probe are tests run by some other tool.
+func probesLoad(name string) (map[string]*apvuln.InspectProbe, error) {
+	var vulns map[string]struct {
+		Probe *apvuln.InspectProbe `json:"Probe,omitempty"`
+	}
 
-// Check for CVE-2019-10149, which is an RCE in Exim 4.87 through 4.91
-func eximProbe2019_10149(ip net.IP, ports []int) {
-	eximProbe(ip, ports, "CVE-2019-10149", "4.87", "4.91")
-}
+	file, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("file read failed: %v", err)
+	}
+
+	if err = json.Unmarshal(file, &vulns); err != nil {
+		return nil, fmt.Errorf("json import failed: %v", err)
+	}
 
-// Check for CVE-2019-15846, which is an RCE in Exim 4.80 through 4.92.1
-func eximProbe2019_15846(ip net.IP, ports []int) {
-	eximProbe(ip, ports, "CVE-2019-15846", "4.80", "4.92.1")
+	rval := make(map[string]*apvuln.InspectProbe)
+	for name, v := range vulns {
+		if v.Probe != nil {
+			rval[name] = v.Probe
+		}
+	}
+	return rval, nil
 }
 
 func usage(exitStatus int) {
 	fmt.Printf("usage: %s [-hlv] [-i ipaddr] [-p ports] [-o outputfile] "+
-		"-n <probeName>\n", pname)
+		"-d <vuln db> -n <probeName>\n", pname)
 	os.Exit(exitStatus)
 }
 
@@ -210,6 +258,16 @@ func main() {
 	if *help {
 		usage(0)
 	}
+	if *vulnDB == "" {
+		usage(1)
+	}
+
+	probes, err := probesLoad(*vulnDB)
+	if err != nil {
+		aputil.Fatalf("Unable to import probes from '%s': %v\n",
+			*vulnDB, err)
+	}
+
 	if *listProbes {
 		aputil.Errorf("Supported probes:\n")
 		for p := range probes {
@@ -239,8 +297,8 @@ func main() {
 		}
 	}
 
-	f := probes[*probeName]
-	if f == nil {
+	probe := probes[*probeName]
+	if probe == nil {
 		aputil.Fatalf("unrecognized probe type: '%s'\n", *probeName)
 	}
 
@@ -253,6 +311,6 @@ func main() {
 		aputil.Errorf("\n")
 	}
 
-	f(ip, ports)
+	outputResults(runProbe(ip, ports, *probeName, probe))
 }
 
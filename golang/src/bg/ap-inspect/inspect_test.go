@@ -0,0 +1,85 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// Start a server which sends the banner to each connection
+func bannerServer(t *testing.T, banner string) (net.Listener, int) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+
+	return l, l.Addr().(*net.TCPAddr).Port
+}
+
+func TestEximProbes(t *testing.T) {
+	probes, err := probesLoad("../ap-vuln-aggregate/sample-db.json")
+	if err != nil {
+		t.Fatalf("loading probes: %v", err)
+	}
+
+	testCases := []struct {
+		banner string
+		vulns  []string
+	}{
+		{"220 mx ESMTP Exim 4.80 Tue, 13 Mar 2018 15:16:40 -0700\r\n",
+			[]string{"CVE-2018-6789", "CVE-2019-15846"}},
+		{"220 mx ESMTP Exim 4.89_1 Tue, 13 Mar 2018 15:16:40 -0700\r\n",
+			[]string{"CVE-2018-6789", "CVE-2019-10149",
+				"CVE-2019-15846"}},
+		{"220 mx ESMTP Exim 4.92.1 Tue, 13 Mar 2018 15:16:40 -0700\r\n",
+			[]string{"CVE-2019-15846"}},
+		{"220 mx ESMTP Exim 4.93 Tue, 13 Mar 2018 15:16:40 -0700\r\n",
+			nil},
+		{"220 mx ESMTP Postfix (Debian/GNU)\r\n", nil},
+	}
+
+	ip := net.ParseIP("127.0.0.1")
+	for _, tc := range testCases {
+		l, port := bannerServer(t, tc.banner)
+
+		expected := make(map[string]bool)
+		for _, v := range tc.vulns {
+			expected[v] = true
+		}
+		for _, name := range []string{"CVE-2018-6789",
+			"CVE-2019-10149", "CVE-2019-15846"} {
+
+			probe := probes[name]
+			if probe == nil {
+				t.Fatalf("missing probe for %s", name)
+			}
+
+			res := runProbe(ip, []int{port}, name, probe)
+			if res.Vulnerable != expected[name] {
+				t.Errorf("%q: %s expected %v, got %v",
+					tc.banner, name, expected[name],
+					res.Vulnerable)
+			}
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/platform"
+	"bg/common/capture"
+	"bg/common/cfgapi"
+
+	"github.com/spf13/cobra"
+)
+
+func captureStart(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("must specify a capture name")
+	}
+
+	spec := &capture.Spec{Name: args[0]}
+	spec.Mac, _ = cmd.Flags().GetString("mac")
+	spec.Ring, _ = cmd.Flags().GetString("ring")
+	spec.Filter, _ = cmd.Flags().GetString("filter")
+	spec.Rules, _ = cmd.Flags().GetBool("rules")
+	spec.Upload, _ = cmd.Flags().GetBool("upload")
+	spec.FileSize, _ = cmd.Flags().GetInt("size")
+	spec.MaxFiles, _ = cmd.Flags().GetInt("files")
+	spec.FilePeriod, _ = cmd.Flags().GetDuration("period")
+	duration, _ := cmd.Flags().GetDuration("duration")
+
+	return capture.Start(context.Background(), config, spec, duration)
+}
+
+func captureStop(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("must specify a capture name")
+	}
+
+	return capture.Stop(context.Background(), config, args[0])
+}
+
+func captureDelete(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("must specify a capture name")
+	}
+
+	return capture.Delete(context.Background(), config, args[0])
+}
+
+func captureList(cmd *cobra.Command, args []string) error {
+	all, err := capture.GetAll(config)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-12s %-8s %-20s %-18s %s\n",
+		"name", "state", "until", "mac", "ring/filter")
+	names := make([]string, 0)
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := all[name]
+
+		state := "stopped"
+		until := "-"
+		if c.Active {
+			state = "active"
+			if c.Until != nil {
+				until = c.Until.Format(time.Stamp)
+			}
+		}
+
+		ring := c.Ring
+		if c.Rules {
+			ring = "<capture rules>"
+		}
+		if c.Filter != "" {
+			ring += " " + c.Filter
+		}
+		fmt.Printf("%-12s %-8s %-20s %-18s %s\n",
+			name, state, until, c.Mac, ring)
+	}
+
+	plat := platform.NewPlatform()
+	dir := plat.ExpandDirPath("__APDATA__", "watchd", "capture")
+	fmt.Printf("\nfiles:\n")
+	for _, sub := range []string{"active", ".", "local"} {
+		path := filepath.Join(dir, sub)
+		files, _ := ioutil.ReadDir(path)
+		for _, f := range files {
+			if f.IsDir() {
+				continue
+			}
+			fmt.Printf("  %-60s %10d %s\n", filepath.Join(path, f.Name()),
+				f.Size(), f.ModTime().Format(time.Stamp))
+		}
+	}
+
+	return nil
+}
+
+func captureMain() {
+	var err error
+
+	config, err = apcfg.NewConfigd(nil, pname, cfgapi.AccessInternal)
+	if err != nil {
+		fmt.Printf("failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	rootCmd := &cobra.Command{
+		Use: pname,
+	}
+
+	startCmd := &cobra.Command{
+		Use:           "start <name>",
+		Short:         "start a packet capture",
+		RunE:          captureStart,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	startCmd.Flags().StringP("mac", "m", "", "capture traffic for this client")
+	startCmd.Flags().StringP("ring", "r", "", "capture traffic on this ring")
+	startCmd.Flags().StringP("filter", "f", "", "BPF filter expression")
+	startCmd.Flags().Bool("rules", false,
+		"capture on rings with CAPTURE firewall rules")
+	startCmd.Flags().BoolP("upload", "u", false,
+		"upload completed files to the cloud")
+	startCmd.Flags().IntP("size", "s", 0, "rotate files after <n> MB")
+	startCmd.Flags().DurationP("period", "p", 0,
+		"rotate files after this long")
+	startCmd.Flags().IntP("files", "n", 0, "completed files to retain")
+	startCmd.Flags().DurationP("duration", "d", time.Hour,
+		"stop the capture after this long (0 to run until stopped)")
+	rootCmd.AddCommand(startCmd)
+
+	stopCmd := &cobra.Command{
+		Use:           "stop <name>",
+		Short:         "stop a packet capture",
+		RunE:          captureStop,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	rootCmd.AddCommand(stopCmd)
+
+	deleteCmd := &cobra.Command{
+		Use:           "delete <name>",
+		Short:         "stop and remove a packet capture",
+		RunE:          captureDelete,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	rootCmd.AddCommand(deleteCmd)
+
+	listCmd := &cobra.Command{
+		Use:           "list",
+		Short:         "list packet captures and their files",
+		RunE:          captureList,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	rootCmd.AddCommand(listCmd)
+
+	if err = rootCmd.Execute(); err != nil {
+		fmt.Printf("failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func init() {
+	addTool("ap-capture", captureMain)
+}
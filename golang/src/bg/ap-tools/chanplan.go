@@ -0,0 +1,88 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/chanplan"
+	"bg/common/cfgapi"
+)
+
+func chanDesc(channel, width int) string {
+	if channel == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%dMHz", channel, width)
+}
+
+// Show the channel plan the gateway would compute for the site, without
+// applying it.
+func chanplanMain() {
+	overlap := flag.Int("overlap", chanplan.DefaultOverlapCost,
+		"cost of each 20MHz channel shared by two of our radios")
+	dfs := flag.Int("dfs", chanplan.DefaultDFSPenalty,
+		"cost of using a channel requiring radar detection")
+	flag.Parse()
+
+	config, err := apcfg.NewConfigd(nil, pname, cfgapi.AccessInternal)
+	if err != nil {
+		fmt.Printf("cannot connect to configd: %v\n", err)
+		os.Exit(1)
+	}
+
+	radios, err := chanplan.Radios(config)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	if len(radios) == 0 {
+		fmt.Printf("no active wireless radios found\n")
+		return
+	}
+
+	plan := chanplan.Compute(radios, chanplan.Costs{
+		Overlap: *overlap,
+		DFS:     *dfs,
+	})
+
+	changes := make(map[*chanplan.Radio]bool)
+	for _, a := range plan.Changes() {
+		changes[a.Radio] = true
+	}
+
+	fmt.Printf("%-20s %-8s %-7s %-12s %-12s %s\n", "radio", "band",
+		"source", "current", "proposed", "")
+	for _, a := range plan.Assignments {
+		r := a.Radio
+		source := "auto"
+		if r.Fixed {
+			source = "user"
+		} else if r.Planned {
+			source = "planner"
+		}
+		change := ""
+		if changes[r] {
+			change = "*"
+		}
+		fmt.Printf("%-20s %-8s %-7s %-12s %-12s %s\n", r.String(),
+			r.Band, source, chanDesc(r.Channel, r.Width),
+			chanDesc(a.Channel, a.Width), change)
+	}
+	fmt.Printf("\ncurrent cost: %d  proposed cost: %d\n", plan.CurrentCost,
+		plan.Cost)
+}
+
+func init() {
+	addTool("ap-chanplan", chanplanMain)
+}
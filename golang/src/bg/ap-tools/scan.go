@@ -27,13 +27,13 @@ func scan() {
 	}
 
 	aps := apscan.ScanIface(os.Args[1])
-	fmt.Printf("%-17s %5s %7s %5s %8s %8s  %s\n",
+	fmt.Printf("%-17s %5s %7s %5s %8s %8s %8s  %s\n",
 		"MacAddr", "Mode", "Channel", "Width", "Strength",
-		"LastSeen", "SSID")
+		"LastSeen", "Security", "SSID")
 	for _, ap := range aps {
-		fmt.Printf("%-17s %5s %7d %5d %8d %8v  %s\n",
+		fmt.Printf("%-17s %5s %7d %5d %8d %8v %8s  %s\n",
 			ap.Mac, ap.Mode, ap.Channel, ap.Width, ap.Strength,
-			ap.LastSeen, ap.SSID)
+			ap.LastSeen, ap.Security, ap.SSID)
 	}
 }
 
@@ -148,6 +148,8 @@ func stateToString(scanState *base_msg.WatchdScanInfo_ScanState) string {
 			s = "active"
 		case base_msg.WatchdScanInfo_SCHEDULED:
 			s = "scheduled"
+		case base_msg.WatchdScanInfo_DEFERRED:
+			s = "deferred"
 		}
 	}
 	return s
@@ -239,6 +241,9 @@ func listScans(c *comms.APComm, args []string) error {
 			w := aputil.ProtobufToTime(scan.When)
 			when = w.Format(time.RFC3339)
 		}
+		if scan.Deferred != nil {
+			when += " (" + *scan.Deferred + ")"
+		}
 		fmt.Printf("%5d %-17s %-17s %-6s %-9s %6s %s\n",
 			*scan.Id, ip, mac, scanType, state, period, when)
 	}
@@ -345,6 +350,161 @@ func nowScan(c *comms.APComm, args []string) error {
 	return err
 }
 
+// Descriptions of the most common 802.11 reason codes given by clients when
+// they disconnect
+var reasonCodes = map[uint32]string{
+	1:  "unspecified",
+	2:  "previous authentication no longer valid",
+	3:  "leaving",
+	4:  "inactivity",
+	5:  "AP unable to handle all associated stations",
+	6:  "class 2 frame from nonauthenticated station",
+	7:  "class 3 frame from nonassociated station",
+	8:  "leaving BSS",
+	14: "MIC failure",
+	15: "4-way handshake timeout",
+	16: "group key handshake timeout",
+	23: "802.1X authentication failed",
+	34: "excessive lost frames",
+}
+
+func journalDetail(e *base_msg.WifiJournalEntry) string {
+	detail := make([]string, 0)
+
+	if e.Ring != nil {
+		detail = append(detail, "ring="+e.GetRing())
+	}
+	if e.Username != nil {
+		detail = append(detail, "user="+e.GetUsername())
+	}
+	if e.Signal != nil {
+		detail = append(detail, fmt.Sprintf("signal=%ddBm",
+			e.GetSignal()))
+	}
+	if e.Reason != nil {
+		r := fmt.Sprintf("reason=%d", e.GetReason())
+		if desc, ok := reasonCodes[e.GetReason()]; ok {
+			r += " (" + desc + ")"
+		}
+		detail = append(detail, r)
+	}
+	if e.Detail != nil {
+		detail = append(detail, e.GetDetail())
+	}
+
+	return strings.Join(detail, " ")
+}
+
+// Ask watchd for the wireless connection history of a single client, or of all
+// clients.
+func showJournal(c *comms.APComm, args []string) error {
+	if len(args) > 1 {
+		watchUsage()
+	}
+
+	cmd := base_msg.WatchdRequest_WIFI_JOURNAL
+	msg := base_msg.WatchdRequest{
+		Timestamp: aputil.NowToProtobuf(),
+		Sender:    proto.String(pname),
+		Cmd:       &cmd,
+	}
+	if len(args) == 1 {
+		if _, err := net.ParseMAC(args[0]); err != nil {
+			return fmt.Errorf("invalid mac address: %s", args[0])
+		}
+		msg.Mac = proto.String(args[0])
+	}
+
+	rval, err := sendMsg(c, &msg)
+	if err != nil {
+		return err
+	}
+
+	if len(rval.Journal) == 0 {
+		fmt.Printf("no wireless events recorded\n")
+		return nil
+	}
+
+	fmt.Printf("%-19s %-17s %-12s %-16s %-10s %-6s %s\n", "when",
+		"mac", "event", "node", "vap", "band", "details")
+	for _, e := range rval.Journal {
+		when := "unknown"
+		if e.When != nil {
+			w := aputil.ProtobufToTime(e.When)
+			when = w.Local().Format("2006-01-02 15:04:05")
+		}
+		event := strings.ToLower(e.GetEvent().String())
+
+		fmt.Printf("%-19s %-17s %-12s %-16s %-10s %-6s %s\n", when,
+			e.GetMac(), event, e.GetNode(), e.GetVirtualAP(),
+			e.GetBand(), journalDetail(e))
+	}
+
+	return nil
+}
+
+// Ask watchd for the history of the ports found open on a single device, or on
+// all devices.
+func showPorts(c *comms.APComm, args []string) error {
+	if len(args) > 1 {
+		watchUsage()
+	}
+
+	cmd := base_msg.WatchdRequest_PORT_TIMELINE
+	msg := base_msg.WatchdRequest{
+		Timestamp: aputil.NowToProtobuf(),
+		Sender:    proto.String(pname),
+		Cmd:       &cmd,
+	}
+	if len(args) == 1 {
+		if _, err := net.ParseMAC(args[0]); err != nil {
+			return fmt.Errorf("invalid mac address: %s", args[0])
+		}
+		msg.Mac = proto.String(args[0])
+	}
+
+	rval, err := sendMsg(c, &msg)
+	if err != nil {
+		return err
+	}
+
+	if len(rval.Timeline) == 0 {
+		fmt.Printf("no port changes recorded\n")
+		return nil
+	}
+
+	fmt.Printf("%-19s %-17s %-15s %-9s %s\n", "when", "mac", "change",
+		"port", "details")
+	for _, e := range rval.Timeline {
+		when := "unknown"
+		if e.When != nil {
+			w := aputil.ProtobufToTime(e.When)
+			when = w.Local().Format("2006-01-02 15:04:05")
+		}
+		kind := strings.ToLower(e.GetKind().String())
+
+		port := "-"
+		if e.Protocol != nil {
+			port = fmt.Sprintf("%s/%d", e.GetProtocol(), e.GetPort())
+		}
+
+		var detail string
+		switch {
+		case e.Before != nil && e.After != nil:
+			detail = e.GetBefore() + " -> " + e.GetAfter()
+		case e.After != nil:
+			detail = e.GetAfter()
+		default:
+			detail = e.GetBefore()
+		}
+
+		fmt.Printf("%-19s %-17s %-15s %-9s %s\n", when, e.GetMac(),
+			kind, port, detail)
+	}
+
+	return nil
+}
+
 // Send a single 0mq message to watchd.  Return the response from watchd, or an
 // error
 func sendMsg(c *comms.APComm, op *base_msg.WatchdRequest) (*base_msg.WatchdResponse, error) {
@@ -375,6 +535,8 @@ func watchUsage() {
 	for name, cmd := range watchCmds {
 		fmt.Printf("\tscan %s %s\n", name, cmd.usage)
 	}
+	fmt.Printf("\tjournal [<mac>]\n")
+	fmt.Printf("\tports [<mac>]\n")
 
 	os.Exit(2)
 }
@@ -382,12 +544,14 @@ func watchUsage() {
 func watchctl() {
 	var err error
 
-	if len(os.Args) < 3 {
+	if len(os.Args) < 2 {
 		watchUsage()
 	}
 
 	cmd := os.Args[1]
-	if cmd != "scan" {
+	if cmd == "scan" && len(os.Args) < 3 {
+		watchUsage()
+	} else if cmd != "scan" && cmd != "journal" && cmd != "ports" {
 		watchUsage()
 	}
 
@@ -400,15 +564,19 @@ func watchctl() {
 	}
 	defer comm.Close()
 
-	subcmd := os.Args[2]
-	if wcmd, ok := watchCmds[subcmd]; ok {
+	if cmd == "journal" {
+		err = showJournal(comm, os.Args[2:])
+	} else if cmd == "ports" {
+		err = showPorts(comm, os.Args[2:])
+	} else if wcmd, ok := watchCmds[os.Args[2]]; ok {
+		cmd += " " + os.Args[2]
 		err = wcmd.fn(comm, os.Args[3:])
 	} else {
 		watchUsage()
 	}
 
 	if err != nil {
-		fmt.Printf("%s %s failed: %v\n", cmd, subcmd, err)
+		fmt.Printf("%s failed: %v\n", cmd, err)
 		os.Exit(1)
 	}
 }
@@ -21,6 +21,7 @@ import (
 	"bg/ap_common/wgctl"
 	"bg/common/cfgapi"
 	"bg/common/wgconf"
+	"bg/common/wgsite"
 
 	"github.com/spf13/cobra"
 
@@ -129,10 +130,45 @@ func wgList(cmd *cobra.Command, args []string) error {
 			fmt.Printf("%6s\t%20s\t%s:%d\n", id, client, addr, port)
 		}
 	}
-	return err
+
+	return wgListKeys()
+}
+
+func wgTime(t *time.Time, def string) string {
+	if t == nil {
+		return def
+	}
+	return t.Format(time.Stamp)
+}
+
+// List the remote-access keys accepted by the VPN server, along with their
+// expiration times and the most recent activity recorded for each.
+func wgListKeys() error {
+	site, err := wgsite.NewSite(config)
+	if err != nil {
+		return err
+	}
+	keys, err := site.GetKeys("")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	fmt.Printf("\n%-16s %4s %17s %15s %15s %8s %8s\n", "user", "id",
+		"mac", "expires", "last handshake", "rx", "tx")
+	for _, key := range keys {
+		fmt.Printf("%-16s %4d %17s %15s %15s %8s %8s\n", key.User,
+			key.ID, key.Mac, wgTime(key.Expires, "never"),
+			wgTime(key.LastHandshake, "never"),
+			toSize(key.RxBytes), toSize(key.TxBytes))
+	}
+
+	return nil
 }
 
-func toSize(bytes int) string {
+func toSize(bytes uint64) string {
 	var unit string
 
 	if bytes < 1000 {
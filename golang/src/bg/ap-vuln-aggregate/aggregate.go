@@ -31,6 +31,8 @@ var (
 	outfile  = flag.String("o", "", "output file")
 	tests    = flag.String("t", "", "tests to (not) run")
 	services = flag.String("services", "", "services from nmap scan")
+	timing   = flag.Int("timing", -1, "nmap timing template (0-5)")
+	maxRate  = flag.Int("rate", 0, "nmap packets per second limit")
 	tools    = make(map[string]execFunc)
 
 	allTests map[string]aggVulnDescription
@@ -62,7 +62,8 @@ func bgVuln(v aggVulnDescription, tgt net.IP) (vuln bool, details string, err er
 
 	details = ""
 
-	cmd := []string{"-i", tgt.String(), "-n", probe, "-o", resName}
+	cmd := []string{"-d", *vulnlist, "-i", tgt.String(), "-n", probe,
+		"-o", resName}
 	if len(v.Ports) > 0 {
 		portlist := strings.Join(v.Ports, ",")
 		cmd = append(cmd, "-p", portlist)
@@ -174,6 +174,14 @@ func nmapVuln(v aggVulnDescription, tgt net.IP) (bool, string, error) {
 		cmd = append(cmd, strings.Split(options, " ")...)
 	}
 
+	// The limits set by ap.watchd override any in the test's own options
+	if *timing >= 0 && *timing <= 5 {
+		cmd = append(cmd, "-T"+strconv.Itoa(*timing))
+	}
+	if *maxRate > 0 {
+		cmd = append(cmd, "--max-rate", strconv.Itoa(*maxRate))
+	}
+
 	script, ok := v.Options["script"]
 	if ok {
 		cmd = append(cmd, "--script", script)
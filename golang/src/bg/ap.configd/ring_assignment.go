@@ -78,7 +78,24 @@ func selectRing(mac string, client *cfgtree.PNode, vap, ring string) string {
 		return ""
 	}
 
-	if vap != "" {
+	if vap != "" && ring != "" {
+		// With both a VAP and a ring in the event, the client
+		// connected using one of the VAP's per-ring PSKs.  The key
+		// determines the ring, overriding any prior assignment other
+		// than quarantine.
+
+		if oldRing == base_def.RING_QUARANTINE {
+			slog.Infof("%s stays on %s", mac, oldRing)
+			newRing = oldRing
+		} else if key := ring + "/" + vap; !ringOnVirtualAP[key] {
+			slog.Warnf("%s: psk ring %s is not on %s", mac, ring, vap)
+		} else {
+			if oldRing != ring {
+				slog.Infof("%s migrates to psk ring %s", mac, key)
+			}
+			newRing = ring
+		}
+	} else if vap != "" {
 		// With a VAP in the event, it came from wifid detecting a new
 		// client attaching.  If the client is already assigned to a
 		// ring on the VAP, stick with it.  If it's not assigned to that
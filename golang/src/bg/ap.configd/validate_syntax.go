@@ -23,6 +23,7 @@ import (
 	"bg/common/cfgapi"
 	"bg/common/mfg"
 	"bg/common/network"
+	"bg/common/portal"
 	"bg/common/wifi"
 )
 
@@ -60,6 +61,8 @@ var (
 		`%policy_sc%`:  {`site`, `clients/%macaddr%`},
 		`%policy_sr%`:  {`site`, `rings/%ring%`},
 		`%policy_rc%`:  {`rings/%ring%`, `clients/%macaddr%`},
+		`%policy_vpn%`: {`site`, `clients/%macaddr%`, `users/%user%`,
+			`groups/%string%`},
 	}
 
 	validationFuncs = map[string]typeValidate{
@@ -69,14 +72,17 @@ var (
 		"privatecidr": validatePrivateCIDR,
 		"fwtarget":    validateForwardTarget,
 		"const":       validateString,
+		"country":     validateCountry,
 		"dnsaddr":     validateDNS,
 		"duration":    validateDuration,
 		"email":       validateString,
 		"float":       validateFloat,
+		"flowproto":   validateFlowProto,
 		"hostname":    validateHostname,
 		"int":         validateInt,
 		"ipaddr":      validateIP,
 		"ipoptport":   validateIPOptPort,
+		"ipprefix":    validateIPPrefix,
 		"keymgmt":     validateKeyMgmt,
 		"macaddr":     validateMac,
 		"nic":         validateNic,
@@ -84,15 +90,19 @@ var (
 		"nicstate":    validateNicState,
 		"passphrase":  validatePassphrase,
 		"phone":       validateString,
+		"pmf":         validatePMF,
 		"port":        validatePort,
+		"portalmode":  validatePortalMode,
 		"proto":       validateProto,
 		"nodeid":      validateNodeID,
 		"ring":        validateRing,
+		"schedule":    validateSchedule,
 		"sshaddr":     validateSSHAddr,
 		"ssid":        validateSSID,
 		"string":      validateString,
 		"time":        validateTime,
 		"time_unit":   validateTimeUnit,
+		"timezone":    validateTimezone,
 		"tribool":     validateTribool,
 		"uid":         validateString,
 		"user":        validateString,
@@ -132,6 +142,18 @@ func validateTribool(val string) error {
 	return err
 }
 
+// Validate an ISO 3166-1 alpha-2 country code
+func validateCountry(val string) error {
+	var err error
+
+	re := regexp.MustCompile(`^[a-zA-Z]{2}$`)
+	if !re.MatchString(val) {
+		err = fmt.Errorf("invalid country code")
+	}
+
+	return err
+}
+
 func validateInt(val string) error {
 	_, err := strconv.ParseInt(val, 10, 64)
 
@@ -152,6 +174,20 @@ func validateString(val string) error {
 	return nil
 }
 
+func validateSchedule(val string) error {
+	_, err := wifi.ParseSchedule(val)
+	return err
+}
+
+func validateTimezone(val string) error {
+	var err error
+
+	if _, lerr := time.LoadLocation(val); val == "" || lerr != nil {
+		err = fmt.Errorf("'%s' is not a valid time zone", val)
+	}
+	return err
+}
+
 func validateTime(val string) error {
 	formats := []string{
 		time.RFC3339,
@@ -222,13 +258,32 @@ func validateRing(val string) error {
 func validateKeyMgmt(val string) error {
 	var err error
 
-	lower := strings.ToLower(val)
-	if lower != "wpa-psk" && lower != "wpa-eap" {
+	switch strings.ToLower(val) {
+	case "wpa-psk", "wpa-eap", "sae", "wpa-psk+sae", "wpa3-eap":
+	default:
 		err = fmt.Errorf("'%s' is not a valid key management", val)
 	}
 	return err
 }
 
+func validatePMF(val string) error {
+	var err error
+
+	if val != "disabled" && val != "optional" && val != "required" {
+		err = fmt.Errorf("'%s' is not a valid PMF setting", val)
+	}
+	return err
+}
+
+func validatePortalMode(val string) error {
+	var err error
+
+	if !portal.ValidMode(val) {
+		err = fmt.Errorf("'%s' is not a valid portal mode", val)
+	}
+	return err
+}
+
 func validateMac(val string) error {
 	_, err := net.ParseMAC(val)
 	if err != nil {
@@ -264,6 +319,17 @@ func validateIP(val string) error {
 	return err
 }
 
+// Validate a network named in a property path, which is either a single address
+// or an address and prefix length separated by '_'.
+func validateIPPrefix(val string) error {
+	_, err := cfgapi.ParseBlockedName(val)
+	if err != nil {
+		err = fmt.Errorf("'%s' is not a valid address or prefix: %v",
+			val, err)
+	}
+	return err
+}
+
 func validateCIDR(val string) error {
 	_, _, err := net.ParseCIDR(val)
 	if err != nil {
@@ -340,6 +406,16 @@ func validateIPOptPort(val string) error {
 	return err
 }
 
+// Validate a flow export protocol: 'ipfix' or 'netflow9'
+func validateFlowProto(val string) error {
+	var err error
+
+	if val != "ipfix" && val != "netflow9" {
+		err = fmt.Errorf("'%s' is not a valid flow export protocol", val)
+	}
+	return err
+}
+
 func validateHostname(val string) error {
 	var err error
 
@@ -116,6 +116,27 @@ var (
 			},
 			testFunc: validateHostname,
 		},
+		{
+			name: "ipprefix",
+			goodVals: []string{
+				"192.0.2.1",
+				"192.0.2.0_24",
+				"2001:db8::1",
+				"2001:db8::_32",
+			},
+			badVals: []string{"a", "", "192.0.2.0/24",
+				"192.0.2.0_33",
+				"192.0.2_24",
+				"192.0.2.0_",
+			},
+			testFunc: validateIPPrefix,
+		},
+		{
+			name:     "country",
+			goodVals: []string{"US", "fr", "Cn"},
+			badVals:  []string{"", "U", "USA", "U1", "12", "U.S."},
+			testFunc: validateCountry,
+		},
 		{
 			name:     "ipoptport",
 			goodVals: []string{"192.168.1.1", "192.168.1.1:53"},
@@ -349,6 +349,8 @@ func main() {
 				http.FileServer(http.Dir(*clientWebDir)))))
 	mainRouter.PathPrefix("/check/").Handler(
 		http.StripPrefix("/check", checkRouter))
+	mainRouter.PathPrefix("/portal/").Handler(
+		http.StripPrefix("/portal", makePortalRouter()))
 
 	hashKey, blockKey := establishHttpdKeys()
 
@@ -387,7 +389,7 @@ func main() {
 		// http/80 requests redirect to https/443.
 		for _, port := range ports {
 			listen(router, port, ring, tlsCfg, certPaths.FullChain,
-				certPaths.Key, nMain)
+				certPaths.Key, portalMiddleware(nMain))
 		}
 	}
 
@@ -1071,6 +1071,9 @@ func makeDemoAPIRouter() *mux.Router {
 	router.HandleFunc("/sites/{s}/network/vap", demoVAPGetHandler).Methods("GET")
 	router.HandleFunc("/sites/{s}/network/vap/{vapname}", demoVAPNameGetHandler).Methods("GET")
 	router.HandleFunc("/sites/{s}/network/vap/{vapname}", demoVAPNamePostHandler).Methods("POST")
+	router.HandleFunc("/sites/{s}/network/portal/pending", demoPortalPendingGetHandler).Methods("GET")
+	router.HandleFunc("/sites/{s}/network/portal/pending/{mac}", demoPortalApproveHandler).Methods("POST")
+	router.HandleFunc("/sites/{s}/network/portal/pending/{mac}", demoPortalDenyHandler).Methods("DELETE")
 	router.HandleFunc("/sites/{s}/network/wan", demoWanGetHandler).Methods("GET")
 	router.HandleFunc("/sites/{s}/network/wg", demoWGGetHandler).Methods("GET")
 	router.HandleFunc("/sites/{s}/network/wg", demoWGPostHandler).Methods("POST")
@@ -0,0 +1,399 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Captive portal for the guest ring.  While the portal is enabled, ap.networkd
+// redirects all http traffic from unauthorized guests to us, no matter where
+// it was headed.  Those requests are sent to the portal page, where the guest
+// can accept the site's terms, redeem a voucher, or ask a sponsor for access.
+//
+// Operating systems detect captive portals by fetching well-known URLs, and
+// checking for a well-known response.  Unauthorized clients are redirected to
+// the portal, which causes the OS to pop up its portal browser.  Authorized
+// clients get the expected response, in case they reach us before their
+// authorization has been applied to the firewall.
+
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/portal"
+
+	"github.com/gorilla/mux"
+)
+
+type detectResponse struct {
+	status int
+	body   string
+}
+
+// The URLs used by the common operating systems to detect captive portals, and
+// the responses they expect when there is no portal.
+var portalDetect = map[string]detectResponse{
+	"captive.apple.com/hotspot-detect.html": {http.StatusOK,
+		"<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"},
+	"www.apple.com/library/test/success.html": {http.StatusOK,
+		"<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>"},
+	"connectivitycheck.gstatic.com/generate_204": {http.StatusNoContent, ""},
+	"connectivitycheck.android.com/generate_204": {http.StatusNoContent, ""},
+	"clients3.google.com/generate_204":           {http.StatusNoContent, ""},
+	"www.google.com/gen_204":                     {http.StatusNoContent, ""},
+	"www.msftconnecttest.com/connecttest.txt": {http.StatusOK,
+		"Microsoft Connect Test"},
+	"www.msftncsi.com/ncsi.txt": {http.StatusOK, "Microsoft NCSI"},
+	"detectportal.firefox.com/success.txt": {http.StatusOK,
+		"success\n"},
+	"nmcheck.gnome.org/check_network_status.txt": {http.StatusOK,
+		"NetworkManager is online\n"},
+	"connectivity-check.ubuntu.com/": {http.StatusNoContent, ""},
+}
+
+var portalTemplate = template.Must(template.New("portal").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+{{if .Pending}}<meta http-equiv="refresh" content="10">{{end}}
+<title>Guest Wi-Fi</title>
+<style>
+body { font-family: sans-serif; max-width: 32em; margin: 2em auto; padding: 0 1em; }
+.terms { white-space: pre-wrap; border: 1px solid #ccc; padding: 1em; max-height: 20em; overflow: auto; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Guest Wi-Fi</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Authorized}}
+<p>You are connected.{{if .Expires}} Your access expires at {{.Expires}}.{{end}}</p>
+{{else if .Pending}}
+<p>Your request has been sent.  This page will refresh once it has been approved.</p>
+{{else}}
+<form method="POST" action="/portal/">
+{{if .Terms}}<div class="terms">{{.Terms}}</div>{{end}}
+{{if eq .Mode "voucher"}}
+<p><label>Voucher code: <input type="text" name="code" autocomplete="off"></label></p>
+{{else if eq .Mode "sponsor"}}
+<p><label>Your name: <input type="text" name="name" maxlength="64"></label></p>
+{{end}}
+<p><label><input type="checkbox" name="accept" value="true"> I accept the terms of use</label></p>
+<p><input type="submit" value="{{if eq .Mode "sponsor"}}Request access{{else}}Connect{{end}}"></p>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type portalPage struct {
+	Mode       string
+	Terms      string
+	Authorized bool
+	Pending    bool
+	Expires    string
+	Error      string
+}
+
+// Identify the client making a request, using the IP address it connected from
+func portalClient(r *http.Request) (net.HardwareAddr, *cfgapi.ClientInfo) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil, nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, nil
+	}
+
+	for mac, client := range config.GetClients() {
+		if client.IPv4 != nil && client.IPv4.Equal(ip) {
+			hwaddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return nil, nil
+			}
+			return hwaddr, client
+		}
+	}
+	return nil, nil
+}
+
+func portalURL() string {
+	return "https://captive." + domainname + "/portal/"
+}
+
+// Is this request addressed to somewhere other than the appliance?  Such
+// requests can only have reached us through the portal's redirect rule.
+func foreignHost(r *http.Request) bool {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if host == "" || host == "localhost" || net.ParseIP(host) != nil {
+		return false
+	}
+	return host != domainname && !strings.HasSuffix(host, "."+domainname)
+}
+
+// portalMiddleware intercepts requests redirected to us by the captive portal
+// rules.  They must be handled before the secure middleware, which would
+// otherwise redirect them to our https server.
+func portalMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil || !foreignHost(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		mac, client := portalClient(r)
+		if client == nil || client.Ring != portal.Ring ||
+			!portal.GetConfig(config).Enabled {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if portal.IsAuthorized(config, mac) {
+			host := strings.ToLower(r.Host)
+			if resp, ok := portalDetect[host+r.URL.Path]; ok {
+				w.Header().Set("Cache-Control", "no-cache")
+				w.WriteHeader(resp.status)
+				w.Write([]byte(resp.body))
+				return
+			}
+		}
+
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		http.Redirect(w, r, portalURL(), http.StatusFound)
+	})
+}
+
+func portalRender(w http.ResponseWriter, page *portalPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	if err := portalTemplate.Execute(w, page); err != nil {
+		slog.Warnf("rendering portal page: %v", err)
+	}
+}
+
+func portalState(mac net.HardwareAddr) *portalPage {
+	cfg := portal.GetConfig(config)
+	page := &portalPage{
+		Mode:  cfg.Mode,
+		Terms: cfg.Terms,
+	}
+
+	if expires, ok := portal.Authorized(config)[mac.String()]; ok {
+		page.Authorized = true
+		if expires != nil {
+			page.Expires = expires.Local().Format(time.Kitchen)
+		}
+	} else if cfg.Mode == portal.ModeSponsor {
+		page.Pending = portal.IsPending(config, mac)
+	}
+
+	return page
+}
+
+// GET /portal/
+func portalGetHandler(w http.ResponseWriter, r *http.Request) {
+	mac, client := portalClient(r)
+	if client == nil || client.Ring != portal.Ring {
+		http.Error(w, "not a guest client", http.StatusForbidden)
+		return
+	}
+
+	portalRender(w, portalState(mac))
+}
+
+// POST /portal/
+func portalPostHandler(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	mac, client := portalClient(r)
+	if client == nil || client.Ring != portal.Ring {
+		http.Error(w, "not a guest client", http.StatusForbidden)
+		return
+	}
+
+	cfg := portal.GetConfig(config)
+	if !cfg.Enabled {
+		http.Error(w, "captive portal not enabled", http.StatusNotFound)
+		return
+	}
+	if err = r.ParseForm(); err != nil {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	page := portalState(mac)
+	if page.Authorized || page.Pending {
+		portalRender(w, page)
+		return
+	}
+
+	if r.PostForm.Get("accept") != "true" {
+		page.Error = "You must accept the terms of use."
+		portalRender(w, page)
+		return
+	}
+
+	ctx := r.Context()
+	switch cfg.Mode {
+	case portal.ModeTerms:
+		err = portal.Authorize(ctx, config, mac, cfg.Mode, cfg.Duration)
+
+	case portal.ModeVoucher:
+		var d time.Duration
+
+		code := r.PostForm.Get("code")
+		if d, err = portal.RedeemVoucher(ctx, config, code,
+			cfg.Duration); err != nil {
+			slog.Infof("%s: rejected voucher %q", mac, code)
+			page.Error = "That voucher code is not valid."
+			portalRender(w, page)
+			return
+		}
+		err = portal.Authorize(ctx, config, mac, cfg.Mode, d)
+
+	case portal.ModeSponsor:
+		name := strings.TrimSpace(r.PostForm.Get("name"))
+		if name == "" {
+			page.Error = "Please provide your name."
+			portalRender(w, page)
+			return
+		}
+		err = portal.Request(ctx, config, mac, name)
+	}
+
+	if err != nil {
+		slog.Warnf("%s: portal %s failed: %v", mac, cfg.Mode, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Infof("%s: portal %s succeeded", mac, cfg.Mode)
+	portalRender(w, portalState(mac))
+}
+
+// GET /portal/api implements the Captive Portal API described in RFC 8908
+func portalAPIHandler(w http.ResponseWriter, r *http.Request) {
+	resp := struct {
+		Captive   bool   `json:"captive"`
+		PortalURL string `json:"user-portal-url,omitempty"`
+		Remaining int64  `json:"seconds-remaining,omitempty"`
+	}{}
+
+	mac, client := portalClient(r)
+	if client != nil && client.Ring == portal.Ring &&
+		portal.GetConfig(config).Enabled {
+		resp.PortalURL = portalURL()
+		expires, ok := portal.Authorized(config)[mac.String()]
+		if !ok {
+			resp.Captive = true
+		} else if expires != nil {
+			resp.Remaining = int64(time.Until(*expires).Seconds())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/captive+json")
+	w.Header().Set("Cache-Control", "private")
+	if err := json.NewEncoder(w).Encode(&resp); err != nil {
+		panic(err)
+	}
+}
+
+func makePortalRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/", portalGetHandler).Methods("GET")
+	router.HandleFunc("/", portalPostHandler).Methods("POST")
+	router.HandleFunc("/api", portalAPIHandler).Methods("GET")
+	return router
+}
+
+type daPortalRequest struct {
+	MacAddress string `json:"macAddress"`
+	Name       string `json:"name"`
+	IPAddress  string `json:"ipAddress,omitempty"`
+}
+
+// Implements GET /api/sites/:uuid/network/portal/pending, returning the guests
+// awaiting a sponsor's approval.
+func demoPortalPendingGetHandler(w http.ResponseWriter, r *http.Request) {
+	clients := config.GetClients()
+
+	resp := make([]daPortalRequest, 0)
+	for mac, name := range portal.Pending(config) {
+		req := daPortalRequest{
+			MacAddress: mac,
+			Name:       name,
+		}
+		if c := clients[mac]; c != nil && c.IPv4 != nil {
+			req.IPAddress = c.IPv4.String()
+		}
+		resp = append(resp, req)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		panic(err)
+	}
+}
+
+// Implements POST /api/sites/:uuid/network/portal/pending/:mac, approving a
+// guest's request for access.
+func demoPortalApproveHandler(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, "bad mac address", http.StatusBadRequest)
+		return
+	}
+	if !portal.IsPending(config, mac) {
+		http.Error(w, "no such request", http.StatusNotFound)
+		return
+	}
+
+	cfg := portal.GetConfig(config)
+	err = portal.Authorize(r.Context(), config, mac, portal.ModeSponsor,
+		cfg.Duration)
+	if err != nil {
+		slog.Warnf("approving %s: %v", mac, err)
+		http.Error(w, "failed to set properties",
+			http.StatusInternalServerError)
+		return
+	}
+	slog.Infof("%s approved for guest access [uid '%s']", mac,
+		getRequestUID(r))
+}
+
+// Implements DELETE /api/sites/:uuid/network/portal/pending/:mac, rejecting a
+// guest's request for access.
+func demoPortalDenyHandler(w http.ResponseWriter, r *http.Request) {
+	mac, err := net.ParseMAC(mux.Vars(r)["mac"])
+	if err != nil {
+		http.Error(w, "bad mac address", http.StatusBadRequest)
+		return
+	}
+
+	if err = portal.Deny(r.Context(), config, mac); err != nil {
+		if err == cfgapi.ErrNoProp {
+			http.Error(w, "no such request", http.StatusNotFound)
+		} else {
+			http.Error(w, "failed to delete properties",
+				http.StatusInternalServerError)
+		}
+		return
+	}
+	slog.Infof("%s denied guest access [uid '%s']", mac, getRequestUID(r))
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+	"bg/common/portal"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap/zaptest"
+)
+
+const (
+	portalTestMac = "00:40:54:00:00:01"
+	portalTestIP  = "192.168.151.10"
+)
+
+func portalTestSetup(t *testing.T, mode string) net.HardwareAddr {
+	slog = zaptest.NewLogger(t).Sugar()
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	domainname = "example.brightgate.net"
+
+	props := map[string]string{
+		portal.EnabledProp:                     "true",
+		portal.ModeProp:                        mode,
+		"@/clients/" + portalTestMac + "/ring": portal.Ring,
+		"@/clients/" + portalTestMac + "/ipv4": portalTestIP,
+	}
+	if err := config.CreateProps(props, nil); err != nil {
+		t.Fatalf("creating props: %v", err)
+	}
+
+	mac, _ := net.ParseMAC(portalTestMac)
+	return mac
+}
+
+// Issue a request to the portal router on behalf of the test client
+func portalTestRequest(h http.Handler, method, target string,
+	form url.Values) *httptest.ResponseRecorder {
+
+	var body *strings.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	} else {
+		body = strings.NewReader("")
+	}
+
+	r := httptest.NewRequest(method, target, body)
+	r.RemoteAddr = portalTestIP + ":40000"
+	if form != nil {
+		r.Header.Set("Content-Type",
+			"application/x-www-form-urlencoded")
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestPortalRedirect(t *testing.T) {
+	mac := portalTestSetup(t, portal.ModeTerms)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := portalMiddleware(next)
+	detect := "http://connectivitycheck.gstatic.com/generate_204"
+
+	// Unauthorized clients are sent to the portal
+	w := portalTestRequest(h, "GET", detect, nil)
+	if w.Code != http.StatusFound ||
+		w.Header().Get("Location") != portalURL() {
+		t.Errorf("unauthorized: got %d %s", w.Code,
+			w.Header().Get("Location"))
+	}
+
+	// Requests for the appliance itself are passed along
+	w = portalTestRequest(h, "GET", "http://"+domainname+"/", nil)
+	if w.Code != http.StatusTeapot {
+		t.Errorf("local request: got %d", w.Code)
+	}
+
+	// Authorized clients get the response the OS expects
+	if err := portal.Authorize(context.Background(), config, mac, portal.ModeTerms,
+		portal.DefaultDuration); err != nil {
+		t.Fatalf("authorizing: %v", err)
+	}
+	w = portalTestRequest(h, "GET", detect, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("authorized: got %d", w.Code)
+	}
+}
+
+func TestPortalAdmit(t *testing.T) {
+	mac := portalTestSetup(t, portal.ModeTerms)
+	router := makePortalRouter()
+
+	// The terms must be accepted
+	w := portalTestRequest(router, "POST", "/", url.Values{})
+	if w.Code != http.StatusOK || portal.IsAuthorized(config, mac) {
+		t.Errorf("admitted without accepting terms: %d", w.Code)
+	}
+
+	form := url.Values{"accept": {"true"}}
+	w = portalTestRequest(router, "POST", "/", form)
+	if w.Code != http.StatusOK || !portal.IsAuthorized(config, mac) {
+		t.Errorf("not admitted after accepting terms: %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "You are connected") {
+		t.Errorf("bad page after admission: %s", w.Body.String())
+	}
+}
+
+func TestPortalVoucher(t *testing.T) {
+	mac := portalTestSetup(t, portal.ModeVoucher)
+	router := makePortalRouter()
+
+	if err := config.CreateProp(portal.VouchersProp+"/abc123", "1h",
+		nil); err != nil {
+		t.Fatalf("creating voucher: %v", err)
+	}
+
+	form := url.Values{"accept": {"true"}, "code": {"wrong"}}
+	portalTestRequest(router, "POST", "/", form)
+	if portal.IsAuthorized(config, mac) {
+		t.Errorf("admitted with a bad voucher")
+	}
+
+	form.Set("code", "abc123")
+	portalTestRequest(router, "POST", "/", form)
+	if !portal.IsAuthorized(config, mac) {
+		t.Errorf("not admitted with a good voucher")
+	}
+	if _, err := config.GetProp(portal.VouchersProp +
+		"/abc123"); err == nil {
+		t.Errorf("voucher not consumed")
+	}
+}
+
+func TestPortalSponsor(t *testing.T) {
+	mac := portalTestSetup(t, portal.ModeSponsor)
+	router := makePortalRouter()
+
+	form := url.Values{"accept": {"true"}, "name": {"Pat Guest"}}
+	portalTestRequest(router, "POST", "/", form)
+	if portal.IsAuthorized(config, mac) {
+		t.Errorf("admitted before the sponsor approved")
+	}
+	pending := portal.Pending(config)
+	if pending[portalTestMac] != "Pat Guest" {
+		t.Fatalf("request not pending: %v", pending)
+	}
+
+	// A sponsor approves the request
+	api := mux.NewRouter()
+	api.HandleFunc("/pending/{mac}", demoPortalApproveHandler).
+		Methods("POST")
+	w := portalTestRequest(api, "POST", "/pending/"+portalTestMac, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("approval failed: %d %s", w.Code, w.Body.String())
+	}
+	if !portal.IsAuthorized(config, mac) {
+		t.Errorf("not admitted after approval")
+	}
+	if portal.IsPending(config, mac) {
+		t.Errorf("request still pending after approval")
+	}
+
+	// There's nothing left to approve
+	w = portalTestRequest(api, "POST", "/pending/"+portalTestMac, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("second approval: got %d", w.Code)
+	}
+}
@@ -203,6 +203,11 @@ func handleException(event []byte) {
 		msg += " ipv4: " + ip.String()
 	}
 
+	extendMsg(&msg, "country", exception.Country, "")
+	if exception.Asn != nil {
+		msg += fmt.Sprintf(" asn: %d", *exception.Asn)
+	}
+
 	if len(exception.Details) > 0 {
 		msg += " details: [" +
 			strings.Join(exception.Details, ",") + "]"
@@ -213,6 +218,66 @@ func handleException(event []byte) {
 	log.Printf("%s [net.exception]\t%s", tstring(exception.Timestamp), msg)
 }
 
+func handleSteer(event []byte) {
+	var msg string
+
+	steer := &base_msg.EventNetSteer{}
+	proto.Unmarshal(event, steer)
+
+	extendMsg(&msg, "from", steer.Sender, "?")
+	if steer.Reason != nil {
+		reasons := base_msg.EventNetSteer_Reason_name
+		num := int32(*steer.Reason)
+		msg += " reason: " + reasons[num]
+	}
+	if steer.MacAddress != nil {
+		mac := network.Uint64ToHWAddr(*steer.MacAddress)
+		msg += " hwaddr: " + mac.String()
+	}
+	extendMsg(&msg, "node", steer.Node, "")
+	extendMsg(&msg, "vap", steer.VirtualAP, "")
+	extendMsg(&msg, "band", steer.Band, "")
+	extendMsg(&msg, "bssid", steer.Bssid, "")
+	if steer.Signal != nil {
+		msg += fmt.Sprintf(" signal: %d", *steer.Signal)
+	}
+	if len(steer.Targets) > 0 {
+		msg += " targets: [" + strings.Join(steer.Targets, ",") + "]"
+	}
+
+	log.Printf("%s [net.steer]\t%s", tstring(steer.Timestamp), msg)
+}
+
+func handleScanChange(event []byte) {
+	var msg string
+
+	change := &base_msg.EventNetScanChange{}
+	proto.Unmarshal(event, change)
+
+	extendMsg(&msg, "from", change.Sender, "?")
+	if change.Kind != nil {
+		kinds := base_msg.EventNetScanChange_Kind_name
+		num := int32(*change.Kind)
+		msg += " kind: " + kinds[num]
+	}
+	if change.MacAddress != nil {
+		mac := network.Uint64ToHWAddr(*change.MacAddress)
+		msg += " hwaddr: " + mac.String()
+	}
+	if change.Ipv4Address != nil {
+		i := network.Uint32ToIPAddr(*change.Ipv4Address)
+		msg += " ipv4: " + i.String()
+	}
+	if change.Port != nil {
+		msg += fmt.Sprintf(" port: %s/%d", change.GetProtocol(),
+			change.GetPort())
+	}
+	extendMsg(&msg, "before", change.Before, "")
+	extendMsg(&msg, "after", change.After, "")
+
+	log.Printf("%s [net.scan_change]\t%s", tstring(change.Timestamp), msg)
+}
+
 func handleResource(event []byte) {
 	var msg string
 
@@ -443,6 +508,8 @@ func daemonStart() {
 	brokerd.Handle(base_def.TOPIC_RESOURCE, handleResource)
 	brokerd.Handle(base_def.TOPIC_REQUEST, handleRequest)
 	brokerd.Handle(base_def.TOPIC_PUBLIC_LOG, handlePublicLog)
+	brokerd.Handle(base_def.TOPIC_STEER, handleSteer)
+	brokerd.Handle(base_def.TOPIC_SCAN_CHANGE, handleScanChange)
 
 	kernelMonitorStart()
 
@@ -71,6 +71,10 @@ func configClientChanged(path []string, val string, expires *time.Time) {
 		}
 	}
 
+	if path[2] == "vpn" {
+		vpnClientDeviceChanged(path)
+	}
+
 	if path[2] == "ipv4" {
 		ip := net.ParseIP(val)
 		if !ip.Equal(c.IPv4) {
@@ -88,6 +92,7 @@ func configClientDeleted(path []string) {
 			delete(clients, hwaddr)
 			clientsMtx.Unlock()
 			forwardUpdateTarget(hwaddr, "")
+			vpnClientDeviceDeleted(hwaddr)
 		} else {
 			configClientChanged(path, "", nil)
 		}
@@ -97,6 +102,9 @@ func configClientDeleted(path []string) {
 func configUserChanged(path []string, val string, expires *time.Time) {
 	if len(path) == 5 && path[2] == "vpn" {
 		vpnUpdateUser(path, val, expires)
+	} else if len(path) == 3 && path[2] == "groups" {
+		// Group membership determines which vpn policies apply
+		applyFilters()
 	}
 }
 
@@ -105,6 +113,8 @@ func configUserDeleted(path []string) {
 		vpnDeleteUser(path)
 	} else if len(path) > 2 && path[2] == "vpn" {
 		vpnDeleteUser(path)
+	} else if len(path) == 3 && path[2] == "groups" {
+		applyFilters()
 	}
 }
 
@@ -163,9 +173,17 @@ func configNetworkUpdated(path []string, val string, expires *time.Time) {
 		// @/network/vpn/server/0/<prop>
 		vpnServerUpdate(path[4], val)
 
+	} else if l >= 3 && path[1] == "vpn" && path[2] == "mesh" {
+		// @/network/vpn/mesh/...
+		vpnMeshChanged()
+
 	} else if l == 4 && path[1] == "wan" && path[2] == "static" {
 		// @/network/wan/static/<prop>
 		wanStaticChanged(path[3], val)
+
+	} else if l >= 3 && path[1] == "portal" {
+		// @/network/portal/...
+		portalChanged(path, true)
 	}
 }
 
@@ -178,6 +196,9 @@ func configNetworkDeleted(path []string) {
 	} else if l == 5 && path[1] == "vpn" && path[2] == "server" {
 		vpnServerDelete(path)
 
+	} else if l >= 3 && path[1] == "vpn" && path[2] == "mesh" {
+		vpnMeshChanged()
+
 	} else if l >= 3 && path[1] == "wan" && path[2] == "static" {
 		var field string
 		if l > 3 {
@@ -187,6 +208,9 @@ func configNetworkDeleted(path []string) {
 		}
 
 		wanStaticDeleted(field)
+
+	} else if l >= 3 && path[1] == "portal" {
+		portalChanged(path, false)
 	}
 }
 
@@ -50,6 +50,11 @@ func newNicOps(id string, nic *physDevice,
 				for _, channel := range x {
 					c = append(c, strconv.Itoa(channel))
 				}
+				r := make([]string, 0)
+				x = aputil.SortIntKeys(cap.RadarChannels)
+				for _, channel := range x {
+					r = append(r, strconv.Itoa(channel))
+				}
 				if len(b) > 0 {
 					newVals["bands"] = list(b)
 				}
@@ -59,6 +64,9 @@ func newNicOps(id string, nic *physDevice,
 				if len(c) > 0 {
 					newVals["channels"] = list(c)
 				}
+				if len(r) > 0 {
+					newVals["dfs_channels"] = list(r)
+				}
 			}
 
 		} else {
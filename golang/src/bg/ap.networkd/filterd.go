@@ -52,7 +52,6 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
 	"sort"
@@ -69,22 +68,29 @@ import (
 var (
 	rules      ruleList
 	applied    map[string]map[string][]string
-	blockedIPs map[uint32]struct{}
+	blockedIPs map[string]struct{}
 	filterLock sync.Mutex
 )
 
 //
-// Linux has 5 pre-defined tables, but we are only using 'nat' and 'filter'.
-// Each table has a set of predefined rule chains.
+// Linux has 5 pre-defined tables, but we are only using 'mangle', 'nat', and
+// 'filter'.  Each table has a set of predefined rule chains.
 //
 var (
 	tables = []string{"mangle", "raw", "nat", "filter"}
 	chains = map[string][]string{
-		"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
-		"filter": {"INPUT", "FORWARD", "OUTPUT", "dropped"},
+		"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+		"nat": {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING",
+			captureChain},
+		"filter": {"INPUT", "FORWARD", "OUTPUT", "dropped",
+			captureChain},
 	}
 )
 
+// Traffic from a captured ring passes through this chain in both the 'nat' and
+// 'filter' tables
+const captureChain = "captured"
+
 const iptablesRulesFile = "/tmp/iptables.rules"
 
 // Implement the Sort interface for the list of rules
@@ -288,7 +294,12 @@ func genEndpointRing(e *endpoint, src bool) (string, error) {
 			b = wan.getNic()
 		}
 
-		return fmt.Sprintf(" %s %s ", d, b), nil
+		ep := fmt.Sprintf(" %s %s ", d, b)
+		if e.addr != nil {
+			addr, _ := genEndpointAddr(e, src)
+			ep += addr
+		}
+		return ep, nil
 	}
 
 	return "", fmt.Errorf("no such ring: %s", e.detail)
@@ -311,6 +322,8 @@ func genEndpointIface(e *endpoint, src bool) (string, error) {
 			return "", fmt.Errorf("bad vpn interface: %s", e.detail)
 		}
 		name = "wgc" + id
+	} else if e.detail == "vpnmesh" {
+		name = vpnMeshNic
 	} else {
 		return "", fmt.Errorf("no such interface: %s", e.detail)
 	}
@@ -391,8 +404,9 @@ func genPorts(r *rule) (portList string, err error) {
 
 //
 // Build the iptables rules for a captive portal subnet.
-// Currently this only supports capturing a RING endpoint.  There's no reason it
-// couldn't be extended to support individual clients in the future.
+// Currently this only supports capturing a RING endpoint.  All of the ring's
+// traffic is passed through the 'captured' chains.  Individual clients may be
+// exempted from the capture, in which case they return to the normal rules.
 //
 func addCaptureRules(r *rule) error {
 	if r.to != nil {
@@ -413,7 +427,11 @@ func addCaptureRules(r *rule) error {
 	}
 
 	ep := " -i " + ring.Bridge
-	webserver := network.SubnetRouter(ring.Subnet) + ":80"
+	router := network.SubnetRouter(ring.Subnet)
+	webserver := router + ":80"
+
+	// Send all of the ring's traffic through the capture chains
+	captureJump := ep + " -j " + captureChain
 
 	// All http packets get forwarded to our local web server
 	captureRule := ep +
@@ -429,22 +447,31 @@ func addCaptureRules(r *rule) error {
 	// Allow http packets through to the FORWARD stage
 	httpAllow := ep + " -p tcp --dport 80 -j ACCEPT"
 
+	// The portal itself may be served over https
+	httpsAllow := ep + " -p tcp --dport 443 -d " + router + " -j ACCEPT"
+
 	// http packets get forwarded.  Everything else gets dropped.
 	otherDrop := ep + " -j dropped"
 
-	iptablesAddRule("nat", "PREROUTING", captureRule)
-	iptablesAddRule("filter", "INPUT", dnsAllow)
-	iptablesAddRule("filter", "INPUT", dhcpAllow)
-	iptablesAddRule("filter", "INPUT", httpAllow)
-	iptablesAddRule("filter", "INPUT", otherDrop)
+	iptablesAddRule("nat", "PREROUTING", captureJump)
+	iptablesAddRule("filter", "INPUT", captureJump)
+	iptablesAddRule("filter", "FORWARD", captureJump)
 
-	iptablesAddRule("filter", "FORWARD", dnsAllow)
-	iptablesAddRule("filter", "FORWARD", dhcpAllow)
-	iptablesAddRule("filter", "FORWARD", httpAllow)
-	iptablesAddRule("filter", "FORWARD", otherDrop)
+	iptablesAddRule("nat", captureChain, captureRule)
+	iptablesAddRule("filter", captureChain, dnsAllow)
+	iptablesAddRule("filter", captureChain, dhcpAllow)
+	iptablesAddRule("filter", captureChain, httpAllow)
+	iptablesAddRule("filter", captureChain, httpsAllow)
+	iptablesAddRule("filter", captureChain, otherDrop)
 	return nil
 }
 
+// The rule letting a single client bypass the CAPTURE rules.  It must precede
+// the capture rules in the 'captured' chains.
+func captureExemptRule(mac string) string {
+	return "-m mac --mac-source " + mac + " -j RETURN"
+}
+
 func buildRule(r *rule) (string, string, error) {
 	var iptablesRule string
 
@@ -550,7 +577,7 @@ func iptablesRuleApply(rule string) {
 }
 
 // Update the live iptables rules needed to add or remove blocks for
-// incoming and outgoing traffic from a blocked IP address
+// incoming and outgoing traffic from a blocked IP address or network
 func updateBlockRules(addr string, add bool) {
 	var action string
 	if add {
@@ -567,25 +594,26 @@ func updateBlockRules(addr string, add bool) {
 	iptablesRuleApply(fwdRule)
 }
 
-// Extract and validate an IP address from a firewall property like
-// @/firewall/blocked/2.3.4.5
-func getAddrFromPath(path []string) (addr string, flat uint32) {
+// Extract and validate an IP address or network from a firewall property like
+// @/firewall/blocked/2.3.4.5 or @/firewall/blocked/2.3.0.0_16.  The result is
+// in the form iptables expects.  We only manage an IPv4 firewall, so IPv6
+// networks are ignored.
+func getAddrFromPath(path []string) string {
 	if len(path) == 3 {
-		addr = path[2]
-		if ip := net.ParseIP(addr); ip != nil {
-			flat = network.IPAddrToUint32(ip)
+		n, err := cfgapi.ParseBlockedName(path[2])
+		if err == nil && n.IP.To4() != nil {
+			return network.PrefixString(n)
 		}
 	}
-	return
+	return ""
 }
 
 // An active block on an IP address has expired.  Remove that from the list of
 // blocked IPs and delete the iptables rules currently implementing the block.
 func configBlocklistExpired(path []string) {
-	addr, flat := getAddrFromPath(path)
-	if flat != 0 {
-		if _, blocked := blockedIPs[flat]; blocked {
-			delete(blockedIPs, flat)
+	if addr := getAddrFromPath(path); addr != "" {
+		if _, blocked := blockedIPs[addr]; blocked {
+			delete(blockedIPs, addr)
 			updateBlockRules(addr, false)
 		}
 	}
@@ -595,10 +623,9 @@ func configBlocklistExpired(path []string) {
 // of blocked IPs and insert new iptables rules to prevent traffic to/from that
 // IP.
 func configBlocklistChanged(path []string, val string, expires *time.Time) {
-	addr, flat := getAddrFromPath(path)
-	if flat != 0 {
-		if _, blocked := blockedIPs[flat]; !blocked {
-			blockedIPs[flat] = struct{}{}
+	if addr := getAddrFromPath(path); addr != "" {
+		if _, blocked := blockedIPs[addr]; !blocked {
+			blockedIPs[addr] = struct{}{}
 			updateBlockRules(addr, true)
 		}
 	}
@@ -651,6 +678,7 @@ func firewallRules() {
 
 	vpnRules := vpnServerFirewallRules()
 	vpnRules = append(vpnRules, vpnClientFirewallRules()...)
+	vpnRules = append(vpnRules, vpnMeshFirewallRules()...)
 	for _, rule := range vpnRules {
 		r, err := parseRule(rule)
 		if err != nil {
@@ -673,6 +701,10 @@ func iptablesRebuild() {
 		applied[t] = make(map[string][]string)
 	}
 
+	// Devices pinned to a VPN tunnel must be cut off before we accept
+	// traffic on established connections
+	vpnClientDeviceRules(wan.getNic())
+
 	// Allowed traffic on connected ports to flow from eth0 back to the
 	// internal network
 	iptablesAddRule("filter", "FORWARD",
@@ -683,6 +715,9 @@ func iptablesRebuild() {
 
 	iptablesAddRule("filter", "INPUT", " -s 127.0.0.1 -j ACCEPT")
 
+	// Unauthorized guests are confined to the captive portal
+	portalRules()
+
 	if wanNic = wan.getNic(); wanNic != "" {
 		wanFilter = "-i " + wanNic + " "
 		lanFilter = "! -i " + wanNic + " "
@@ -697,17 +732,20 @@ func iptablesRebuild() {
 
 	// Repopulate the list of blocked  IPs
 	active := config.GetActiveBlocks()
-	blockedIPs = make(map[uint32]struct{})
-	for _, addr := range active {
-		if ip := net.ParseIP(addr); ip != nil {
-			flat := network.IPAddrToUint32(ip)
-			blockedIPs[flat] = struct{}{}
+	blockedIPs = make(map[string]struct{})
+	for _, n := range active {
+		if n.IP.To4() != nil {
+			addr := network.PrefixString(n)
+			blockedIPs[addr] = struct{}{}
 			dropRule := addr + " -j dropped"
 			iptablesAddRule("filter", "INPUT", " -s "+dropRule)
 			iptablesAddRule("filter", "FORWARD", " -d "+dropRule)
 		}
 	}
 
+	// Drop traffic to/from countries and networks blocked by site policy
+	geoblockRules(wanNic)
+
 	// Dropped packets should be logged.  We use different rules for LAN and
 	// WAN drops so they can be rate-limited independently.  We can
 	// optionally skip logging of dropped packets on the WAN port
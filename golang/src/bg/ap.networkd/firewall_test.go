@@ -60,6 +60,18 @@ var testCases = []testCase{
 		parse:    true,
 		build:    true,
 	},
+	{
+		in:       "ACCEPT FROM RING core ADDR 192.168.148.5/32 TO RING devices",
+		expected: "-A FORWARD  -i brvlan3  -s 192.168.148.5/32  -o brvlan5  -j ACCEPT",
+		parse:    true,
+		build:    true,
+	},
+	{
+		in:       "ACCEPT FROM RING NOT core ADDR 192.168.148.5/32",
+		expected: "",
+		parse:    false, // can't negate a ring and address together
+		build:    false,
+	},
 	{
 		in:       "ACCEPT TO AP DPORTS 22",
 		expected: "-A INPUT --dport 22 -j ACCEPT",
@@ -0,0 +1,152 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/base_def"
+	"bg/common/geoip"
+)
+
+// All of the networks belonging to the countries and autonomous systems listed
+// in @/policy/site/geoblock are loaded into an ipset.  Traffic between that set
+// and any ring not exempted by @/policy/rings/<ring>/geoblock/exempt is
+// dropped.
+
+const (
+	geoblockSet    = "bg-geoblock"
+	geoblockMaxElm = 1 << 20
+)
+
+var (
+	geoDir = apcfg.String("geoip_dir", "__APDATA__/geoip", true, nil)
+
+	geoblockActive bool
+)
+
+func geoblockExempt(ring string) bool {
+	prop := "@/policy/rings/" + ring + "/geoblock/exempt"
+	val, err := config.GetProp(prop)
+
+	return err == nil && strings.EqualFold(val, "true")
+}
+
+// Feed a series of commands to 'ipset restore'
+func ipsetRestore(cmds *bytes.Buffer) error {
+	cmd := exec.Command(plat.IPSetCmd, "restore", "-exist")
+	cmd.Stdin = cmds
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, out)
+	}
+	return nil
+}
+
+// Rebuild the ipset containing all of the blocked networks.  The new set is
+// populated under a temporary name, and then swapped into place, so the
+// firewall never sees a partially populated set.
+func geoblockUpdate() {
+	var nets []string
+
+	if satellite {
+		return
+	}
+
+	policy := geoip.GetPolicy(config)
+	if !policy.Empty() {
+		dir := plat.ExpandDirPath(*geoDir)
+		db, err := geoip.Open(filepath.Join(dir, geoip.CountryDB),
+			filepath.Join(dir, geoip.ASNDB))
+		if err != nil {
+			slog.Warnf("unable to enforce geoblock policy: %v", err)
+		} else if all, err := db.Networks(policy.Blocked); err != nil {
+			slog.Warnf("unable to evaluate geoblock policy: %v", err)
+		} else {
+			for _, n := range all {
+				nets = append(nets, n.String())
+			}
+		}
+	}
+
+	tmp := geoblockSet + "-new"
+	create := fmt.Sprintf(" hash:net family inet maxelem %d\n",
+		geoblockMaxElm)
+
+	cmds := new(bytes.Buffer)
+	cmds.WriteString("create " + geoblockSet + create)
+	cmds.WriteString("create " + tmp + create)
+	cmds.WriteString("flush " + tmp + "\n")
+	for _, n := range nets {
+		cmds.WriteString("add " + tmp + " " + n + "\n")
+	}
+	cmds.WriteString("swap " + tmp + " " + geoblockSet + "\n")
+	cmds.WriteString("destroy " + tmp + "\n")
+
+	if err := ipsetRestore(cmds); err != nil {
+		slog.Warnf("failed to populate %s: %v", geoblockSet, err)
+		geoblockActive = false
+		return
+	}
+
+	geoblockActive = len(nets) > 0
+	if geoblockActive {
+		slog.Infof("blocking %d networks for %s", len(nets),
+			policy.String())
+	}
+}
+
+// Build the iptables rules dropping traffic between the blocked networks and
+// our rings.
+func geoblockRules(wanNic string) {
+	if !geoblockActive || wanNic == "" {
+		return
+	}
+
+	match := " -m set --match-set " + geoblockSet
+	iptablesAddRule("filter", "INPUT",
+		" -i "+wanNic+match+" src -j dropped")
+
+	for ring, config := range rings {
+		var bridge string
+
+		if ring == base_def.RING_INTERNAL || geoblockExempt(ring) {
+			continue
+		}
+		if ring == base_def.RING_VPN {
+			bridge = vpnServerNic
+		} else {
+			bridge = config.Bridge
+		}
+		if bridge == "" {
+			continue
+		}
+
+		iptablesAddRule("filter", "FORWARD", " -i "+bridge+
+			" -o "+wanNic+match+" dst -j dropped")
+		iptablesAddRule("filter", "FORWARD", " -i "+wanNic+
+			" -o "+bridge+match+" src -j dropped")
+	}
+}
+
+func geoblockChanged(path []string, val string, expires *time.Time) {
+	slog.Infof("Responding to change in geoblock policy or data")
+	geoblockUpdate()
+	applyFilters()
+}
+
+func geoblockDeleted(path []string) {
+	geoblockChanged(path, "", nil)
+}
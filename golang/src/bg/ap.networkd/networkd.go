@@ -218,7 +218,9 @@ func daemonInit() error {
 	config.HandleChange(`^@/firewall/blocked/`, configBlocklistChanged)
 	config.HandleDelExp(`^@/firewall/blocked/`, configBlocklistExpired)
 	config.HandleChange(`^@/users/.*/vpn/.*`, configUserChanged)
+	config.HandleChange(`^@/users/.*/groups$`, configUserChanged)
 	config.HandleDelExp(`^@/users/.*`, configUserDeleted)
+	config.HandleExpire(`^@/users/.*/vpn/.*/public_key$`, vpnKeyExpired)
 	config.HandleChange(`^@/policy/site/vpn/client/.*/enabled`, vpnClientUpdateEnabled)
 	config.HandleDelExp(`^@/policy/site/vpn/client/.*/enabled`, vpnClientDeleteEnabled)
 	config.HandleChange(`^@/policy/site/vpn/server/.*/enabled`, vpnServerUpdateEnabled)
@@ -229,8 +231,19 @@ func daemonInit() error {
 	config.HandleDelExp(`^@/policy/.*/vpn/server/.*/rings`, vpnDeleteRings)
 	config.HandleChange(`^@/policy/.*/vpn/server/.*/subnets`, vpnUpdateRings)
 	config.HandleDelExp(`^@/policy/.*/vpn/server/.*/subnets`, vpnDeleteRings)
+	config.HandleChange(`^@/policy/.*/vpn/server/.*/ports`, vpnUpdateRings)
+	config.HandleDelExp(`^@/policy/.*/vpn/server/.*/ports`, vpnDeleteRings)
+	config.HandleChange(`^@/policy/site/vpn/mesh/enabled`, vpnMeshUpdateEnabled)
+	config.HandleDelExp(`^@/policy/site/vpn/mesh/enabled`, vpnMeshDeleteEnabled)
+	config.HandleChange(`^@/policy/rings/.*/vpn/mesh/allowed`, vpnMeshUpdateAllowed)
+	config.HandleDelExp(`^@/policy/rings/.*/vpn/mesh/allowed`, vpnMeshDeleteAllowed)
 	config.HandleChange(`^@/policy/site/network/forward/.*/tgt$`, forwardUpdated)
 	config.HandleDelExp(`^@/policy/site/network/forward/.*/tgt$`, forwardDeleted)
+	config.HandleChange(`^@/policy/site/geoblock/`, geoblockChanged)
+	config.HandleDelExp(`^@/policy/site/geoblock/`, geoblockDeleted)
+	config.HandleChange(`^@/policy/rings/.*/geoblock/`, geoblockChanged)
+	config.HandleDelExp(`^@/policy/rings/.*/geoblock/`, geoblockDeleted)
+	config.HandleChange(`^@/updates/geoip_(country|asn)$`, geoblockChanged)
 
 	rings = config.GetRings()
 	clients = config.GetClients()
@@ -273,11 +286,9 @@ func daemonInit() error {
 		} else {
 			go vpnServerLoop(&cleanup.wg, addDoneChan())
 		}
-		if err := vpnClientInit(); err != nil {
-			slog.Errorf("vpnClientInit failed: %v", err)
-		} else {
-			go vpnClientLoop(&cleanup.wg, addDoneChan())
-		}
+		vpnClientInit()
+		go vpnClientLoop(&cleanup.wg, addDoneChan())
+		go vpnMeshLoop(&cleanup.wg, addDoneChan())
 	}
 
 	ntpdSetup()
@@ -336,6 +347,7 @@ func main() {
 		slog.Fatalf("networkd failed to start: %v", err)
 	}
 
+	geoblockUpdate()
 	applyFilters()
 
 	mcpd.SetState(mcp.ONLINE)
@@ -28,7 +28,7 @@ package main
 // Endpoint:  <kind> <detail>
 // --------
 // ADDR  CIDR
-// RING  ring_name
+// RING  ring_name [ADDR CIDR]
 // TYPE  client_type
 // IFACE wan/lan
 // AP
@@ -183,7 +183,8 @@ func getAddr(addr string) (ipnet *net.IPNet, err error) {
 	return
 }
 
-// Parse (FROM|TO) (ADDR <addr>|RING <ring>|TYPE <type>|IFACE <iface>|AP)
+// Parse (FROM|TO) (ADDR <addr>|RING <ring> [ADDR <addr>]|TYPE <type>|
+// IFACE <iface>|AP)
 func getEndpoint(tokens []string, name string) (ep *endpoint, cnt int, err error) {
 	var e endpoint
 
@@ -232,6 +233,19 @@ func getEndpoint(tokens []string, name string) (ep *endpoint, cnt int, err error
 		e.addr, err = getAddr(e.detail)
 	case "RING":
 		e.kind = endpointRing
+
+		// A ring may be narrowed to a range of addresses within it.
+		// The result can't be negated, since iptables would only
+		// apply the negation to the interface.
+		if cnt+1 < len(tokens) && strings.ToUpper(tokens[cnt]) == "ADDR" {
+			if e.not {
+				err = fmt.Errorf("Invalid %s endpoint: NOT "+
+					"with ADDR", name)
+			} else {
+				e.addr, err = getAddr(tokens[cnt+1])
+				cnt += 2
+			}
+		}
 	case "TYPE":
 		e.kind = endpointType
 	case "IFACE":
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Firewall support for the guest ring's captive portal.  While the portal is
+// enabled, the guest ring is captured by a standard CAPTURE rule, which
+// redirects http traffic to the portal page served by ap.httpd.  Each client
+// authorized by the portal is exempted from the capture.
+//
+// Authorizations come and go frequently, so they are applied to the live
+// firewall rather than triggering a full rebuild.
+
+package main
+
+import (
+	"net"
+
+	"bg/common/portal"
+)
+
+var (
+	// Authorized clients with rules in the live capture chains
+	portalClients map[string]struct{}
+	portalActive  bool
+)
+
+// Add the rules implementing the captive portal to the set being rebuilt
+func portalRules() {
+	portalClients = make(map[string]struct{})
+	portalActive = false
+
+	if satellite || !portal.GetConfig(config).Enabled {
+		return
+	}
+
+	r, err := parseRule("CAPTURE FROM RING " + portal.Ring)
+	if err != nil {
+		slog.Warnf("bad captive portal rule: %v", err)
+		return
+	}
+
+	// The exemptions must precede the capture rules in the chains
+	for mac := range portal.Authorized(config) {
+		portalClients[mac] = struct{}{}
+		iptablesAddRule("nat", captureChain, captureExemptRule(mac))
+		iptablesAddRule("filter", captureChain, captureExemptRule(mac))
+	}
+
+	if err = addRule(r); err != nil {
+		slog.Warnf("adding captive portal rules: %v", err)
+		return
+	}
+	portalActive = true
+}
+
+// Add or remove the live rules letting a single client bypass the portal
+func updatePortalClient(mac string, add bool) {
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	if !portalActive {
+		return
+	}
+
+	_, present := portalClients[mac]
+	if add == present {
+		return
+	}
+
+	var action string
+	if add {
+		slog.Infof("Authorizing %s on the captive portal", mac)
+		portalClients[mac] = struct{}{}
+		action = " -I "
+	} else {
+		slog.Infof("Removing %s from the captive portal", mac)
+		delete(portalClients, mac)
+		action = " -D "
+	}
+
+	rule := action + captureChain + " " + captureExemptRule(mac)
+	iptablesRuleApply("-t nat" + rule)
+	iptablesRuleApply("-t filter" + rule)
+}
+
+// A portal setting has changed.  Changes to a client's authorization are
+// applied directly.  Anything else requires the rules to be rebuilt.
+func portalChanged(path []string, add bool) {
+	if len(path) == 4 && path[2] == "authorized" {
+		if mac, err := net.ParseMAC(path[3]); err == nil {
+			updatePortalClient(mac.String(), add)
+		}
+	} else if len(path) == 3 {
+		switch path[2] {
+		case "enabled", "authorized":
+			applyFilters()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+	"bg/common/portal"
+)
+
+func TestPortalRules(t *testing.T) {
+	rings[portal.Ring] = buildRing("192.168.151.0/24", "brvlan6")
+	defer delete(rings, portal.Ring)
+
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	expired := time.Now().Add(-time.Minute)
+	props := map[string]string{
+		portal.EnabledProp: "true",
+	}
+	if err := config.CreateProps(props, nil); err != nil {
+		t.Fatalf("enabling portal: %v", err)
+	}
+	if err := config.CreateProp(portal.AuthorizedProp+"/00:40:54:00:00:01",
+		portal.ModeTerms, nil); err != nil {
+		t.Fatalf("authorizing client: %v", err)
+	}
+	if err := config.CreateProp(portal.AuthorizedProp+"/00:40:54:00:00:02",
+		portal.ModeTerms, &expired); err != nil {
+		t.Fatalf("authorizing client: %v", err)
+	}
+
+	applied = map[string]map[string][]string{
+		"filter": {}, "nat": {}, "mangle": {},
+	}
+	portalRules()
+
+	if !portalActive {
+		t.Fatalf("portal rules not active")
+	}
+
+	// Only the unexpired authorization is exempted from the capture
+	exempt := "-m mac --mac-source 00:40:54:00:00:01 -j RETURN"
+	jump := " -i brvlan6 -j " + captureChain
+	want := map[string]map[string][]string{
+		"nat": {
+			"PREROUTING": {jump},
+			captureChain: {
+				exempt,
+				" -i brvlan6 -p tcp --dport 80 -j DNAT " +
+					"--to-destination 192.168.151.1:80",
+			},
+		},
+		"filter": {
+			"INPUT":   {jump},
+			"FORWARD": {jump},
+			captureChain: {
+				exempt,
+				" -i brvlan6 -p udp --dport 53 " +
+					"-d 192.168.151.0/24 -j ACCEPT",
+				" -i brvlan6 -p udp --dport 67 -j ACCEPT",
+				" -i brvlan6 -p tcp --dport 80 -j ACCEPT",
+				" -i brvlan6 -p tcp --dport 443 " +
+					"-d 192.168.151.1 -j ACCEPT",
+				" -i brvlan6 -j dropped",
+			},
+		},
+		"mangle": {},
+	}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("got %v\nwant %v", applied, want)
+	}
+
+	// With the portal disabled, the guest ring isn't captured
+	config.CreateProp(portal.EnabledProp, "false", nil)
+	applied = map[string]map[string][]string{
+		"filter": {}, "nat": {}, "mangle": {},
+	}
+	portalRules()
+	if portalActive || len(applied["nat"]) != 0 ||
+		len(applied["filter"]) != 0 {
+		t.Errorf("disabled portal added rules: %v", applied)
+	}
+}
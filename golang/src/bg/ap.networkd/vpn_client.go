@@ -10,20 +10,49 @@
 package main
 
 import (
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"bg/ap_common/netctl"
 	"bg/ap_common/wgctl"
+	"bg/common/cfgapi"
 	"bg/common/wgconf"
 )
 
+// Individual devices can be routed through a VPN client tunnel by setting
+// @/clients/<mac>/vpn/client/<idx>/enabled.  Their packets are marked as they
+// enter the gateway, and the mark selects a routing table whose only entry is
+// a default route through the tunnel.  A rule consulting the main table, but
+// ignoring its default route, precedes the mark rule, so traffic to our own
+// rings and to the tunnel's subnets is unaffected.
+//
+// If @/clients/<mac>/vpn/client/<idx>/killswitch is also set, the device's
+// marked traffic is never forwarded to the WAN port, so its internet access is
+// cut off whenever the tunnel is down.
+const (
+	vpnClientMarkBase  = 0x1000
+	vpnClientTableBase = 1000
+	vpnClientRulePrio  = 1000
+)
+
 var (
 	wgClient       *wgconf.Client
 	wgClientUpdate = make(chan bool, 4)
 	wgClientReset  = make(chan bool, 4)
+
+	// Devices currently selected for VPN routing, and whether each has the
+	// kill switch enabled.
+	vpnClientDevices    map[string]bool
+	vpnClientDevicesMtx sync.Mutex
 )
 
+func vpnClientMark(idx int) string {
+	return "0x" + strconv.FormatInt(int64(vpnClientMarkBase+idx), 16)
+}
+
 func vpnClientUpdateEnabled(path []string, val string, expires *time.Time) {
 	enable := strings.EqualFold(val, "true")
 
@@ -114,6 +143,14 @@ func vpnClientLoop(wg *sync.WaitGroup, doneChan chan bool) {
 				slog.Infof("WireGuard client device %s created",
 					wgClient.Devname)
 				isUp = true
+
+				// The route is removed along with the device
+				err = netctl.RouteAddTable("0.0.0.0/0",
+					wgClient.Devname, vpnClientTableBase)
+				if err != nil {
+					slog.Errorf("adding per-device route: %v",
+						err)
+				}
 			}
 		}
 		if isUp {
@@ -142,6 +179,9 @@ func vpnClientLoop(wg *sync.WaitGroup, doneChan chan bool) {
 			isUp = false
 		}
 	}
+
+	_ = netctl.RuleDel(vpnClientRulePrio)
+	_ = netctl.RuleDel(vpnClientRulePrio + 1)
 }
 
 func vpnClientFirewallRules() []string {
@@ -165,7 +205,116 @@ func vpnClientFirewallRules() []string {
 	return rules
 }
 
-func vpnClientInit() error {
-	return nil
+// Find all of the devices in the @/clients subtree which should have their
+// traffic routed through the VPN client tunnel.
+func vpnClientGetDevices(all *cfgapi.PropertyNode, idx int) map[string]bool {
+	devices := make(map[string]bool)
+
+	if all == nil {
+		return devices
+	}
+
+	id := strconv.Itoa(idx)
+	for mac, client := range all.Children {
+		node, _ := client.GetChild("vpn")
+		node, _ = node.GetChild("client")
+		node, _ = node.GetChild(id)
+
+		if enabled, _ := node.GetChildBool("enabled"); enabled {
+			devices[mac], _ = node.GetChildBool("killswitch")
+		}
+	}
+
+	return devices
+}
+
+// Build the rules that mark traffic from the selected devices, allow it to be
+// forwarded through the tunnel, and keep it from leaking out the WAN port if
+// the kill switch is set.  The kill switch rules must precede the rule
+// accepting traffic on established connections, so a connection opened through
+// the tunnel can't fall back to the WAN when the tunnel goes down.
+func vpnClientDeviceRules(wanNic string) {
+	const idx = 0
+
+	if satellite {
+		return
+	}
+
+	all, _ := config.GetProps("@/clients")
+	devices := vpnClientGetDevices(all, idx)
+	vpnClientDevicesMtx.Lock()
+	vpnClientDevices = devices
+	vpnClientDevicesMtx.Unlock()
+
+	dev := ""
+	if wgClient != nil && wgClient.Enabled {
+		dev = wgClient.Devname
+	}
+	vpnClientAddRules(idx, devices, wanNic, dev)
+}
+
+// Add the rules for the selected devices.  'dev' is the tunnel's device, or ""
+// if the tunnel isn't up.
+func vpnClientAddRules(idx int, devices map[string]bool, wanNic, dev string) {
+	if len(devices) == 0 {
+		return
+	}
+
+	mark := " -m mark --mark " + vpnClientMark(idx)
+	for mac, killswitch := range devices {
+		iptablesAddRule("mangle", "PREROUTING", " -m mac --mac-source "+
+			mac+" -j MARK --set-mark "+vpnClientMark(idx))
+
+		if killswitch && wanNic != "" {
+			iptablesAddRule("filter", "FORWARD", " -o "+wanNic+
+				" -m mac --mac-source "+mac+" -j dropped")
+		}
+	}
+
+	if dev != "" {
+		iptablesAddRule("filter", "FORWARD", " -o "+dev+mark+
+			" -j ACCEPT")
+		iptablesAddRule("nat", "POSTROUTING", " -o "+dev+mark+
+			" -j MASQUERADE")
+	}
+}
+
+// A device's VPN routing policy has changed
+func vpnClientDeviceChanged(path []string) {
+	slog.Infof("Responding to change in VPN policy for %s", path[1])
+	applyFilters()
+}
+
+// A device has been deleted.  If it was being routed through the tunnel, the
+// stale rules need to be removed.
+func vpnClientDeviceDeleted(mac string) {
+	vpnClientDevicesMtx.Lock()
+	_, ok := vpnClientDevices[mac]
+	vpnClientDevicesMtx.Unlock()
+
+	if ok {
+		applyFilters()
+	}
+}
+
+// Install the policy routing rules used to send marked traffic through the
+// tunnel.  If they can't be installed, per-device routing won't work, but the
+// tunnel itself is still usable, so the failure is logged rather than returned.
+func vpnClientInit() {
+	const idx = 0
+
+	// Clean up after any previous instance
+	_ = netctl.RuleDel(vpnClientRulePrio)
+	_ = netctl.RuleDel(vpnClientRulePrio + 1)
+
+	err := netctl.RuleAddSuppress(syscall.RT_TABLE_MAIN, 0,
+		vpnClientRulePrio)
+	if err == nil {
+		err = netctl.RuleAddMark(vpnClientMarkBase+idx,
+			vpnClientTableBase+idx, vpnClientRulePrio+1)
+	}
+	if err != nil {
+		slog.Errorf("adding per-device VPN routing rules: %v", err)
+	}
 }
 
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"bg/common/cfgapi"
+)
+
+// Build the @/clients/<mac>/vpn/client/0 subtree for a single device
+func vpnTestClient(settings map[string]string) *cfgapi.PropertyNode {
+	idx := &cfgapi.PropertyNode{Children: make(cfgapi.ChildMap)}
+	for name, val := range settings {
+		idx.Children[name] = &cfgapi.PropertyNode{Value: val}
+	}
+
+	client := &cfgapi.PropertyNode{
+		Children: cfgapi.ChildMap{"0": idx},
+	}
+	vpn := &cfgapi.PropertyNode{
+		Children: cfgapi.ChildMap{"client": client},
+	}
+	return &cfgapi.PropertyNode{
+		Children: cfgapi.ChildMap{"vpn": vpn},
+	}
+}
+
+func TestVPNClientDevices(t *testing.T) {
+	all := &cfgapi.PropertyNode{
+		Children: cfgapi.ChildMap{
+			"00:00:00:00:00:01": vpnTestClient(map[string]string{
+				"enabled": "true",
+			}),
+			"00:00:00:00:00:02": vpnTestClient(map[string]string{
+				"enabled":    "true",
+				"killswitch": "true",
+			}),
+			"00:00:00:00:00:03": vpnTestClient(map[string]string{
+				"enabled":    "false",
+				"killswitch": "true",
+			}),
+			"00:00:00:00:00:04": {},
+		},
+	}
+
+	got := vpnClientGetDevices(all, 0)
+	want := map[string]bool{
+		"00:00:00:00:00:01": false,
+		"00:00:00:00:00:02": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got = vpnClientGetDevices(nil, 0); len(got) != 0 {
+		t.Errorf("got %v with no clients", got)
+	}
+}
+
+func TestVPNClientRules(t *testing.T) {
+	devices := map[string]bool{"00:00:00:00:00:02": true}
+	mark := " -j MARK --set-mark 0x1000"
+	drop := " -o eth0 -m mac --mac-source 00:00:00:00:00:02 -j dropped"
+
+	// With the tunnel down, the device is cut off from the WAN
+	applied = map[string]map[string][]string{
+		"filter": {}, "nat": {}, "mangle": {},
+	}
+	vpnClientAddRules(0, devices, "eth0", "")
+	want := map[string]map[string][]string{
+		"filter": {"FORWARD": {drop}},
+		"nat":    {},
+		"mangle": {"PREROUTING": {
+			" -m mac --mac-source 00:00:00:00:00:02" + mark,
+		}},
+	}
+	if !reflect.DeepEqual(applied, want) {
+		t.Errorf("tunnel down: got %v, want %v", applied, want)
+	}
+
+	// With the tunnel up, its marked traffic is forwarded and masqueraded
+	applied = map[string]map[string][]string{
+		"filter": {}, "nat": {}, "mangle": {},
+	}
+	vpnClientAddRules(0, devices, "eth0", "wgc0")
+	fwd := applied["filter"]["FORWARD"]
+	if len(fwd) != 2 || fwd[0] != drop ||
+		fwd[1] != " -o wgc0 -m mark --mark 0x1000 -j ACCEPT" {
+		t.Errorf("tunnel up: bad FORWARD rules %v", fwd)
+	}
+	nat := applied["nat"]["POSTROUTING"]
+	if len(nat) != 1 || nat[0] != " -o wgc0 -m mark --mark 0x1000 -j MASQUERADE" {
+		t.Errorf("tunnel up: bad POSTROUTING rules %v", nat)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"bg/ap_common/wgctl"
+	"bg/common/wgconf"
+	"bg/common/wgsite"
+)
+
+// The site-to-site mesh is a single WireGuard device with a peer for each of
+// the other sites in the organization.  The peers, their keys, and the subnets
+// they route are all pushed into @/network/vpn/mesh by the cloud.  Traffic is
+// routed, not NATed, so each remote site sees our clients' real addresses.
+
+const (
+	vpnMeshNic = "wgm0"
+)
+
+var (
+	wgMesh       *wgconf.Mesh
+	wgMeshMtx    sync.Mutex
+	wgMeshUpdate = make(chan bool, 4)
+)
+
+// A single cloud update may touch dozens of mesh properties.  We only need to
+// know that at least one rebuild is pending, so we don't block if the channel
+// is already full.
+func vpnMeshChanged() {
+	select {
+	case wgMeshUpdate <- true:
+	default:
+	}
+}
+
+func vpnMeshUpdateEnabled(path []string, val string, expires *time.Time) {
+	vpnMeshChanged()
+}
+
+func vpnMeshDeleteEnabled(path []string) {
+	vpnMeshChanged()
+}
+
+func vpnMeshUpdateAllowed(path []string, val string, expires *time.Time) {
+	applyFilters()
+}
+
+func vpnMeshDeleteAllowed(path []string) {
+	applyFilters()
+}
+
+// Determine whether a configuration change requires the mesh device to be
+// rebuilt, rather than just having its peers updated
+func vpnMeshBounce(old, mesh *wgconf.Mesh) bool {
+	return old.Enabled != mesh.Enabled || old.ListenPort != mesh.ListenPort ||
+		old.Key == nil || mesh.Key == nil || *old.Key != *mesh.Key
+}
+
+// Bring the mesh device in line with the current configuration.  Changes to the
+// peers are applied to the running device, so the tunnels to the other sites
+// survive a cloud update.  The device is only torn down and rebuilt if its key
+// or port has changed, or if the mesh has been enabled or disabled.
+func vpnMeshRebuild() {
+	mesh, err := wgctl.GetMesh(config, vpnMeshNic)
+	if err != nil {
+		slog.Errorf("getting WireGuard mesh config: %v", err)
+	}
+
+	wgMeshMtx.Lock()
+	old := wgMesh
+	wgMeshMtx.Unlock()
+
+	if old != nil && mesh != nil && !vpnMeshBounce(old, mesh) {
+		if err = wgctl.MeshRoutesUpdate(mesh, old); err != nil {
+			slog.Errorf("updating mesh routes: %v", err)
+		}
+		if err = wgctl.MeshConfig(mesh, old); err != nil {
+			slog.Errorf("updating WireGuard mesh config: %v", err)
+		}
+		slog.Infof("WireGuard mesh device %s updated with %d peers",
+			vpnMeshNic, len(mesh.Peers))
+
+		wgMeshMtx.Lock()
+		wgMesh = mesh
+		wgMeshMtx.Unlock()
+		return
+	}
+
+	wgMeshMtx.Lock()
+	wgMesh = nil
+	wgMeshMtx.Unlock()
+
+	if old != nil {
+		slog.Infof("bringing down mesh device")
+		wgctl.MeshDevDown(old)
+	}
+
+	if mesh == nil || !mesh.Enabled {
+		return
+	}
+
+	if err = wgctl.MeshDevUp(mesh); err != nil {
+		slog.Errorf("instantiating mesh device %s: %v", vpnMeshNic, err)
+		wgctl.MeshDevDown(mesh)
+		return
+	}
+	if err = wgctl.MeshConfig(mesh, nil); err != nil {
+		slog.Errorf("installing WireGuard mesh config: %v", err)
+	}
+	slog.Infof("WireGuard mesh device %s created with %d peers",
+		vpnMeshNic, len(mesh.Peers))
+
+	wgMeshMtx.Lock()
+	wgMesh = mesh
+	wgMeshMtx.Unlock()
+}
+
+func vpnMeshLoop(wg *sync.WaitGroup, doneChan chan bool) {
+	defer wg.Done()
+
+	done := false
+	updateNeeded := true
+	for !done {
+		if updateNeeded {
+			vpnMeshRebuild()
+			applyFilters()
+			updateNeeded = false
+		}
+
+		select {
+		case done = <-doneChan:
+		case updateNeeded = <-wgMeshUpdate:
+		}
+
+		// The cloud pushes the whole mesh configuration at once, so
+		// drain the channel
+		for drained := false; !drained; {
+			select {
+			case x := <-wgMeshUpdate:
+				updateNeeded = updateNeeded || x
+			default:
+				drained = true
+			}
+		}
+	}
+
+	wgMeshMtx.Lock()
+	if wgMesh != nil {
+		wgctl.MeshDevDown(wgMesh)
+		wgMesh = nil
+	}
+	wgMeshMtx.Unlock()
+}
+
+// Accept WireGuard traffic from the other sites, and allow traffic to flow
+// between the mesh and any ring that has been opened to it.
+func vpnMeshFirewallRules() []string {
+	wgMeshMtx.Lock()
+	mesh := wgMesh
+	wgMeshMtx.Unlock()
+
+	if mesh == nil {
+		return nil
+	}
+
+	port := strconv.Itoa(mesh.ListenPort)
+	rules := []string{"ACCEPT UDP FROM IFACE wan TO AP DPORTS " + port}
+
+	for ring := range rings {
+		prop := wgsite.MeshAllowedProp(ring)
+		if allowed, _ := config.GetPropBool(prop); allowed {
+			rules = append(rules,
+				"ACCEPT FROM RING "+ring+" TO IFACE vpnmesh",
+				"ACCEPT FROM IFACE vpnmesh TO RING "+ring)
+		}
+	}
+
+	return rules
+}
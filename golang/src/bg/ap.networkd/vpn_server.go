@@ -17,12 +17,15 @@ import (
 	"sync"
 	"time"
 
+	"bg/ap_common/apcfg"
 	"bg/ap_common/aputil"
 	"bg/ap_common/wgctl"
 	"bg/base_def"
 	"bg/common/cfgapi"
 	"bg/common/wgconf"
 	"bg/common/wgsite"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 const (
@@ -32,8 +35,23 @@ const (
 var (
 	wgServer       *wgconf.Server
 	wgServerUpdate = make(chan bool, 4)
+
+	vpnStatsPeriod = apcfg.Duration("vpn_stats_period", 5*time.Minute,
+		true, nil)
+
+	// The traffic counters most recently reported by the kernel for each
+	// client key.  This is nil until the first collection after networkd
+	// starts.  The device may have outlived our previous instance, whose
+	// traffic is already included in the totals, so that collection only
+	// establishes a baseline.
+	vpnPeerCounters map[wgtypes.Key]vpnCounters
 )
 
+type vpnCounters struct {
+	rx int64
+	tx int64
+}
+
 func vpnUpdateRings(path []string, val string, expires *time.Time) {
 	applyFilters()
 }
@@ -112,6 +130,103 @@ func vpnDeleteUser(path []string) {
 	wgServerUpdate <- true
 }
 
+// A client key has reached its expiration time.  The server stops accepting it
+// when the expiration of its public key is reported as a deletion, so all that
+// remains is to clean up the rest of its properties.  That cleanup happens even
+// if the server isn't running, so expired keys don't linger in the tree.
+func vpnKeyExpired(path []string) {
+	if len(path) != 5 {
+		return
+	}
+
+	base := "@/" + strings.Join(path[:4], "/")
+	slog.Infof("vpn key %s for %s expired", path[3], path[1])
+	if err := config.DeleteProp(base); err != nil && err != cfgapi.ErrNoProp {
+		slog.Warnf("removing expired key %s: %v", base, err)
+	}
+}
+
+// Collect the latest handshake time and traffic counters for each client key
+// from the server device.
+func vpnServerCollectStats() {
+	var dev *wgtypes.Device
+
+	devs, err := wgctl.GetDevices()
+	if err != nil {
+		slog.Warnf("collecting vpn stats: %v", err)
+		return
+	}
+	for _, d := range devs {
+		if d.Name == vpnServerNic {
+			dev = d
+		}
+	}
+	if dev != nil {
+		vpnServerRecordStats(dev.Peers)
+	}
+}
+
+// Record any changes in the per-key statistics in the config tree.  The
+// kernel's counters are reset whenever the device is reconfigured, so we add
+// the traffic seen since the last collection to the totals already in the tree.
+func vpnServerRecordStats(devPeers []wgtypes.Peer) {
+	peers := make(map[wgtypes.Key]wgtypes.Peer)
+	for _, p := range devPeers {
+		peers[p.PublicKey] = p
+	}
+
+	baseline := (vpnPeerCounters == nil)
+	counters := make(map[wgtypes.Key]vpnCounters)
+	props := make(map[string]string)
+	for _, user := range config.GetUsers() {
+		for _, key := range user.WGConfig {
+			if key.Key == nil {
+				continue
+			}
+			p, ok := peers[*key.Key]
+			if !ok {
+				continue
+			}
+
+			base := "@/users/" + user.UID + "/vpn/" + key.Mac + "/"
+			last := vpnPeerCounters[*key.Key]
+			rx := p.ReceiveBytes - last.rx
+			if rx < 0 {
+				rx = p.ReceiveBytes
+			}
+			tx := p.TransmitBytes - last.tx
+			if tx < 0 {
+				tx = p.TransmitBytes
+			}
+			counters[*key.Key] = vpnCounters{
+				rx: p.ReceiveBytes,
+				tx: p.TransmitBytes,
+			}
+
+			if !baseline && (rx > 0 || tx > 0) {
+				props[base+"rx_bytes"] = strconv.FormatUint(
+					key.RxBytes+uint64(rx), 10)
+				props[base+"tx_bytes"] = strconv.FormatUint(
+					key.TxBytes+uint64(tx), 10)
+			}
+
+			t := p.LastHandshakeTime.Truncate(time.Second)
+			if !t.IsZero() && (key.LastHandshake == nil ||
+				t.After(*key.LastHandshake)) {
+				props[base+"last_handshake"] =
+					t.UTC().Format(time.RFC3339)
+			}
+		}
+	}
+	vpnPeerCounters = counters
+
+	if len(props) > 0 {
+		if err := config.CreateProps(props, nil); err != nil {
+			slog.Warnf("updating vpn stats: %v", err)
+		}
+	}
+}
+
 func vpnServerUpdate(setting, val string) {
 	if setting == "public_key" {
 		wgctl.ServerLoadKeys(wgServer)
@@ -143,10 +258,16 @@ func vpnServerDelete(path []string) {
 func vpnServerLoop(wg *sync.WaitGroup, doneChan chan bool) {
 	defer wg.Done()
 
+	ticker := time.NewTicker(*vpnStatsPeriod)
+	defer ticker.Stop()
+
 	done := false
 	updateNeeded := true
 	for !done {
 		if updateNeeded {
+			// Reconfiguring the device resets its counters, so
+			// capture them first.
+			vpnServerCollectStats()
 			applyFilters()
 			if wgServer != nil {
 				wgctl.ServerConfig(wgServer)
@@ -157,6 +278,8 @@ func vpnServerLoop(wg *sync.WaitGroup, doneChan chan bool) {
 		select {
 		case done = <-doneChan:
 		case updateNeeded = <-wgServerUpdate:
+		case <-ticker.C:
+			vpnServerCollectStats()
 		}
 
 		// Multiple properties may be updated at once, so drain the
@@ -174,6 +297,56 @@ func vpnServerLoop(wg *sync.WaitGroup, doneChan chan bool) {
 	wgctl.ServerDevDown(wgServer)
 }
 
+// Generate the rules allowing traffic from a single client key to the
+// destinations permitted by its policy.  The rules match the key's address only
+// on the VPN interface, so a device on another ring can't claim the key's
+// access by spoofing its address.
+func vpnKeyFirewallRules(key *wgconf.UserConf, policy *wgsite.Policy) []string {
+	src := "FROM RING " + base_def.RING_VPN + " ADDR " +
+		key.IPAddress.IP.String() + "/32 TO "
+
+	// If the policy limits the ports the client may reach, each
+	// destination needs both a TCP and a UDP rule.
+	rules := make([]string, 0)
+	add := func(dst string) {
+		if len(policy.Ports) == 0 {
+			rules = append(rules, "ACCEPT "+src+dst)
+			return
+		}
+		dports := " DPORTS " + strings.Join(policy.Ports, " ")
+		for _, proto := range []string{"TCP", "UDP"} {
+			rule := "ACCEPT " + proto + " " + src + dst + dports
+			rules = append(rules, rule)
+		}
+	}
+
+	rings := policy.Rings
+	if rings == nil {
+		rings = []string{base_def.RING_STANDARD, base_def.RING_DEVICES}
+	}
+	for _, ring := range rings {
+		if !cfgapi.ValidRings[ring] {
+			continue
+		}
+		if ring == base_def.RING_WAN {
+			add("IFACE wan")
+		} else {
+			add("RING " + ring)
+		}
+	}
+
+	for _, subnet := range policy.Subnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			slog.Infof("bad vpn-allowed subnet %s for %s: %v", subnet,
+				key.Mac, err)
+		} else {
+			add("ADDR " + subnet)
+		}
+	}
+
+	return rules
+}
+
 func vpnServerFirewallRules() []string {
 	if wgServer == nil || !wgServer.Enabled {
 		return nil
@@ -185,37 +358,19 @@ func vpnServerFirewallRules() []string {
 	}
 	rules := []string{"ACCEPT UDP FROM IFACE wan TO AP DPORTS " + port}
 
-	rings, err := config.GetProp(wgsite.RingsProp)
-	if err == cfgapi.ErrNoProp {
-		rings = "standard,devices"
-	}
-
-	// XXX - need to handle per-user exceptions
-	for _, ring := range slice(rings) {
-		if ring == "" {
-			continue
-		}
-		if cfgapi.ValidRings[ring] {
-			var rule string
-			if ring == base_def.RING_WAN {
-				rule = "ACCEPT FROM RING vpn to IFACE wan"
-			} else {
-				rule = "ACCEPT FROM RING vpn to RING " + ring
+	// Each key is limited to the rings, subnets, and ports allowed by its
+	// client, user, group, or site policy.  Because the rules are keyed on
+	// the client's assigned address, a key without an address gets no
+	// access beyond the AP itself.
+	for _, user := range config.GetUsers() {
+		for _, key := range user.WGConfig {
+			if key.IPAddress == nil || key.Key == nil {
+				slog.Warnf("vpn key %q for %s has no address; "+
+					"no access granted", key.Mac, user.UID)
+				continue
 			}
-			rules = append(rules, rule)
-		}
-	}
-
-	subnets, err := config.GetProp(wgsite.SubnetsProp)
-	for _, subnet := range slice(subnets) {
-		if subnet == "" {
-			continue
-		}
-		if _, _, err := net.ParseCIDR(subnet); err != nil {
-			slog.Infof("bad vpn-allowed subnet %s: %v", subnet, err)
-		} else {
-			rule := "ACCEPT FROM RING vpn to ADDR " + subnet
-			rules = append(rules, rule)
+			policy := wgsite.GetPolicy(config, user.UID, key.Mac)
+			rules = append(rules, vpnKeyFirewallRules(key, policy)...)
 		}
 	}
 
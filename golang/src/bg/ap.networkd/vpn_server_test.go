@@ -0,0 +1,163 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+	"bg/common/wgconf"
+	"bg/common/wgsite"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	vpnTestUser = "alice"
+	vpnTestMac  = "00:40:54:00:00:01"
+	vpnTestKey  = "@/users/" + vpnTestUser + "/vpn/" + vpnTestMac
+)
+
+// Build a config tree with a single user holding a single vpn key
+func vpnTestConfig(t *testing.T, public string) {
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	props := map[string]string{
+		"@/users/" + vpnTestUser + "/uid": vpnTestUser,
+		vpnTestKey + "/public_key":        public,
+		vpnTestKey + "/assigned_ip":       "192.168.151.2",
+		vpnTestKey + "/rx_bytes":          "1000",
+		vpnTestKey + "/tx_bytes":          "2000",
+	}
+	if err := config.CreateProps(props, nil); err != nil {
+		t.Fatalf("creating vpn key: %v", err)
+	}
+}
+
+func TestVPNKeyExpired(t *testing.T) {
+	private, _ := wgtypes.GeneratePrivateKey()
+	vpnTestConfig(t, private.PublicKey().String())
+
+	// The key's properties are removed even though the server isn't
+	// running.
+	wgServer = nil
+	vpnKeyExpired([]string{"users", vpnTestUser, "vpn"})
+	if _, err := config.GetProps(vpnTestKey); err != nil {
+		t.Errorf("key removed by a malformed expiration: %v", err)
+	}
+
+	path := []string{"users", vpnTestUser, "vpn", vpnTestMac, "public_key"}
+	vpnKeyExpired(path)
+	if _, err := config.GetProps(vpnTestKey); err == nil {
+		t.Errorf("expired key not removed")
+	}
+
+	// A key which has already been removed is harmless
+	vpnKeyExpired(path)
+}
+
+func TestVPNServerStats(t *testing.T) {
+	private, _ := wgtypes.GeneratePrivateKey()
+	public := private.PublicKey()
+	vpnTestConfig(t, public.String())
+	defer func() { vpnPeerCounters = nil }()
+
+	check := func(when string, rx, tx string) {
+		t.Helper()
+		if got, _ := config.GetProp(vpnTestKey + "/rx_bytes"); got != rx {
+			t.Errorf("%s: rx_bytes %s, expected %s", when, got, rx)
+		}
+		if got, _ := config.GetProp(vpnTestKey + "/tx_bytes"); got != tx {
+			t.Errorf("%s: tx_bytes %s, expected %s", when, got, tx)
+		}
+	}
+
+	handshake := time.Now().Add(-time.Minute).Truncate(time.Second)
+	peer := wgtypes.Peer{
+		PublicKey:         public,
+		LastHandshakeTime: handshake,
+		ReceiveBytes:      500,
+		TransmitBytes:     700,
+	}
+	other, _ := wgtypes.GeneratePrivateKey()
+	stranger := wgtypes.Peer{
+		PublicKey:     other.PublicKey(),
+		ReceiveBytes:  10000,
+		TransmitBytes: 10000,
+	}
+
+	// The first collection after a restart only establishes a baseline,
+	// since the totals already include the device's earlier traffic.
+	vpnPeerCounters = nil
+	vpnServerRecordStats([]wgtypes.Peer{peer, stranger})
+	check("baseline", "1000", "2000")
+	got, _ := config.GetProp(vpnTestKey + "/last_handshake")
+	if want := handshake.UTC().Format(time.RFC3339); got != want {
+		t.Errorf("last_handshake %s, expected %s", got, want)
+	}
+
+	// Later traffic is added to the totals
+	peer.ReceiveBytes = 800
+	peer.TransmitBytes = 900
+	vpnServerRecordStats([]wgtypes.Peer{peer, stranger})
+	check("update", "1300", "2200")
+
+	// Nothing changes if there has been no traffic
+	vpnServerRecordStats([]wgtypes.Peer{peer, stranger})
+	check("idle", "1300", "2200")
+
+	// Reconfiguring the device resets its counters
+	peer.ReceiveBytes = 100
+	peer.TransmitBytes = 50
+	vpnServerRecordStats([]wgtypes.Peer{peer, stranger})
+	check("reset", "1400", "2250")
+}
+
+func TestVPNKeyFirewallRules(t *testing.T) {
+	rings["vpn"] = buildRing("192.168.151.0/24", "")
+	defer delete(rings, "vpn")
+
+	key := &wgconf.UserConf{Mac: "00:40:54:00:00:01"}
+	key.IPAddress = &net.IPNet{
+		IP:   net.ParseIP("192.168.151.2"),
+		Mask: net.IPv4Mask(255, 255, 255, 255),
+	}
+	policy := &wgsite.Policy{
+		Rings: []string{"core"},
+		Ports: []string{"22"},
+	}
+
+	// Each rule must be limited to traffic arriving on the VPN interface
+	want := []string{
+		"-A FORWARD  -p tcp -i wgs0  -s 192.168.151.2/32  -o brvlan3 --dport 22 -j ACCEPT",
+		"-A FORWARD  -p udp -i wgs0  -s 192.168.151.2/32  -o brvlan3 --dport 22 -j ACCEPT",
+	}
+	rules := vpnKeyFirewallRules(key, policy)
+	if len(rules) != len(want) {
+		t.Fatalf("got %d rules, want %d: %v", len(rules), len(want),
+			rules)
+	}
+	for i, text := range rules {
+		r, err := parseRule(text)
+		if err != nil {
+			t.Fatalf("%s failed to parse: %v", text, err)
+		}
+		chain, line, err := buildRule(r)
+		if err != nil {
+			t.Fatalf("%s failed to build: %v", text, err)
+		}
+		if line = "-A " + chain + " " + line; line != want[i] {
+			t.Errorf("%s\n  got:\n\t%s\n  expected:\n\t%s", text,
+				line, want[i])
+		}
+	}
+}
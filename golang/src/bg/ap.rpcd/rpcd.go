@@ -203,6 +203,16 @@ func handleNetException(ctx context.Context, tclient cloud_rpc.EventClient, even
 		cloudNetExc.Details = exception.Details
 	}
 
+	if exception.Country != nil {
+		cloudNetExc.Details = append(cloudNetExc.Details,
+			"country="+*exception.Country)
+	}
+
+	if exception.Asn != nil {
+		cloudNetExc.Details = append(cloudNetExc.Details,
+			fmt.Sprintf("asn=%d", *exception.Asn))
+	}
+
 	if exception.VirtualAP != nil {
 		cloudNetExc.VirtualAP = *exception.VirtualAP
 	}
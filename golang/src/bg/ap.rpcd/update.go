@@ -101,6 +101,21 @@ var updates = map[string]updateInfo{
 		localName:  "vendor_defaults.csv",
 		latestName: "vendor_defaults.latest",
 	},
+	"cve_db": {
+		localDir:   "__APDATA__/watchd/",
+		localName:  "cve-db.json.gz",
+		latestName: "cve-db.latest",
+	},
+	"geoip_country": {
+		localDir:   "__APDATA__/geoip/",
+		localName:  "GeoLite2-Country.mmdb",
+		latestName: "GeoLite2-Country.latest",
+	},
+	"geoip_asn": {
+		localDir:   "__APDATA__/geoip/",
+		localName:  "GeoLite2-ASN.mmdb",
+		latestName: "GeoLite2-ASN.latest",
+	},
 	// "vulnerabilities": {
 	// localDir:   "__APDATA__/watchd/",
 	// localName:  "vuln-db.json",
@@ -140,6 +155,12 @@ var uploadTypes = []uploadType{
 		".gob",
 		archive.StatBinaryType,
 	},
+	{
+		"__APDATA__/watchd/capture",
+		"captures",
+		".pcapng",
+		archive.CaptureContentType,
+	},
 }
 
 type oneUpload struct {
@@ -103,6 +103,8 @@ func convertScan(in *ScanRequest, active bool) *base_msg.WatchdScanInfo {
 
 	if active {
 		state = base_msg.WatchdScanInfo_ACTIVE
+	} else if in.Deferred != "" {
+		state = base_msg.WatchdScanInfo_DEFERRED
 	} else {
 		state = base_msg.WatchdScanInfo_SCHEDULED
 	}
@@ -129,6 +131,9 @@ func convertScan(in *ScanRequest, active bool) *base_msg.WatchdScanInfo {
 		When:   aputil.TimeToProtobuf(&in.When),
 		Period: &period,
 	}
+	if state == base_msg.WatchdScanInfo_DEFERRED {
+		out.Deferred = proto.String(in.Deferred)
+	}
 	return &out
 }
 
@@ -146,6 +151,105 @@ func listScans() *base_msg.WatchdResponse {
 	return &base_msg.WatchdResponse{Scans: scans}
 }
 
+// Construct the protobuf equivalent of a wifi journal entry
+func convertJournalEntry(in *journalEntry) *base_msg.WifiJournalEntry {
+	event := in.Event
+	out := base_msg.WifiJournalEntry{
+		Mac:   proto.String(in.Mac),
+		When:  aputil.TimeToProtobuf(&in.When),
+		Event: &event,
+	}
+	if in.Node != "" {
+		out.Node = proto.String(in.Node)
+	}
+	if in.VAP != "" {
+		out.VirtualAP = proto.String(in.VAP)
+	}
+	if in.Band != "" {
+		out.Band = proto.String(in.Band)
+	}
+	if in.Ring != "" {
+		out.Ring = proto.String(in.Ring)
+	}
+	if in.Username != "" {
+		out.Username = proto.String(in.Username)
+	}
+	if in.Signal != 0 {
+		out.Signal = proto.Int32(in.Signal)
+	}
+	if in.Reason != 0 {
+		out.Reason = proto.Uint32(in.Reason)
+	}
+	if in.Detail != "" {
+		out.Detail = proto.String(in.Detail)
+	}
+	return &out
+}
+
+func getJournal(mac *string) *base_msg.WatchdResponse {
+	var hwaddr string
+
+	if mac != nil {
+		m, err := net.ParseMAC(*mac)
+		if err != nil {
+			return &base_msg.WatchdResponse{
+				Errmsg: proto.String("invalid mac address"),
+			}
+		}
+		hwaddr = m.String()
+	}
+
+	list := make([]*base_msg.WifiJournalEntry, 0)
+	for _, e := range journalGet(hwaddr) {
+		list = append(list, convertJournalEntry(e))
+	}
+
+	return &base_msg.WatchdResponse{Journal: list}
+}
+
+// Construct the protobuf equivalent of a port timeline entry
+func convertPortChange(mac string, in *portChange) *base_msg.PortTimelineEntry {
+	kind := in.Kind
+	out := base_msg.PortTimelineEntry{
+		Mac:  proto.String(mac),
+		When: aputil.TimeToProtobuf(&in.When),
+		Kind: &kind,
+	}
+	if in.Protocol != "" {
+		out.Protocol = proto.String(in.Protocol)
+		out.Port = proto.Int32(int32(in.Port))
+	}
+	if in.Before != "" {
+		out.Before = proto.String(in.Before)
+	}
+	if in.After != "" {
+		out.After = proto.String(in.After)
+	}
+	return &out
+}
+
+func getPortTimeline(mac *string) *base_msg.WatchdResponse {
+	var hwaddr string
+
+	if mac != nil {
+		m, err := net.ParseMAC(*mac)
+		if err != nil {
+			return &base_msg.WatchdResponse{
+				Errmsg: proto.String("invalid mac address"),
+			}
+		}
+		hwaddr = m.String()
+	}
+
+	list := make([]*base_msg.PortTimelineEntry, 0)
+	changes, macs := portTimelineGet(hwaddr)
+	for i, c := range changes {
+		list = append(list, convertPortChange(macs[i], c))
+	}
+
+	return &base_msg.WatchdResponse{Timeline: list}
+}
+
 func apiHandle(msg []byte) []byte {
 	var resp *base_msg.WatchdResponse
 
@@ -171,6 +275,10 @@ func apiHandle(msg []byte) []byte {
 			resp = delScan(req.Scan)
 		case base_msg.WatchdRequest_SCAN_RESCHED:
 			resp = reschedScan(req.Scan)
+		case base_msg.WatchdRequest_WIFI_JOURNAL:
+			resp = getJournal(req.Mac)
+		case base_msg.WatchdRequest_PORT_TIMELINE:
+			resp = getPortTimeline(req.Mac)
 		default:
 			resp = &base_msg.WatchdResponse{
 				Errmsg: proto.String("unknown command"),
@@ -0,0 +1,522 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Learn what each device's traffic normally looks like, and raise an exception
+// when a device strays far from it.
+//
+// Every hour of a device's activity is summarized by a handful of metrics: the
+// bytes it sent to and received from the internet, the number of distinct
+// remote hosts and ports it talked to, and the number of DNS queries it made.
+// The traffic metrics come from the stats snapshots; the DNS queries from the
+// net.request events published by our DNS server.  For each metric we keep an
+// exponentially weighted mean and variance of the hourly values, with the
+// weight chosen so that the baseline reflects roughly the last baseline_window
+// of activity.
+//
+// Once a device has been observed for baseline_learn, each snapshot compares
+// the running totals for the current hour with the device's baseline.  A metric
+// which is more than baseline_sigma standard deviations above its mean, and
+// above a floor which keeps quiet devices from tripping over trivial amounts of
+// traffic, is reported as a TRAFFIC_ANOMALY exception.  The busiest endpoints
+// (or the most frequent DNS queries) for the hour are attached to it.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/archive"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	baselineFile    = "baselines.json"
+	baselineSave    = 10 * time.Minute
+	baselineMaxAge  = 30 * 24 * time.Hour // forget devices idle this long
+	baselineDetails = 10                  // endpoints attached to an exception
+)
+
+// The hourly metrics we baseline for each device
+const (
+	metricBytesSent = iota
+	metricBytesRcvd
+	metricRemoteHosts
+	metricRemotePorts
+	metricDNSQueries
+	metricCount
+)
+
+var (
+	baselineWindow = apcfg.Duration("baseline_window", 7*24*time.Hour, true,
+		nil)
+	baselineLearn = apcfg.Duration("baseline_learn", 48*time.Hour, true,
+		nil)
+	baselineSigma = apcfg.Int("baseline_sigma", 5, true, nil)
+
+	metricNames = [metricCount]string{
+		"bytes_sent",
+		"bytes_rcvd",
+		"remote_hosts",
+		"remote_ports",
+		"dns_queries",
+	}
+
+	// Hourly values below these are never considered anomalous
+	metricFloors = [metricCount]float64{
+		50 * 1000 * 1000,  // bytes_sent
+		500 * 1000 * 1000, // bytes_rcvd
+		50,                // remote_hosts
+		20,                // remote_ports
+		500,               // dns_queries
+	}
+
+	baselines      = make(map[string]*deviceBaseline)
+	baselineDirty  bool
+	baselineMtx    sync.Mutex
+	baselineActive bool
+
+	baselineState = &stateFile{
+		name:  "baselines",
+		file:  baselineFile,
+		freq:  baselineSave,
+		mtx:   &baselineMtx,
+		dirty: &baselineDirty,
+		state: func() interface{} {
+			baselinePrune(time.Now())
+			return baselines
+		},
+	}
+)
+
+// A running estimate of a metric's typical hourly value
+type baselineStat struct {
+	Mean float64 `json:"mean"`
+	Var  float64 `json:"var"`
+}
+
+// Fold a new hourly value into the running estimate
+func (s *baselineStat) update(x, alpha float64) {
+	diff := x - s.Mean
+	incr := alpha * diff
+	s.Mean += incr
+	s.Var = (1 - alpha) * (s.Var + diff*incr)
+}
+
+// The traffic between a device and a single remote host within the current hour
+type remoteActivity struct {
+	ip    string
+	sent  uint64
+	rcvd  uint64
+	ports map[int]bool
+}
+
+func (r *remoteActivity) String() string {
+	ports := make([]int, 0)
+	for p := range r.ports {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+
+	plist := make([]string, 0)
+	for i, p := range ports {
+		if i == 5 {
+			plist = append(plist, "...")
+			break
+		}
+		plist = append(plist, fmt.Sprintf("%d", p))
+	}
+
+	return fmt.Sprintf("%s sent=%s rcvd=%s ports=%s", r.ip,
+		toSize(r.sent), toSize(r.rcvd), strings.Join(plist, "+"))
+}
+
+// A device's activity within the current hour
+type hourActivity struct {
+	start   time.Time
+	sent    uint64
+	rcvd    uint64
+	remotes map[string]*remoteActivity
+	ports   map[int]bool
+	queries map[string]int
+	dns     int
+	warned  [metricCount]bool
+}
+
+func newHourActivity(start time.Time) *hourActivity {
+	return &hourActivity{
+		start:   start,
+		remotes: make(map[string]*remoteActivity),
+		ports:   make(map[int]bool),
+		queries: make(map[string]int),
+	}
+}
+
+func (h *hourActivity) values() [metricCount]float64 {
+	return [metricCount]float64{
+		float64(h.sent),
+		float64(h.rcvd),
+		float64(len(h.remotes)),
+		float64(len(h.ports)),
+		float64(h.dns),
+	}
+}
+
+// Everything we know about a single device's typical traffic
+type deviceBaseline struct {
+	Stats    map[string]*baselineStat `json:"stats"`
+	Learned  time.Duration            `json:"learned"`
+	LastSeen time.Time                `json:"last_seen"`
+
+	current *hourActivity
+}
+
+func newDeviceBaseline() *deviceBaseline {
+	b := &deviceBaseline{
+		Stats: make(map[string]*baselineStat),
+	}
+	for _, name := range metricNames {
+		b.Stats[name] = &baselineStat{}
+	}
+	return b
+}
+
+func toSize(bytes uint64) string {
+	var unit string
+
+	if bytes < 1000 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	f := float64(bytes)
+
+	for _, unit = range []string{"KB", "MB", "GB", "TB"} {
+		if f = f / 1000; f < 1000 {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%1.1f%s", f, unit)
+}
+
+func metricString(metric int, val float64) string {
+	if metric == metricBytesSent || metric == metricBytesRcvd {
+		return toSize(uint64(val))
+	}
+	return fmt.Sprintf("%.0f", val)
+}
+
+// Look up a device's baseline, creating one if necessary, and make sure its
+// current activity covers the hour containing 'now'.  If a new hour has begun,
+// the previous hour's activity is folded into the baseline.
+func baselineGet(mac string, now time.Time) *deviceBaseline {
+	b := baselines[mac]
+	if b == nil {
+		b = newDeviceBaseline()
+		baselines[mac] = b
+	}
+	b.LastSeen = now
+
+	hour := now.Truncate(time.Hour)
+	if b.current == nil {
+		b.current = newHourActivity(hour)
+
+	} else if hour.After(b.current.start) {
+		hours := float64(*baselineWindow / time.Hour)
+		if hours < 1 {
+			hours = 1
+		}
+		alpha := 2 / (hours + 1)
+
+		vals := b.current.values()
+		for i, name := range metricNames {
+			b.Stats[name].update(vals[i], alpha)
+		}
+		b.Learned += time.Hour
+		b.current = newHourActivity(hour)
+		baselineDirty = true
+	}
+
+	return b
+}
+
+// Pick out the details to attach to an anomaly exception
+func anomalyDetails(metric int, h *hourActivity) []string {
+	details := make([]string, 0)
+
+	if metric == metricDNSQueries {
+		names := make([]string, 0)
+		for name := range h.queries {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return h.queries[names[i]] > h.queries[names[j]]
+		})
+		for i, name := range names {
+			if i == baselineDetails {
+				break
+			}
+			details = append(details,
+				fmt.Sprintf("%s queries=%d", name, h.queries[name]))
+		}
+		return details
+	}
+
+	remotes := make([]*remoteActivity, 0)
+	for _, r := range h.remotes {
+		if metric != metricRemotePorts || len(r.ports) > 0 {
+			remotes = append(remotes, r)
+		}
+	}
+	sort.Slice(remotes, func(i, j int) bool {
+		ri, rj := remotes[i], remotes[j]
+		switch metric {
+		case metricBytesRcvd:
+			return ri.rcvd > rj.rcvd
+		case metricRemotePorts:
+			return len(ri.ports) > len(rj.ports)
+		}
+		return ri.sent+ri.rcvd > rj.sent+rj.rcvd
+	})
+
+	for i, r := range remotes {
+		if i == baselineDetails {
+			details = append(details, fmt.Sprintf("%d more hosts",
+				len(remotes)-i))
+			break
+		}
+		details = append(details, r.String())
+	}
+	return details
+}
+
+func anomalyException(mac, msg string, details []string) {
+	reason := base_msg.EventNetException_TRAFFIC_ANOMALY
+	entity := &base_msg.EventNetException{
+		Timestamp:  aputil.NowToProtobuf(),
+		Sender:     proto.String(brokerd.Name),
+		Debug:      proto.String("-"),
+		Reason:     &reason,
+		Message:    proto.String(msg),
+		MacAddress: aputil.MacStrToProtobuf(mac),
+		Details:    details,
+	}
+	if ip := getIPFromMac(mac); ip != "" {
+		entity.Ipv4Address = aputil.IPStrToProtobuf(ip)
+	}
+
+	err := brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v",
+			base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
+type anomaly struct {
+	mac     string
+	metric  int
+	message string
+	details []string
+}
+
+// Compare a device's activity for the current hour with its baseline,
+// returning any metrics which have strayed too far.  Each metric is reported
+// at most once per hour.
+func baselineCheck(mac string, b *deviceBaseline) []anomaly {
+	found := make([]anomaly, 0)
+
+	if b.Learned < *baselineLearn || b.current == nil {
+		return found
+	}
+
+	vals := b.current.values()
+	for i, name := range metricNames {
+		s := b.Stats[name]
+		limit := s.Mean + float64(*baselineSigma)*math.Sqrt(s.Var)
+		if b.current.warned[i] || vals[i] < metricFloors[i] ||
+			vals[i] <= limit {
+			continue
+		}
+		b.current.warned[i] = true
+
+		msg := fmt.Sprintf("%s %s this hour, typically %s", name,
+			metricString(i, vals[i]), metricString(i, s.Mean))
+		found = append(found, anomaly{
+			mac:     mac,
+			metric:  i,
+			message: msg,
+			details: anomalyDetails(i, b.current),
+		})
+	}
+
+	return found
+}
+
+// Add a snapshot's traffic to each device's current hour, and check for any
+// anomalies.
+func baselineSnapshot(sn *archive.Snapshot) {
+	found := make([]anomaly, 0)
+
+	baselineMtx.Lock()
+	if !baselineActive {
+		baselineMtx.Unlock()
+		return
+	}
+	for mac, rec := range sn.Data {
+		if internalMacs[network.MacToUint64(mac)] {
+			continue
+		}
+
+		b := baselineGet(mac, sn.End)
+		h := b.current
+		for key, x := range rec.WANStats {
+			s := archive.KeyToSession(key)
+			ip := s.RAddr.String()
+
+			r := h.remotes[ip]
+			if r == nil {
+				r = &remoteActivity{
+					ip:    ip,
+					ports: make(map[int]bool),
+				}
+				h.remotes[ip] = r
+			}
+			r.sent += x.BytesSent
+			r.rcvd += x.BytesRcvd
+			h.sent += x.BytesSent
+			h.rcvd += x.BytesRcvd
+
+			// Only count the ports the device connects to, rather
+			// than the ephemeral ports on its side of the session
+			if x.PktsSent > 0 && s.RPort != 0 && s.RPort < s.LPort {
+				r.ports[s.RPort] = true
+				h.ports[s.RPort] = true
+			}
+		}
+
+		found = append(found, baselineCheck(mac, b)...)
+	}
+	baselineMtx.Unlock()
+
+	for _, a := range found {
+		slog.Infof("traffic anomaly on %s: %s", a.mac, a.message)
+		anomalyException(a.mac, a.message, a.details)
+	}
+}
+
+// Extract the name from a DNS question, as formatted by dns.Question.String():
+// ";example.com.\tIN\t A"
+func dnsQuestionName(q string) string {
+	f := strings.Fields(strings.TrimPrefix(q, ";"))
+	if len(f) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(f[0], ".")
+}
+
+func baselineRequestHandler(event []byte) {
+	request := &base_msg.EventNetRequest{}
+	if err := proto.Unmarshal(event, request); err != nil {
+		slog.Warnf("Unmarshaling NET.REQUEST event: %v", err)
+		return
+	}
+	if request.GetProtocol() != base_msg.Protocol_DNS ||
+		request.Requestor == nil {
+		return
+	}
+
+	mac := getMacFromIP(*request.Requestor)
+	if mac == "" {
+		return
+	}
+
+	baselineMtx.Lock()
+	if !baselineActive {
+		baselineMtx.Unlock()
+		return
+	}
+	b := baselineGet(mac, time.Now())
+	for _, q := range request.Request {
+		if name := dnsQuestionName(q); name != "" {
+			b.current.queries[name]++
+			b.current.dns++
+		}
+	}
+	baselineMtx.Unlock()
+}
+
+// Drop devices we haven't seen in a long time
+func baselinePrune(now time.Time) {
+	for mac, b := range baselines {
+		if now.Sub(b.LastSeen) > baselineMaxAge {
+			delete(baselines, mac)
+		}
+	}
+}
+
+func baselineLoad() {
+	saved := make(map[string]*deviceBaseline)
+	if !baselineState.load(&saved) {
+		return
+	}
+	for mac, b := range saved {
+		if _, err := net.ParseMAC(mac); err != nil {
+			delete(saved, mac)
+			continue
+		}
+		if b.Stats == nil {
+			b.Stats = make(map[string]*baselineStat)
+		}
+		for _, name := range metricNames {
+			if b.Stats[name] == nil {
+				b.Stats[name] = &baselineStat{}
+			}
+		}
+	}
+
+	baselineMtx.Lock()
+	baselines = saved
+	baselinePrune(time.Now())
+	baselineMtx.Unlock()
+}
+
+func baselineFini(w *watcher) {
+	w.running = false
+
+	baselineMtx.Lock()
+	baselineActive = false
+	baselineMtx.Unlock()
+
+	baselineState.stop()
+}
+
+func baselineInit(w *watcher) {
+	baselineLoad()
+	brokerd.Handle(base_def.TOPIC_REQUEST, baselineRequestHandler)
+
+	baselineMtx.Lock()
+	baselineActive = true
+	baselineMtx.Unlock()
+	baselineState.start()
+	w.running = true
+}
+
+func init() {
+	addWatcher("baseline", baselineInit, baselineFini)
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBaselineStat(t *testing.T) {
+	var s baselineStat
+
+	// A steady value is learned, with no variance
+	for i := 0; i < 500; i++ {
+		s.update(100, 0.05)
+	}
+	if math.Abs(s.Mean-100) > 0.01 || s.Var > 0.01 {
+		t.Errorf("steady: got mean %f var %f", s.Mean, s.Var)
+	}
+
+	// Alternating values settle around their mean and spread
+	s = baselineStat{}
+	for i := 0; i < 1000; i++ {
+		s.update(float64(100+50*(i%2)), 0.01)
+	}
+	if math.Abs(s.Mean-125) > 1 || math.Abs(math.Sqrt(s.Var)-25) > 1 {
+		t.Errorf("alternating: got mean %f stddev %f", s.Mean,
+			math.Sqrt(s.Var))
+	}
+}
+
+func TestBaselineCheck(t *testing.T) {
+	mac := "00:11:22:33:44:55"
+	baselines = make(map[string]*deviceBaseline)
+
+	// Learn a device which sends about 1MB an hour to a single server
+	start := time.Date(2020, time.June, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	for ; now.Sub(start) < *baselineLearn+time.Hour; now = now.Add(time.Hour) {
+		b := baselineGet(mac, now)
+		b.current.sent += 1000*1000 + uint64(now.Hour())*1000
+		b.current.dns += 10
+	}
+
+	b := baselineGet(mac, now)
+	if b.Learned < *baselineLearn {
+		t.Fatalf("only learned %v", b.Learned)
+	}
+	if a := baselineCheck(mac, b); len(a) != 0 {
+		t.Fatalf("unexpected anomalies: %v", a)
+	}
+
+	// Now it uploads 2GB to a few hundred hosts
+	for i := 0; i < 200; i++ {
+		ip := net.IPv4(203, 0, byte(i/100), byte(i%100)).String()
+		b.current.remotes[ip] = &remoteActivity{
+			ip:    ip,
+			sent:  10 * 1000 * 1000,
+			ports: map[int]bool{443: true},
+		}
+		b.current.sent += 10 * 1000 * 1000
+	}
+	b.current.ports[443] = true
+
+	found := baselineCheck(mac, b)
+	if len(found) != 2 || found[0].metric != metricBytesSent ||
+		found[1].metric != metricRemoteHosts {
+		t.Fatalf("expected bytes_sent and remote_hosts, got %v", found)
+	}
+	if !strings.HasPrefix(found[0].message, "bytes_sent 2.0GB") {
+		t.Errorf("bad message: %s", found[0].message)
+	}
+	details := found[0].details
+	if len(details) != baselineDetails+1 ||
+		details[baselineDetails] != "190 more hosts" {
+		t.Errorf("bad details: %v", details)
+	}
+
+	// Each metric is only reported once an hour
+	if a := baselineCheck(mac, b); len(a) != 0 {
+		t.Errorf("anomalies repeated: %v", a)
+	}
+}
+
+func TestDNSQuestionName(t *testing.T) {
+	if n := dnsQuestionName(";example.com.\tIN\t A"); n != "example.com" {
+		t.Errorf("got %q", n)
+	}
+	if n := dnsQuestionName(""); n != "" {
+		t.Errorf("got %q for empty question", n)
+	}
+}
@@ -11,8 +11,6 @@ package main
 
 import (
 	"bufio"
-	"encoding/binary"
-	"fmt"
 	"net"
 	"os"
 	"strings"
@@ -22,6 +20,7 @@ import (
 	"bg/ap_common/aputil"
 	"bg/base_def"
 	"bg/base_msg"
+	"bg/common/cfgapi"
 	"bg/common/network"
 
 	"github.com/golang/protobuf/proto"
@@ -29,116 +28,46 @@ import (
 
 const blockfileName = "ip_blocklist.csv"
 
-type ipSet map[uint32]struct{}
-
-type blocklist struct {
-	ips    ipSet      // All IPs in the list
-	filter [][]uint64 // 4-layer bloom filter
-}
-
 var (
-	currentList    *blocklist
+	currentList    *network.PrefixTrie
 	currentListMtx sync.Mutex
 
-	activeBlocks = make(ipSet) // IPs being actively blocked
+	// Networks being actively blocked
+	activeBlocks = make(map[string]struct{})
 
 	blockPeriod = time.Hour
 	lastUpdate  string
 )
 
-func newBlocklist() *blocklist {
-	var b blocklist
-
-	b.ips = make(ipSet)
-	b.filter = make([][]uint64, 4)
-	for i := 0; i < 4; i++ {
-		b.filter[i] = make([]uint64, 1024)
-	}
-	return &b
-}
-
-// The full blocklist is maintained in an ipv4-indexed map.  We use a simple
-// bloom filter as a pre-check to reduce the number of times we have to do a
-// full map lookup.  The structure and order of the hashes was hand-crafted
-// based on a list of 52,000 blocked IPs aggregated by CriticalStack.  Using
-// half as training and half as testing, this resulted in a false positive rate
-// of ~10%.  Almost 70% of negatives were detected on the first hash lookup.
-
-func buildHashes(addr uint32) []uint16 {
-	b := make([]byte, 4)
-	binary.BigEndian.PutUint32(b, addr)
-
-	h0 := uint16(b[3])<<8 | uint16(b[2])
-	h1 := uint16(b[3])<<8 | uint16(b[1])
-	h2 := uint16(b[2])<<8 | uint16(b[1])
-	h3 := uint16(b[3])<<8 | uint16(b[0])
-	return []uint16{h0, h1, h2, h3}
-}
-
-// Translate an index number into a (word, bit) bitmap offset
-func getPosition(v uint16) (uint16, uint16) {
-	const shift = 6
-	const mask = (1 << shift) - 1
-
-	return v >> shift, v & mask
-}
-
-// Add an IP address to the block list.  Each address gets stored in the
-// blockedAddr map and we update the bloom filter.
-func blocklistAdd(building *blocklist, addr uint32) {
-	building.ips[addr] = struct{}{}
-
-	hashes := buildHashes(addr)
-	for h := 0; h < len(hashes); h++ {
-		word, bit := getPosition(hashes[h])
-		building.filter[h][word] |= (1 << bit)
-	}
-}
-
-// Look to see whether an IP address is in the block list
-func blocklistLookup(addr uint32) bool {
-	if _, blocked := activeBlocks[addr]; blocked {
-		return true
-	}
-
+// The full blocklist is maintained as a trie of IPv4 and IPv6 prefixes.  Many
+// lists (e.g., Spamhaus DROP) are made up of entire networks, which can't be
+// represented in a set of single addresses without expanding them into
+// millions of entries.  A single address is simply a /32 (or /128) prefix.
+//
+// A lookup costs at most one node visit per bit in the address, and usually
+// far fewer thanks to path compression, so we no longer need the bloom filter
+// that used to sit in front of the per-address map.
+
+// Look to see whether an IP address is in the block list.  If it is, we return
+// the listed network containing it.
+func blocklistLookup(ip net.IP) *net.IPNet {
 	currentListMtx.Lock()
 	blocklist := currentList
 	currentListMtx.Unlock()
 
 	if blocklist == nil {
-		return false
+		return nil
 	}
 
-	// We use a bloom filter as a quick check to determine whether we
-	// need to do a full map lookup.
-	hashes := buildHashes(addr)
-	for h := 0; h < len(hashes); h++ {
-		word, bit := getPosition(hashes[h])
-		if blocklist.filter[h][word]&(1<<bit) == 0 {
-			return false
-		}
-	}
-	_, blocked := blocklist.ips[addr]
-
-	// XXX: It's probably worth creating a small MRU cache of IP addresses
-	// that make it through the bloom filter and aren't in the blocked list.
-	// If we get unlucky and a high-traffic address (e.g., a Netflix content
-	// server) escapes the filter, we're going to be doing a ton of map
-	// lookups for the same IP address.
-
-	return blocked
+	return blocklist.Match(ip)
 }
 
 func blockExpired(path []string) {
-	var ip net.IP
-
 	if len(path) > 2 {
-		ip = net.ParseIP(path[2])
-	}
-	if ip != nil {
-		slog.Infof("removing %v from actively blocked IPs", ip)
-		addr := network.IPAddrToUint32(ip)
-		delete(activeBlocks, addr)
+		if n, err := cfgapi.ParseBlockedName(path[2]); err == nil {
+			slog.Infof("removing %v from actively blocked networks", n)
+			delete(activeBlocks, network.PrefixString(n))
+		}
 	}
 }
 
@@ -163,29 +92,37 @@ func notifyBlockEvent(dev net.HardwareAddr, ip net.IP) {
 }
 
 // Check to see whether the given IP address is in the block list.  If it is,
-// then we add a config property indicating that it should be blocked, which
-// will in turn cause networkd to insert an iptables rule to implement the
+// then we add a config property indicating that its network should be blocked,
+// which will in turn cause networkd to insert an iptables rule to implement the
 // block.
 func checkBlock(dev net.HardwareAddr, ip net.IP) {
-	addr := network.IPAddrToUint32(ip)
-	if addr != 0 && blocklistLookup(addr) {
-		_, ok := activeBlocks[addr]
-		if ok {
+	if ip.IsUnspecified() {
+		return
+	}
+
+	if n := blocklistLookup(ip); n != nil {
+		key := network.PrefixString(n)
+		if _, ok := activeBlocks[key]; ok {
 			// We've already sent the block notification, but it
 			// takes a little time for that to finally be enshrined
 			// in an iptable rule.
 			return
 		}
 
-		slog.Infof("%v is talking with blocked IP %v", dev, ip)
-		activeBlocks[addr] = struct{}{}
+		if key != ip.String() {
+			slog.Infof("%v is talking with blocked IP %v (in %s)",
+				dev, ip, key)
+		} else {
+			slog.Infof("%v is talking with blocked IP %v", dev, ip)
+		}
+		activeBlocks[key] = struct{}{}
 		notifyBlockEvent(dev, ip)
 		metrics.blockedIPs.Inc()
 
-		// Create a property for this IP, which will cause networkd to
-		// add a new firewall rule blocking it.  We set an expiration
-		// time for the block to avoid an ever-growing list of iptables
-		// rules.
+		// Create a property for this network, which will cause
+		// networkd to add a new firewall rule blocking it.  We set an
+		// expiration time for the block to avoid an ever-growing list
+		// of iptables rules.
 		//
 		// XXX: instead of a constant timeout, we could implement some
 		// sort of exponentially increasing timeout to handle persistent
@@ -194,16 +131,16 @@ func checkBlock(dev net.HardwareAddr, ip net.IP) {
 		// culled.  For simplicity in this initial implementation, we'll
 		// live with having to re-block an address once an hour.
 
-		prop := fmt.Sprintf("@/firewall/blocked/%v", ip)
 		expires := time.Now().Add(blockPeriod)
-		config.CreateProp(prop, "true", &expires)
+		config.CreateProp(cfgapi.BlockedProp(n), "true", &expires)
 	}
 }
 
 // Pull a list of blocked IPs from a CSV.  The first field of each line must be
-// an IP address.  The rest of the line is ignored.
+// an IP address or a network in CIDR notation.  The rest of the line is
+// ignored.
 func ingestBlocklist(filename string) {
-	building := newBlocklist()
+	building := network.NewPrefixTrie()
 
 	file, err := os.Open(filename)
 	if err != nil {
@@ -216,7 +153,7 @@ func ingestBlocklist(filename string) {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if line[0] == '#' {
+		if len(line) == 0 || line[0] == '#' {
 			continue
 		}
 
@@ -224,15 +161,13 @@ func ingestBlocklist(filename string) {
 		if len(fields) < 2 {
 			continue
 		}
-		if ip := net.ParseIP(fields[0]); ip != nil {
-			if addr := network.IPAddrToUint32(ip); addr != 0 {
-				cnt++
-				blocklistAdd(building, addr)
-			}
+		n, err := network.ParsePrefix(fields[0])
+		if err == nil && !n.IP.IsUnspecified() && building.Insert(n) {
+			cnt++
 		}
 	}
 
-	slog.Infof("Ingested %d blocked IPs from %s", cnt, filename)
+	slog.Infof("Ingested %d blocked networks from %s", cnt, filename)
 	currentListMtx.Lock()
 	currentList = building
 	currentListMtx.Unlock()
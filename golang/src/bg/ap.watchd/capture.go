@@ -0,0 +1,545 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// On-demand packet capture.  Each capture is described by a subtree of the
+// config tree:
+//
+//     @/capture/<name>/active       - capture runs while true and unexpired
+//     @/capture/<name>/mac          - only capture packets to/from this client
+//     @/capture/<name>/ring         - only capture packets on this ring
+//     @/capture/<name>/filter       - additional BPF expression
+//     @/capture/<name>/rules        - capture on rings with CAPTURE rules
+//     @/capture/<name>/file_size    - rotate files after <n> MB
+//     @/capture/<name>/file_period  - rotate files after this duration
+//     @/capture/<name>/max_files    - number of completed files to retain
+//     @/capture/<name>/upload       - upload completed files to the cloud
+//
+// Completed files are moved into the capture directory, from which ap.rpcd
+// uploads and removes them.  Files that aren't meant to be uploaded are kept in
+// the 'local' subdirectory.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/base_def"
+	"bg/common/cfgapi"
+
+	// Requires libpcap
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	captureRoot   = "@/capture"
+	captureSuffix = ".pcapng"
+)
+
+var (
+	captureSnaplen = apcfg.Int("capture_snaplen", 65536, true, nil)
+
+	// default limits applied to each capture file
+	captureFileSize   = apcfg.Int("capture_file_size", 16, true, nil)
+	captureFilePeriod = apcfg.Duration("capture_file_period",
+		15*time.Minute, true, nil)
+	captureMaxFiles = apcfg.Int("capture_max_files", 8, true, nil)
+
+	captureDir string
+	captures   = make(map[string]*capture)
+	captureMtx sync.Mutex
+)
+
+type captureSpec struct {
+	mac        string
+	ring       string
+	filter     string
+	rules      bool
+	upload     bool
+	fileSize   int64
+	filePeriod time.Duration
+	maxFiles   int
+}
+
+type capture struct {
+	name    string
+	spec    captureSpec
+	running bool
+	wg      sync.WaitGroup
+	sync.Mutex
+}
+
+// Per-interface state for a running capture
+type captureFile struct {
+	cap    *capture
+	ring   string
+	iface  string
+	filter string
+
+	file    *os.File
+	writer  *pcapgo.NgWriter
+	opened  time.Time
+	written int64
+}
+
+func captureSpecFromProps(node *cfgapi.PropertyNode) (*captureSpec, error) {
+	var err error
+
+	spec := captureSpec{
+		fileSize:   int64(*captureFileSize),
+		filePeriod: *captureFilePeriod,
+		maxFiles:   *captureMaxFiles,
+	}
+
+	spec.mac, _ = node.GetChildString("mac")
+	spec.ring, _ = node.GetChildString("ring")
+	spec.filter, _ = node.GetChildString("filter")
+	spec.rules, _ = node.GetChildBool("rules")
+	spec.upload, _ = node.GetChildBool("upload")
+
+	if spec.ring != "" && rings[spec.ring] == nil {
+		return nil, fmt.Errorf("no such ring: %s", spec.ring)
+	}
+
+	if x, err := node.GetChildInt("file_size"); err == nil && x > 0 {
+		spec.fileSize = int64(x)
+	}
+	if x, err := node.GetChildInt("max_files"); err == nil && x > 0 {
+		spec.maxFiles = x
+	}
+	if x, _ := node.GetChildString("file_period"); x != "" {
+		if spec.filePeriod, err = time.ParseDuration(x); err != nil {
+			return nil, fmt.Errorf("bad file_period '%s': %v", x, err)
+		}
+	}
+	spec.fileSize *= 1024 * 1024
+
+	return &spec, nil
+}
+
+// Find all of the rings that are the source of an active CAPTURE rule
+func captureRuleRings() map[string]bool {
+	captured := make(map[string]bool)
+
+	props, _ := config.GetProps("@/firewall/rules")
+	if props == nil {
+		return captured
+	}
+
+	for _, rule := range props.Children {
+		if active, err := rule.GetChildBool("active"); err == nil && !active {
+			continue
+		}
+		text, _ := rule.GetChildString("rule")
+		f := strings.Fields(text)
+		if len(f) < 4 || !strings.EqualFold(f[0], "CAPTURE") {
+			continue
+		}
+		for i := 1; i < len(f)-2; i++ {
+			if strings.EqualFold(f[i], "FROM") &&
+				strings.EqualFold(f[i+1], "RING") {
+				captured[f[i+2]] = true
+			}
+		}
+	}
+	return captured
+}
+
+// Build the list of files to be captured, each representing a single
+// interface and the filter to be applied to it.
+func (c *capture) targets() []*captureFile {
+	var ruleRings map[string]bool
+
+	if c.spec.rules {
+		ruleRings = captureRuleRings()
+	}
+
+	files := make([]*captureFile, 0)
+	for ring, ringConfig := range rings {
+		var iface string
+		var terms []string
+
+		if ring == base_def.RING_INTERNAL {
+			continue
+		}
+		if c.spec.ring != "" && ring != c.spec.ring {
+			continue
+		}
+		if c.spec.rules && !ruleRings[ring] {
+			continue
+		}
+
+		if ring == base_def.RING_VPN {
+			// The VPN interface has no layer2 header, so we
+			// have to filter on the client's IP address.
+			iface = "wgs0"
+			if c.spec.mac != "" {
+				ip := getIPFromMac(c.spec.mac)
+				if ip == "" {
+					continue
+				}
+				terms = append(terms, "host "+ip)
+			}
+		} else {
+			iface = ringConfig.Bridge
+			if c.spec.mac != "" {
+				terms = append(terms, "ether host "+c.spec.mac)
+			}
+		}
+		if iface == "" {
+			continue
+		}
+
+		if c.spec.filter != "" {
+			terms = append(terms, "("+c.spec.filter+")")
+		}
+
+		f := &captureFile{
+			cap:    c,
+			ring:   ring,
+			iface:  iface,
+			filter: strings.Join(terms, " and "),
+		}
+		files = append(files, f)
+	}
+
+	return files
+}
+
+func (f *captureFile) activePath() string {
+	return filepath.Join(captureDir, "active",
+		f.cap.name+"-"+f.ring+captureSuffix)
+}
+
+func (f *captureFile) open(hdl *pcap.Handle) error {
+	var err error
+
+	path := f.activePath()
+	if f.file, err = os.Create(path); err != nil {
+		return fmt.Errorf("creating %s: %v", path, err)
+	}
+
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = f.iface
+	intf.Description = f.ring
+	intf.Filter = f.filter
+	intf.LinkType = hdl.LinkType()
+	intf.SnapLength = uint32(*captureSnaplen)
+
+	f.writer, err = pcapgo.NewNgWriterInterface(f.file, intf,
+		pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		f.file.Close()
+		os.Remove(path)
+		return fmt.Errorf("creating pcapng writer: %v", err)
+	}
+
+	f.opened = time.Now()
+	f.written = 0
+	return nil
+}
+
+// Decide whether the current file has reached its size or age limit
+func (f *captureFile) full(now time.Time) bool {
+	return f.file != nil && (f.written >= f.cap.spec.fileSize ||
+		now.Sub(f.opened) >= f.cap.spec.filePeriod)
+}
+
+// Close the current file and move it to its final location.  If the capture
+// isn't being uploaded, prune the oldest files beyond the retention limit.
+// Files waiting to be uploaded are left for ap.rpcd to remove.
+func (f *captureFile) close() {
+	if f.file == nil {
+		return
+	}
+
+	if err := f.writer.Flush(); err != nil {
+		slog.Warnf("flushing capture %s: %v", f.file.Name(), err)
+	}
+	f.file.Close()
+
+	dir := captureDir
+	if !f.cap.spec.upload {
+		dir = filepath.Join(captureDir, "local")
+	}
+
+	name := fmt.Sprintf("%s-%s-%s%s", f.cap.name, f.ring,
+		f.opened.UTC().Format("20060102T150405Z"), captureSuffix)
+	final := filepath.Join(dir, name)
+	if f.written == 0 {
+		os.Remove(f.file.Name())
+	} else if err := os.Rename(f.file.Name(), final); err != nil {
+		slog.Warnf("renaming %s to %s: %v", f.file.Name(), final, err)
+	} else {
+		slog.Debugf("completed capture file %s", final)
+	}
+
+	f.file = nil
+	f.writer = nil
+	if !f.cap.spec.upload {
+		capturePrune(dir, f.cap.name+"-"+f.ring+"-",
+			f.cap.spec.maxFiles)
+	}
+}
+
+// Remove the oldest completed files with the given prefix, leaving at most
+// 'max' behind.
+func capturePrune(dir, prefix string, max int) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	names := make([]string, 0)
+	for _, f := range files {
+		n := f.Name()
+		if strings.HasPrefix(n, prefix) && strings.HasSuffix(n, captureSuffix) {
+			names = append(names, n)
+		}
+	}
+
+	// The embedded timestamps cause the names to sort chronologically
+	sort.Strings(names)
+	for len(names) > max {
+		os.Remove(filepath.Join(dir, names[0]))
+		names = names[1:]
+	}
+}
+
+func (f *captureFile) run(hdl *pcap.Handle) {
+	c := f.cap
+
+	defer c.wg.Done()
+	defer hdl.Close()
+
+	slog.Infof("capture %s: capturing on %s (%s) filter '%s'", c.name,
+		f.iface, f.ring, f.filter)
+	for c.isRunning() {
+		data, ci, err := hdl.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			err = nil
+		} else if err != nil {
+			if c.isRunning() {
+				slog.Warnf("capture %s: reading from %s: %v",
+					c.name, f.iface, err)
+			}
+			break
+		}
+
+		if f.full(time.Now()) {
+			f.close()
+		}
+		if data == nil {
+			continue
+		}
+
+		if f.file == nil {
+			if err = f.open(hdl); err != nil {
+				slog.Warnf("capture %s: %v", c.name, err)
+				break
+			}
+		}
+
+		if err = f.writer.WritePacket(ci, data); err != nil {
+			slog.Warnf("capture %s: writing: %v", c.name, err)
+			break
+		}
+		f.written += int64(len(data))
+	}
+	f.close()
+	slog.Infof("capture %s: stopped on %s (%s)", c.name, f.iface, f.ring)
+}
+
+func (c *capture) isRunning() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.running
+}
+
+func (c *capture) start() error {
+	files := c.targets()
+	if len(files) == 0 {
+		return fmt.Errorf("no interfaces match the capture criteria")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	started := 0
+	c.running = true
+	for _, f := range files {
+		hdl, err := pcap.OpenLive(f.iface, int32(*captureSnaplen), true,
+			time.Second)
+		if err == nil && f.filter != "" {
+			if err = hdl.SetBPFFilter(f.filter); err != nil {
+				hdl.Close()
+			}
+		}
+		if err != nil {
+			slog.Warnf("capture %s: unable to open %s: %v", c.name,
+				f.iface, err)
+			continue
+		}
+
+		started++
+		c.wg.Add(1)
+		go f.run(hdl)
+	}
+
+	if started == 0 {
+		c.running = false
+		return fmt.Errorf("unable to open any interfaces")
+	}
+	return nil
+}
+
+func (c *capture) stop() {
+	c.Lock()
+	c.running = false
+	c.Unlock()
+
+	c.wg.Wait()
+}
+
+// Compare the set of captures described in the config tree with those
+// currently running, starting and stopping captures as needed.
+func captureRefresh() {
+	wanted := make(map[string]*captureSpec)
+
+	props, _ := config.GetProps(captureRoot)
+	if props != nil {
+		for name, node := range props.Children {
+			active, _ := node.GetChild("active")
+			if active == nil || active.Expired() {
+				continue
+			}
+			if on, _ := active.GetBool(); !on {
+				continue
+			}
+
+			spec, err := captureSpecFromProps(node)
+			if err != nil {
+				slog.Warnf("bad capture %s: %v", name, err)
+				continue
+			}
+			wanted[name] = spec
+		}
+	}
+
+	captureMtx.Lock()
+	defer captureMtx.Unlock()
+
+	for name, c := range captures {
+		if spec := wanted[name]; spec == nil || *spec != c.spec {
+			slog.Infof("stopping capture %s", name)
+			c.stop()
+			delete(captures, name)
+		}
+	}
+
+	for name, spec := range wanted {
+		if captures[name] != nil {
+			continue
+		}
+
+		c := &capture{
+			name: name,
+			spec: *spec,
+		}
+		slog.Infof("starting capture %s", name)
+		if err := c.start(); err != nil {
+			slog.Warnf("capture %s failed: %v", name, err)
+		} else {
+			captures[name] = c
+		}
+	}
+}
+
+func configCaptureChanged(path []string, val string, expires *time.Time) {
+	captureRefresh()
+}
+
+func configCaptureDeleted(path []string) {
+	captureRefresh()
+}
+
+// If a capture is limited to CAPTURE-rule rings, changes to the firewall rules
+// may change the set of interfaces it should be watching.
+func configCaptureRuleChanged(path []string, val string, expires *time.Time) {
+	configCaptureRuleDeleted(path)
+}
+
+func configCaptureRuleDeleted(path []string) {
+	captureMtx.Lock()
+	for name, c := range captures {
+		if c.spec.rules {
+			c.stop()
+			delete(captures, name)
+		}
+	}
+	captureMtx.Unlock()
+
+	captureRefresh()
+}
+
+func captureFini(w *watcher) {
+	captureMtx.Lock()
+	for name, c := range captures {
+		c.stop()
+		delete(captures, name)
+	}
+	captureMtx.Unlock()
+
+	w.running = false
+}
+
+func captureInit(w *watcher) {
+	captureDir = filepath.Join(*watchDir, "capture")
+	for _, dir := range []string{"active", "local"} {
+		path := filepath.Join(captureDir, dir)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			slog.Warnf("Error adding directory %s: %v", path, err)
+			return
+		}
+	}
+
+	// Any files left in the working directory were interrupted by a
+	// crash or restart.  Keep them, tagged with their modification time.
+	active := filepath.Join(captureDir, "active")
+	if files, err := ioutil.ReadDir(active); err == nil {
+		for _, f := range files {
+			base := strings.TrimSuffix(f.Name(), captureSuffix)
+			name := base + "-" +
+				strconv.FormatInt(f.ModTime().Unix(), 10) +
+				captureSuffix
+			os.Rename(filepath.Join(active, f.Name()),
+				filepath.Join(captureDir, "local", name))
+		}
+	}
+
+	config.HandleChange(`^@/capture/.*`, configCaptureChanged)
+	config.HandleDelExp(`^@/capture/.*`, configCaptureDeleted)
+	config.HandleChange(`^@/firewall/rules/.*`, configCaptureRuleChanged)
+	config.HandleDelExp(`^@/firewall/rules/.*`, configCaptureRuleDeleted)
+
+	captureRefresh()
+	w.running = true
+}
+
+func init() {
+	addWatcher("capture", captureInit, captureFini)
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"go.uber.org/zap/zaptest"
+)
+
+func captureTestDir(t *testing.T) {
+	var err error
+
+	if captureDir, err = ioutil.TempDir("", "capture"); err != nil {
+		t.Fatalf("creating capture directory: %v", err)
+	}
+	for _, dir := range []string{"active", "local"} {
+		os.Mkdir(filepath.Join(captureDir, dir), 0755)
+	}
+}
+
+// Open a capture file and write a single packet to it
+func captureTestFile(t *testing.T, c *capture, opened time.Time) *captureFile {
+	f := &captureFile{cap: c, ring: "standard", iface: "brvlan5"}
+
+	file, err := os.Create(f.activePath())
+	if err != nil {
+		t.Fatalf("creating capture file: %v", err)
+	}
+	intf := pcapgo.DefaultNgInterface
+	intf.LinkType = layers.LinkTypeEthernet
+	f.writer, err = pcapgo.NewNgWriterInterface(file, intf,
+		pcapgo.DefaultNgWriterOptions)
+	if err != nil {
+		t.Fatalf("creating pcapng writer: %v", err)
+	}
+	f.file = file
+	f.opened = opened
+
+	data := make([]byte, 60)
+	ci := gopacket.CaptureInfo{
+		Timestamp:     opened,
+		CaptureLength: len(data),
+		Length:        len(data),
+	}
+	if err = f.writer.WritePacket(ci, data); err != nil {
+		t.Fatalf("writing packet: %v", err)
+	}
+	f.written = int64(len(data))
+
+	return f
+}
+
+func captureTestFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("reading %s: %v", dir, err)
+	}
+
+	names := make([]string, 0)
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return names
+}
+
+func TestCaptureRotate(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	captureTestDir(t)
+	defer os.RemoveAll(captureDir)
+
+	c := &capture{
+		name: "test",
+		spec: captureSpec{fileSize: 100, filePeriod: time.Minute},
+	}
+	now := time.Now()
+	f := captureTestFile(t, c, now)
+	defer f.close()
+
+	if f.full(now) {
+		t.Errorf("new file is already full")
+	}
+	if !f.full(now.Add(time.Minute)) {
+		t.Errorf("file not rotated after its period")
+	}
+	f.written = 100
+	if !f.full(now) {
+		t.Errorf("file not rotated at its size limit")
+	}
+}
+
+func TestCapturePrune(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	captureTestDir(t)
+	defer os.RemoveAll(captureDir)
+
+	start := time.Date(2020, time.June, 1, 12, 0, 0, 0, time.UTC)
+	local := &capture{name: "local", spec: captureSpec{maxFiles: 2}}
+	upload := &capture{
+		name: "upload",
+		spec: captureSpec{maxFiles: 2, upload: true},
+	}
+
+	for i := 0; i < 4; i++ {
+		opened := start.Add(time.Duration(i) * time.Minute)
+		captureTestFile(t, local, opened).close()
+		captureTestFile(t, upload, opened).close()
+	}
+
+	// Only the newest local files are retained
+	names := captureTestFiles(t, filepath.Join(captureDir, "local"))
+	want := []string{
+		"local-standard-20200601T120200Z.pcapng",
+		"local-standard-20200601T120300Z.pcapng",
+	}
+	if len(names) != len(want) || names[0] != want[0] ||
+		names[1] != want[1] {
+		t.Errorf("local files: got %v, want %v", names, want)
+	}
+
+	// Files waiting to be uploaded are never pruned
+	if names = captureTestFiles(t, captureDir); len(names) != 4 {
+		t.Errorf("upload files: got %v, want 4 files", names)
+	}
+	if names = captureTestFiles(t, filepath.Join(captureDir,
+		"active")); len(names) != 0 {
+		t.Errorf("files left in the active directory: %v", names)
+	}
+}
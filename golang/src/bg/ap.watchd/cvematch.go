@@ -0,0 +1,611 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Match the products and versions identified by nmap's service scans against
+// an offline snapshot of the NVD CVE feed.  The snapshot is a gzipped NVD JSON
+// 1.1 feed, kept in the watchd data directory and refreshed by ap.rpcd like
+// our other data files.  Each CPE reported for an open port is looked up by
+// vendor and product, and the service's version is checked against the
+// version ranges of the CVE's vulnerable configurations.  Services whose
+// version nmap couldn't determine are never matched.
+//
+// Matches are reported as apvuln findings with a CVSS score, and are cleared
+// when a later scan no longer matches them.  CVEs which have a dedicated test
+// in the vulnerability list are left to that test.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/aputil"
+	"bg/ap_common/apvuln"
+
+	nmap "github.com/lair-framework/go-nmap"
+)
+
+const (
+	cveMatchTool   = "cve-match"
+	cveDBName      = "cve-db.json.gz"
+	cveSummaryMax  = 200
+	cveAnyVersion  = "*"
+	cveNoVersion   = "-"
+	cveUpdatesProp = "@/updates/cve_db"
+)
+
+var (
+	cveWarnScore = apcfg.Int("cve_warn_cvss", 7, true, nil)
+
+	cveDB         *cveDatabase
+	cveServices   = make(map[string][]*cveService)
+	cveLastUpdate string
+	cveMtx        sync.Mutex
+)
+
+// A single CVE from the feed
+type cveEntry struct {
+	ID      string
+	CVSS    float64
+	Summary string
+}
+
+// One vulnerable configuration of a CVE.  An exact version of "*" matches all
+// versions within the (optional) range.
+type cveRange struct {
+	cve *cveEntry
+
+	version   string
+	startIncl string
+	startExcl string
+	endIncl   string
+	endExcl   string
+	bounded   bool
+}
+
+// The CVE ranges, indexed by "<part>:<vendor>:<product>"
+type cveDatabase struct {
+	products map[string][]*cveRange
+	cves     int
+}
+
+// A service found listening on a port, along with the CPEs nmap reported
+type cveService struct {
+	Protocol string
+	Port     int
+	Service  string
+	Product  string
+	Version  string
+	CPEs     []string
+}
+
+// The subset of the NVD JSON 1.1 schema we care about
+type nvdCPEMatch struct {
+	Vulnerable            bool   `json:"vulnerable"`
+	CPE23URI              string `json:"cpe23Uri"`
+	VersionStartIncluding string `json:"versionStartIncluding"`
+	VersionStartExcluding string `json:"versionStartExcluding"`
+	VersionEndIncluding   string `json:"versionEndIncluding"`
+	VersionEndExcluding   string `json:"versionEndExcluding"`
+}
+
+type nvdNode struct {
+	Operator string        `json:"operator"`
+	Children []nvdNode     `json:"children"`
+	CPEMatch []nvdCPEMatch `json:"cpe_match"`
+}
+
+type nvdItem struct {
+	CVE struct {
+		Meta struct {
+			ID string `json:"ID"`
+		} `json:"CVE_data_meta"`
+		Description struct {
+			Data []struct {
+				Lang  string `json:"lang"`
+				Value string `json:"value"`
+			} `json:"description_data"`
+		} `json:"description"`
+	} `json:"cve"`
+	Configurations struct {
+		Nodes []nvdNode `json:"nodes"`
+	} `json:"configurations"`
+	Impact struct {
+		V3 struct {
+			CVSS struct {
+				BaseScore float64 `json:"baseScore"`
+			} `json:"cvssV3"`
+		} `json:"baseMetricV3"`
+		V2 struct {
+			CVSS struct {
+				BaseScore float64 `json:"baseScore"`
+			} `json:"cvssV2"`
+		} `json:"baseMetricV2"`
+	} `json:"impact"`
+}
+
+// Split a version string into its numeric and alphabetic components, so
+// "7.4p1" becomes ["7", "4", "p", "1"].
+func versionFields(v string) []string {
+	var cur []rune
+	fields := make([]string, 0)
+
+	flush := func() {
+		if len(cur) > 0 {
+			fields = append(fields, string(cur))
+			cur = cur[:0]
+		}
+	}
+
+	isDigit := func(r rune) bool { return r >= '0' && r <= '9' }
+	for _, r := range strings.ToLower(v) {
+		if !isDigit(r) && (r < 'a' || r > 'z') {
+			flush()
+		} else if len(cur) > 0 && isDigit(cur[0]) != isDigit(r) {
+			flush()
+			cur = append(cur, r)
+		} else {
+			cur = append(cur, r)
+		}
+	}
+	flush()
+
+	return fields
+}
+
+// versionCompare returns -1, 0, or 1 depending on whether version a is older
+// than, the same as, or newer than version b.  Numeric components are compared
+// numerically, and a numeric component is considered newer than an alphabetic
+// one, so 1.0 is newer than 1.0rc1.
+func versionCompare(a, b string) int {
+	af := versionFields(a)
+	bf := versionFields(b)
+
+	for i := 0; i < len(af) || i < len(bf); i++ {
+		var x, y string
+		if i < len(af) {
+			x = af[i]
+		}
+		if i < len(bf) {
+			y = bf[i]
+		}
+
+		xn, xerr := strconv.ParseUint(x, 10, 64)
+		yn, yerr := strconv.ParseUint(y, 10, 64)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+		case x == "":
+			if yerr == nil {
+				return -1
+			}
+			return 1
+		case y == "":
+			if xerr == nil {
+				return 1
+			}
+			return -1
+		case xerr == nil:
+			return 1
+		case yerr == nil:
+			return -1
+		case x != y:
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func (r *cveRange) matches(version string) bool {
+	if r.version != cveAnyVersion {
+		return versionCompare(version, r.version) == 0
+	}
+
+	if r.startIncl != "" && versionCompare(version, r.startIncl) < 0 {
+		return false
+	}
+	if r.startExcl != "" && versionCompare(version, r.startExcl) <= 0 {
+		return false
+	}
+	if r.endIncl != "" && versionCompare(version, r.endIncl) > 0 {
+		return false
+	}
+	if r.endExcl != "" && versionCompare(version, r.endExcl) >= 0 {
+		return false
+	}
+
+	// A "*" without any bounds claims every version is vulnerable, which
+	// is almost always an artifact of an incomplete NVD entry.
+	return r.bounded
+}
+
+// Parse a CPE into its "<part>:<vendor>:<product>" key and its version.  We
+// accept both the 2.3 formatted string binding used by NVD and the 2.2 URI
+// binding used by nmap.
+func cpeParse(cpe string) (key, version string) {
+	var f []string
+
+	if strings.HasPrefix(cpe, "cpe:2.3:") {
+		f = strings.Split(cpe[len("cpe:2.3:"):], ":")
+	} else if strings.HasPrefix(cpe, "cpe:/") {
+		f = strings.Split(cpe[len("cpe:/"):], ":")
+	} else {
+		return
+	}
+
+	if len(f) < 3 || f[1] == "" || f[2] == "" {
+		return
+	}
+	key = strings.ToLower(strings.Join(f[:3], ":"))
+
+	if len(f) > 3 {
+		version = f[3]
+
+		// NVD splits suffixes like OpenSSH's "p1" into the 'update'
+		// field, while nmap leaves them in the version.
+		if len(f) > 4 && version != cveAnyVersion &&
+			version != cveNoVersion && f[4] != cveAnyVersion &&
+			f[4] != cveNoVersion && f[4] != "" {
+			version += f[4]
+		}
+	}
+
+	return
+}
+
+func (db *cveDatabase) addNode(cve *cveEntry, node *nvdNode) {
+	for _, m := range node.CPEMatch {
+		if !m.Vulnerable {
+			continue
+		}
+		key, version := cpeParse(m.CPE23URI)
+		if key == "" || version == "" || version == cveNoVersion {
+			continue
+		}
+
+		r := &cveRange{
+			cve:       cve,
+			version:   version,
+			startIncl: m.VersionStartIncluding,
+			startExcl: m.VersionStartExcluding,
+			endIncl:   m.VersionEndIncluding,
+			endExcl:   m.VersionEndExcluding,
+		}
+		r.bounded = r.startIncl != "" || r.startExcl != "" ||
+			r.endIncl != "" || r.endExcl != ""
+		db.products[key] = append(db.products[key], r)
+	}
+
+	for i := range node.Children {
+		db.addNode(cve, &node.Children[i])
+	}
+}
+
+func (db *cveDatabase) addItem(item *nvdItem) {
+	cve := &cveEntry{ID: item.CVE.Meta.ID}
+	if cve.ID == "" {
+		return
+	}
+
+	if cve.CVSS = item.Impact.V3.CVSS.BaseScore; cve.CVSS == 0 {
+		cve.CVSS = item.Impact.V2.CVSS.BaseScore
+	}
+	for _, d := range item.CVE.Description.Data {
+		if d.Lang == "en" {
+			cve.Summary = d.Value
+			break
+		}
+	}
+	if len(cve.Summary) > cveSummaryMax {
+		cve.Summary = cve.Summary[:cveSummaryMax-3] + "..."
+	}
+
+	for i := range item.Configurations.Nodes {
+		db.addNode(cve, &item.Configurations.Nodes[i])
+	}
+	db.cves++
+}
+
+// Stream the CVE_Items out of an NVD JSON feed, rather than unmarshaling the
+// whole (very large) feed at once.
+func cveDBParse(r io.Reader) (*cveDatabase, error) {
+	db := &cveDatabase{
+		products: make(map[string][]*cveRange),
+	}
+
+	dec := json.NewDecoder(r)
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != '{' {
+		return nil, fmt.Errorf("feed isn't a JSON object")
+	}
+
+	for dec.More() {
+		if tok, err = dec.Token(); err != nil {
+			return nil, err
+		}
+
+		if key, _ := tok.(string); key != "CVE_Items" {
+			// Skip over the feed's metadata
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if tok, err = dec.Token(); err != nil {
+			return nil, err
+		}
+		if d, ok := tok.(json.Delim); !ok || d != '[' {
+			return nil, fmt.Errorf("CVE_Items isn't an array")
+		}
+		for dec.More() {
+			var item nvdItem
+
+			if err = dec.Decode(&item); err != nil {
+				return nil, err
+			}
+			db.addItem(&item)
+		}
+		if _, err = dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+
+	return db, nil
+}
+
+func cveDBLoad() {
+	name := *watchDir + "/" + cveDBName
+	if !aputil.FileExists(name) {
+		slog.Infof("no CVE database at %s", name)
+		return
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		slog.Warnf("opening CVE database: %v", err)
+		return
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		slog.Warnf("reading CVE database: %v", err)
+		return
+	}
+	defer zr.Close()
+
+	start := time.Now()
+	db, err := cveDBParse(zr)
+	if err != nil {
+		slog.Warnf("parsing CVE database %s: %v", name, err)
+		return
+	}
+	slog.Infof("Ingested %d CVEs covering %d products from %s in %v",
+		db.cves, len(db.products), name,
+		time.Since(start).Round(time.Millisecond))
+
+	cveMtx.Lock()
+	cveDB = db
+	cveMtx.Unlock()
+}
+
+// Find the CVEs affecting a single service
+func (db *cveDatabase) match(svc *cveService) []*cveEntry {
+	found := make(map[string]*cveEntry)
+
+	for _, cpe := range svc.CPEs {
+		key, version := cpeParse(cpe)
+		if key == "" {
+			continue
+		}
+		if version == "" {
+			version = svc.Version
+		}
+		if version == "" {
+			continue
+		}
+
+		for _, r := range db.products[key] {
+			if r.matches(version) {
+				found[r.cve.ID] = r.cve
+			}
+		}
+	}
+
+	rval := make([]*cveEntry, 0, len(found))
+	for _, cve := range found {
+		rval = append(rval, cve)
+	}
+	sort.Slice(rval, func(i, j int) bool {
+		return rval[i].ID < rval[j].ID
+	})
+
+	return rval
+}
+
+func cveServicesFromNmap(protocol string, host *nmap.Host) []*cveService {
+	services := make([]*cveService, 0)
+
+	for _, p := range host.Ports {
+		if p.State.State != "open" || p.Protocol != protocol ||
+			len(p.Service.CPEs) == 0 {
+			continue
+		}
+
+		// nmap often adds distribution details to the version, as in
+		// "7.4p1 Debian 10+deb9u7"
+		var version string
+		if f := strings.Fields(p.Service.Version); len(f) > 0 {
+			version = f[0]
+		}
+
+		svc := &cveService{
+			Protocol: protocol,
+			Port:     p.PortId,
+			Service:  p.Service.Name,
+			Product:  p.Service.Product,
+			Version:  version,
+		}
+		for _, cpe := range p.Service.CPEs {
+			svc.CPEs = append(svc.CPEs, string(cpe))
+		}
+		services = append(services, svc)
+	}
+
+	return services
+}
+
+func cveDetail(svc *cveService, cve *cveEntry) map[string]interface{} {
+	return map[string]interface{}{
+		"identifier":  cve.ID,
+		"cvss":        cve.CVSS,
+		"summary":     cve.Summary,
+		"service":     svc.Service,
+		"program":     svc.Product,
+		"program_ver": svc.Version,
+		"protocol":    svc.Protocol,
+		"port":        strconv.Itoa(svc.Port),
+	}
+}
+
+// Build the findings for all of a device's services.  Any CVE we previously
+// found that no longer matches is reported as cleared.
+func cveFindings(db *cveDatabase, services []*cveService,
+	previous []string) map[string]apvuln.TestResult {
+
+	results := make(map[string]apvuln.TestResult)
+
+	for _, svc := range services {
+		for _, cve := range db.match(svc) {
+			if _, ok := vulnList[cve.ID]; ok {
+				continue
+			}
+
+			res, ok := results[cve.ID]
+			if !ok {
+				nickname := svc.Product
+				if nickname == "" {
+					nickname = svc.Service
+				}
+				res = apvuln.TestResult{
+					State:    apvuln.Vulnerable,
+					Tool:     cveMatchTool,
+					Name:     cve.ID,
+					Nickname: nickname,
+					CVSS:     cve.CVSS,
+					Details:  make(map[string]interface{}),
+				}
+			}
+			idx := strconv.Itoa(len(res.Details) + 1)
+			res.Details[idx] = cveDetail(svc, cve)
+			results[cve.ID] = res
+		}
+	}
+
+	for _, name := range previous {
+		if _, ok := results[name]; !ok {
+			results[name] = apvuln.TestResult{
+				State: apvuln.Cleared,
+				Tool:  cveMatchTool,
+				Name:  name,
+			}
+		}
+	}
+
+	return results
+}
+
+// Return the names of the CVEs this matcher has currently flagged on a device
+func cveActive(mac string) []string {
+	active := make([]string, 0)
+	for name, vi := range config.GetVulnerabilities(mac) {
+		if vi.Active && vi.Source == cveMatchTool {
+			active = append(active, name)
+		}
+	}
+	return active
+}
+
+// cveDescription synthesizes the vulnerability list entry for a CVE found by
+// the matcher, which determines the actions taken when it's found.
+func cveDescription(res *apvuln.TestResult) vulnDescription {
+	desc := vulnDescription{
+		Nickname: fmt.Sprintf("%s, CVSS %.1f", res.Nickname, res.CVSS),
+	}
+	if res.CVSS >= float64(*cveWarnScore) {
+		desc.Actions = []string{"Warn"}
+	}
+	return desc
+}
+
+// cveScan records the services found by a port scan and checks all of the
+// device's known services against the CVE database.
+func cveScan(mac, ip, protocol string, host *nmap.Host) {
+	services := cveServicesFromNmap(protocol, host)
+
+	cveMtx.Lock()
+	cveServices[mac+":"+protocol] = services
+	all := make([]*cveService, 0)
+	all = append(all, cveServices[mac+":tcp"]...)
+	all = append(all, cveServices[mac+":udp"]...)
+	db := cveDB
+	cveMtx.Unlock()
+
+	if db == nil {
+		return
+	}
+
+	results := cveFindings(db, all, cveActive(mac))
+	if len(results) > 0 {
+		vulnScanProcess(ip, results)
+	}
+}
+
+func cveForget(mac, protocol string) {
+	cveMtx.Lock()
+	delete(cveServices, mac+":"+protocol)
+	cveMtx.Unlock()
+}
+
+func cveDBChanged(path []string, value string, expires *time.Time) {
+	if value != cveLastUpdate {
+		cveLastUpdate = value
+		go cveDBLoad()
+	}
+}
+
+func cveInit() {
+	go cveDBLoad()
+
+	cveLastUpdate, _ = config.GetProp(cveUpdatesProp)
+	config.HandleChange(`^`+cveUpdatesProp+`$`, cveDBChanged)
+}
@@ -220,6 +220,8 @@ func logMonitor(name string) {
 
 	for droplogRunning && scanner.Scan() {
 		if d := getDrop(scanner.Text()); d != nil {
+			geoAnnotate(d)
+
 			lock.Lock()
 			if wanIfaces[d.Indev] {
 				wanDrops = append(wanDrops, d)
@@ -304,6 +306,7 @@ func droplogFini(w *watcher) {
 
 func droplogInit(w *watcher) {
 	findWanNics()
+	geoInit()
 
 	dropDir = *watchDir + "/droplog"
 	if !aputil.FileExists(dropDir) {
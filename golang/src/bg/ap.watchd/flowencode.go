@@ -0,0 +1,229 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Encode flow records as IPFIX (RFC 7011) or NetFlow v9 (RFC 3954) messages.
+//
+// Both protocols describe each record with a single template.  Along with the
+// usual 5-tuple and counters, each record carries the MAC addresses seen on
+// the wire and three elements of our own: the MAC of the local device the flow
+// belongs to, the ring it was observed on, and the device's identity (its EAP
+// username or the best name we have for it).  In IPFIX these are
+// enterprise-specific elements under the private enterprise number in
+// flow_export_pen.  NetFlow v9 has no enterprise numbers, so they are sent
+// with field types 0x8000 + their element ID, and the strings are fixed-length.
+
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+const (
+	ipfixVersion      = 10
+	ipfixTemplateSet  = 2
+	netflow9Version   = 9
+	netflow9Template  = 0
+	flowTemplateID    = 256
+	flowEnterpriseBit = 0x8000
+	flowVarLen        = 0xffff
+
+	// Keep each message within a single unfragmented UDP datagram
+	flowMaxMessage = 1400
+
+	// Fixed sizes of the NetFlow v9 string fields
+	netflow9RingLen     = 16
+	netflow9IdentityLen = 64
+)
+
+// Our enterprise-specific information elements
+const (
+	flowIEClientMac = 1 + iota
+	flowIERing
+	flowIEIdentity
+)
+
+type flowField struct {
+	id         uint16
+	len        uint16
+	enterprise bool
+}
+
+// The elements in each record, in order
+func flowTemplate(protocol string) []flowField {
+	fields := []flowField{
+		{8, 4, false},  // sourceIPv4Address
+		{12, 4, false}, // destinationIPv4Address
+		{7, 2, false},  // sourceTransportPort
+		{11, 2, false}, // destinationTransportPort
+		{4, 1, false},  // protocolIdentifier
+		{6, 1, false},  // tcpControlBits
+		{2, 8, false},  // packetDeltaCount
+		{1, 8, false},  // octetDeltaCount
+	}
+
+	if protocol == "netflow9" {
+		fields = append(fields,
+			flowField{22, 4, false}, // FIRST_SWITCHED
+			flowField{21, 4, false}, // LAST_SWITCHED
+			flowField{56, 6, false}, // IN_SRC_MAC
+			flowField{80, 6, false}, // IN_DST_MAC
+			flowField{flowIEClientMac, 6, true},
+			flowField{flowIERing, netflow9RingLen, true},
+			flowField{flowIEIdentity, netflow9IdentityLen, true})
+	} else {
+		fields = append(fields,
+			flowField{152, 8, false}, // flowStartMilliseconds
+			flowField{153, 8, false}, // flowEndMilliseconds
+			flowField{56, 6, false},  // sourceMacAddress
+			flowField{80, 6, false},  // destinationMacAddress
+			flowField{flowIEClientMac, 6, true},
+			flowField{flowIERing, flowVarLen, true},
+			flowField{flowIEIdentity, flowVarLen, true})
+	}
+
+	return fields
+}
+
+func put16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func put32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func put64(b []byte, v uint64) []byte {
+	return put32(put32(b, uint32(v>>32)), uint32(v))
+}
+
+// Pad a set to a multiple of 4 bytes and fill in its length
+func setFinish(set []byte) []byte {
+	for len(set)%4 != 0 {
+		set = append(set, 0)
+	}
+	binary.BigEndian.PutUint16(set[2:], uint16(len(set)))
+	return set
+}
+
+func flowTemplateSet(protocol string, pen uint32) []byte {
+	fields := flowTemplate(protocol)
+
+	setID := uint16(ipfixTemplateSet)
+	if protocol == "netflow9" {
+		setID = netflow9Template
+	}
+
+	set := put16(nil, setID)
+	set = put16(set, 0)
+	set = put16(set, flowTemplateID)
+	set = put16(set, uint16(len(fields)))
+	for _, f := range fields {
+		if !f.enterprise {
+			set = put16(set, f.id)
+			set = put16(set, f.len)
+		} else if protocol == "netflow9" {
+			set = put16(set, flowEnterpriseBit+f.id)
+			set = put16(set, f.len)
+		} else {
+			set = put16(set, flowEnterpriseBit|f.id)
+			set = put16(set, f.len)
+			set = put32(set, pen)
+		}
+	}
+
+	return setFinish(set)
+}
+
+// Append a string as an IPFIX variable-length field
+func putVarString(b []byte, s string) []byte {
+	if len(s) > 254 {
+		s = s[:254]
+	}
+	b = append(b, byte(len(s)))
+	return append(b, s...)
+}
+
+// Append a string as a fixed-length, zero-padded field
+func putFixedString(b []byte, s string, l int) []byte {
+	if len(s) > l {
+		s = s[:l]
+	}
+	b = append(b, s...)
+	for i := len(s); i < l; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// NetFlow v9 timestamps are milliseconds of exporter uptime
+func netflow9Uptime(t time.Time) uint32 {
+	return uint32(t.Sub(flowBoot) / time.Millisecond)
+}
+
+func flowEncodeRecord(protocol string, f *flowRecord, identity string) []byte {
+	b := make([]byte, 0, 128)
+
+	b = append(b, f.srcIP[:]...)
+	b = append(b, f.dstIP[:]...)
+	b = put16(b, f.srcPort)
+	b = put16(b, f.dstPort)
+	b = append(b, f.proto, f.flags)
+	b = put64(b, f.packets)
+	b = put64(b, f.bytes)
+
+	if protocol == "netflow9" {
+		b = put32(b, netflow9Uptime(f.first))
+		b = put32(b, netflow9Uptime(f.last))
+	} else {
+		b = put64(b, uint64(f.first.UnixNano()/int64(time.Millisecond)))
+		b = put64(b, uint64(f.last.UnixNano()/int64(time.Millisecond)))
+	}
+
+	b = append(b, f.srcMac[:]...)
+	b = append(b, f.dstMac[:]...)
+	b = append(b, f.client[:]...)
+
+	if protocol == "netflow9" {
+		b = putFixedString(b, f.ring, netflow9RingLen)
+		b = putFixedString(b, identity, netflow9IdentityLen)
+	} else {
+		b = putVarString(b, f.ring)
+		b = putVarString(b, identity)
+	}
+
+	return b
+}
+
+// Build a message from a set of already-encoded sets.  'seq' is the number of
+// data records sent before this message for IPFIX, or the number of messages
+// sent before it for NetFlow v9.  'cnt' is the number of records (template and
+// data) in the message, which only NetFlow v9 uses.
+func flowMessage(protocol string, now time.Time, seq uint32, cnt int,
+	sets []byte) []byte {
+
+	var msg []byte
+
+	if protocol == "netflow9" {
+		msg = put16(msg, netflow9Version)
+		msg = put16(msg, uint16(cnt))
+		msg = put32(msg, netflow9Uptime(now))
+		msg = put32(msg, uint32(now.Unix()))
+		msg = put32(msg, seq)
+		msg = put32(msg, 0) // source ID
+	} else {
+		msg = put16(msg, ipfixVersion)
+		msg = put16(msg, uint16(16+len(sets)))
+		msg = put32(msg, uint32(now.Unix()))
+		msg = put32(msg, seq)
+		msg = put32(msg, 0) // observation domain ID
+	}
+
+	return append(msg, sets...)
+}
@@ -0,0 +1,459 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Export the traffic seen by the packet sampler as IPFIX or NetFlow v9 flow
+// records.  Each collector configured under @/network/flow_export/<idx> gets
+// its own flow cache, so each may use different timeouts.  A flow is exported
+// when it has been idle for the inactive timeout, when a TCP FIN or RST is
+// seen, or when it has been open for the active timeout.  In the last case,
+// any further traffic starts a new record.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/aputil"
+	"bg/common/cfgapi"
+
+	"github.com/google/gopacket/layers"
+)
+
+const (
+	flowActiveDefault   = time.Minute
+	flowInactiveDefault = 15 * time.Second
+	flowTemplateRefresh = 10 * time.Minute
+	flowIdentityFreq    = time.Minute
+
+	ipfixPort    = 4739
+	netflow9Port = 2055
+
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+)
+
+var (
+	// Private enterprise number for our information elements.  The default
+	// is the number reserved for documentation (RFC 5612).
+	flowPEN = apcfg.Int("flow_export_pen", 32473, true, nil)
+
+	// Most flows tracked for each collector
+	flowMaxFlows = apcfg.Int("flow_export_max", 16384, true, nil)
+
+	flowCollectors []*flowCollector
+	flowIdentities = make(map[string]string)
+	flowMtx        sync.RWMutex
+
+	flowBoot      = time.Now()
+	flowDone      = make(chan bool, 1)
+	flowWaitGroup sync.WaitGroup
+)
+
+type flowKey struct {
+	ring    string
+	srcIP   [4]byte
+	dstIP   [4]byte
+	srcPort uint16
+	dstPort uint16
+	proto   uint8
+}
+
+type flowRecord struct {
+	flowKey
+
+	srcMac [6]byte
+	dstMac [6]byte
+	client [6]byte // the local device the flow belongs to
+
+	first   time.Time
+	last    time.Time
+	packets uint64
+	bytes   uint64
+	flags   uint8
+}
+
+type flowCollector struct {
+	idx      string
+	addr     string
+	protocol string
+	active   time.Duration
+	inactive time.Duration
+
+	conn    net.Conn
+	closed  bool
+	flows   map[flowKey]*flowRecord
+	dropped int
+	tlog    *aputil.ThrottledLogger
+
+	lastTemplate time.Time
+	recordsSent  uint32
+	messagesSent uint32
+
+	sync.Mutex
+}
+
+func (c *flowCollector) String() string {
+	return fmt.Sprintf("%s collector %s (%s)", c.protocol, c.idx, c.addr)
+}
+
+func tcpFlags(tcp *layers.TCP) uint8 {
+	var flags uint8
+
+	bits := []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG}
+	for i, set := range bits {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+func (c *flowCollector) observe(key flowKey, src, dst endpoint, flags uint8,
+	size int, now time.Time) {
+
+	c.Lock()
+	defer c.Unlock()
+
+	f := c.flows[key]
+	if f == nil {
+		if c.closed {
+			return
+		}
+		if len(c.flows) >= *flowMaxFlows {
+			c.dropped++
+			return
+		}
+
+		f = &flowRecord{flowKey: key, first: now}
+		copy(f.srcMac[:], src.hwaddr)
+		copy(f.dstMac[:], dst.hwaddr)
+		if localIPAddr(src.ip) {
+			copy(f.client[:], src.hwaddr)
+		} else if localIPAddr(dst.ip) {
+			copy(f.client[:], dst.hwaddr)
+		}
+		c.flows[key] = f
+	}
+
+	f.last = now
+	f.packets++
+	f.bytes += uint64(size)
+	f.flags |= flags
+}
+
+// flowObserve adds a single sampled packet to each collector's flow cache
+func flowObserve(ring string, src, dst endpoint, proto, flags uint8, size int) {
+	flowMtx.RLock()
+	collectors := flowCollectors
+	flowMtx.RUnlock()
+
+	if len(collectors) == 0 {
+		return
+	}
+
+	srcIP, dstIP := src.ip.To4(), dst.ip.To4()
+	if srcIP == nil || dstIP == nil {
+		return
+	}
+
+	key := flowKey{
+		ring:    ring,
+		srcPort: uint16(src.port),
+		dstPort: uint16(dst.port),
+		proto:   proto,
+	}
+	copy(key.srcIP[:], srcIP)
+	copy(key.dstIP[:], dstIP)
+
+	now := time.Now()
+	for _, c := range collectors {
+		c.observe(key, src, dst, flags, size, now)
+	}
+}
+
+func flowIdentity(client [6]byte) string {
+	mac := net.HardwareAddr(client[:]).String()
+
+	flowMtx.RLock()
+	defer flowMtx.RUnlock()
+	return flowIdentities[mac]
+}
+
+// Build the messages carrying a set of expired flows, preceded by the template
+// if it's time to refresh it.
+func (c *flowCollector) messages(now time.Time, recs []*flowRecord) [][]byte {
+	var sets, data []byte
+	var templates, records int
+
+	msgs := make([][]byte, 0)
+	hdrLen := 16
+	if c.protocol == "netflow9" {
+		hdrLen = 20
+	}
+
+	emit := func() {
+		if records > 0 {
+			sets = append(sets, setFinish(data)...)
+		}
+		if len(sets) == 0 {
+			return
+		}
+
+		seq := c.recordsSent
+		if c.protocol == "netflow9" {
+			seq = c.messagesSent
+		}
+		msgs = append(msgs, flowMessage(c.protocol, now, seq,
+			templates+records, sets))
+
+		c.recordsSent += uint32(records)
+		c.messagesSent++
+		sets, data = nil, nil
+		templates, records = 0, 0
+	}
+
+	if now.Sub(c.lastTemplate) >= flowTemplateRefresh {
+		sets = flowTemplateSet(c.protocol, uint32(*flowPEN))
+		templates = 1
+		c.lastTemplate = now
+	}
+
+	for _, f := range recs {
+		rec := flowEncodeRecord(c.protocol, f, flowIdentity(f.client))
+
+		size := hdrLen + len(sets) + len(data) + len(rec) + 3
+		if records > 0 && size > flowMaxMessage {
+			emit()
+		}
+		if data == nil {
+			data = put16(put16(nil, flowTemplateID), 0)
+		}
+		data = append(data, rec...)
+		records++
+	}
+	emit()
+
+	return msgs
+}
+
+// Find the flows which have expired, and send them to the collector.  If
+// 'flush' is set, every flow is sent.
+func (c *flowCollector) sweep(now time.Time, flush bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	expired := make([]*flowRecord, 0)
+	for key, f := range c.flows {
+		if flush || now.Sub(f.last) >= c.inactive ||
+			now.Sub(f.first) >= c.active ||
+			f.flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+			expired = append(expired, f)
+			delete(c.flows, key)
+		}
+	}
+
+	if c.dropped > 0 {
+		c.tlog.Warnf("%v: flow cache full, %d flows dropped", c,
+			c.dropped)
+		c.dropped = 0
+	}
+
+	for _, msg := range c.messages(now, expired) {
+		if _, err := c.conn.Write(msg); err != nil {
+			c.tlog.Warnf("%v: send failed: %v", c, err)
+		}
+	}
+}
+
+func (c *flowCollector) close() {
+	c.sweep(time.Now(), true)
+
+	c.Lock()
+	c.closed = true
+	c.conn.Close()
+	c.Unlock()
+}
+
+func newFlowCollector(idx string, node *cfgapi.PropertyNode) (*flowCollector, error) {
+	c := &flowCollector{
+		idx:      idx,
+		protocol: "ipfix",
+		active:   flowActiveDefault,
+		inactive: flowInactiveDefault,
+		flows:    make(map[flowKey]*flowRecord),
+		tlog: aputil.GetThrottledLogger(slog, time.Second,
+			10*time.Minute),
+	}
+
+	addr, err := node.GetChildString("collector")
+	if err != nil {
+		return nil, fmt.Errorf("no collector address")
+	}
+	if p, err := node.GetChildString("protocol"); err == nil {
+		c.protocol = p
+	}
+
+	port := ipfixPort
+	if c.protocol == "netflow9" {
+		port = netflow9Port
+	} else if c.protocol != "ipfix" {
+		return nil, fmt.Errorf("unsupported protocol %s", c.protocol)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(port))
+	}
+	c.addr = addr
+
+	timeouts := map[string]*time.Duration{
+		"active_timeout":   &c.active,
+		"inactive_timeout": &c.inactive,
+	}
+	for name, timeout := range timeouts {
+		if v, err := node.GetChildString(name); err == nil {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("bad %s: %s", name, v)
+			}
+			*timeout = d
+		}
+	}
+
+	if c.conn, err = net.Dial("udp", addr); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Rebuild the list of collectors from the current config.  Any flows tracked
+// for the old collectors are flushed.
+func flowExportLoad() {
+	list := make([]*flowCollector, 0)
+
+	if props, err := config.GetProps("@/network/flow_export"); err == nil {
+		for idx, node := range props.Children {
+			c, err := newFlowCollector(idx, node)
+			if err != nil {
+				slog.Warnf("flow_export/%s: %v", idx, err)
+				continue
+			}
+			slog.Infof("exporting flows to %v", c)
+			list = append(list, c)
+		}
+	}
+
+	flowMtx.Lock()
+	old := flowCollectors
+	flowCollectors = list
+	flowMtx.Unlock()
+
+	for _, c := range old {
+		c.close()
+	}
+}
+
+// Refresh the names reported for each device
+func flowIdentityRefresh() {
+	ids := make(map[string]string)
+
+	for mac, client := range config.GetClients() {
+		names := []string{client.Username, client.FriendlyName,
+			client.DNSName, client.DHCPName}
+		for _, name := range names {
+			if name != "" {
+				ids[mac] = name
+				break
+			}
+		}
+	}
+
+	flowMtx.Lock()
+	flowIdentities = ids
+	flowMtx.Unlock()
+}
+
+func flowExporter() {
+	defer flowWaitGroup.Done()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var nextIdentity time.Time
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case done = <-flowDone:
+		}
+
+		flowMtx.RLock()
+		collectors := flowCollectors
+		flowMtx.RUnlock()
+
+		now := time.Now()
+		if len(collectors) > 0 && now.After(nextIdentity) {
+			flowIdentityRefresh()
+			nextIdentity = now.Add(flowIdentityFreq)
+		}
+
+		for _, c := range collectors {
+			c.sweep(now, done)
+		}
+	}
+}
+
+func configFlowExportChanged(path []string, value string, expires *time.Time) {
+	flowExportLoad()
+}
+
+func configFlowExportDeleted(path []string) {
+	flowExportLoad()
+}
+
+func flowExportFini(w *watcher) {
+	flowDone <- true
+	flowWaitGroup.Wait()
+
+	flowMtx.Lock()
+	for _, c := range flowCollectors {
+		c.Lock()
+		c.closed = true
+		c.conn.Close()
+		c.Unlock()
+	}
+	flowCollectors = nil
+	flowMtx.Unlock()
+
+	w.running = false
+}
+
+func flowExportInit(w *watcher) {
+	flowExportLoad()
+	config.HandleChange(`^@/network/flow_export/.*$`,
+		configFlowExportChanged)
+	config.HandleDelete(`^@/network/flow_export.*$`,
+		configFlowExportDeleted)
+
+	flowWaitGroup.Add(1)
+	go flowExporter()
+
+	w.running = true
+}
+
+func init() {
+	addWatcher("flowexport", flowExportInit, flowExportFini)
+}
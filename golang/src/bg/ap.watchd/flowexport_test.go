@@ -0,0 +1,211 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+
+	"go.uber.org/zap/zaptest"
+)
+
+var (
+	flowClient = endpoint{
+		ip:     net.ParseIP("192.168.1.10").To4(),
+		hwaddr: net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55},
+		port:   40000,
+	}
+	flowServer = endpoint{
+		ip:     net.ParseIP("203.0.113.5").To4(),
+		hwaddr: net.HardwareAddr{0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb},
+		port:   443,
+	}
+)
+
+func flowTestCollector(t *testing.T, protocol string) (*flowCollector, *net.UDPConn) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	listener, err := net.ListenUDP("udp", local)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+
+	node := &cfgapi.PropertyNode{
+		Children: cfgapi.ChildMap{
+			"collector": {Value: listener.LocalAddr().String()},
+			"protocol":  {Value: protocol},
+		},
+	}
+	c, err := newFlowCollector("0", node)
+	if err != nil {
+		t.Fatalf("newFlowCollector failed: %v", err)
+	}
+
+	return c, listener
+}
+
+func flowReceive(t *testing.T, l *net.UDPConn) []byte {
+	buf := make([]byte, 2048)
+
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatalf("no flow message received: %v", err)
+	}
+	return buf[:n]
+}
+
+// Split a message into its sets, indexed by set ID
+func flowSets(t *testing.T, msg []byte, hdrLen int) map[uint16][]byte {
+	sets := make(map[uint16][]byte)
+
+	for b := msg[hdrLen:]; len(b) > 0; {
+		id := binary.BigEndian.Uint16(b)
+		l := int(binary.BigEndian.Uint16(b[2:]))
+		if l < 4 || l > len(b) {
+			t.Fatalf("bad set length %d", l)
+		}
+		sets[id] = b[4:l]
+		b = b[l:]
+	}
+	return sets
+}
+
+func TestFlowExportIPFIX(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	subnets = []*net.IPNet{subnet}
+	flowIdentities = map[string]string{
+		flowClient.hwaddr.String(): "alice",
+	}
+
+	c, l := flowTestCollector(t, "ipfix")
+	defer l.Close()
+	defer c.close()
+
+	now := time.Now()
+	key := flowKey{ring: "standard", srcPort: 40000, dstPort: 443, proto: 6}
+	copy(key.srcIP[:], flowClient.ip)
+	copy(key.dstIP[:], flowServer.ip)
+	c.observe(key, flowClient, flowServer, 0x02, 60, now)
+	c.observe(key, flowClient, flowServer, 0x10, 52, now)
+	c.observe(key, flowClient, flowServer, tcpFlagFIN|0x10, 52, now)
+
+	udpKey := key
+	udpKey.proto = 17
+	c.observe(udpKey, flowClient, flowServer, 0, 100, now)
+
+	// Only the closed TCP flow has expired
+	c.sweep(now, false)
+	msg := flowReceive(t, l)
+	if v := binary.BigEndian.Uint16(msg); v != ipfixVersion {
+		t.Fatalf("bad version %d", v)
+	}
+	if l := binary.BigEndian.Uint16(msg[2:]); int(l) != len(msg) {
+		t.Fatalf("message length %d, received %d", l, len(msg))
+	}
+
+	sets := flowSets(t, msg, 16)
+	if _, ok := sets[ipfixTemplateSet]; !ok {
+		t.Errorf("no template set in first message")
+	}
+	rec, ok := sets[flowTemplateID]
+	if !ok {
+		t.Fatalf("no data set")
+	}
+
+	if !net.IP(rec[0:4]).Equal(flowClient.ip) ||
+		!net.IP(rec[4:8]).Equal(flowServer.ip) {
+		t.Errorf("bad addresses: %v", rec[0:8])
+	}
+	if p := binary.BigEndian.Uint16(rec[10:]); p != 443 {
+		t.Errorf("bad destination port %d", p)
+	}
+	if rec[12] != 6 || rec[13] != 0x13 {
+		t.Errorf("bad protocol %d or flags %x", rec[12], rec[13])
+	}
+	if n := binary.BigEndian.Uint64(rec[14:]); n != 3 {
+		t.Errorf("bad packet count %d", n)
+	}
+	if n := binary.BigEndian.Uint64(rec[22:]); n != 164 {
+		t.Errorf("bad byte count %d", n)
+	}
+
+	// Skip the timestamps and the two wire MACs
+	client := rec[58:64]
+	if net.HardwareAddr(client).String() != flowClient.hwaddr.String() {
+		t.Errorf("bad client MAC %v", net.HardwareAddr(client))
+	}
+	strs := rec[64:]
+	ring := string(strs[1 : 1+strs[0]])
+	strs = strs[1+strs[0]:]
+	identity := string(strs[1 : 1+strs[0]])
+	if ring != "standard" || identity != "alice" {
+		t.Errorf("bad ring %q or identity %q", ring, identity)
+	}
+
+	// The UDP flow goes idle, and is exported without another template
+	c.sweep(now.Add(flowInactiveDefault), false)
+	msg = flowReceive(t, l)
+	if seq := binary.BigEndian.Uint32(msg[8:]); seq != 1 {
+		t.Errorf("bad sequence number %d", seq)
+	}
+	sets = flowSets(t, msg, 16)
+	if _, ok := sets[ipfixTemplateSet]; ok {
+		t.Errorf("unexpected template set")
+	}
+	if rec = sets[flowTemplateID]; rec == nil || rec[12] != 17 {
+		t.Errorf("missing UDP flow")
+	}
+}
+
+func TestFlowExportNetflow9(t *testing.T) {
+	c, l := flowTestCollector(t, "netflow9")
+	defer l.Close()
+	defer c.close()
+
+	now := time.Now()
+	key := flowKey{ring: "guest", srcPort: 40000, dstPort: 53, proto: 17}
+	copy(key.srcIP[:], flowClient.ip)
+	copy(key.dstIP[:], flowServer.ip)
+	c.observe(key, flowClient, flowServer, 0, 80, now.Add(-time.Minute))
+	c.observe(key, flowClient, flowServer, 0, 80, now)
+
+	// The flow is still active, but has been open too long
+	c.sweep(now, false)
+	msg := flowReceive(t, l)
+	if v := binary.BigEndian.Uint16(msg); v != netflow9Version {
+		t.Fatalf("bad version %d", v)
+	}
+	if cnt := binary.BigEndian.Uint16(msg[2:]); cnt != 2 {
+		t.Errorf("bad record count %d", cnt)
+	}
+
+	sets := flowSets(t, msg, 20)
+	if _, ok := sets[netflow9Template]; !ok {
+		t.Errorf("no template flowset")
+	}
+	rec := sets[flowTemplateID]
+	if len(rec) < 56+netflow9RingLen {
+		t.Fatalf("short record: %d bytes", len(rec))
+	}
+	ring := strings.TrimRight(string(rec[56:56+netflow9RingLen]), "\x00")
+	if ring != "guest" {
+		t.Errorf("bad ring %q", ring)
+	}
+	if len(c.flows) != 0 {
+		t.Errorf("active flow not removed from the cache")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/aputil"
+	"bg/ap_common/publiclog"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/archive"
+	"bg/common/geoip"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	geoDir = apcfg.String("geoip_dir", "__APDATA__/geoip", true, nil)
+
+	geoDB     *geoip.DB
+	geoPolicy *geoip.Policy
+	geoExempt map[string]bool // rings not subject to the policy
+	geoMtx    sync.Mutex
+
+	// When we last reported a geoblock hit for each (device, remote) pair
+	geoReported = make(map[string]time.Time)
+
+	// The last update seen for each database
+	geoLastUpdate = make(map[string]string)
+)
+
+func notifyGeoBlockEvent(mac string, local, remote net.IP, rec *geoip.Record) {
+	protocol := base_msg.Protocol_IP
+	reason := base_msg.EventNetException_GEO_BLOCKED
+	topic := base_def.TOPIC_EXCEPTION
+
+	entity := &base_msg.EventNetException{
+		Timestamp:   aputil.NowToProtobuf(),
+		Sender:      proto.String(brokerd.Name),
+		Debug:       proto.String("-"),
+		Protocol:    &protocol,
+		Reason:      &reason,
+		Ipv4Address: proto.Uint32(network.IPAddrToUint32(remote)),
+		Details:     []string{rec.String()},
+	}
+	if hwaddr, err := net.ParseMAC(mac); err == nil {
+		entity.MacAddress = proto.Uint64(network.HWAddrToUint64(hwaddr))
+	}
+	if rec.Country != "" {
+		entity.Country = proto.String(rec.Country)
+	}
+	if rec.ASN != 0 {
+		entity.Asn = proto.Uint32(rec.ASN)
+	}
+
+	if err := brokerd.Publish(entity, topic); err != nil {
+		slog.Warnf("couldn't publish %s (%v): %v", topic, entity, err)
+	}
+
+	publiclog.SendLogGeoBlocked(brokerd, mac, local.String(),
+		remote.String(), rec.Country, rec.ASN)
+}
+
+// Attach the location of the remote endpoint to a dropped packet record.  If
+// the packet was dropped because of the site's geoblock policy, and the local
+// device's ring isn't exempt from it, send a notification.  To avoid flooding
+// the event stream, each device/remote pair is reported at most once per
+// blockPeriod.
+func geoAnnotate(d *archive.DropRecord) {
+	var local, remote net.IP
+
+	geoMtx.Lock()
+	defer geoMtx.Unlock()
+
+	if geoDB == nil {
+		return
+	}
+
+	ring := ipToRing(d.SrcIP.String())
+	if ring != "" {
+		local, remote = d.SrcIP, d.DstIP
+	} else {
+		local, remote = d.DstIP, d.SrcIP
+		ring = ipToRing(local.String())
+	}
+
+	rec := geoDB.Lookup(remote)
+	if rec == nil {
+		return
+	}
+	d.Country = rec.Country
+	d.ASN = rec.ASN
+
+	if !geoPolicy.Blocked(rec) || geoExempt[ring] {
+		return
+	}
+
+	mac := getMacFromIP(local.String())
+	key := mac + "|" + remote.String()
+	now := time.Now()
+	if last, ok := geoReported[key]; ok && now.Sub(last) < blockPeriod {
+		return
+	}
+
+	for k, t := range geoReported {
+		if now.Sub(t) >= blockPeriod {
+			delete(geoReported, k)
+		}
+	}
+	geoReported[key] = now
+
+	slog.Infof("%s (%v) blocked from talking with %v: %s", mac, local,
+		remote, rec.String())
+	notifyGeoBlockEvent(mac, local, remote, rec)
+}
+
+// (Re)load the GeoIP databases and the site's blocking policy
+func geoLoad() {
+	dir := plat.ExpandDirPath(*geoDir)
+	db, err := geoip.Open(filepath.Join(dir, geoip.CountryDB),
+		filepath.Join(dir, geoip.ASNDB))
+	if err != nil {
+		slog.Infof("GeoIP annotations unavailable: %v", err)
+	}
+	policy := geoip.GetPolicy(config)
+
+	exempt := make(map[string]bool)
+	if props, _ := config.GetProps("@/policy/rings"); props != nil {
+		for ring, node := range props.Children {
+			if geo, _ := node.GetChild("geoblock"); geo != nil {
+				exempt[ring], _ = geo.GetChildBool("exempt")
+			}
+		}
+	}
+
+	geoMtx.Lock()
+	geoDB = db
+	geoPolicy = policy
+	geoExempt = exempt
+	geoMtx.Unlock()
+}
+
+func geoPolicyChanged(path []string, val string, expires *time.Time) {
+	geoLoad()
+}
+
+func geoPolicyDeleted(path []string) {
+	geoLoad()
+}
+
+// ap.rpcd has downloaded a fresh copy of one of the GeoIP databases
+func geoDBChanged(path []string, value string, expires *time.Time) {
+	name := path[len(path)-1]
+	if value != geoLastUpdate[name] {
+		geoLastUpdate[name] = value
+		slog.Infof("reloading GeoIP databases after %s update", name)
+		geoLoad()
+	}
+}
+
+func geoInit() {
+	geoLoad()
+
+	if props, _ := config.GetProps("@/updates"); props != nil {
+		for name, node := range props.Children {
+			geoLastUpdate[name] = node.Value
+		}
+	}
+	config.HandleChange(`^@/updates/geoip_(country|asn)$`, geoDBChanged)
+
+	config.HandleChange(`^@/policy/site/geoblock/`, geoPolicyChanged)
+	config.HandleDelExp(`^@/policy/site/geoblock/`, geoPolicyDeleted)
+	config.HandleChange(`^@/policy/rings/.*/geoblock/`, geoPolicyChanged)
+	config.HandleDelExp(`^@/policy/rings/.*/geoblock/`, geoPolicyDeleted)
+}
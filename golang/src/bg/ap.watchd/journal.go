@@ -0,0 +1,268 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// The wifi journal keeps a short history of each wireless client's
+// connections: when and where it associated, how it authenticated, why it
+// failed to authenticate, and why it left.  The events are collected from the
+// net.entity, net.exception, and net.steer messages sent by ap.wifid on every
+// node, so the journal covers the whole site.  The most recent events for each
+// client are kept, and the journal is saved across restarts.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	journalMax      = 64                  // events kept per client
+	journalMaxAge   = 30 * 24 * time.Hour // forget clients idle this long
+	journalSaveFreq = 10 * time.Minute
+	journalFile     = "wifi_journal.json"
+)
+
+type journalEntry struct {
+	Mac      string                          `json:"mac"`
+	When     time.Time                       `json:"when"`
+	Event    base_msg.WifiJournalEntry_Event `json:"event"`
+	Node     string                          `json:"node,omitempty"`
+	VAP      string                          `json:"vap,omitempty"`
+	Band     string                          `json:"band,omitempty"`
+	Ring     string                          `json:"ring,omitempty"`
+	Username string                          `json:"username,omitempty"`
+	Signal   int32                           `json:"signal,omitempty"`
+	Reason   uint32                          `json:"reason,omitempty"`
+	Detail   string                          `json:"detail,omitempty"`
+}
+
+var (
+	journal      = make(map[string][]*journalEntry)
+	journalDirty bool
+	journalMtx   sync.Mutex
+
+	journalState = &stateFile{
+		name:  "wifi journal",
+		file:  journalFile,
+		freq:  journalSaveFreq,
+		mtx:   &journalMtx,
+		dirty: &journalDirty,
+		state: func() interface{} {
+			journalPrune(time.Now())
+			return journal
+		},
+	}
+)
+
+func journalAdd(e *journalEntry) {
+	journalMtx.Lock()
+	defer journalMtx.Unlock()
+
+	list := append(journal[e.Mac], e)
+	if len(list) > journalMax {
+		list = list[len(list)-journalMax:]
+	}
+	journal[e.Mac] = list
+	journalDirty = true
+}
+
+// Attach the arrival signal strength to the connection it belongs to.  The
+// signal is measured shortly after the client connects, so it is reported
+// separately.
+func journalSignal(mac, node, vap string, signal int32) {
+	journalMtx.Lock()
+	defer journalMtx.Unlock()
+
+	list := journal[mac]
+	for i := len(list) - 1; i >= 0; i-- {
+		e := list[i]
+		if e.Event == base_msg.WifiJournalEntry_CONNECT {
+			if e.Node == node && e.VAP == vap && e.Signal == 0 {
+				e.Signal = signal
+				journalDirty = true
+			}
+			return
+		}
+	}
+}
+
+func journalEntityHandler(event []byte) {
+	entity := &base_msg.EventNetEntity{}
+	if err := proto.Unmarshal(event, entity); err != nil {
+		slog.Warnf("Unmarshaling NET.ENTITY event: %v", err)
+		return
+	}
+
+	// Only wireless events identify a virtual AP
+	if entity.MacAddress == nil || entity.VirtualAP == nil {
+		return
+	}
+
+	mac := network.Uint64ToMac(*entity.MacAddress)
+	e := &journalEntry{
+		Mac:      mac,
+		When:     *aputil.ProtobufToTime(entity.Timestamp),
+		Node:     entity.GetNode(),
+		VAP:      entity.GetVirtualAP(),
+		Band:     entity.GetBand(),
+		Ring:     entity.GetRing(),
+		Username: entity.GetUsername(),
+		Reason:   entity.GetDisconnectReason(),
+		Detail:   entity.GetDisconnectCause(),
+	}
+
+	switch {
+	case entity.GetDisconnect():
+		e.Event = base_msg.WifiJournalEntry_DISCONNECT
+	case entity.Username != nil:
+		e.Event = base_msg.WifiJournalEntry_AUTH_SUCCESS
+	case entity.Ring != nil:
+		// The ring was chosen by the client's key or by the RADIUS
+		// server.
+		e.Event = base_msg.WifiJournalEntry_RING
+	case entity.Signal != nil:
+		journalSignal(mac, e.Node, e.VAP, entity.GetSignal())
+		return
+	case entity.Band != nil:
+		e.Event = base_msg.WifiJournalEntry_CONNECT
+	default:
+		// Signature updates aren't connection events
+		return
+	}
+
+	journalAdd(e)
+}
+
+func journalExceptionHandler(event []byte) {
+	exception := &base_msg.EventNetException{}
+	if err := proto.Unmarshal(event, exception); err != nil {
+		slog.Warnf("Unmarshaling NET.EXCEPTION event: %v", err)
+		return
+	}
+
+	if exception.MacAddress == nil || exception.VirtualAP == nil {
+		return
+	}
+
+	e := &journalEntry{
+		Mac:      network.Uint64ToMac(*exception.MacAddress),
+		When:     *aputil.ProtobufToTime(exception.Timestamp),
+		Node:     exception.GetNode(),
+		VAP:      exception.GetVirtualAP(),
+		Band:     exception.GetBand(),
+		Username: exception.GetUsername(),
+		Detail:   strings.Join(exception.Details, ", "),
+	}
+
+	switch exception.GetReason() {
+	case base_msg.EventNetException_BAD_PASSWORD:
+		e.Event = base_msg.WifiJournalEntry_AUTH_FAILURE
+	case base_msg.EventNetException_CLIENT_RETRANSMIT:
+		e.Event = base_msg.WifiJournalEntry_RETRANSMIT
+	default:
+		return
+	}
+
+	journalAdd(e)
+}
+
+func journalSteerHandler(event []byte) {
+	steer := &base_msg.EventNetSteer{}
+	if err := proto.Unmarshal(event, steer); err != nil {
+		slog.Warnf("Unmarshaling NET.STEER event: %v", err)
+		return
+	}
+
+	if steer.MacAddress == nil {
+		return
+	}
+
+	journalAdd(&journalEntry{
+		Mac:    network.Uint64ToMac(*steer.MacAddress),
+		When:   *aputil.ProtobufToTime(steer.Timestamp),
+		Event:  base_msg.WifiJournalEntry_STEERED,
+		Node:   steer.GetNode(),
+		VAP:    steer.GetVirtualAP(),
+		Band:   steer.GetBand(),
+		Signal: steer.GetSignal(),
+		Detail: strings.ToLower(steer.GetReason().String()),
+	})
+}
+
+// Return the journal for a single client, or for all clients if no mac address
+// is provided.  The events are returned in the order they happened.
+func journalGet(mac string) []*journalEntry {
+	journalMtx.Lock()
+	defer journalMtx.Unlock()
+
+	rval := make([]*journalEntry, 0)
+	if mac != "" {
+		rval = append(rval, journal[mac]...)
+	} else {
+		for _, list := range journal {
+			rval = append(rval, list...)
+		}
+		sort.SliceStable(rval, func(i, j int) bool {
+			return rval[i].When.Before(rval[j].When)
+		})
+	}
+
+	return rval
+}
+
+// Drop clients we haven't heard from in a long time
+func journalPrune(now time.Time) {
+	for mac, list := range journal {
+		if len(list) == 0 ||
+			now.Sub(list[len(list)-1].When) > journalMaxAge {
+			delete(journal, mac)
+		}
+	}
+}
+
+func journalLoad() {
+	saved := make(map[string][]*journalEntry)
+	if !journalState.load(&saved) {
+		return
+	}
+
+	journalMtx.Lock()
+	journal = saved
+	journalPrune(time.Now())
+	journalMtx.Unlock()
+}
+
+func journalFini(w *watcher) {
+	w.running = false
+	journalState.stop()
+}
+
+func journalInit(w *watcher) {
+	journalLoad()
+
+	brokerd.Handle(base_def.TOPIC_ENTITY, journalEntityHandler)
+	brokerd.Handle(base_def.TOPIC_EXCEPTION, journalExceptionHandler)
+	brokerd.Handle(base_def.TOPIC_STEER, journalSteerHandler)
+
+	journalState.start()
+	w.running = true
+}
+
+func init() {
+	addWatcher("journal", journalInit, journalFini)
+}
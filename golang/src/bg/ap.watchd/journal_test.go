@@ -0,0 +1,120 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"bg/ap_common/aputil"
+	"bg/base_msg"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+	"go.uber.org/zap/zaptest"
+)
+
+const journalTestMac = "00:11:22:33:44:55"
+
+func testEntity() *base_msg.EventNetEntity {
+	hwaddr, _ := net.ParseMAC(journalTestMac)
+	return &base_msg.EventNetEntity{
+		Timestamp:  aputil.NowToProtobuf(),
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+		Node:       proto.String("node1"),
+		VirtualAP:  proto.String("eap"),
+	}
+}
+
+func sendTestEvent(t *testing.T, msg proto.Message, handler func([]byte)) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	handler(data)
+}
+
+func TestJournal(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	journal = make(map[string][]*journalEntry)
+
+	connect := testEntity()
+	connect.Band = proto.String("5GHz")
+	sendTestEvent(t, connect, journalEntityHandler)
+
+	// Signature updates aren't recorded
+	sig := testEntity()
+	sig.WifiSignature = proto.String("wifi4|probe:0")
+	sendTestEvent(t, sig, journalEntityHandler)
+
+	// The signal is attached to the connection
+	signal := testEntity()
+	signal.Signal = proto.Int32(-61)
+	sendTestEvent(t, signal, journalEntityHandler)
+
+	reason := base_msg.EventNetException_BAD_PASSWORD
+	hwaddr, _ := net.ParseMAC(journalTestMac)
+	fail := &base_msg.EventNetException{
+		Timestamp:  aputil.NowToProtobuf(),
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+		VirtualAP:  proto.String("eap"),
+		Node:       proto.String("node1"),
+		Reason:     &reason,
+		Username:   proto.String("alice"),
+		Details:    []string{"eap failure"},
+	}
+	sendTestEvent(t, fail, journalExceptionHandler)
+
+	gone := testEntity()
+	gone.Band = proto.String("5GHz")
+	gone.Disconnect = proto.Bool(true)
+	gone.DisconnectReason = proto.Uint32(3)
+	sendTestEvent(t, gone, journalEntityHandler)
+
+	// Non-wireless entities are ignored
+	wired := testEntity()
+	wired.VirtualAP = nil
+	wired.Ipv4Address = proto.Uint32(0x0a000001)
+	sendTestEvent(t, wired, journalEntityHandler)
+
+	list := journalGet(journalTestMac)
+	expected := []base_msg.WifiJournalEntry_Event{
+		base_msg.WifiJournalEntry_CONNECT,
+		base_msg.WifiJournalEntry_AUTH_FAILURE,
+		base_msg.WifiJournalEntry_DISCONNECT,
+	}
+	if len(list) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected),
+			len(list))
+	}
+	for i, e := range list {
+		if e.Event != expected[i] {
+			t.Errorf("entry %d: expected %v, got %v", i,
+				expected[i], e.Event)
+		}
+	}
+	if list[0].Signal != -61 || list[0].Band != "5GHz" {
+		t.Errorf("bad connect entry: %+v", list[0])
+	}
+	if list[1].Username != "alice" || list[1].Detail != "eap failure" {
+		t.Errorf("bad auth failure entry: %+v", list[1])
+	}
+	if list[2].Reason != 3 {
+		t.Errorf("bad disconnect entry: %+v", list[2])
+	}
+
+	// The journal for each client is bounded
+	for i := 0; i < 2*journalMax; i++ {
+		sendTestEvent(t, connect, journalEntityHandler)
+	}
+	if n := len(journalGet(journalTestMac)); n != journalMax {
+		t.Errorf("expected %d entries, got %d", journalMax, n)
+	}
+}
@@ -469,6 +469,7 @@ func snapshotter() {
 		updateRolling(*rfreq)
 		if time.Now().After(nextSnapshot) {
 			sn := snapshotStats(statsDir)
+			baselineSnapshot(sn)
 			if err := writeStats(statsDir, sn); err != nil {
 				slog.Warnf("Persisting snapshot: %v", err)
 			}
@@ -36,7 +36,7 @@ func dpRepairPropRE() string {
 
 func execPasswordChange(ipaddr string, dpVuln apvuln.DPvulnerability) (apvuln.DPcredentials, error) {
 	var newCreds apvuln.DPcredentials
-	if dpVuln.Service != "ssh" {
+	if dpVuln.Service != "ssh" && dpVuln.Service != "telnet" {
 		return newCreds, fmt.Errorf("Unsupported password repair service %s", dpVuln.Service)
 	}
 	defaultpass := plat.ExpandDirPath("__APPACKAGE__", "bin/ap-defaultpass")
@@ -276,6 +276,13 @@ func processOnePacket(state *samplerState, data []byte) {
 		}
 		updateStats(src, dst, proto, int(ipv4.Length))
 
+		var flags uint8
+		if tcp != nil {
+			flags = tcpFlags(tcp)
+		}
+		flowObserve(state.ring, src, dst, uint8(ipv4.Protocol), flags,
+			int(ipv4.Length))
+
 		if !localIPAddr(srcIP) {
 			checkBlock(dstMac, srcIP)
 		}
@@ -0,0 +1,341 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Limit when, and how hard, the scanners probe the devices on the network.
+//
+//   - A ring (or the whole site) may have quiet hours, during which its devices
+//     are left alone.  Subnet scans, which just look for new devices, still run.
+//   - A single device may be excluded from scanning altogether.
+//   - The site may cap the number of scans running at once across all of the
+//     scan pools, and the aggregate packet rate those scans may generate.
+//   - A client, ring, or the site may select the nmap timing template used to
+//     scan its devices.
+//
+// A scan held back by any of these limits stays in its pool's pending queue,
+// marked with the reason it was deferred.
+
+package main
+
+import (
+	"container/heap"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/common/wifi"
+)
+
+// The reasons a due scan may be deferred
+const (
+	deferExcluded = "excluded"
+	deferQuiet    = "quiet hours"
+	deferBudget   = "budget"
+)
+
+const (
+	// How often an excluded device with no scan period is reconsidered
+	excludeRecheck = time.Hour
+
+	// How far ahead we look for the end of a ring's quiet hours
+	quietHorizon = 8 * 24 * time.Hour
+)
+
+// scanBudget tracks the scans running across all of the scan pools, and the
+// site-wide limits on them.
+type scanBudget struct {
+	maxConcurrent int // 0 means no limit
+	maxRate       int // packets per second; 0 means no limit
+	running       int
+
+	sync.Mutex
+}
+
+var (
+	budget scanBudget
+
+	nmapTimingRE = regexp.MustCompile(`^-T[0-5]$`)
+)
+
+// Claim one of the concurrent scan slots, if any are available
+func (b *scanBudget) acquire() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.maxConcurrent > 0 && b.running >= b.maxConcurrent {
+		return false
+	}
+	b.running++
+	return true
+}
+
+func (b *scanBudget) release() {
+	b.Lock()
+	if b.running > 0 {
+		b.running--
+	}
+	b.Unlock()
+}
+
+// Each scan gets an equal share of the site's packet rate.  The share is based
+// on the most scans that can run at once, rather than the number currently
+// running, so the total can't be exceeded as more scans start.
+func (b *scanBudget) rate() int {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.maxRate <= 0 {
+		return 0
+	}
+
+	slots := b.maxConcurrent
+	if slots <= 0 {
+		for _, cnt := range scanThreads {
+			slots += cnt
+		}
+	}
+
+	rate := b.maxRate / slots
+	if rate < 1 {
+		rate = 1
+	}
+	return rate
+}
+
+func scanBudgetLoad() {
+	maxConcurrent, _ := config.GetPropInt("@/policy/site/scans/max_concurrent")
+	maxRate, _ := config.GetPropInt("@/policy/site/scans/max_rate")
+
+	budget.Lock()
+	budget.maxConcurrent = maxConcurrent
+	budget.maxRate = maxRate
+	budget.Unlock()
+
+	slog.Infof("scan budget: %d concurrent, %d packets/second",
+		maxConcurrent, maxRate)
+}
+
+func scanRing(req *ScanRequest) string {
+	if req.Ring != "" {
+		return req.Ring
+	}
+	return ipToRing(req.IP)
+}
+
+// Build the list of properties which may hold a scan policy setting, from the
+// most specific to the least.
+func scanPolicyProps(mac, ring, setting string) []string {
+	props := make([]string, 0)
+
+	if mac != "" {
+		props = append(props, "@/policy/clients/"+mac+"/scans/"+setting)
+	}
+	if ring != "" {
+		props = append(props, "@/policy/rings/"+ring+"/scans/"+setting)
+	}
+	return append(props, "@/policy/site/scans/"+setting)
+}
+
+// Return the nmap timing template (0-5) selected for a scan, or -1 if the
+// scan's own arguments should be left alone.
+func scanTiming(req *ScanRequest) int {
+	for _, prop := range scanPolicyProps(req.Mac, scanRing(req), "timing") {
+		t, err := config.GetPropInt(prop)
+		if err != nil {
+			continue
+		}
+		if t < 0 || t > 5 {
+			slog.Warnf("ignoring bad timing template %s: %d", prop, t)
+			continue
+		}
+		return t
+	}
+
+	return -1
+}
+
+// Find the quiet hours which apply to a ring.  A ring with no quiet hours of
+// its own inherits the site's.
+func quietSchedule(ring string) (wifi.Schedule, bool) {
+	for _, prop := range scanPolicyProps("", ring, "quiet_hours") {
+		spec, err := config.GetProp(prop)
+		if err != nil {
+			continue
+		}
+
+		// An empty schedule is always active, so we treat it as
+		// having no quiet hours at all.
+		if spec == "" {
+			return nil, false
+		}
+
+		sched, err := wifi.ParseSchedule(spec)
+		if err != nil {
+			slog.Warnf("bad %s %q: %v", prop, spec, err)
+			return nil, false
+		}
+		return sched, true
+	}
+
+	return nil, false
+}
+
+// Find the first minute after 'now' that falls outside of the quiet hours.  If
+// the quiet hours never end, we give up at the horizon and try again then.
+func quietEnd(sched wifi.Schedule, now time.Time) time.Time {
+	limit := now.Add(quietHorizon)
+
+	t := now.Truncate(time.Minute).Add(time.Minute)
+	for ; t.Before(limit); t = t.Add(time.Minute) {
+		if !sched.Active(t) {
+			return t
+		}
+	}
+	return limit
+}
+
+// Determine whether a due scan should be deferred.  If so, return the reason
+// and the time at which it should next be considered.
+func scanDeferral(req *ScanRequest) (string, time.Time) {
+	now := time.Now()
+
+	if req.Mac != "" {
+		prop := "@/policy/clients/" + req.Mac + "/scans/exclude"
+		if excluded, _ := config.GetPropBool(prop); excluded {
+			next := req.Period
+			if next == 0 {
+				next = excludeRecheck
+			}
+			return deferExcluded, now.Add(next)
+		}
+	}
+
+	if req.ScanType != "subnet" {
+		if sched, ok := quietSchedule(scanRing(req)); ok {
+			local, err := apcfg.SiteNow(config)
+			if err != nil {
+				slog.Warnf("%v", err)
+			}
+			if sched.Active(local) {
+				return deferQuiet, quietEnd(sched, local)
+			}
+		}
+	}
+
+	return "", time.Time{}
+}
+
+// Adjust a scan's nmap arguments to use the selected timing template and to
+// stay within its share of the packet rate.
+func scanLimitArgs(args []string, timing, rate int) []string {
+	rval := make([]string, 0, len(args)+3)
+
+	for _, arg := range args {
+		if timing < 0 || !nmapTimingRE.MatchString(arg) {
+			rval = append(rval, arg)
+		}
+	}
+	if timing >= 0 {
+		rval = append(rval, "-T"+strconv.Itoa(timing))
+	}
+	if rate > 0 {
+		rval = append(rval, "--max-rate", strconv.Itoa(rate))
+	}
+
+	return rval
+}
+
+func scanArgs(req *ScanRequest) []string {
+	return scanLimitArgs(req.Args, scanTiming(req), budget.rate())
+}
+
+// Move any deferred scans matching the caller's criteria to the front of their
+// queues, so they will be reconsidered under the new policy.
+func scanReconsider(match matchFunc) {
+	now := time.Now()
+
+	for _, pool := range scanPools {
+		pool.Lock()
+		for _, req := range pool.pending {
+			if req.Deferred != "" && match(req) &&
+				req.When.After(now) {
+				req.When = now
+			}
+		}
+		heap.Init(&pool.pending)
+		pool.Unlock()
+	}
+}
+
+// Stop any scans of a newly excluded device.  The scans remain scheduled, and
+// will be deferred until the exclusion is lifted.
+func scanStopDevice(mac string) {
+	for _, pool := range scanPools {
+		pool.Lock()
+		for _, req := range pool.active {
+			if req != nil && req.Mac == mac && req.Child != nil {
+				slog.Infof("stopping %v of excluded device", req)
+				req.Child.Stop()
+			}
+		}
+		pool.Unlock()
+	}
+}
+
+// Handle a change to one of the scan limits:
+//
+//	@/policy/site/scans/[max_concurrent|max_rate|quiet_hours|timing]
+//	@/policy/rings/<ring>/scans/[quiet_hours|timing]
+//	@/policy/clients/<mac>/scans/[exclude|timing]
+//
+// Returns false if the property isn't one of the limits.
+func scanLimitChanged(path []string, value string) bool {
+	var setting string
+
+	if len(path) == 4 && path[1] == "site" && path[2] == "scans" {
+		setting = path[3]
+	} else if len(path) == 5 && path[3] == "scans" {
+		setting = path[4]
+	} else {
+		return false
+	}
+
+	all := func(r *ScanRequest) bool { return true }
+
+	switch setting {
+	case "max_concurrent", "max_rate":
+		scanBudgetLoad()
+		scanReconsider(all)
+	case "quiet_hours":
+		scanReconsider(all)
+	case "exclude":
+		mac := path[2]
+		if excluded, _ := strconv.ParseBool(value); excluded {
+			scanStopDevice(mac)
+		} else {
+			scanReconsider(func(r *ScanRequest) bool {
+				return r.Mac == mac
+			})
+		}
+	case "timing":
+		// Picked up as each scan starts
+	default:
+		return false
+	}
+
+	return true
+}
+
+func configScanPolicyDeleted(path []string) {
+	if scanLimitChanged(path, "") {
+		slog.Infof("scan policy deleted: @/%s", strings.Join(path, "/"))
+	}
+}
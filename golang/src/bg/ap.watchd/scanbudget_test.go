@@ -0,0 +1,93 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"bg/common/wifi"
+)
+
+func TestScanLimitArgs(t *testing.T) {
+	testData := []struct {
+		timing int
+		rate   int
+		want   []string
+	}{
+		{-1, 0, []string{"-v", "-sV", "-O", "-T4"}},
+		{2, 0, []string{"-v", "-sV", "-O", "-T2"}},
+		{-1, 100, []string{"-v", "-sV", "-O", "-T4", "--max-rate", "100"}},
+		{0, 5, []string{"-v", "-sV", "-O", "-T0", "--max-rate", "5"}},
+	}
+
+	for _, td := range testData {
+		got := scanLimitArgs(tcpNmapArgs, td.timing, td.rate)
+		if !reflect.DeepEqual(got, td.want) {
+			t.Errorf("timing %d rate %d: got %v, want %v", td.timing,
+				td.rate, got, td.want)
+		}
+	}
+
+	// The shared argument list must not be modified
+	if tcpNmapArgs[3] != "-T4" {
+		t.Errorf("tcpNmapArgs modified: %v", tcpNmapArgs)
+	}
+}
+
+func TestScanBudget(t *testing.T) {
+	b := scanBudget{maxConcurrent: 2, maxRate: 100}
+
+	if !b.acquire() || !b.acquire() {
+		t.Fatalf("couldn't acquire budgeted slots")
+	}
+	if b.acquire() {
+		t.Errorf("acquired more than %d slots", b.maxConcurrent)
+	}
+	b.release()
+	if !b.acquire() {
+		t.Errorf("released slot not available")
+	}
+	if r := b.rate(); r != 50 {
+		t.Errorf("rate: got %d, want 50", r)
+	}
+
+	// With no concurrency limit, the rate is shared by every scan thread
+	b = scanBudget{maxRate: 70}
+	for i := 0; i < 20; i++ {
+		if !b.acquire() {
+			t.Fatalf("unlimited budget refused a scan")
+		}
+	}
+	if r := b.rate(); r != 10 {
+		t.Errorf("rate: got %d, want 10", r)
+	}
+}
+
+func TestQuietEnd(t *testing.T) {
+	sched, err := wifi.ParseSchedule("mon-fri 08:00-18:00")
+	if err != nil {
+		t.Fatalf("ParseSchedule failed: %v", err)
+	}
+
+	// Wednesday afternoon
+	now := time.Date(2020, time.June, 3, 14, 30, 15, 0, time.UTC)
+	want := time.Date(2020, time.June, 3, 18, 0, 0, 0, time.UTC)
+	if got := quietEnd(sched, now); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Quiet hours that never end are retried at the horizon
+	sched, _ = wifi.ParseSchedule("daily 00:00-24:00")
+	if got := quietEnd(sched, now); !got.Equal(now.Add(quietHorizon)) {
+		t.Errorf("got %v, want %v", got, now.Add(quietHorizon))
+	}
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Track how the results of each device's port scans change over time.  Each
+// scan is compared with the previous one of the same type, and we report any
+// ports which have opened or closed, any change in the service (or its version)
+// listening on a port, and any change in the OS nmap believes the device to be
+// running.  The changes are published as net.scan_change events, and newly
+// opened ports are raised as exceptions.  A device's first scan establishes
+// its baseline, and doesn't generate any events.
+//
+// The history of the changes for each device is kept as its port timeline.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/network"
+
+	"github.com/golang/protobuf/proto"
+	nmap "github.com/lair-framework/go-nmap"
+)
+
+const (
+	portTimelineMax    = 128                 // changes kept per device
+	portHistoryMaxAge  = 30 * 24 * time.Hour // forget devices idle this long
+	portHistorySave    = 10 * time.Minute
+	portHistoryFile    = "port_history.json"
+	portHistoryUnknown = "unknown"
+)
+
+// The service found listening on a single port
+type portService struct {
+	Name    string `json:"name,omitempty"`
+	Product string `json:"product,omitempty"`
+	Version string `json:"version,omitempty"`
+	Extra   string `json:"extra,omitempty"`
+}
+
+func (s portService) String() string {
+	f := make([]string, 0)
+	for _, x := range []string{s.Name, s.Product, s.Version} {
+		if x != "" {
+			f = append(f, x)
+		}
+	}
+	if s.Extra != "" {
+		f = append(f, "("+s.Extra+")")
+	}
+	if len(f) == 0 {
+		return portHistoryUnknown
+	}
+	return strings.Join(f, " ")
+}
+
+type portChange struct {
+	When     time.Time                        `json:"when"`
+	Kind     base_msg.EventNetScanChange_Kind `json:"kind"`
+	Protocol string                           `json:"protocol,omitempty"`
+	Port     int                              `json:"port,omitempty"`
+	Before   string                           `json:"before,omitempty"`
+	After    string                           `json:"after,omitempty"`
+}
+
+func (c *portChange) String() string {
+	var what string
+
+	if c.Kind == base_msg.EventNetScanChange_OS_CHANGED {
+		what = "os"
+	} else {
+		what = fmt.Sprintf("%s/%d", c.Protocol, c.Port)
+	}
+
+	switch c.Kind {
+	case base_msg.EventNetScanChange_PORT_OPENED:
+		return what + " opened: " + c.After
+	case base_msg.EventNetScanChange_PORT_CLOSED:
+		return what + " closed: " + c.Before
+	}
+	return what + " changed: " + c.Before + " -> " + c.After
+}
+
+// Everything we remember about a single device's scans
+type portHistory struct {
+	// The open ports found by the most recent scans, indexed by
+	// "<protocol>/<port>"
+	Ports map[string]portService `json:"ports"`
+	OS    string                 `json:"os,omitempty"`
+
+	// The protocols for which we have a baseline
+	Scanned  map[string]bool `json:"scanned"`
+	LastScan time.Time       `json:"last_scan"`
+
+	Timeline []*portChange `json:"timeline,omitempty"`
+}
+
+var (
+	portHistories    = make(map[string]*portHistory)
+	portHistoryDirty bool
+	portHistoryMtx   sync.Mutex
+
+	portHistoryState = &stateFile{
+		name:  "port history",
+		file:  portHistoryFile,
+		freq:  portHistorySave,
+		mtx:   &portHistoryMtx,
+		dirty: &portHistoryDirty,
+		state: func() interface{} {
+			portHistoryPrune(time.Now())
+			return portHistories
+		},
+	}
+)
+
+func portKey(protocol string, port int) string {
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+func splitPortKey(key string) (string, int) {
+	var port int
+
+	f := strings.SplitN(key, "/", 2)
+	if len(f) == 2 {
+		fmt.Sscanf(f[1], "%d", &port)
+	}
+	return f[0], port
+}
+
+// Extract the open ports of a single protocol, and the best guess at the OS,
+// from an nmap scan.
+func nmapServices(protocol string, host *nmap.Host) (map[string]portService,
+	string) {
+
+	ports := make(map[string]portService)
+	for _, p := range host.Ports {
+		if p.Protocol != protocol || p.State.State != "open" {
+			continue
+		}
+		ports[portKey(p.Protocol, p.PortId)] = portService{
+			Name:    p.Service.Name,
+			Product: p.Service.Product,
+			Version: p.Service.Version,
+			Extra:   p.Service.ExtraInfo,
+		}
+	}
+
+	// nmap lists its OS guesses in order of decreasing accuracy
+	var osName string
+	if len(host.Os.OsMatches) > 0 {
+		osName = host.Os.OsMatches[0].Name
+	}
+
+	return ports, osName
+}
+
+// Compare the results of a scan with the device's history, update the history,
+// and return the list of changes.  No changes are returned for the first scan
+// of a protocol, but its ports are added to the timeline.
+func portHistoryUpdate(h *portHistory, protocol string,
+	ports map[string]portService, osName string,
+	now time.Time) []*portChange {
+
+	changes := make([]*portChange, 0)
+	add := func(kind base_msg.EventNetScanChange_Kind, key, before,
+		after string) {
+
+		c := &portChange{
+			When:   now,
+			Kind:   kind,
+			Before: before,
+			After:  after,
+		}
+		if key != "" {
+			c.Protocol, c.Port = splitPortKey(key)
+		}
+		changes = append(changes, c)
+	}
+
+	// nmap sometimes fails to identify a service it recognized the last
+	// time, which isn't interesting.
+	for key, svc := range ports {
+		if old, ok := h.Ports[key]; !ok {
+			add(base_msg.EventNetScanChange_PORT_OPENED, key, "",
+				svc.String())
+		} else if old != svc && svc.String() != portHistoryUnknown {
+			add(base_msg.EventNetScanChange_SERVICE_CHANGED, key,
+				old.String(), svc.String())
+		}
+	}
+	for key, svc := range h.Ports {
+		if p, _ := splitPortKey(key); p != protocol {
+			continue
+		}
+		if _, ok := ports[key]; !ok {
+			add(base_msg.EventNetScanChange_PORT_CLOSED, key,
+				svc.String(), "")
+		}
+	}
+
+	// OS detection is unreliable, so a scan without an answer doesn't
+	// count as a change.
+	if osName != "" && osName != h.OS {
+		if h.OS != "" {
+			add(base_msg.EventNetScanChange_OS_CHANGED, "", h.OS,
+				osName)
+		}
+		h.OS = osName
+	}
+
+	for key := range h.Ports {
+		if p, _ := splitPortKey(key); p == protocol {
+			if _, ok := ports[key]; !ok {
+				delete(h.Ports, key)
+			}
+		}
+	}
+	for key, svc := range ports {
+		old, ok := h.Ports[key]
+		if !ok || svc.String() != portHistoryUnknown {
+			h.Ports[key] = svc
+		} else {
+			h.Ports[key] = old
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return changes[i].Kind < changes[j].Kind
+		}
+		return changes[i].Port < changes[j].Port
+	})
+
+	baseline := h.Scanned[protocol]
+	h.Scanned[protocol] = true
+	h.LastScan = now
+	h.Timeline = append(h.Timeline, changes...)
+	if len(h.Timeline) > portTimelineMax {
+		h.Timeline = h.Timeline[len(h.Timeline)-portTimelineMax:]
+	}
+
+	if !baseline {
+		return nil
+	}
+	return changes
+}
+
+func publishScanChange(mac, ip string, c *portChange) {
+	kind := c.Kind
+	change := &base_msg.EventNetScanChange{
+		Timestamp: aputil.TimeToProtobuf(&c.When),
+		Sender:    proto.String(brokerd.Name),
+		Debug:     proto.String("-"),
+		Kind:      &kind,
+	}
+	if hwaddr, err := net.ParseMAC(mac); err == nil {
+		change.MacAddress = proto.Uint64(network.HWAddrToUint64(hwaddr))
+	}
+	if addr := net.ParseIP(ip); addr != nil {
+		change.Ipv4Address = proto.Uint32(network.IPAddrToUint32(addr))
+	}
+	if c.Protocol != "" {
+		change.Protocol = proto.String(c.Protocol)
+		change.Port = proto.Int32(int32(c.Port))
+	}
+	if c.Before != "" {
+		change.Before = proto.String(c.Before)
+	}
+	if c.After != "" {
+		change.After = proto.String(c.After)
+	}
+
+	err := brokerd.Publish(change, base_def.TOPIC_SCAN_CHANGE)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v",
+			base_def.TOPIC_SCAN_CHANGE, err)
+	}
+}
+
+func portOpenedException(mac, ip string, c *portChange) {
+	reason := base_msg.EventNetException_PORT_OPENED
+	entity := &base_msg.EventNetException{
+		Timestamp:   aputil.NowToProtobuf(),
+		Sender:      proto.String(brokerd.Name),
+		Debug:       proto.String("-"),
+		Reason:      &reason,
+		MacAddress:  aputil.MacStrToProtobuf(mac),
+		Ipv4Address: aputil.IPStrToProtobuf(ip),
+		Details:     []string{c.String()},
+	}
+
+	err := brokerd.Publish(entity, base_def.TOPIC_EXCEPTION)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v",
+			base_def.TOPIC_EXCEPTION, err)
+	}
+}
+
+// Compare the results of a port scan with the device's earlier scans, and
+// report anything that has changed.
+func portScanDiff(mac, ip, protocol string, host *nmap.Host) {
+	if mac == "" {
+		return
+	}
+
+	ports, osName := nmapServices(protocol, host)
+
+	portHistoryMtx.Lock()
+	h := portHistories[mac]
+	if h == nil {
+		h = &portHistory{
+			Ports:   make(map[string]portService),
+			Scanned: make(map[string]bool),
+		}
+		portHistories[mac] = h
+	}
+	changes := portHistoryUpdate(h, protocol, ports, osName, time.Now())
+	portHistoryDirty = true
+	portHistoryMtx.Unlock()
+
+	for _, c := range changes {
+		slog.Infof("%s (%s) %v", mac, ip, c)
+		publishScanChange(mac, ip, c)
+		if c.Kind == base_msg.EventNetScanChange_PORT_OPENED {
+			portOpenedException(mac, ip, c)
+		}
+	}
+}
+
+// Return the port timeline for a single device, or for all devices if no mac
+// address is provided.  The changes are returned in the order they happened,
+// along with the mac address of the device each belongs to.
+func portTimelineGet(mac string) ([]*portChange, []string) {
+	type entry struct {
+		mac    string
+		change *portChange
+	}
+
+	portHistoryMtx.Lock()
+	all := make([]entry, 0)
+	for m, h := range portHistories {
+		if mac == "" || m == mac {
+			for _, c := range h.Timeline {
+				all = append(all, entry{m, c})
+			}
+		}
+	}
+	portHistoryMtx.Unlock()
+
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].change.When.Before(all[j].change.When)
+	})
+
+	changes := make([]*portChange, len(all))
+	macs := make([]string, len(all))
+	for i, e := range all {
+		changes[i] = e.change
+		macs[i] = e.mac
+	}
+	return changes, macs
+}
+
+// Drop devices we haven't scanned in a long time
+func portHistoryPrune(now time.Time) {
+	for mac, h := range portHistories {
+		if now.Sub(h.LastScan) > portHistoryMaxAge {
+			delete(portHistories, mac)
+		}
+	}
+}
+
+func portHistoryLoad() {
+	saved := make(map[string]*portHistory)
+	if !portHistoryState.load(&saved) {
+		return
+	}
+	for _, h := range saved {
+		if h.Ports == nil {
+			h.Ports = make(map[string]portService)
+		}
+		if h.Scanned == nil {
+			h.Scanned = make(map[string]bool)
+		}
+	}
+
+	portHistoryMtx.Lock()
+	portHistories = saved
+	portHistoryPrune(time.Now())
+	portHistoryMtx.Unlock()
+}
+
+func portHistoryFini(w *watcher) {
+	w.running = false
+	portHistoryState.stop()
+}
+
+func portHistoryInit(w *watcher) {
+	portHistoryLoad()
+
+	portHistoryState.start()
+	w.running = true
+}
+
+func init() {
+	addWatcher("porthistory", portHistoryInit, portHistoryFini)
+}
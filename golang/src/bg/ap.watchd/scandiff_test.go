@@ -0,0 +1,127 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bg/base_msg"
+
+	nmap "github.com/lair-framework/go-nmap"
+)
+
+func testHost(osName string, ports ...nmap.Port) *nmap.Host {
+	h := &nmap.Host{Ports: ports}
+	if osName != "" {
+		h.Os.OsMatches = []nmap.OsMatch{{Name: osName}}
+	}
+	return h
+}
+
+func testPort(protocol string, id int, name, product,
+	version string) nmap.Port {
+
+	var p nmap.Port
+
+	p.Protocol = protocol
+	p.PortId = id
+	p.State.State = "open"
+	p.Service.Name = name
+	p.Service.Product = product
+	p.Service.Version = version
+	return p
+}
+
+func TestPortHistory(t *testing.T) {
+	h := &portHistory{
+		Ports:   make(map[string]portService),
+		Scanned: make(map[string]bool),
+	}
+	now := time.Now()
+
+	scan := func(protocol string, host *nmap.Host) []*portChange {
+		ports, osName := nmapServices(protocol, host)
+		now = now.Add(time.Minute)
+		return portHistoryUpdate(h, protocol, ports, osName, now)
+	}
+
+	http := testPort("tcp", 80, "http", "lighttpd", "1.4.35")
+	rtsp := testPort("tcp", 554, "rtsp", "", "")
+	dns := testPort("udp", 53, "domain", "", "")
+
+	// The first scan is the baseline
+	changes := scan("tcp", testHost("Linux 3.2", http, rtsp, dns))
+	if len(changes) != 0 {
+		t.Fatalf("baseline scan reported changes: %v", changes)
+	}
+	if len(h.Ports) != 2 || len(h.Timeline) != 2 {
+		t.Fatalf("bad baseline: %v / %v", h.Ports, h.Timeline)
+	}
+
+	// Nothing changed, and a scan without an OS match doesn't count
+	if changes = scan("tcp", testHost("", http, rtsp)); len(changes) != 0 {
+		t.Errorf("unchanged scan reported changes: %v", changes)
+	}
+
+	// The first udp scan is a baseline too
+	if changes = scan("udp", testHost("", dns)); len(changes) != 0 {
+		t.Errorf("udp baseline reported changes: %v", changes)
+	}
+
+	// telnet opens, the web server is upgraded, rtsp closes, and the
+	// device starts looking like something else
+	telnet := testPort("tcp", 23, "telnet", "BusyBox telnetd", "")
+	http.Service.Version = "1.4.55"
+	changes = scan("tcp", testHost("Linux 4.4", telnet, http))
+
+	expected := []struct {
+		kind   base_msg.EventNetScanChange_Kind
+		port   int
+		before string
+		after  string
+	}{
+		{base_msg.EventNetScanChange_PORT_OPENED, 23, "",
+			"telnet BusyBox telnetd"},
+		{base_msg.EventNetScanChange_PORT_CLOSED, 554, "rtsp", ""},
+		{base_msg.EventNetScanChange_SERVICE_CHANGED, 80,
+			"http lighttpd 1.4.35", "http lighttpd 1.4.55"},
+		{base_msg.EventNetScanChange_OS_CHANGED, 0, "Linux 3.2",
+			"Linux 4.4"},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %v", len(expected), changes)
+	}
+	for i, e := range expected {
+		c := changes[i]
+		if c.Kind != e.kind || c.Port != e.port ||
+			c.Before != e.before || c.After != e.after {
+			t.Errorf("change %d: expected %+v, got %+v", i, e, *c)
+		}
+	}
+
+	// The udp port isn't affected by the tcp scans
+	if _, ok := h.Ports["udp/53"]; !ok {
+		t.Errorf("udp port lost: %v", h.Ports)
+	}
+
+	// A service nmap can't identify this time isn't a change
+	http.Service = nmap.Service{}
+	if changes = scan("tcp", testHost("", telnet, http)); len(changes) != 0 {
+		t.Errorf("unidentified service reported changes: %v", changes)
+	}
+	if s := h.Ports["tcp/80"].String(); s != "http lighttpd 1.4.55" {
+		t.Errorf("service forgotten: %s", s)
+	}
+
+	if len(h.Timeline) != 2+1+len(expected) {
+		t.Errorf("unexpected timeline length %d", len(h.Timeline))
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -160,6 +161,7 @@ type ScanRequest struct {
 	Where    uint32
 
 	Cancelled bool
+	Deferred  string // why a due scan hasn't been started
 	Period    time.Duration
 	When      time.Time
 	Last      time.Time
@@ -395,6 +397,9 @@ func configScanPolicyChanged(path []string, value string, expires *time.Time) {
 	//    @/policy/clients/<mac>/scans/<scantype>/period
 	prop := "@/" + strings.Join(path, "/")
 	slog.Infof("scan policy change: %s -> %s", prop, value)
+	if scanLimitChanged(path, value) {
+		return
+	}
 	if len(path) != 6 || path[3] != "scans" || path[5] != "period" {
 		return
 	}
@@ -447,7 +452,28 @@ func poolGetNext(pool *scanPool) *ScanRequest {
 		return nil
 	}
 
+	// The scan is due, but it may be held back by the scan limits.  A scan
+	// deferred by policy is pushed back to the next time it may run, while
+	// one waiting for a free slot in the budget stays at the head of the
+	// queue.
+	if !budget.acquire() {
+		req.Deferred = deferBudget
+		return nil
+	}
+	if reason, next := scanDeferral(req); reason != "" {
+		budget.release()
+		if req.Deferred != reason {
+			slog.Infof("deferring %v until %s: %s", req,
+				next.Format(time.Stamp), reason)
+		}
+		req.Deferred = reason
+		req.When = next
+		heap.Fix(&pool.pending, req.index)
+		return nil
+	}
+
 	req = heap.Remove(&pool.pending, 0).(*ScanRequest)
+	req.Deferred = ""
 	pool.scansRun++
 	if late := delta * -1.0; late > 2.0 {
 		pool.scansLate++
@@ -489,6 +515,7 @@ func scanner(pool *scanPool, threadID int) {
 			mkScanProp(req, "start")
 
 			req.Scanner(req)
+			budget.release()
 
 			mkScanProp(req, "finish")
 			slog.Debugf("finished %v", req)
@@ -751,7 +778,7 @@ func nmapScan(req *ScanRequest) (*nmap.NmapRun, error) {
 	defer os.Remove(name)
 
 	args := []string{req.IP, "-oX", name}
-	args = append(args, req.Args...)
+	args = append(args, scanArgs(req)...)
 
 	if err = runCmd(req, "/usr/bin/nmap", args); err != nil {
 		return nil, err
@@ -991,10 +1018,13 @@ func portScan(req *ScanRequest) {
 	host := &res.Hosts[0]
 	if host.Status.State != "up" {
 		delete(activeServices, req.Mac+":"+req.ScanType)
+		cveForget(req.Mac, req.ScanType)
 		return
 	}
 
 	recordNmapResults(req.ScanType, host)
+	portScanDiff(req.Mac, req.IP, req.ScanType, host)
+	cveScan(req.Mac, req.IP, req.ScanType, host)
 	marshalledHosts := make([]*base_msg.Host, 1)
 	marshalledHosts[0] = marshalNmapResults(host)
 
@@ -1060,7 +1090,9 @@ func vulnPropOp(mac, vuln, field, val string) cfgapi.PropertyOp {
 
 // Determine which actions need to be taken for this vulnerability, based on the
 // information stored in the VulnInfo map.
-func vulnActions(name string, vmap cfgapi.VulnMap) (first, warn, quarantine bool, text string) {
+func vulnActions(name string, res *apvuln.TestResult,
+	vmap cfgapi.VulnMap) (first, warn, quarantine bool, text string) {
+
 	ignore := false
 
 	vi, ok := vmap[name]
@@ -1071,7 +1103,11 @@ func vulnActions(name string, vmap cfgapi.VulnMap) (first, warn, quarantine bool
 	}
 
 	nickname := ""
-	if v, ok := vulnList[name]; ok {
+	v, ok := vulnList[name]
+	if !ok && res.Tool == cveMatchTool {
+		v, ok = cveDescription(res), true
+	}
+	if ok {
 		nickname = v.Nickname
 		for _, a := range v.Actions {
 			switch a {
@@ -1124,9 +1160,15 @@ func vulnScanProcess(ip string, discovered map[string]apvuln.TestResult) {
 
 		if state.State == apvuln.Vulnerable {
 			slog.Debugf("%s vulnerable to %s", mac, name)
-			first, warn, q, text := vulnActions(name, vmap)
+			first, warn, q, text := vulnActions(name, &state, vmap)
 			props["active"] = "true"
 			props["latest"] = now
+			if state.Tool != "" {
+				props["source"] = state.Tool
+			}
+			if state.CVSS > 0 {
+				props["cvss"] = fmt.Sprintf("%.1f", state.CVSS)
+			}
 
 			details := strings.TrimSpace(state.DetailsSummary())
 			if len(details) > 0 {
@@ -1212,6 +1254,12 @@ func vulnScan(req *ScanRequest) {
 	if len(req.Args) > 0 {
 		args = append(args, req.Args...)
 	}
+	if timing := scanTiming(req); timing >= 0 {
+		args = append(args, "-timing", strconv.Itoa(timing))
+	}
+	if rate := budget.rate(); rate > 0 {
+		args = append(args, "-rate", strconv.Itoa(rate))
+	}
 
 	start := time.Now()
 	slog.Debugf("vulnerability scan starting: %s %v", prober, args)
@@ -1343,6 +1391,8 @@ func scannerFini(w *watcher) {
 func scannerInit(w *watcher) {
 	activeHosts = hostmapCreate()
 	vulnInit()
+	cveInit()
+	scanBudgetLoad()
 
 	scanPools = make(map[string]*scanPool)
 	for name, cnt := range scanThreads {
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Several watchers keep state which needs to survive a restart.  Each is saved
+// as a JSON file in the watchd data directory.  Changes are written out
+// periodically by a background goroutine, and once more when the watcher is
+// shut down.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type stateFile struct {
+	name  string        // used in log messages
+	file  string        // file name within watchDir
+	freq  time.Duration // how often to write out changes
+	mtx   *sync.Mutex   // protects the state and the dirty flag
+	dirty *bool         // set by the owner when the state changes
+
+	// Called with mtx held.  Returns the state to be saved.
+	state func() interface{}
+
+	done    chan bool
+	running bool
+}
+
+func (s *stateFile) path() string {
+	return *watchDir + "/" + s.file
+}
+
+// Read the saved state into 'v'.  Returns false if there is no usable state.
+func (s *stateFile) load(v interface{}) bool {
+	data, err := ioutil.ReadFile(s.path())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warnf("reading %s: %v", s.name, err)
+		}
+		return false
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		slog.Warnf("parsing %s: %v", s.name, err)
+		return false
+	}
+	return true
+}
+
+// Write out the state if it has changed since the last write
+func (s *stateFile) write() {
+	s.mtx.Lock()
+	if !*s.dirty {
+		s.mtx.Unlock()
+		return
+	}
+	data, err := json.Marshal(s.state())
+	*s.dirty = false
+	s.mtx.Unlock()
+
+	if err != nil {
+		slog.Warnf("encoding %s: %v", s.name, err)
+	} else if err = ioutil.WriteFile(s.path(), data, 0644); err != nil {
+		slog.Warnf("writing %s: %v", s.name, err)
+	}
+}
+
+func (s *stateFile) saver(done chan bool) {
+	ticker := time.NewTicker(s.freq)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.write()
+		case <-done:
+			s.write()
+			done <- true
+			return
+		}
+	}
+}
+
+// Start writing out changes periodically
+func (s *stateFile) start() {
+	if !s.running {
+		s.done = make(chan bool)
+		s.running = true
+		go s.saver(s.done)
+	}
+}
+
+// Stop the periodic writes, after writing out any outstanding changes
+func (s *stateFile) stop() {
+	if s.running {
+		s.running = false
+		s.done <- true
+		<-s.done
+	}
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestStateFile(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	dir, err := ioutil.TempDir("", "statefile")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { *watchDir = old }(*watchDir)
+	*watchDir = dir
+
+	var (
+		mtx   sync.Mutex
+		dirty bool
+	)
+	state := map[string]int{"a": 1, "b": 2}
+	s := &stateFile{
+		name:  "test state",
+		file:  "test.json",
+		freq:  time.Hour,
+		mtx:   &mtx,
+		dirty: &dirty,
+		state: func() interface{} { return state },
+	}
+
+	saved := make(map[string]int)
+	if s.load(&saved) {
+		t.Errorf("loaded state before it was written")
+	}
+
+	// Nothing is written until the state has changed
+	s.write()
+	if _, err = os.Stat(s.path()); !os.IsNotExist(err) {
+		t.Errorf("state written before it changed: %v", err)
+	}
+
+	// Stopping the saver writes out any outstanding changes
+	s.start()
+	mtx.Lock()
+	dirty = true
+	mtx.Unlock()
+	s.stop()
+	if dirty {
+		t.Errorf("dirty flag not cleared by write")
+	}
+
+	if !s.load(&saved) {
+		t.Fatalf("failed to load saved state")
+	}
+	if !reflect.DeepEqual(saved, state) {
+		t.Errorf("loaded %v, expected %v", saved, state)
+	}
+
+	// Unparseable state is rejected
+	if err = ioutil.WriteFile(s.path(), []byte("{"), 0644); err != nil {
+		t.Fatalf("writing bad state: %v", err)
+	}
+	if s.load(&saved) {
+		t.Errorf("loaded unparseable state")
+	}
+}
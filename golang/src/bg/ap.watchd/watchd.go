@@ -416,6 +416,8 @@ func main() {
 	config.HandleChange(`^@/clients/.*/ipv4$`, configIPv4Changed)
 	config.HandleChange(`^@/policy/clients/.*/scans/.*$`, configScanPolicyChanged)
 	config.HandleChange(`^@/policy/rings/.*/scans/.*$`, configScanPolicyChanged)
+	config.HandleChange(`^@/policy/site/scans/.*$`, configScanPolicyChanged)
+	config.HandleDelete(`^@/policy/.*/scans/.*$`, configScanPolicyDeleted)
 	brokerd.Handle(base_def.TOPIC_UPDATE, netEventHandler)
 	brokerd.Handle(base_def.TOPIC_ENTITY, entityEventHandler)
 
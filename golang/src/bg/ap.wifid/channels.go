@@ -24,9 +24,23 @@ import (
 	"bg/common/wifi"
 )
 
+const (
+	quietHoursProp    = "@/network/channel_quiet_hours"
+	defaultQuietHours = "daily 02:00-05:00"
+
+	// How often we check whether a channel evaluation is due
+	chanEvalCheck = 10 * time.Minute
+)
+
 type wifiConfig struct {
 	radiusSecret string
+	ftKey        string
 	domain       string
+	dfs          bool // allow channels requiring radar detection
+	planner      bool // channels are chosen by the site-wide planner
+
+	radiusServers []radiusServer // external RADIUS servers
+	radiusVlans   map[int]string // RADIUS-assigned VLAN -> ring
 }
 
 var (
@@ -49,6 +63,8 @@ type wifiInfo struct {
 	activeChannel int    // channel actually being used
 	activeWidth   int    // witdh of channel actually being used
 
+	fallback bool // configured channel is blocked by radar
+
 	cap *wificaps.WifiCapabilities // What features the device supports
 }
 
@@ -62,12 +78,6 @@ var (
 
 	// For each channel, this represents a set of the legal channel widths
 	channelWidths map[int]map[int]bool
-
-	// In 802.11n, a 40MHz channel is constructed from 2 20MHz channels.
-	// Whether the primary channel is above or below the secondary will
-	// determine one of the ht_capab settings.
-	nModePrimaryAbove map[int]bool
-	nModePrimaryBelow map[int]bool
 )
 
 // used to track the potential interference from other APs
@@ -105,10 +115,8 @@ func updateAPScan(dev string) {
 	aps := apscan.ScanIface(dev)
 	now := time.Now()
 
-	ourRadios := make(map[string]bool)
-	for _, d := range wirelessNics {
-		ourRadios[strings.ToLower(d.hwaddr)] = true
-	}
+	ourRadios := siteRadios()
+	others := make([]*apscan.ScannedAP, 0)
 	apLock.Lock()
 	for _, ap := range aps {
 		// Ignore old sightings
@@ -121,10 +129,12 @@ func updateAPScan(dev string) {
 			continue
 		}
 
-		// Ignore our own radios
+		// Ignore our own radios, including those on other nodes
 		if ourRadios[strings.ToLower(ap.Mac)] {
 			continue
 		}
+		others = append(others, ap)
+
 		t := apMap[ap.Mac]
 		if t == nil {
 			t = &apTrack{}
@@ -149,6 +159,7 @@ func updateAPScan(dev string) {
 	apLock.Unlock()
 
 	buildCongestionMap()
+	checkRogueAPs(others, ourRadios)
 }
 
 // Use the accumulated AP observations to build a table tracking the relative
@@ -186,7 +197,7 @@ func buildCongestionMap() {
 
 	// Use the 20MHz data to construct the maps for the wider channels
 	for _, c := range wificaps.ChannelLists["hiBand40MHz"] {
-		if nModePrimaryAbove[c] {
+		if wifi.HT40Above[c] {
 			cmap[40][c] = cmap[20][c] + cmap[20][c-4]
 		} else {
 			cmap[40][c] = cmap[20][c] + cmap[20][c+4]
@@ -201,16 +212,38 @@ func buildCongestionMap() {
 	apLock.Unlock()
 }
 
+// Estimate the cost of using a channel.  The congestion is normalized to a
+// single 20MHz channel, so channels of different widths can be compared.  A
+// channel requiring radar detection carries an additional penalty, reflecting
+// the time lost to the availability check and the risk of being forced off of
+// it.
+func channelCost(w *wifiInfo, channel, width int) int {
+	cost := congestionMap[width][channel] / (width / 20)
+	if dfsRequired(w, channel, width) {
+		cost += *dfsPenalty
+	}
+	return cost
+}
+
 // Given a slice of channel numbers for a given width, sort the slice according
-// to the calculated congestion on each channel.
-func congestionSortList(list []int, width int) {
-	sort.Slice(list, func(i, j int) bool {
-		chanI := list[i]
-		chanJ := list[j]
-		return congestionMap[width][chanI] < congestionMap[width][chanJ]
+// to the calculated cost of each channel.
+func costSortList(w *wifiInfo, list []int, width int) {
+	sort.SliceStable(list, func(i, j int) bool {
+		return channelCost(w, list[i], width) <
+			channelCost(w, list[j], width)
 	})
 }
 
+// Is the improvement from moving between two channels large enough to justify
+// disrupting the clients?
+func worthMoving(old, new *wifiInfo) bool {
+	cur := channelCost(old, old.activeChannel, old.activeWidth)
+	next := channelCost(new, new.activeChannel, new.activeWidth)
+	gain := cur - next
+
+	return gain >= *chanMinGain && gain*100 >= cur*(*chanHysteresis)
+}
+
 func copyChannelList(name string) []int {
 	return append([]int(nil), wificaps.ChannelLists[name]...)
 }
@@ -225,12 +258,22 @@ func apMonitorLoop(wg *sync.WaitGroup, doneChan chan bool) {
 
 	freq := *apScanFreq
 	t := time.NewTicker(freq)
+	evalTick := time.NewTicker(chanEvalCheck)
+	defer evalTick.Stop()
+
 	slog.Infof("AP monitor loop starting")
 	for {
 		select {
 		case <-doneChan:
 			return
 
+		case <-evalTick.C:
+			if time.Now().After(nextChanEval) &&
+				inQuietHours(siteNow()) {
+				reoptimizeChannels()
+			}
+			continue
+
 		case <-t.C:
 		}
 
@@ -239,11 +282,7 @@ func apMonitorLoop(wg *sync.WaitGroup, doneChan chan bool) {
 				updateAPScan(d.name)
 			}
 		}
-
-		if time.Now().After(nextChanEval) {
-			wifiEvaluate = true
-			hostapd.reset()
-		}
+		publishCongestion()
 
 		// If the frequency setting has been changed, reset our timer to
 		// the new value.
@@ -255,6 +294,33 @@ func apMonitorLoop(wg *sync.WaitGroup, doneChan chan bool) {
 	}
 }
 
+// Determine whether this device can legally use the given channel
+func channelUsable(w *wifiInfo, band string, channel, width int) error {
+	if !bandChannels[band][channel] {
+		return fmt.Errorf("channel %d not valid on %s", channel, band)
+	}
+	if !channelWidths[width][channel] {
+		return fmt.Errorf("width %d not valid for channel %d",
+			width, channel)
+	}
+
+	for _, c := range wifi.SpanChannels(channel, width) {
+		if w.cap.RadarChannels[c] {
+			if !wconf.dfs {
+				return fmt.Errorf("channel %d requires DFS", c)
+			}
+		} else if !w.cap.Channels[c] {
+			return fmt.Errorf("channel %d not supported on this nic",
+				c)
+		}
+	}
+	if radarBlocked(channel, width) {
+		return fmt.Errorf("radar detected on channel %d", channel)
+	}
+
+	return nil
+}
+
 func setChannel(w *wifiInfo, band string, channel, width int) error {
 	if width == 0 {
 		// XXX - update for 160MHz wide channels
@@ -267,16 +333,8 @@ func setChannel(w *wifiInfo, band string, channel, width int) error {
 		}
 	}
 
-	if !w.cap.Channels[channel] {
-		return fmt.Errorf("channel %d not supported on this nic",
-			channel)
-	}
-	if !bandChannels[band][channel] {
-		return fmt.Errorf("channel %d not valid on %s", channel, band)
-	}
-	if !channelWidths[width][channel] {
-		return fmt.Errorf("width %d not valid for channel %d",
-			width, channel)
+	if err := channelUsable(w, band, channel, width); err != nil {
+		return err
 	}
 
 	if band == wifi.HiBand && w.cap.WifiModes["ac"] {
@@ -305,7 +363,7 @@ func findChannel(w *wifiInfo, band, listName string, width int) {
 	}
 
 	list := copyChannelList(listName)
-	congestionSortList(list, width)
+	costSortList(w, list, width)
 	slog.Debugf("congestion map for %dMHz %s: %v", width, band,
 		congestionMap[width])
 
@@ -318,6 +376,31 @@ func findChannel(w *wifiInfo, band, listName string, width int) {
 	}
 }
 
+// Choose the least costly channel from within the specified band
+func pickChannel(w *wifiInfo, band string) {
+	w.activeChannel = 0
+	if band == wifi.LoBand {
+		// We first try to choose one of the non-overlapping
+		// channels.  If that fails, we'll take any channel in
+		// this range.
+		findChannel(w, band, "loBandNoOverlap", 20)
+		if w.activeChannel == 0 {
+			findChannel(w, band, "loBand20MHz", 20)
+		}
+	} else {
+		if w.cap.WifiModes["ac"] {
+			// XXX: update for 160MHz and 80+80
+			findChannel(w, band, "hiBand80MHz", 80)
+		}
+		if w.activeChannel == 0 && w.cap.HTCapabilities[wificaps.HTCAP_HT20_40] {
+			findChannel(w, band, "hiBand40MHz", 40)
+		}
+		if w.activeChannel == 0 {
+			findChannel(w, band, "hiBand20MHz", 20)
+		}
+	}
+}
+
 // Choose a channel for this wifi device from within the specified band
 func selectWifiChannel(d *physDevice, band string) error {
 	var err error
@@ -334,36 +417,43 @@ func selectWifiChannel(d *physDevice, band string) error {
 	oldInfo := *w
 
 	w.activeChannel = 0
+	w.fallback = false
 	if w.configChannel != 0 {
-		err = setChannel(w, band, w.configChannel, w.configWidth)
-		if err != nil {
-			w.state = wifi.DevBadChan
-			err = fmt.Errorf("setChannel failed: %v", err)
-		}
-		if !wifiInfoEqual(&oldInfo, w) {
-			wifiDeviceToConfig(d)
+		if radarBlocked(w.configChannel, w.configWidth) {
+			// Fall back to automatic selection until the
+			// channel's non-occupancy period has passed
+			slog.Warnf("%s: radar on configured channel %d - "+
+				"using a fallback channel", d.name,
+				w.configChannel)
+			w.fallback = true
+		} else {
+			err = setChannel(w, band, w.configChannel,
+				w.configWidth)
+			if err != nil {
+				w.state = wifi.DevBadChan
+				err = fmt.Errorf("setChannel failed: %v", err)
+			}
+			if !wifiInfoEqual(&oldInfo, w) {
+				wifiDeviceToConfig(d)
+			}
 			return err
 		}
 	}
 
-	if band == wifi.LoBand {
-		// We first try to choose one of the non-overlapping
-		// channels.  If that fails, we'll take any channel in
-		// this range.
-		findChannel(w, band, "loBandNoOverlap", 20)
-		if w.activeChannel == 0 {
-			findChannel(w, band, "loBand20MHz", 20)
-		}
-	} else {
-		if w.cap.WifiModes["ac"] {
-			// XXX: update for 160MHz and 80+80
-			findChannel(w, band, "hiBand80MHz", 80)
-		}
-		if w.activeChannel == 0 && w.cap.HTCapabilities[wificaps.HTCAP_HT20_40] {
-			findChannel(w, band, "hiBand40MHz", 40)
-		}
-		if w.activeChannel == 0 {
-			findChannel(w, band, "hiBand20MHz", 20)
+	pickChannel(w, band)
+
+	// Don't abandon a perfectly usable channel for a marginally better one
+	if w.activeChannel != 0 && oldInfo.activeChannel != 0 &&
+		oldInfo.activeBand == band && !oldInfo.fallback &&
+		(w.activeChannel != oldInfo.activeChannel ||
+			w.activeWidth != oldInfo.activeWidth) {
+		usable := channelUsable(w, band, oldInfo.activeChannel,
+			oldInfo.activeWidth) == nil
+		if usable && !worthMoving(&oldInfo, w) {
+			slog.Debugf("%s: staying on channel %d", d.name,
+				oldInfo.activeChannel)
+			setChannel(w, band, oldInfo.activeChannel,
+				oldInfo.activeWidth)
 		}
 	}
 
@@ -378,6 +468,95 @@ func selectWifiChannel(d *physDevice, band string) error {
 	return err
 }
 
+// Determine whether this device would be significantly better off on a
+// different channel.  If so, return a description of the change.
+func channelImprovement(d *physDevice) string {
+	w := d.wifi
+	if w.activeChannel == 0 || cacActive(d) {
+		return ""
+	}
+
+	if w.fallback {
+		if !radarBlocked(w.configChannel, w.configWidth) {
+			return fmt.Sprintf("returning to configured channel %d",
+				w.configChannel)
+		}
+		return ""
+	}
+	if w.configChannel != 0 {
+		return ""
+	}
+
+	trial := *w
+	pickChannel(&trial, w.activeBand)
+	if trial.activeChannel == 0 ||
+		(trial.activeChannel == w.activeChannel &&
+			trial.activeWidth == w.activeWidth) {
+		return ""
+	}
+
+	if !worthMoving(w, &trial) {
+		slog.Debugf("%s: channel %d/%dMHz (cost %d) is not enough "+
+			"better than %d/%dMHz (cost %d)", d.name,
+			trial.activeChannel, trial.activeWidth,
+			channelCost(&trial, trial.activeChannel,
+				trial.activeWidth),
+			w.activeChannel, w.activeWidth,
+			channelCost(w, w.activeChannel, w.activeWidth))
+		return ""
+	}
+
+	return fmt.Sprintf("moving from %d/%dMHz to %d/%dMHz", w.activeChannel,
+		w.activeWidth, trial.activeChannel, trial.activeWidth)
+}
+
+// Channel changes disrupt all of the connected clients, so they are only
+// considered during the site's quiet hours.
+func inQuietHours(now time.Time) bool {
+	spec, err := config.GetProp(quietHoursProp)
+	if err != nil {
+		spec = defaultQuietHours
+	}
+
+	sched, err := wifi.ParseSchedule(spec)
+	if err != nil {
+		slog.Warnf("bad %s %q: %v", quietHoursProp, spec, err)
+		sched, _ = wifi.ParseSchedule(defaultQuietHours)
+	}
+
+	return sched.Active(now)
+}
+
+// Using the latest congestion data, determine whether any of our devices should
+// change channels.  If so, restart hostapd to select new channels.
+func reoptimizeChannels() {
+	nextChanEval = time.Now().Add(*chanEvalFreq)
+	if hostapd == nil {
+		return
+	}
+
+	for _, d := range hostapd.devices {
+		if !d.pseudo {
+			updateAPScan(d.name)
+		}
+	}
+	publishCongestion()
+
+	if wconf.planner && !satellite {
+		planChannels()
+	}
+
+	for _, d := range hostapd.devices {
+		if change := channelImprovement(d); change != "" {
+			slog.Infof("%s: %s", d.name, change)
+			wifiEvaluate = true
+			hostapd.reset()
+			return
+		}
+	}
+	slog.Infof("channel evaluation: no changes needed")
+}
+
 // How desirable is it to use this device in this band?
 func score(d *physDevice, band string) int {
 	var score int
@@ -570,22 +749,6 @@ func makeValidChannelMaps() {
 			channelWidths[width][channel] = true
 		}
 	}
-
-	// The 2.4GHz band is crowded, so the use of 40MHz bonded channels is
-	// discouraged.  Thus, the following lists only include channels in the
-	// 5GHz band.
-	above := []int{36, 44, 52, 60, 100, 108, 116, 124, 132, 140, 149, 157}
-	below := []int{40, 48, 56, 64, 104, 112, 120, 128, 136, 144, 153, 161}
-
-	nModePrimaryAbove = make(map[int]bool)
-	for _, c := range above {
-		nModePrimaryAbove[c] = true
-	}
-
-	nModePrimaryBelow = make(map[int]bool)
-	for _, c := range below {
-		nModePrimaryBelow[c] = true
-	}
 }
 
 func globalWifiInit(props *cfgapi.PropertyNode) error {
@@ -615,6 +778,13 @@ func globalWifiInit(props *cfgapi.PropertyNode) error {
 		slog.Warnf("no radius_auth_secret configured")
 	}
 
+	wconf.ftKey, _ = props.GetChildString("ft_key")
+	wconf.dfs, _ = props.GetChildBool("dfs")
+	wconf.planner, _ = props.GetChildBool("channel_planner")
+
+	wconf.radiusServers, wconf.radiusVlans =
+		getRadiusConfig(props.Children["radius"])
+
 	wifiEvaluate = true
 
 	congestionMap = make(map[int]map[int]int)
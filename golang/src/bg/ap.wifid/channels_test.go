@@ -0,0 +1,136 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"bg/ap_common/wificaps"
+	"bg/common/wifi"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func testWifiInfo() *wifiInfo {
+	caps := &wificaps.WifiCapabilities{
+		Channels:       make(map[int]bool),
+		RadarChannels:  make(map[int]bool),
+		WifiBands:      map[string]bool{wifi.HiBand: true},
+		WifiModes:      map[string]bool{"n": true, "ac": true},
+		HTCapabilities: map[int]bool{wificaps.HTCAP_HT20_40: true},
+	}
+	for _, c := range wifi.Channels[wifi.HiBand] {
+		if c >= 52 && c <= 144 {
+			caps.RadarChannels[c] = true
+		} else {
+			caps.Channels[c] = true
+		}
+	}
+
+	return &wifiInfo{state: wifi.DevOK, cap: caps}
+}
+
+func setCongestion(channels map[int]int) {
+	apMap = make(map[string]*apTrack)
+	for c, strength := range channels {
+		apMap[strconv.Itoa(c)] = &apTrack{
+			channels: []int{c},
+			strength: strength - 100,
+		}
+	}
+	buildCongestionMap()
+}
+
+func TestDFSChannels(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	makeValidChannelMaps()
+
+	w := testWifiInfo()
+	wconf.dfs = false
+	if err := channelUsable(w, wifi.HiBand, 52, 20); err == nil {
+		t.Errorf("DFS channel usable with DFS disabled")
+	}
+	if err := channelUsable(w, wifi.HiBand, 36, 80); err != nil {
+		t.Errorf("channel 36/80MHz unusable: %v", err)
+	}
+
+	wconf.dfs = true
+	if err := channelUsable(w, wifi.HiBand, 52, 80); err != nil {
+		t.Errorf("DFS channel unusable with DFS enabled: %v", err)
+	}
+	if !dfsRequired(w, 52, 80) || dfsRequired(w, 36, 80) {
+		t.Errorf("DFS requirements misidentified")
+	}
+
+	// Radar on 56 should block every channel that overlaps it
+	dfsState.nol[56] = time.Now().Add(time.Minute)
+	for _, c := range []struct {
+		channel, width int
+	}{{52, 80}, {56, 20}, {52, 40}} {
+		err := channelUsable(w, wifi.HiBand, c.channel, c.width)
+		if err == nil {
+			t.Errorf("%d/%dMHz usable during non-occupancy", c.channel,
+				c.width)
+		}
+	}
+	if err := channelUsable(w, wifi.HiBand, 60, 20); err != nil {
+		t.Errorf("channel 60 blocked by radar on 56: %v", err)
+	}
+
+	// Once the non-occupancy period has passed, the channel is available
+	dfsState.nol[56] = time.Now().Add(-time.Minute)
+	if err := channelUsable(w, wifi.HiBand, 56, 20); err != nil {
+		t.Errorf("channel 56 blocked after non-occupancy: %v", err)
+	}
+	wconf.dfs = false
+}
+
+func TestChannelHysteresis(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	makeValidChannelMaps()
+	wconf.dfs = false
+
+	old := testWifiInfo()
+	old.activeChannel = 36
+	old.activeWidth = 20
+
+	new := testWifiInfo()
+	new.activeChannel = 149
+	new.activeWidth = 20
+
+	tests := []struct {
+		congestion map[int]int
+		move       bool
+	}{
+		{map[int]int{36: 50}, true},           // a clear improvement
+		{map[int]int{36: 50, 149: 35}, false}, // not enough gain
+		{map[int]int{36: 15}, false},          // not enough to matter
+		{map[int]int{149: 50}, false},         // worse
+	}
+
+	for _, tc := range tests {
+		setCongestion(tc.congestion)
+		if move := worthMoving(old, new); move != tc.move {
+			t.Errorf("%v: worthMoving() = %v, expected %v",
+				tc.congestion, move, tc.move)
+		}
+	}
+
+	// A quiet DFS channel has to overcome the DFS penalty
+	wconf.dfs = true
+	new.activeChannel = 52
+	setCongestion(map[int]int{36: 50})
+	if worthMoving(old, new) {
+		t.Errorf("moved to DFS channel for small gain")
+	}
+	wconf.dfs = false
+}
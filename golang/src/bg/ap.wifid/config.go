@@ -115,7 +115,7 @@ func configClientChanged(path []string, val string, expires *time.Time) {
 
 		if reload {
 			hostapd.reload()
-			hostapd.disassociate(hwaddr)
+			hostapd.disassociate(hwaddr, path[2]+" changed")
 			if val == base_def.RING_QUARANTINE {
 				publiclog.SendLogDeviceQuarantine(brokerd, hwaddr)
 			}
@@ -203,9 +203,44 @@ func configNetworkChanged(path []string, val string, expires *time.Time) {
 			reload = true
 		}
 	}
-	if len(path) == 4 && path[1] == "vap" {
+	if len(path) == 2 && path[1] == "ft_key" && wconf.ftKey != val {
+		slog.Infof("ft_key changed")
+		wconf.ftKey = val
 		reload = true
 	}
+	if len(path) >= 4 && path[1] == "vap" {
+		reload = true
+	}
+	if len(path) >= 3 && path[1] == "radius" && refreshRadiusConfig() {
+		reload = true
+	}
+	if len(path) == 2 && path[1] == "dfs" {
+		dfs := (val == "true")
+		if wconf.dfs != dfs {
+			slog.Infof("dfs changed to %v", dfs)
+			wconf.dfs = dfs
+			wifiEvaluate = true
+			hostapd.reset()
+		}
+	}
+	if len(path) == 2 && path[1] == "channel_planner" {
+		planner := (val == "true")
+		if wconf.planner != planner {
+			slog.Infof("channel_planner changed to %v", planner)
+			wconf.planner = planner
+
+			// Reevaluate the channels at the next opportunity.
+			// If the planner is being disabled, the radios are
+			// freed to choose their own channels.
+			nextChanEval = time.Now()
+			if !planner && !satellite {
+				go releaseChannels()
+			}
+		}
+	}
+	if len(path) == 2 && path[1] == "timezone" {
+		go hostapd.evaluateSchedules(false)
+	}
 
 	if reload {
 		wifiEvaluate = true
@@ -0,0 +1,184 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Support for Dynamic Frequency Selection.  Most of the 5GHz band is shared
+// with radar systems, so an AP may only use those channels if it listens for
+// radar before (the Channel Availability Check) and while using them.  hostapd
+// does the listening, and reports its results on the control socket:
+//
+//    DFS-CAC-START freq=5260 chan=52 sec_chan=1, width=1, seg0=58, ...
+//    DFS-CAC-COMPLETED success=1 freq=5260 ht_enabled=1 chan_offset=1 ...
+//    DFS-RADAR-DETECTED freq=5260 ht_enabled=1 chan_offset=1 ...
+//    DFS-NEW-CHANNEL freq=5180 chan=36 sec_chan=1
+//
+// When radar is detected, the channel may not be used again until its
+// non-occupancy period has passed.  hostapd will usually move to a new channel
+// on its own.  If it doesn't, we restart it on a fallback channel.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/common/wifi"
+)
+
+const (
+	nonOccupancyPeriod = 30 * time.Minute
+	radarFallbackDelay = 5 * time.Second
+)
+
+var dfsState = struct {
+	nol     map[int]time.Time // channel -> end of non-occupancy period
+	cac     map[string]bool   // devices performing a CAC
+	pending map[string]bool   // devices awaiting a radar fallback
+	sync.Mutex
+}{
+	nol:     make(map[int]time.Time),
+	cac:     make(map[string]bool),
+	pending: make(map[string]bool),
+}
+
+// Does any part of this channel require radar detection?
+func dfsRequired(w *wifiInfo, channel, width int) bool {
+	for _, c := range wifi.SpanChannels(channel, width) {
+		if w.cap.RadarChannels[c] {
+			return true
+		}
+	}
+	return false
+}
+
+// Is any part of this channel in its non-occupancy period?
+func radarBlocked(channel, width int) bool {
+	now := time.Now()
+
+	dfsState.Lock()
+	defer dfsState.Unlock()
+
+	for _, c := range wifi.SpanChannels(channel, width) {
+		if until, ok := dfsState.nol[c]; ok {
+			if now.Before(until) {
+				return true
+			}
+			delete(dfsState.nol, c)
+		}
+	}
+	return false
+}
+
+// Is this device performing a Channel Availability Check?
+func cacActive(d *physDevice) bool {
+	dfsState.Lock()
+	defer dfsState.Unlock()
+
+	return dfsState.cac[d.name]
+}
+
+// Extract the integer value of a 'key=value' field from a DFS event
+func dfsField(status, key string) int {
+	for _, f := range strings.Fields(status) {
+		f = strings.TrimSuffix(f, ",")
+		if strings.HasPrefix(f, key+"=") {
+			v, _ := strconv.Atoi(strings.TrimPrefix(f, key+"="))
+			return v
+		}
+	}
+	return 0
+}
+
+// If hostapd hasn't moved off of a channel on which radar was detected, restart
+// it on a fallback channel.
+func radarFallback(d *physDevice) {
+	dfsState.Lock()
+	pending := dfsState.pending[d.name]
+	delete(dfsState.pending, d.name)
+	dfsState.Unlock()
+
+	if pending {
+		slog.Infof("%s: moving to a fallback channel", d.name)
+		wifiEvaluate = true
+		hostapd.reset()
+	}
+}
+
+func radarDetected(d *physDevice, status string) {
+	w := d.wifi
+
+	slog.Warnf("%s: radar detected on channel %d (freq %d)", d.name,
+		w.activeChannel, dfsField(status, "freq"))
+
+	until := time.Now().Add(nonOccupancyPeriod)
+	dfsState.Lock()
+	for _, c := range wifi.SpanChannels(w.activeChannel, w.activeWidth) {
+		dfsState.nol[c] = until
+	}
+	dfsState.pending[d.name] = true
+	delete(dfsState.cac, d.name)
+	dfsState.Unlock()
+
+	time.AfterFunc(radarFallbackDelay, func() { radarFallback(d) })
+}
+
+// hostapd has switched channels on its own, following a radar event
+func dfsNewChannel(d *physDevice, status string) {
+	channel := dfsField(status, "chan")
+
+	slog.Infof("%s: hostapd moved from channel %d to %d", d.name,
+		d.wifi.activeChannel, channel)
+
+	dfsState.Lock()
+	delete(dfsState.pending, d.name)
+	dfsState.Unlock()
+
+	if channel != 0 {
+		d.wifi.activeChannel = channel
+		go wifiDeviceToConfig(d)
+	}
+}
+
+// Handle one of the DFS-* events.  This is called with the connection lock
+// held, so it must not issue any hostapd commands.
+func (c *hostapdConn) dfsEvent(status string) {
+	d := c.device
+	f := strings.Fields(status)
+
+	switch f[0] {
+	case "DFS-CAC-START":
+		slog.Infof("%s: starting channel availability check on %d "+
+			"(%s)", d.name, dfsField(status, "chan"), status)
+		dfsState.Lock()
+		dfsState.cac[d.name] = true
+		dfsState.Unlock()
+
+	case "DFS-CAC-COMPLETED":
+		dfsState.Lock()
+		delete(dfsState.cac, d.name)
+		dfsState.Unlock()
+
+		if dfsField(status, "success") == 1 {
+			slog.Infof("%s: channel availability check passed",
+				d.name)
+		} else {
+			radarDetected(d, status)
+		}
+
+	case "DFS-RADAR-DETECTED":
+		radarDetected(d, status)
+
+	case "DFS-NEW-CHANNEL":
+		dfsNewChannel(d, status)
+
+	default:
+		slog.Debugf("%v: %s", c, status)
+	}
+}
@@ -0,0 +1,382 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Support for authenticating wpa-eap clients against a site's own RADIUS
+// servers, rather than the local user database.  A VAP opts in by setting
+// @/network/vap/<name>/external_radius.  The servers are shared by all such
+// VAPs:
+//
+//    @/network/radius/server/<n>/address     server's IP address
+//    @/network/radius/server/<n>/auth_port   authentication port (1812)
+//    @/network/radius/server/<n>/acct_port   accounting port (1813)
+//    @/network/radius/server/<n>/secret      shared secret
+//
+// hostapd tries the servers in the order they are listed, so the server with
+// the lowest index is the primary and the rest are fallbacks.
+//
+// The server may assign a client to a VLAN using the Tunnel-Private-Group-ID
+// attribute of its Access-Accept.  Each VLAN is mapped to one of our rings:
+//
+//    @/network/radius/vlan/<vlan>            ring for clients on <vlan>
+//
+// A VLAN matching one of our rings' VLANs needs no entry.  hostapd bridges a
+// client on a mapped VLAN into its ring's bridge, and we report the ring to
+// configd once the client has been authenticated.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"bg/common/cfgapi"
+)
+
+const (
+	radiusAuthPort = 1812
+	radiusAcctPort = 1813
+
+	radiusProbeTimeout = 3 * time.Second
+
+	// RADIUS packet codes and attributes used by the Status-Server probe
+	radiusAccessAccept = 2
+	radiusStatusServer = 12
+	radiusAttrMsgAuth  = 80
+	radiusHdrLen       = 20
+)
+
+type radiusServer struct {
+	Address  string
+	AuthPort int
+	AcctPort int // 0 -> no accounting
+	Secret   string
+}
+
+func (s *radiusServer) String() string {
+	return net.JoinHostPort(s.Address, strconv.Itoa(s.AuthPort))
+}
+
+var staVlanRE = regexp.MustCompile(`(?m)^vlan_id=(\d+)`)
+
+// Extract the external RADIUS servers and the VLAN->ring map from the
+// @/network/radius subtree.
+func getRadiusConfig(props *cfgapi.PropertyNode) ([]radiusServer,
+	map[int]string) {
+
+	servers := make([]radiusServer, 0)
+	vlans := make(map[int]string)
+	if props == nil {
+		return servers, vlans
+	}
+
+	if node, ok := props.Children["server"]; ok {
+		idx := make([]int, 0)
+		for name := range node.Children {
+			if i, err := strconv.Atoi(name); err == nil {
+				idx = append(idx, i)
+			}
+		}
+		sort.Ints(idx)
+
+		for _, i := range idx {
+			s := node.Children[strconv.Itoa(i)]
+			server := radiusServer{
+				AuthPort: radiusAuthPort,
+				AcctPort: radiusAcctPort,
+			}
+			server.Address, _ = s.GetChildString("address")
+			server.Secret, _ = s.GetChildString("secret")
+			if server.Address == "" || server.Secret == "" {
+				slog.Warnf("radius server %d: missing address "+
+					"or secret", i)
+				continue
+			}
+			if p, err := s.GetChildInt("auth_port"); err == nil {
+				server.AuthPort = p
+			}
+			if p, err := s.GetChildInt("acct_port"); err == nil {
+				server.AcctPort = p
+			}
+			servers = append(servers, server)
+		}
+	}
+
+	if node, ok := props.Children["vlan"]; ok {
+		for name, ring := range node.Children {
+			vlan, err := strconv.Atoi(name)
+			if err != nil || vlan <= 0 || vlan >= 4095 {
+				slog.Warnf("radius vlan map: bad vlan %s", name)
+			} else if !cfgapi.ValidRings[ring.Value] {
+				slog.Warnf("radius vlan map: bad ring %s for "+
+					"vlan %d", ring.Value, vlan)
+			} else {
+				vlans[vlan] = ring.Value
+			}
+		}
+	}
+
+	return servers, vlans
+}
+
+// Re-read the external RADIUS settings after something in @/network/radius
+// has changed.  Returns true if hostapd's configuration needs to be rebuilt.
+func refreshRadiusConfig() bool {
+	props, _ := config.GetProps("@/network/radius")
+	servers, vlans := getRadiusConfig(props)
+
+	changed := len(servers) != len(wconf.radiusServers) ||
+		len(vlans) != len(wconf.radiusVlans)
+	for i := 0; !changed && i < len(servers); i++ {
+		changed = servers[i] != wconf.radiusServers[i]
+	}
+	for vlan, ring := range vlans {
+		changed = changed || wconf.radiusVlans[vlan] != ring
+	}
+
+	if changed {
+		slog.Infof("external radius config changed: %d servers, "+
+			"%d mapped vlans", len(servers), len(vlans))
+		wconf.radiusServers = servers
+		wconf.radiusVlans = vlans
+		if externalRadiusInUse() {
+			go checkRadiusServers(servers)
+		}
+	}
+	return changed
+}
+
+// Choose the servers a VAP's wpa-eap clients will be authenticated by.  local
+// is the address of the gateway's built-in RADIUS server.
+func (v *vapConfig) setRadius(vap *cfgapi.VirtualAP, local string) error {
+	v.DynamicVlan = 0
+	if v.EapComment != "" {
+		return nil
+	}
+
+	if vap.ExternalRADIUS {
+		if len(wconf.radiusServers) == 0 {
+			return fmt.Errorf("no external radius servers defined")
+		}
+		v.RadiusServers = wconf.radiusServers
+
+		// Use the VLAN assigned by the server if there is one,
+		// falling back to the client's ring otherwise.
+		v.DynamicVlan = 1
+		return nil
+	}
+
+	if wconf.radiusSecret == "" {
+		return fmt.Errorf("radius secret undefined")
+	}
+	v.RadiusServers = []radiusServer{
+		{
+			Address:  local,
+			AuthPort: radiusAuthPort,
+			Secret:   wconf.radiusSecret,
+		},
+	}
+	return nil
+}
+
+// Return the ring a RADIUS-assigned VLAN places a client on, or "" if the VLAN
+// isn't one we recognize.
+func radiusVlanRing(vlan int) string {
+	if ring, ok := wconf.radiusVlans[vlan]; ok {
+		return ring
+	}
+	for name, ring := range rings {
+		if ring.Vlan == vlan {
+			return name
+		}
+	}
+	return ""
+}
+
+// Determine which of the mapped RADIUS VLANs can be used on a VAP, given the
+// ring VLANs already on it.  The result maps each RADIUS VLAN to the bridge it
+// should be attached to.
+func radiusVlanBridges(vapName string, vapVlans map[string]int) map[int]string {
+	inUse := make(map[int]string)
+	for ring, vlan := range vapVlans {
+		inUse[vlan] = ring
+	}
+
+	bridges := make(map[int]string)
+	for vlan, ring := range wconf.radiusVlans {
+		if _, ok := vapVlans[ring]; !ok {
+			slog.Warnf("VAP %s: radius vlan %d maps to ring %s, "+
+				"which isn't on this VAP", vapName, vlan, ring)
+			continue
+		}
+		if other, ok := inUse[vlan]; ok {
+			if other != ring {
+				slog.Warnf("VAP %s: radius vlan %d conflicts "+
+					"with ring %s", vapName, vlan, other)
+			}
+			continue
+		}
+		if r := rings[ring]; r != nil && r.Bridge != "" {
+			bridges[vlan] = r.Bridge
+		}
+	}
+
+	return bridges
+}
+
+// A client on a VAP using external RADIUS has been authenticated.  Find out
+// which VLAN the server placed it on, and report the corresponding ring.
+func (c *hostapdConn) externalAuth(sta string) {
+	status, err := c.command("STA " + sta)
+	if err != nil {
+		slog.Warnf("%v: failed to get status for %s: %v", c, sta, err)
+		return
+	}
+
+	m := staVlanRE.FindStringSubmatch(status)
+	if len(m) < 2 {
+		// No VLAN assigned, so the client stays on its current ring
+		return
+	}
+	vlan, _ := strconv.Atoi(m[1])
+	if vlan == 0 {
+		return
+	}
+
+	ring := radiusVlanRing(vlan)
+	if ring == "" {
+		slog.Warnf("%v: %s assigned unmapped radius vlan %d", c, sta,
+			vlan)
+		return
+	}
+
+	slog.Infof("%v externalAuth(%s) vlan=%d ring=%s", c, sta, vlan, ring)
+	sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, &ring, nil, false)
+}
+
+// Build an RFC 5997 Status-Server request
+func radiusStatusRequest(id byte, secret string) []byte {
+	pkt := make([]byte, radiusHdrLen+18)
+	pkt[0] = radiusStatusServer
+	pkt[1] = id
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+	rand.Read(pkt[4:radiusHdrLen])
+
+	// The Message-Authenticator is an HMAC of the whole packet, computed
+	// while the attribute's own value is zeroed.
+	attr := pkt[radiusHdrLen:]
+	attr[0] = radiusAttrMsgAuth
+	attr[1] = 18
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(pkt)
+	copy(attr[2:], mac.Sum(nil))
+
+	return pkt
+}
+
+// Verify the response to a Status-Server request.  The response authenticator
+// proves the server shares our secret.
+func radiusCheckResponse(req, resp []byte, secret string) error {
+	if len(resp) < radiusHdrLen {
+		return fmt.Errorf("short response")
+	}
+	l := int(binary.BigEndian.Uint16(resp[2:4]))
+	if l < radiusHdrLen || l > len(resp) {
+		return fmt.Errorf("bad response length %d", l)
+	}
+	resp = resp[:l]
+
+	if resp[1] != req[1] {
+		return fmt.Errorf("response id mismatch")
+	}
+
+	h := md5.New()
+	h.Write(resp[:4])
+	h.Write(req[4:radiusHdrLen])
+	h.Write(resp[radiusHdrLen:])
+	h.Write([]byte(secret))
+	if !hmac.Equal(h.Sum(nil), resp[4:radiusHdrLen]) {
+		return fmt.Errorf("bad response authenticator - " +
+			"shared secret mismatch?")
+	}
+
+	if resp[0] != radiusAccessAccept {
+		return fmt.Errorf("unexpected response code %d", resp[0])
+	}
+	return nil
+}
+
+// Send a Status-Server request to a RADIUS server to confirm that it is
+// reachable and that we agree on the shared secret.
+func radiusProbe(s radiusServer, timeout time.Duration) error {
+	conn, err := net.DialTimeout("udp", s.String(), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var id [1]byte
+	rand.Read(id[:])
+	req := radiusStatusRequest(id[0], s.Secret)
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 4096)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return err
+	}
+
+	return radiusCheckResponse(req, resp[:n], s.Secret)
+}
+
+// Check each of the configured servers, so problems show up in the log before
+// clients start failing to connect.  Not all servers answer Status-Server
+// requests, so a silent server is not necessarily a broken one.
+func checkRadiusServers(servers []radiusServer) {
+	for i, s := range servers {
+		role := "primary"
+		if i > 0 {
+			role = "secondary"
+		}
+
+		err := radiusProbe(s, radiusProbeTimeout)
+		if err == nil {
+			slog.Infof("%s radius server %v is responding", role,
+				s.String())
+		} else if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			slog.Infof("%s radius server %v didn't answer "+
+				"Status-Server", role, s.String())
+		} else {
+			slog.Warnf("%s radius server %v: %v", role, s.String(),
+				err)
+		}
+	}
+}
+
+// Returns true if any of the VAPs is configured to use external RADIUS
+func externalRadiusInUse() bool {
+	for _, vap := range virtualAPs {
+		if vap.ExternalRADIUS && cfgapi.KeyMgmtUsesEAP(vap.KeyMgmt) {
+			return true
+		}
+	}
+	return false
+}
+
@@ -0,0 +1,285 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"bg/common/cfgapi"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func leaf(val string) *cfgapi.PropertyNode {
+	return &cfgapi.PropertyNode{Value: val}
+}
+
+func testRadiusProps() *cfgapi.PropertyNode {
+	return &cfgapi.PropertyNode{
+		Children: cfgapi.ChildMap{
+			"server": {
+				Children: cfgapi.ChildMap{
+					"10": {
+						Children: cfgapi.ChildMap{
+							"address": leaf("10.0.0.2"),
+							"secret":  leaf("backup"),
+						},
+					},
+					"2": {
+						Children: cfgapi.ChildMap{
+							"address":   leaf("10.0.0.1"),
+							"secret":    leaf("primary"),
+							"auth_port": leaf("11812"),
+							"acct_port": leaf("11813"),
+						},
+					},
+					"3": {
+						Children: cfgapi.ChildMap{
+							"address": leaf("10.0.0.3"),
+						},
+					},
+				},
+			},
+			"vlan": {
+				Children: cfgapi.ChildMap{
+					"100":  leaf("standard"),
+					"200":  leaf("devices"),
+					"300":  leaf("guest"),
+					"3":    leaf("standard"),
+					"5":    leaf("guest"),
+					"bad":  leaf("standard"),
+					"4000": leaf("nosuchring"),
+				},
+			},
+		},
+	}
+}
+
+func TestRadiusConfig(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	servers, vlans := getRadiusConfig(testRadiusProps())
+	if len(servers) != 2 {
+		t.Fatalf("expected 2 servers, got %d", len(servers))
+	}
+	if servers[0].Address != "10.0.0.1" || servers[0].AuthPort != 11812 ||
+		servers[0].AcctPort != 11813 {
+		t.Errorf("bad primary server: %+v", servers[0])
+	}
+	if servers[1].Address != "10.0.0.2" ||
+		servers[1].AuthPort != radiusAuthPort ||
+		servers[1].AcctPort != radiusAcctPort {
+		t.Errorf("bad secondary server: %+v", servers[1])
+	}
+	if len(vlans) != 5 || vlans[100] != "standard" {
+		t.Errorf("bad vlan map: %v", vlans)
+	}
+
+	wconf.radiusVlans = vlans
+	rings = cfgapi.RingMap{
+		"standard": {Vlan: 3, Bridge: "brvlan3"},
+		"devices":  {Vlan: 4, Bridge: "brvlan4"},
+		"guest":    {Vlan: 5, Bridge: "brvlan5"},
+	}
+
+	for vlan, ring := range map[int]string{
+		100: "standard",
+		4:   "devices",
+		5:   "guest",
+		999: "",
+	} {
+		if r := radiusVlanRing(vlan); r != ring {
+			t.Errorf("vlan %d: expected ring %q, got %q", vlan,
+				ring, r)
+		}
+	}
+
+	// Only standard and devices are on this VAP.  vlan 3 is already the
+	// standard ring's vlan, and vlan 5 would collide with the guest ring
+	// if it were on the VAP.
+	bridges := radiusVlanBridges("test", map[string]int{
+		"standard": 3,
+		"devices":  4,
+	})
+	expected := map[int]string{100: "brvlan3", 200: "brvlan4"}
+	if len(bridges) != len(expected) {
+		t.Errorf("expected bridges %v, got %v", expected, bridges)
+	}
+	for vlan, bridge := range expected {
+		if bridges[vlan] != bridge {
+			t.Errorf("vlan %d: expected %s, got %s", vlan, bridge,
+				bridges[vlan])
+		}
+	}
+}
+
+func TestRadiusTemplate(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	tplt, err := template.ParseFiles("virtualap.conf.got")
+	if err != nil {
+		t.Fatalf("virtualap.conf.got template parse failed: %v\n", err)
+	}
+
+	wconf.radiusSecret = "localsecret"
+	wconf.radiusServers, _ = getRadiusConfig(testRadiusProps())
+
+	for _, external := range []bool{false, true} {
+		vap := &cfgapi.VirtualAP{
+			SSID:           "test",
+			KeyMgmt:        "wpa-eap",
+			ExternalRADIUS: external,
+		}
+		conf := &vapConfig{
+			Name:     "test",
+			physical: loDev,
+			logical:  loDev,
+			vap:      vap,
+		}
+		if err = conf.setSecurity(vap, wpa2Caps); err != nil {
+			t.Fatalf("setSecurity failed: %v", err)
+		}
+		if err = conf.setRadius(vap, "127.0.0.1"); err != nil {
+			t.Fatalf("setRadius failed: %v", err)
+		}
+		conf.setRoaming(vap, "")
+
+		var b bytes.Buffer
+		if err = tplt.Execute(&b, conf); err != nil {
+			t.Fatalf("template execution failed: %v\n", err)
+		}
+		out := b.String()
+
+		var present, absent []string
+		if external {
+			present = []string{
+				"\nauth_server_addr=10.0.0.1\n" +
+					"auth_server_port=11812\n" +
+					"auth_server_shared_secret=primary\n" +
+					"acct_server_addr=10.0.0.1\n" +
+					"acct_server_port=11813\n" +
+					"acct_server_shared_secret=primary\n" +
+					"auth_server_addr=10.0.0.2\n",
+				"\nacct_server_port=1813\n",
+				"\ndynamic_vlan=1\n",
+			}
+			absent = []string{"server_addr=127.0.0.1", "localsecret"}
+		} else {
+			present = []string{
+				"\nauth_server_addr=127.0.0.1\n" +
+					"auth_server_port=1812\n" +
+					"auth_server_shared_secret=localsecret\n\n",
+				"\ndynamic_vlan=0\n",
+			}
+			absent = []string{"acct_server", "10.0.0.1"}
+		}
+		for _, p := range present {
+			if !strings.Contains(out, p) {
+				t.Errorf("external=%v: missing %q", external, p)
+			}
+		}
+		for _, a := range absent {
+			if strings.Contains(out, a) {
+				t.Errorf("external=%v: unexpected %q", external, a)
+			}
+		}
+	}
+
+	// An external VAP can't come up without any servers
+	wconf.radiusServers = nil
+	vap := &cfgapi.VirtualAP{KeyMgmt: "wpa-eap", ExternalRADIUS: true}
+	conf := &vapConfig{Name: "test", physical: loDev, vap: vap}
+	conf.setSecurity(vap, wpa2Caps)
+	if err = conf.setRadius(vap, "127.0.0.1"); err == nil {
+		t.Errorf("expected failure with no external servers")
+	}
+}
+
+// A minimal RADIUS server, which answers Status-Server requests the way
+// FreeRADIUS does.
+func radiusStandIn(t *testing.T, secret string) (*net.UDPConn, int) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			if n < radiusHdrLen || req[0] != radiusStatusServer {
+				continue
+			}
+
+			resp := make([]byte, radiusHdrLen)
+			resp[0] = radiusAccessAccept
+			resp[1] = req[1]
+			resp[3] = radiusHdrLen
+			h := md5.New()
+			h.Write(resp[:4])
+			h.Write(req[4:radiusHdrLen])
+			h.Write([]byte(secret))
+			copy(resp[4:], h.Sum(nil))
+			conn.WriteToUDP(resp, addr)
+		}
+	}()
+
+	return conn, conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestRadiusProbe(t *testing.T) {
+	conn, port := radiusStandIn(t, "s3cret")
+	defer conn.Close()
+
+	good := radiusServer{
+		Address:  "127.0.0.1",
+		AuthPort: port,
+		Secret:   "s3cret",
+	}
+	if err := radiusProbe(good, time.Second); err != nil {
+		t.Errorf("probe failed: %v", err)
+	}
+
+	bad := good
+	bad.Secret = "wrong"
+	if err := radiusProbe(bad, time.Second); err == nil {
+		t.Errorf("probe with wrong secret succeeded")
+	} else if !strings.Contains(err.Error(), "secret") {
+		t.Errorf("unexpected error with wrong secret: %v", err)
+	}
+
+	// Find a port with nobody listening
+	idle, _ := net.ListenUDP("udp", &net.UDPAddr{
+		IP: net.IPv4(127, 0, 0, 1),
+	})
+	silent := good
+	silent.AuthPort = idle.LocalAddr().(*net.UDPAddr).Port
+	idle.Close()
+	if err := radiusProbe(silent, 200*time.Millisecond); err == nil {
+		t.Errorf("probe of silent server succeeded")
+	}
+
+	if s := good.String(); s != "127.0.0.1:"+strconv.Itoa(port) {
+		t.Errorf("unexpected server name %s", s)
+	}
+}
@@ -51,20 +51,32 @@ type vapConfig struct {
 	physical *physDevice       // physical device hosting this virtual AP
 	logical  *physDevice       // logical device hosting this virtual AP
 
-	BSSID      string
-	SSID       string
-	Passphrase string
-	KeyMgmt    string
-	PskComment string // Used to disable wpa-psk in .conf template
-	EapComment string // Used to disable wpa-eap in .conf template
-	ConfPrefix string // Location of vlan and mac config files
+	BSSID          string
+	SSID           string
+	Passphrase     string
+	KeyMgmt        string // hostapd's wpa_key_mgmt setting
+	Pairwise       string // ciphers allowed for WPA pairwise keys
+	PMF            int    // 0: disabled, 1: optional, 2: required
+	PskComment     string // Used to disable wpa-psk in .conf template
+	EapComment     string // Used to disable wpa-eap in .conf template
+	SaeComment     string // Used to disable sae in .conf template
+	PskFileComment string // Used to disable per-client PSKs in .conf template
+	ClosedComment  string // Used to start a VAP outside its scheduled hours
+	RoamComment    string // Used to disable 802.11k/v/r in .conf template
+	MobilityDomain string // 802.11r mobility domain shared by all nodes
+	NasID          string // Identifies this BSS to other FT key holders
+	FTKey          string // Used to protect FT key exchanges
+	BTMComment     string // Used to disable 802.11v in .conf template
+	SteerComment   string // Used to disable probe suppression in template
+	SteerPeer      string // 5GHz interface hosting the same VAP
+	ConfPrefix     string // Location of vlan and mac config files
 
 	confFile string // Name of this NIC's hostapd.conf
 	status   error  // collect hostapd failures
+	closed   bool   // outside of its scheduled hours
 
-	RadiusAuthServer     string
-	RadiusAuthServerPort string
-	RadiusAuthSecret     string // RADIUS shared secret
+	RadiusServers []radiusServer // In the order hostapd should try them
+	DynamicVlan   int            // 1: use RADIUS-assigned VLANs
 }
 
 type devConfig struct {
@@ -84,6 +96,8 @@ type devConfig struct {
 	VHTWidthComment   string // Enable 802.11ac 80MHz channel
 	VHTChanWidth      int
 	VHTCenterFreqSeg0 int
+
+	TrackComment string // Enable station tracking for band steering
 }
 
 type hostapdCmd struct {
@@ -116,16 +130,25 @@ type hostapdConn struct {
 	hostapd     *hostapdHdl
 	device      *physDevice
 	name        string        // device name used by this bssid
+	bssid       string        // mac address of this bss
 	localName   string        // our end of the control socket
+	monName     string        // our end of the monitor socket
 	remoteName  string        // hostapd's end of the control socket
 	vapName     string        // virtual AP
 	wifiBand    string        // wifi mode type used by this bssid
 	conn        *net.UnixConn // unix-domain control socket to hostapd
+	monConn     *net.UnixConn // debug-level monitor socket to hostapd
 	liveCmd     *hostapdCmd   // the in-flight hostapd command
 	pendingCmds []*hostapdCmd // all queued commands
 
 	inStatus bool // currently collecting per-station status
 	stations map[string]*stationInfo
+	closed   bool // VAP is outside of its scheduled hours
+
+	attached    bool // receiving async status messages
+	probeEvents bool // status messages include probe requests
+
+	neighbors map[string]neighbor // other nodes' BSSes hosting this VAP
 
 	sync.Mutex
 }
@@ -133,6 +156,12 @@ type hostapdConn struct {
 type stationInfo struct {
 	lastSeen  time.Time
 	signature string
+
+	// Why the client is leaving, if known.  The reason code comes from a
+	// deauth/disassoc frame sent by the client.  The cause is set when we
+	// remove the client ourselves.
+	reason uint32
+	cause  string
 }
 
 // We have a single hostapd process, which may be managing multiple interfaces
@@ -153,27 +182,35 @@ func (c *hostapdConn) String() string {
 // Connect to the hostapd command socket for this interface and create a unix
 // domain socket for it to reply to.
 func (c *hostapdConn) connect() {
-	laddr := net.UnixAddr{Name: c.localName, Net: "unixgram"}
+	c.Lock()
+	c.conn = c.dial(c.localName)
+	c.Unlock()
+}
+
+// Wait for hostapd to create its end of the control socket, and connect to it
+// from a socket at localName.  Called with the connection lock held, which is
+// dropped while waiting.  Returns nil if the connection is stopped first.
+func (c *hostapdConn) dial(localName string) *net.UnixConn {
+	laddr := net.UnixAddr{Name: localName, Net: "unixgram"}
 	raddr := net.UnixAddr{Name: c.remoteName, Net: "unixgram"}
 
-	c.Lock()
 	for c.active {
 		// Wait for the child process to create its socket
 		if aputil.FileExists(c.remoteName) {
 			// If our socket still exists (either from a previous
 			// instance of ap.networkd or because we failed a prior
 			// Dial attempt), remove it now.
-			os.Remove(c.localName)
-			c.conn, _ = net.DialUnix("unixgram", &laddr, &raddr)
-			if c.conn != nil {
-				break
+			os.Remove(localName)
+			conn, _ := net.DialUnix("unixgram", &laddr, &raddr)
+			if conn != nil {
+				return conn
 			}
 		}
 		c.Unlock()
 		time.Sleep(100 * time.Millisecond)
 		c.Lock()
 	}
-	c.Unlock()
+	return nil
 }
 
 // This hostapd connection is going away, so flush all of the commands out of
@@ -240,7 +277,16 @@ func (c *hostapdConn) handleResult(result string) {
 	}
 }
 
-func sendNetEntity(mac string, username, vapName, bandName, sig *string, disconnect bool) {
+func sendNetEntity(mac string, username, vapName, bandName, ring, sig *string,
+	disconnect bool) {
+
+	publishNetEntity(newNetEntity(mac, username, vapName, bandName, ring,
+		sig, disconnect))
+}
+
+func newNetEntity(mac string, username, vapName, bandName, ring, sig *string,
+	disconnect bool) *base_msg.EventNetEntity {
+
 	band := "?"
 	if bandName != nil {
 		band = *bandName
@@ -257,9 +303,13 @@ func sendNetEntity(mac string, username, vapName, bandName, sig *string, disconn
 	if vapName != nil {
 		vap = *vapName
 	}
+	r := "?"
+	if ring != nil {
+		r = *ring
+	}
 
-	slog.Debugf("NetEntity(%s, user: %s vap: %s, band: %s, %s)", mac, user,
-		vap, band, action)
+	slog.Debugf("NetEntity(%s, user: %s vap: %s, band: %s, ring: %s, %s)",
+		mac, user, vap, band, r, action)
 	hwaddr, _ := net.ParseMAC(mac)
 	entity := &base_msg.EventNetEntity{
 		Timestamp:     aputil.NowToProtobuf(),
@@ -272,16 +322,21 @@ func sendNetEntity(mac string, username, vapName, bandName, sig *string, disconn
 		Disconnect:    &disconnect,
 		MacAddress:    proto.Uint64(network.HWAddrToUint64(hwaddr)),
 		Band:          bandName,
+		Ring:          ring,
 	}
 
+	return entity
+}
+
+func publishNetEntity(entity *base_msg.EventNetEntity) {
 	err := brokerd.Publish(entity, base_def.TOPIC_ENTITY)
 	if err != nil {
 		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_ENTITY, err)
 	}
 }
 
-func sendNetException(mac, username string, vapName *string,
-	reason *base_msg.EventNetException_Reason) {
+func sendNetException(mac, username string, vapName, bandName *string,
+	reason *base_msg.EventNetException_Reason, details ...string) {
 
 	vap := "?"
 	if vapName != nil {
@@ -296,8 +351,11 @@ func sendNetException(mac, username string, vapName *string,
 		Sender:     proto.String(brokerd.Name),
 		Debug:      proto.String("-"),
 		VirtualAP:  vapName,
+		Node:       &nodeID,
+		Band:       bandName,
 		Reason:     reason,
 		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+		Details:    details,
 	}
 	if username != "" {
 		entity.Username = proto.String(username)
@@ -309,7 +367,15 @@ func sendNetException(mac, username string, vapName *string,
 	}
 }
 
-var signalRE = regexp.MustCompile(`signal=(\S+)\s`)
+var (
+	signalRE = regexp.MustCompile(`signal=(\S+)\s`)
+
+	// hostapd reports deauth and disassoc frames from clients at debug
+	// level (sic):
+	//    deauthentication: STA=b8:27:eb:9f:d8:e0 reason_code=3
+	//    disassocation: STA=b8:27:eb:9f:d8:e0 reason_code=8
+	leavingRE = regexp.MustCompile(`STA=(\S+) reason_code=(\d+)`)
+)
 
 // Fetch a single station's status from hostapd.  Return the signal strength.
 func (c *hostapdConn) statusOne(sta string) (string, error) {
@@ -350,6 +416,8 @@ func (c *hostapdConn) statusAll() {
 	for _, sta := range stations {
 		if str, err := c.statusOne(sta); err == nil {
 			props["@/metrics/clients/"+sta+"/signal_str"] = str
+			signal, _ := strconv.Atoi(str)
+			c.checkSteering(sta, signal)
 		}
 	}
 	config.CreateProps(props, nil)
@@ -366,7 +434,7 @@ func (c *hostapdConn) getSignature(sta string) {
 	} else if info, ok := c.stations[sta]; ok {
 		if info.signature != sig {
 			info.signature = sig
-			sendNetEntity(sta, nil, &c.vapName, nil, &sig, false)
+			sendNetEntity(sta, nil, &c.vapName, nil, nil, &sig, false)
 		}
 	}
 }
@@ -376,7 +444,7 @@ func (c *hostapdConn) stationPresent(sta string, newConnection bool) {
 	slog.Infof("%v stationPresent(%s) new: %v", c, sta, newConnection)
 	info := c.stations[sta]
 	if info == nil {
-		sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, nil, false)
+		sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, nil, nil, false)
 		info = &stationInfo{}
 		c.stations[sta] = info
 	}
@@ -387,24 +455,105 @@ func (c *hostapdConn) stationPresent(sta string, newConnection bool) {
 		// from probe and association frames, hostapd will return an
 		// empty signature if you ask too quickly.  So, we wait a
 		// second.
-		time.AfterFunc(time.Second, func() { c.getSignature(sta) })
+		time.AfterFunc(time.Second, func() {
+			c.getSignature(sta)
+			c.reportSignal(sta)
+		})
 	} else {
 		go c.getSignature(sta)
 	}
 
 }
 
+// A client connected using one of the VAP's additional PSKs.  The key
+// determines the client's ring.  If that differs from the client's current
+// ring, configd will reassign it and we will bounce the client so it returns on
+// the right VLAN.
+func (c *hostapdConn) pskConnected(sta, keyid string) {
+	sta = strings.ToLower(sta)
+	vap := virtualAPs[c.vapName]
+	if vap == nil {
+		return
+	}
+
+	psk, ok := vap.PSKs[keyid]
+	if !ok {
+		slog.Warnf("%v: %s connected with unknown psk %s", c, sta, keyid)
+		return
+	}
+
+	// A quarantined client stays in quarantine, regardless of the key
+	clientsMtx.Lock()
+	client := clients[sta]
+	clientsMtx.Unlock()
+	if client != nil && client.Ring == base_def.RING_QUARANTINE {
+		slog.Infof("%v pskConnected(%s) key=%s: quarantined", c, sta,
+			keyid)
+		return
+	}
+
+	slog.Infof("%v pskConnected(%s) key=%s ring=%s", c, sta, keyid,
+		psk.Ring)
+	ring := psk.Ring
+	sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, &ring, nil, false)
+}
+
 func (c *hostapdConn) stationGone(sta string) {
 	slog.Infof("%v stationGone(%s)", c, sta)
+	publishNetEntity(c.departure(sta))
+}
+
+// Build the disconnect event for a departing client, and forget about it
+func (c *hostapdConn) departure(sta string) *base_msg.EventNetEntity {
+	sta = strings.ToLower(sta)
+	entity := newNetEntity(sta, nil, &c.vapName, &c.wifiBand, nil, nil,
+		true)
+	if info := c.stations[sta]; info != nil {
+		if info.reason != 0 {
+			entity.DisconnectReason = proto.Uint32(info.reason)
+		}
+		if info.cause != "" {
+			entity.DisconnectCause = proto.String(info.cause)
+		}
+	}
 	delete(c.stations, sta)
-	sendNetEntity(sta, nil, &c.vapName, &c.wifiBand, nil, true)
+	return entity
+}
+
+// The client told us why it is leaving.  The frame may also have been forged,
+// so it is counted whether or not the client is one of ours.
+func (c *hostapdConn) stationLeaving(status string) {
+	m := leavingRE.FindStringSubmatch(status)
+	if len(m) < 3 {
+		return
+	}
+
+	sta := strings.ToLower(m[1])
+	code, _ := strconv.Atoi(m[2])
+	if info := c.stations[sta]; info != nil {
+		info.reason = uint32(code)
+	}
+	c.deauthSeen(sta, time.Now())
+}
+
+// After a client connects, report the signal strength at which it arrived.
+func (c *hostapdConn) reportSignal(sta string) {
+	str, err := c.statusOne(sta)
+	if err != nil || str == "" {
+		return
+	}
+
+	signal, _ := strconv.Atoi(str)
+	entity := newNetEntity(sta, nil, &c.vapName, nil, nil, nil, false)
+	entity.Signal = proto.Int32(int32(signal))
+	publishNetEntity(entity)
 }
 
 func (c *hostapdConn) stationRetransmit(sta string) {
 	reason := base_msg.EventNetException_CLIENT_RETRANSMIT
 
 	slog.Infof("%v stationRetransmit(%s)", c, sta)
-	sendNetException(sta, "", &c.vapName, &reason)
+	sendNetException(sta, "", &c.vapName, &c.wifiBand, &reason)
 }
 
 func (c *hostapdConn) eapSuccess(sta, username string) {
@@ -426,28 +575,47 @@ func (c *hostapdConn) eapSuccess(sta, username string) {
 
 	slog.Infof("%v eapSuccess(%s) user=%s", c, sta, username)
 
-	sendNetEntity(sta, user, &c.vapName, &c.wifiBand, nil, false)
+	sendNetEntity(sta, user, &c.vapName, &c.wifiBand, nil, nil, false)
 	publiclog.SendLogLoginEAPSuccess(brokerd, sta, username)
+
+	// The server may have assigned the client a VLAN, which won't be
+	// applied until the handshake completes.
+	if vap := virtualAPs[c.vapName]; vap != nil && vap.ExternalRADIUS {
+		time.AfterFunc(time.Second, func() { c.externalAuth(sta) })
+	}
 }
 
-func (c *hostapdConn) stationBadPassword(sta, username string) {
+func (c *hostapdConn) stationBadPassword(sta, username, detail string) {
 	reason := base_msg.EventNetException_BAD_PASSWORD
 
 	slog.Infof("%v stationBadPassword(%s) user=%s", c, sta, username)
 
-	sendNetException(sta, username, &c.vapName, &reason)
+	sendNetException(sta, username, &c.vapName, &c.wifiBand, &reason,
+		detail)
 	publiclog.SendLogLoginRepeatedFailure(brokerd, sta, username)
 }
 
-func (c *hostapdConn) deauthSta(sta string) {
+// Record why we are about to remove a client, so it can be included in the
+// disconnect event.
+func (c *hostapdConn) setCause(sta, cause string) {
+	c.Lock()
+	if info := c.stations[sta]; info != nil {
+		info.cause = cause
+	}
+	c.Unlock()
+}
+
+func (c *hostapdConn) deauthSta(sta, cause string) {
 	sta = strings.ToLower(sta)
-	slog.Infof("%v deauthenticating(%s)", c, sta)
+	slog.Infof("%v deauthenticating(%s): %s", c, sta, cause)
+	c.setCause(sta, cause)
 	c.command("DEAUTHENTICATE " + sta)
 }
 
-func (c *hostapdConn) disassociate(sta string) {
+func (c *hostapdConn) disassociate(sta, cause string) {
 	sta = strings.ToLower(sta)
-	slog.Infof("%v disassociating(%s)", c, sta)
+	slog.Infof("%v disassociating(%s): %s", c, sta, cause)
+	c.setCause(sta, cause)
 	c.command("DISASSOCIATE " + sta)
 }
 
@@ -528,7 +696,7 @@ func (c *hostapdConn) eapRetransmit(mac string) {
 	} else if state.count >= *retransmitSoftLimit {
 		slog.Warnf("%d retransmits for %s since %s - kicking",
 			state.count, mac, state.first.Format(time.RFC3339))
-		go c.deauthSta(mac)
+		go c.deauthSta(mac, "eap retransmits")
 	}
 }
 
@@ -537,13 +705,15 @@ func (c *hostapdConn) handleStatus(status string) {
 	const (
 		// We're looking for one of the following messages:
 		//    AP-STA-CONNECTED b8:27:eb:9f:d8:e0     (client arrived)
-		//    AP-STA-DISCONNECTED b8:27:eb:9f:d8:e0  (client left)
+		//    AP-STA-CONNECTED b8:27:eb:9f:d8:e0 [key=value ...]
+		//                     (keyid=iot if using a PSK)
 		//    AP-STA-POLL-OK b8:27:eb:9f:d8:e0       (client still here)
 		//    AP-STA-POSSIBLE-PSK-MISMATCH b8:27:eb:9f:d8:e0  (bad password)
 		//    CTRL-EVENT-EAP-SUCCESS2 b8:27:eb:9f:d8:e0 [username] (success)
 		//    CTRL-EVENT-EAP-FAILURE2 b8:27:eb:9f:d8:e0 [username] (bad password)
 		//    CTRL-EVENT-EAP-RETRANSMIT b8:27:eb:9f:d8:e0 (possibly T268)
-		msgs = "(AP-STA-CONNECTED|AP-STA-DISCONNECTED|" +
+		// Departures are handled by monitorStatus().
+		msgs = "(AP-STA-CONNECTED|" +
 			"AP-STA-POLL-OK|AP-STA-POSSIBLE-PSK-MISMATCH|" +
 			"CTRL-EVENT-EAP-SUCCESS2|CTRL-EVENT-EAP-FAILURE2|" +
 			"CTRL-EVENT-EAP-RETRANSMIT|CTRL-EVENT-EAP-RETRANSMIT2)"
@@ -554,6 +724,17 @@ func (c *hostapdConn) handleStatus(status string) {
 		username = " ?(.*)$"
 	)
 
+	if strings.HasPrefix(status, "DFS-") {
+		c.dfsEvent(status)
+		return
+	}
+
+	// Probe requests are reported on 5GHz, for band steering
+	if strings.HasPrefix(status, "RX-PROBE-REQUEST ") {
+		c.probeReceived(status)
+		return
+	}
+
 	re := regexp.MustCompile(msgs + " " + macAddr + username)
 	m := re.FindStringSubmatch(status)
 	if len(m) >= 3 {
@@ -568,27 +749,53 @@ func (c *hostapdConn) handleStatus(status string) {
 		switch msg {
 		case "AP-STA-CONNECTED":
 			c.stationPresent(mac, true)
+			for _, field := range strings.Fields(username) {
+				if strings.HasPrefix(field, "keyid=") {
+					c.pskConnected(mac,
+						strings.TrimPrefix(field, "keyid="))
+				}
+			}
 		case "AP-STA-POLL-OK":
 			c.stationPresent(mac, false)
-		case "AP-STA-DISCONNECTED":
-			c.stationGone(mac)
 		case "CTRL-EVENT-EAP-SUCCESS2":
 			c.eapSuccess(mac, username)
-		case "AP-STA-POSSIBLE-PSK-MISMATCH", "CTRL-EVENT-EAP-FAILURE2":
-			c.stationBadPassword(mac, username)
+		case "AP-STA-POSSIBLE-PSK-MISMATCH":
+			c.stationBadPassword(mac, username, "psk mismatch")
+		case "CTRL-EVENT-EAP-FAILURE2":
+			c.stationBadPassword(mac, username, "eap failure")
 		case "CTRL-EVENT-EAP-RETRANSMIT", "CTRL-EVENT-EAP-RETRANSMIT2":
 			c.eapRetransmit(mac)
 		}
 	}
 }
 
-// close the socket, which will interrupt any pending read/write.
+// Handle an async status message from the monitor socket
+func (c *hostapdConn) monitorStatus(status string) {
+	// We're looking for the following messages:
+	//    deauthentication: STA=b8:27:eb:9f:d8:e0 reason_code=3
+	//    disassocation: STA=b8:27:eb:9f:d8:e0 reason_code=8
+	//    AP-STA-DISCONNECTED b8:27:eb:9f:d8:e0  (client left)
+	if strings.HasPrefix(status, "deauthentication: ") ||
+		strings.HasPrefix(status, "disassocation: ") {
+		c.stationLeaving(status)
+
+	} else if strings.HasPrefix(status, "AP-STA-DISCONNECTED ") {
+		if f := strings.Fields(status); len(f) >= 2 {
+			c.stationGone(f[1])
+		}
+	}
+}
+
+// close the sockets, which will interrupt any pending read/write.
 func (c *hostapdConn) stop() {
 	c.Lock()
 	c.active = false
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	if c.monConn != nil {
+		c.monConn.Close()
+	}
 	c.Unlock()
 }
 
@@ -600,6 +807,11 @@ func (c *hostapdConn) checkIn(exit chan bool) {
 	statusTick := time.NewTicker(time.Second * 10)
 	defer statusTick.Stop()
 
+	// Neighbor reports are refreshed from the node inventory periodically,
+	// starting shortly after hostapd comes up.
+	neighborTimer := time.NewTimer(time.Second * 15)
+	defer neighborTimer.Stop()
+
 	for {
 		select {
 		case <-exit:
@@ -608,13 +820,91 @@ func (c *hostapdConn) checkIn(exit chan bool) {
 			c.command("PING")
 		case <-statusTick.C:
 			c.statusAll()
+		case <-neighborTimer.C:
+			c.updateNeighbors()
+			neighborTimer.Reset(time.Minute)
+		}
+	}
+}
+
+// Ask hostapd to send us async status messages.  With band steering enabled,
+// we also need to hear about probes on 5GHz to identify dual-band clients.  If
+// that setting has changed since we last attached, we reattach.
+func (c *hostapdConn) attach() {
+	vap := virtualAPs[c.vapName]
+	probes := vap != nil && vap.BandSteering && c.wifiBand == wifi.HiBand
+
+	c.Lock()
+	attached, hadProbes := c.attached, c.probeEvents
+	c.attached = true
+	c.probeEvents = probes
+	c.Unlock()
+
+	if attached {
+		if hadProbes == probes {
+			return
+		}
+		c.command("DETACH")
+	}
+
+	cmd := "ATTACH"
+	if probes {
+		cmd += " probe_rx_events=1"
+	}
+	if _, err := c.command(cmd); err != nil {
+		slog.Warnf("%v failed to attach: %v", c, err)
+	}
+}
+
+// hostapd only reports the deauth and disassoc frames sent by clients, which
+// carry the reason they are leaving, at debug level.  Lowering the level of our
+// control socket would bury it in debug chatter, so we open a second socket at
+// debug level and discard everything else that arrives on it.  A client's frame
+// is reported just ahead of its AP-STA-DISCONNECTED event, so we handle
+// departures on this socket too, to keep the two in order.
+func (c *hostapdConn) runMonitor(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	c.Lock()
+	c.monConn = c.dial(c.monName)
+	conn := c.monConn
+	c.Unlock()
+	if conn == nil {
+		return
+	}
+
+	for _, cmd := range []string{"ATTACH", "LEVEL 2"} {
+		if _, err := conn.Write([]byte(cmd)); err != nil {
+			slog.Warnf("%v failed to set up monitor: %v", c, err)
+			return
+		}
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf[:])
+		if err != nil {
+			c.Lock()
+			if c.active {
+				slog.Warnf("%v monitor read error: %v", c, err)
+			}
+			c.Unlock()
+			return
+		}
+
+		// Replies to our commands don't start with <#>, and can be
+		// ignored.
+		if n > 3 && buf[0] == '<' {
+			c.Lock()
+			c.monitorStatus(string(buf[3:n]))
+			c.Unlock()
 		}
 	}
 }
 
 func (c *hostapdConn) run(wg *sync.WaitGroup) {
 
-	go c.command("ATTACH")
+	go c.attach()
 	c.connect()
 
 	stopCheckins := make(chan bool, 1)
@@ -736,10 +1026,10 @@ func getHTCaps(w *wifiInfo) string {
 		// With a 40MHz channel, we can support a secondary
 		// 20MHz channel either above or below the primary,
 		// depending on what the primary channel is.
-		if nModePrimaryAbove[w.activeChannel] {
+		if wifi.HT40Above[w.activeChannel] {
 			rval += "[HT40+]"
 		}
-		if nModePrimaryBelow[w.activeChannel] {
+		if wifi.HT40Below[w.activeChannel] {
 			rval += "[HT40-]"
 		}
 		if htcaps[wificaps.HTCAP_HT40_SGI] {
@@ -831,15 +1121,9 @@ func getDevConfig(d *physDevice) *devConfig {
 			chanWidth = 1
 			centerFreq = w.activeChannel + 6
 		}
-		if d.wifi.activeChannel > 36 && d.wifi.activeChannel < 149 {
-			// XXX: it looks like DFS is only needed for frequencies
-			// associated with channels between 50 and 144.  Because
-			// of the way the AC channels are laid out, that
-			// effectively includes all channels above 36 and below
-			// 149.  All of this should really be vetted by somebody
-			// more qualified.
-			dfsComment = ""
-		}
+	}
+	if dfsRequired(w, w.activeChannel, w.activeWidth) {
+		dfsComment = ""
 	}
 	if w.cap.WifiModes["n"] {
 		modeNComment = ""
@@ -862,6 +1146,18 @@ func getDevConfig(d *physDevice) *devConfig {
 		VHTWidthComment:   vhtWidthComment,
 		VHTChanWidth:      chanWidth,
 		VHTCenterFreqSeg0: centerFreq,
+
+		TrackComment: "#",
+	}
+
+	// hostapd can only suppress 2.4GHz probe responses for clients it has
+	// been tracking on 5GHz.
+	if hwMode == "a" {
+		for _, vap := range virtualAPs {
+			if vap.BandSteering {
+				data.TrackComment = ""
+			}
+		}
 	}
 
 	return &data
@@ -871,7 +1167,7 @@ func getDevConfig(d *physDevice) *devConfig {
 // Get network settings from configd and use them to initialize the AP
 //
 func getVAPConfig(name string, d *physDevice, idx int) *vapConfig {
-	var bssid, eapComment, pskComment, passphrase, radiusServer string
+	var bssid, localServer string
 	var logical *physDevice
 
 	vap := virtualAPs[name]
@@ -890,30 +1186,15 @@ func getVAPConfig(name string, d *physDevice, idx int) *vapConfig {
 		ssid += "-5ghz"
 	}
 
-	switch vap.KeyMgmt {
-	case "wpa-psk":
-		eapComment = "#"
-		passphrase = vap.Passphrase
-		if passphrase == "" {
-			slog.Errorf("VAP %s: missing WPA-PSK passphrase", name)
-			return nil
-		}
-	case "wpa-eap":
-		pskComment = "#"
-		if wconf.radiusSecret == "" {
-			slog.Errorf("radius secret undefined")
-			return nil
-		}
-	default:
-		slog.Errorf("VAP %s: unsupported key management: %s", name,
-			vap.KeyMgmt)
+	if cfgapi.KeyMgmtUsesPSK(vap.KeyMgmt) && vap.Passphrase == "" {
+		slog.Errorf("VAP %s: missing %s passphrase", name, vap.KeyMgmt)
 		return nil
 	}
 
 	if satellite {
-		radiusServer = getGatewayIP()
+		localServer = getGatewayIP()
 	} else {
-		radiusServer = "127.0.0.1"
+		localServer = "127.0.0.1"
 	}
 
 	if idx == 0 {
@@ -939,20 +1220,119 @@ func getVAPConfig(name string, d *physDevice, idx int) *vapConfig {
 		vap:        vap,
 		BSSID:      bssid,
 		SSID:       ssid,
-		Passphrase: passphrase,
-		KeyMgmt:    strings.ToUpper(vap.KeyMgmt),
-		PskComment: pskComment,
-		EapComment: eapComment,
+		Passphrase: vap.Passphrase,
 		ConfPrefix: confPrefix,
+	}
 
-		RadiusAuthServer:     radiusServer,
-		RadiusAuthServerPort: "1812",
-		RadiusAuthSecret:     wconf.radiusSecret,
+	if err := data.setSecurity(vap, d.wifi.cap); err != nil {
+		slog.Errorf("VAP %s: %v", name, err)
+		return nil
+	}
+	if err := data.setRadius(vap, localServer); err != nil {
+		slog.Errorf("VAP %s: %v", name, err)
+		return nil
+	}
+
+	data.setRoaming(vap, wconf.ftKey)
+
+	// A VAP outside of its scheduled hours is still configured, so it can
+	// be opened later without restarting hostapd, but it doesn't beacon.
+	data.closed = !vapOpen(vap, siteNow())
+	if !data.closed {
+		data.ClosedComment = "#"
 	}
 
 	return &data
 }
 
+// Translate the VAP's key management and PMF settings into the hostapd
+// configuration, taking into account what the hosting device can support.
+func (v *vapConfig) setSecurity(vap *cfgapi.VirtualAP,
+	caps *wificaps.WifiCapabilities) error {
+
+	keymgmt := strings.ToLower(vap.KeyMgmt)
+	pmf := 0
+
+	// A device that can't do SAE can still offer the WPA2 half of a
+	// transition-mode network.
+	if keymgmt == "wpa-psk+sae" && !caps.SupportSAE {
+		slog.Warnf("VAP %s: %s doesn't support SAE.  Falling back "+
+			"to wpa-psk", v.Name, v.physical.name)
+		keymgmt = "wpa-psk"
+	}
+
+	v.PskComment = "#"
+	v.EapComment = "#"
+	v.SaeComment = "#"
+	switch keymgmt {
+	case "wpa-psk":
+		v.KeyMgmt = "WPA-PSK"
+		v.PskComment = ""
+	case "wpa-eap":
+		v.KeyMgmt = "WPA-EAP"
+		v.EapComment = ""
+	case "sae":
+		if !caps.SupportSAE {
+			return fmt.Errorf("%s doesn't support SAE",
+				v.physical.name)
+		}
+		v.KeyMgmt = "SAE"
+		v.SaeComment = ""
+		pmf = 2
+	case "wpa-psk+sae":
+		v.KeyMgmt = "WPA-PSK SAE"
+		v.PskComment = ""
+		v.SaeComment = ""
+		pmf = 1
+	case "wpa3-eap":
+		if !caps.SupportPMF {
+			return fmt.Errorf("%s doesn't support PMF",
+				v.physical.name)
+		}
+		v.KeyMgmt = "WPA-EAP WPA-EAP-SHA256"
+		v.EapComment = ""
+		pmf = 2
+	default:
+		return fmt.Errorf("unsupported key management: %s",
+			vap.KeyMgmt)
+	}
+
+	// An explicit PMF setting can strengthen, but not weaken, the level
+	// required by the key management mode.
+	switch vap.PMF {
+	case "optional":
+		if pmf < 1 {
+			pmf = 1
+		}
+	case "required":
+		pmf = 2
+	}
+	if pmf > 0 && !caps.SupportPMF {
+		if pmf == 2 {
+			return fmt.Errorf("%s doesn't support PMF",
+				v.physical.name)
+		}
+		pmf = 0
+	}
+	v.PMF = pmf
+
+	// Additional PSKs are only supported by WPA2-PSK.  In transition mode,
+	// they will only be usable by WPA2 clients.
+	v.PskFileComment = "#"
+	if v.PskComment == "" && len(vap.PSKs) > 0 {
+		v.PskFileComment = ""
+	}
+
+	// TKIP isn't allowed in WPA3 networks, or in networks using PMF.
+	if pmf == 0 {
+		v.Pairwise = "TKIP CCMP"
+	} else {
+		v.Pairwise = "CCMP"
+	}
+
+	return nil
+}
+
 //
 // Generate the configuration files needed for hostapd.
 //
@@ -981,6 +1361,15 @@ func generateVlanConf(vap *vapConfig) error {
 		fmt.Fprintf(vf, "%d %s_%s.%d\n", vlan, vap.physical.name,
 			vap.Name, vlan)
 	}
+
+	// VLANs assigned by an external RADIUS server are attached to the
+	// bridge of the ring they map to.
+	if vap.DynamicVlan != 0 {
+		for vlan, bridge := range radiusVlanBridges(vap.Name, vapVlans) {
+			fmt.Fprintf(vf, "%d %s_%s.%d %s\n", vlan,
+				vap.physical.name, vap.Name, vlan, bridge)
+		}
+	}
 	vf.Close()
 
 	// Create the 'accept_macs' file, which tells hostapd how to map clients
@@ -1002,6 +1391,81 @@ func generateVlanConf(vap *vapConfig) error {
 	return nil
 }
 
+// Create the 'psk' file, which lists the additional passphrases accepted by a
+// VAP and the vlan on which each places its clients.  Each line looks like:
+//    keyid=<name> vlanid=<vlan_id> <mac addr> <passphrase>
+// where a mac address of all zeroes means the key may be used by any client.
+// A quarantined client gets its own copy of each key, with no vlanid, so it
+// remains on the quarantine vlan assigned by the 'accept_macs' file.  hostapd
+// tries the entries in the reverse of the order they appear in the file, so
+// those copies come last.
+func generatePSKConf(vap *vapConfig) error {
+	if vap.PskFileComment != "" {
+		return nil
+	}
+
+	pfn := vap.ConfPrefix + ".psk"
+	pf, err := os.OpenFile(pfn, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to create %s: %v", pfn, err)
+	}
+	defer pf.Close()
+
+	quarantined := make([]string, 0)
+	clientsMtx.Lock()
+	for mac, client := range clients {
+		if client.Ring == base_def.RING_QUARANTINE {
+			quarantined = append(quarantined, mac)
+		}
+	}
+	clientsMtx.Unlock()
+	sort.Strings(quarantined)
+
+	valid := make([]string, 0)
+	for _, name := range aputil.SortStringKeys(vap.vap.PSKs) {
+		psk := vap.vap.PSKs[name]
+
+		if !cfgapi.ValidPSKName(name) {
+			slog.Warnf("VAP %s: ignoring invalid psk name '%s'",
+				vap.Name, name)
+			continue
+		}
+
+		ring := rings[psk.Ring]
+		onVap := false
+		if ring != nil {
+			for _, ringVap := range ring.VirtualAPs {
+				onVap = onVap || (ringVap == vap.Name)
+			}
+		}
+		if !onVap {
+			slog.Warnf("VAP %s: psk %s uses ring %s, which isn't "+
+				"on this VAP", vap.Name, name, psk.Ring)
+			continue
+		}
+
+		mac := "00:00:00:00:00:00"
+		if psk.Mac != "" {
+			mac = psk.Mac
+		}
+		fmt.Fprintf(pf, "keyid=%s vlanid=%d %s %s\n", name, ring.Vlan,
+			mac, psk.Passphrase)
+		valid = append(valid, name)
+	}
+
+	for _, mac := range quarantined {
+		for _, name := range valid {
+			psk := vap.vap.PSKs[name]
+			if psk.Mac == "" || psk.Mac == mac {
+				fmt.Fprintf(pf, "keyid=%s %s %s\n", name, mac,
+					psk.Passphrase)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (h *hostapdHdl) deauthUser(user string) {
 	// We don't currently have a user->device mapping, so we deauth all
 	// devices
@@ -1017,12 +1481,12 @@ func (h *hostapdHdl) deauthUser(user string) {
 
 		for _, sta := range list {
 			slog.Debugf("deauthing %s from %s", sta, c.name)
-			c.disassociate(sta)
+			c.disassociate(sta, "user credentials changed")
 		}
 	}
 }
 
-func (h *hostapdHdl) disassociate(sta string) {
+func (h *hostapdHdl) disassociate(sta, cause string) {
 	sta = strings.ToLower(sta)
 	for _, c := range h.conns {
 		c.Lock()
@@ -1031,7 +1495,7 @@ func (h *hostapdHdl) disassociate(sta string) {
 
 		if ok {
 			slog.Infof("kicking %s from %s", sta, c.name)
-			c.disassociate(sta)
+			c.disassociate(sta, cause)
 		}
 	}
 }
@@ -1060,15 +1524,15 @@ func (h *hostapdHdl) generateHostAPDConf() {
 		return
 	}
 
+	// Build the configuration for each device and all of the VAPs it
+	// hosts before writing any of it out, because the band steering
+	// settings for each VAP depend on the other devices.
+	devs := make([]*devConfig, 0)
+	devVaps := make(map[string][]*vapConfig)
 	unenrolledVap := rings[base_def.RING_UNENROLLED].VirtualAPs[0]
 	for _, d := range h.devices {
-		confName := confdir + "/" + "hostapd.conf." + d.name
-		cf, _ := os.Create(confName)
-		defer cf.Close()
-
 		dev := getDevConfig(d)
-		if err = devTemplate.Execute(cf, dev); err != nil {
-			slog.Warnf("%v", err)
+		if dev == nil {
 			continue
 		}
 
@@ -1082,9 +1546,11 @@ func (h *hostapdHdl) generateHostAPDConf() {
 			}
 			if vap := getVAPConfig(name, d, idx); vap != nil {
 				if err = generateVlanConf(vap); err == nil {
-					err = vapTemplate.Execute(cf, vap)
+					err = generatePSKConf(vap)
 				}
 				if err == nil {
+					devVaps[d.name] = append(devVaps[d.name],
+						vap)
 					allVaps = append(allVaps, vap)
 					idx++
 				} else {
@@ -1096,11 +1562,32 @@ func (h *hostapdHdl) generateHostAPDConf() {
 				}
 			}
 		}
+		devs = append(devs, dev)
+		devices = append(devices, d)
+	}
+
+	setBandSteering(allVaps)
+
+	for _, dev := range devs {
+		confName := confdir + "/" + "hostapd.conf." + dev.Interface
+		cf, _ := os.Create(confName)
+		defer cf.Close()
+
+		if err = devTemplate.Execute(cf, dev); err != nil {
+			slog.Warnf("%v", err)
+			continue
+		}
+		for _, vap := range devVaps[dev.Interface] {
+			if err = vapTemplate.Execute(cf, vap); err != nil {
+				slog.Warnf("%v", err)
+			}
+		}
 
 		files = append(files, confName)
-		devices = append(devices, d)
 	}
 
+	publishBSSes(allVaps)
+
 	h.vaps = allVaps
 	h.devices = devices
 	h.unenrolled = unenrolled
@@ -1131,19 +1618,24 @@ func (h *hostapdHdl) newConn(vap *vapConfig) *hostapdConn {
 	remoteName := "/var/run/hostapd/" + fullName
 	localName := "/tmp/hostapd_ctrl_" + fullName + "-" +
 		strconv.Itoa(os.Getpid())
+	monName := "/tmp/hostapd_mon_" + fullName + "-" +
+		strconv.Itoa(os.Getpid())
 
 	newConn := hostapdConn{
 		hostapd:     h,
-		eap:         strings.EqualFold(vap.KeyMgmt, "wpa-eap"),
+		eap:         cfgapi.KeyMgmtUsesEAP(vap.vap.KeyMgmt),
 		name:        fullName,
+		bssid:       vap.logical.hwaddr,
 		remoteName:  remoteName,
 		localName:   localName,
+		monName:     monName,
 		vapName:     vap.Name,
 		wifiBand:    vap.physical.wifi.activeBand,
 		active:      true,
 		device:      vap.physical,
 		pendingCmds: make([]*hostapdCmd, 0),
 		stations:    make(map[string]*stationInfo),
+		closed:      vap.closed,
 	}
 	slog.Debugf("%v: %s -> %s", &newConn, remoteName, localName)
 	os.Remove(newConn.name)
@@ -1159,6 +1651,7 @@ func (h *hostapdHdl) start() {
 	for _, v := range h.vaps {
 		conn := h.newConn(v)
 		defer os.Remove(conn.localName)
+		defer os.Remove(conn.monName)
 		h.conns = append(h.conns, conn)
 	}
 
@@ -1190,8 +1683,9 @@ func (h *hostapdHdl) start() {
 
 	var wg sync.WaitGroup
 	for _, c := range h.conns {
-		wg.Add(1)
+		wg.Add(2)
 		go c.run(&wg)
+		go c.runMonitor(&wg)
 	}
 
 	// create a channel which will be signalled when the child exits
@@ -1240,6 +1734,10 @@ func (h *hostapdHdl) reload() {
 		virtualAPs = config.GetVirtualAPs()
 		h.generateConfigFiles()
 		h.process.Signal(plat.ReloadSignal)
+		go h.evaluateSchedules(true)
+		for _, c := range h.conns {
+			go c.attach()
+		}
 	}
 }
 
@@ -1348,6 +1846,9 @@ func hostapdLoop(wg *sync.WaitGroup, doneChan chan bool) {
 	slog.Infof("hostapd loop starting")
 	p := aputil.NewPaceTracker(failuresAllowed, period)
 	virtualAPs = config.GetVirtualAPs()
+	if externalRadiusInUse() {
+		go checkRadiusServers(wconf.radiusServers)
+	}
 
 runLoop:
 	for {
@@ -0,0 +1,210 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"bg/ap_common/broker"
+	"bg/ap_common/platform"
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+	"bg/common/wifi"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// Set up the daemon state shared by most tests: a logger, an empty config tree,
+// a platform which names each nic after its device, and a broker with nothing
+// to publish to.
+func wifidTestSetup(t *testing.T, node string) {
+	slog = zaptest.NewLogger(t).Sugar()
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	plat = &platform.Platform{
+		NicID: func(name, mac string) string { return name },
+	}
+	brokerd = &broker.Broker{Name: "ap.wifid"}
+	nodeID = node
+}
+
+// A fake hostapd control socket, which acknowledges and records each command
+// sent to it.
+type testSocket struct {
+	dir  string
+	sock *net.UnixConn
+	cmds []string
+	sync.Mutex
+}
+
+func newTestConn(t *testing.T, vapName string) (*hostapdConn,
+	*testSocket) {
+
+	dir, err := ioutil.TempDir("", "hostapd")
+	if err != nil {
+		t.Fatalf("creating temp directory: %v", err)
+	}
+	remote := &net.UnixAddr{
+		Name: filepath.Join(dir, "remote"),
+		Net:  "unixgram",
+	}
+	sock, err := net.ListenUnixgram("unixgram", remote)
+	if err != nil {
+		t.Fatalf("listening on %s: %v", remote.Name, err)
+	}
+	conn, err := net.DialUnix("unixgram", nil, remote)
+	if err != nil {
+		t.Fatalf("connecting to %s: %v", remote.Name, err)
+	}
+
+	c := &hostapdConn{
+		device:   &physDevice{name: "wlan0"},
+		name:     "wlan0",
+		vapName:  vapName,
+		conn:     conn,
+		stations: make(map[string]*stationInfo),
+	}
+	s := &testSocket{dir: dir, sock: sock}
+
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := sock.Read(buf)
+			if err != nil {
+				return
+			}
+			s.Lock()
+			s.cmds = append(s.cmds, string(buf[:n]))
+			s.Unlock()
+
+			c.Lock()
+			c.handleResult("OK")
+			c.pushCmd()
+			c.Unlock()
+		}
+	}()
+
+	return c, s
+}
+
+func (s *testSocket) close() {
+	s.sock.Close()
+	os.RemoveAll(s.dir)
+}
+
+// Return and reset the commands received so far
+func (s *testSocket) received() []string {
+	s.Lock()
+	defer s.Unlock()
+
+	cmds := s.cmds
+	s.cmds = nil
+	return cmds
+}
+
+func TestAttach(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	virtualAPs = map[string]*cfgapi.VirtualAP{
+		"psk": {BandSteering: false},
+	}
+	defer func() { virtualAPs = nil }()
+
+	lo, ls := newTestConn(t, "psk")
+	defer ls.close()
+	lo.wifiBand = wifi.LoBand
+	hi, hs := newTestConn(t, "psk")
+	defer hs.close()
+	hi.wifiBand = wifi.HiBand
+
+	check := func(s *testSocket, want ...string) {
+		t.Helper()
+		if got := s.received(); !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Probe events are only requested with band steering enabled
+	lo.attach()
+	hi.attach()
+	check(ls, "ATTACH")
+	check(hs, "ATTACH")
+
+	// Reattaching is only needed if that setting changes
+	lo.attach()
+	hi.attach()
+	check(ls)
+	check(hs)
+
+	virtualAPs["psk"].BandSteering = true
+	lo.attach()
+	hi.attach()
+	check(ls)
+	check(hs, "DETACH", "ATTACH probe_rx_events=1")
+
+	virtualAPs["psk"].BandSteering = false
+	hi.attach()
+	check(hs, "DETACH", "ATTACH")
+}
+
+func TestMonitorStatus(t *testing.T) {
+	wifidTestSetup(t, "node1")
+
+	c, s := newTestConn(t, "psk")
+	defer s.close()
+
+	const (
+		sta   = "b8:27:eb:9f:d8:e0"
+		other = "b8:27:eb:9f:d8:e1"
+	)
+	c.stations[sta] = &stationInfo{}
+	c.stations[other] = &stationInfo{}
+
+	// Frames from unknown clients and unrelated debug messages are
+	// ignored.
+	c.monitorStatus("deauthentication: STA=02:00:00:00:00:01 " +
+		"reason_code=1")
+	c.monitorStatus("disassocation: STA=" + sta)
+	c.monitorStatus("AP-STA-DISCONNECTED")
+	if len(c.stations) != 2 || c.stations[sta].reason != 0 {
+		t.Errorf("unexpected station state: %v", c.stations)
+	}
+
+	c.monitorStatus("disassocation: STA=B8:27:EB:9F:D8:E0 reason_code=8")
+	if r := c.stations[sta].reason; r != 8 {
+		t.Errorf("expected reason 8, got %d", r)
+	}
+
+	e := c.departure(sta)
+	if e.GetDisconnectReason() != 8 || e.DisconnectCause != nil {
+		t.Errorf("bad disconnect for %s: %v", sta, e)
+	}
+	if c.stations[sta] != nil {
+		t.Errorf("%s still present after departure", sta)
+	}
+
+	// A client we removed ourselves has a cause instead
+	c.stations[other].cause = "vap closed"
+	e = c.departure(other)
+	if e.DisconnectReason != nil || e.GetDisconnectCause() != "vap closed" {
+		t.Errorf("bad disconnect for %s: %v", other, e)
+	}
+
+	c.stations[sta] = &stationInfo{}
+	c.monitorStatus("AP-STA-DISCONNECTED " + sta)
+	if len(c.stations) != 0 {
+		t.Errorf("stations left after disconnect: %v", c.stations)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Support for site-wide channel planning.  Every node publishes the congestion
+// it observes on each channel.  When the planner is enabled, the gateway uses
+// those observations to choose channels for all of the radios in the site, and
+// pushes its choices out as cfg_channel/cfg_width settings.  See
+// ap_common/chanplan for the planning algorithm.
+
+package main
+
+import (
+	"strings"
+
+	"bg/ap_common/chanplan"
+	"bg/common/cfgapi"
+)
+
+// The congestion values we most recently published, indexed by nic
+var publishedCongestion = make(map[string]string)
+
+// Return the MAC addresses of all of the radios and BSSes in the site, so we
+// don't mistake our own satellites for interference.
+func siteRadios() map[string]bool {
+	radios := make(map[string]bool)
+	for _, d := range wirelessNics {
+		radios[strings.ToLower(d.hwaddr)] = true
+	}
+
+	// Include the BSSes of the VAPs we are hosting, which may not have
+	// been published yet.
+	if h := hostapd; h != nil {
+		for _, v := range h.vaps {
+			if v.logical != nil {
+				radios[strings.ToLower(v.logical.hwaddr)] = true
+			}
+		}
+		for _, d := range h.unenrolled {
+			radios[strings.ToLower(d.hwaddr)] = true
+		}
+	}
+
+	nodes, err := config.GetProps("@/nodes")
+	if err != nil {
+		return radios
+	}
+	for _, n := range nodes.Children {
+		nics := n.Children["nics"]
+		if nics == nil {
+			continue
+		}
+		for _, nic := range nics.Children {
+			if mac, _ := nic.GetChildString("mac"); mac != "" {
+				radios[strings.ToLower(mac)] = true
+			}
+			if bss := nic.Children["bss"]; bss != nil {
+				for _, b := range bss.Children {
+					radios[strings.ToLower(b.Value)] = true
+				}
+			}
+		}
+	}
+
+	return radios
+}
+
+// Publish the per-channel congestion seen by each of our radios, for use by the
+// gateway's channel planner.
+func publishCongestion() {
+	ops := make([]cfgapi.PropertyOp, 0)
+
+	apLock.Lock()
+	for id, d := range wirelessNics {
+		if d.pseudo || d.wifi == nil || d.wifi.cap == nil {
+			continue
+		}
+
+		cap := d.wifi.cap
+		cmap := make(map[int]int)
+		for c, v := range congestionMap[20] {
+			if cap.Channels[c] || cap.RadarChannels[c] {
+				cmap[c] = v
+			}
+		}
+
+		val := chanplan.FormatCongestion(cmap)
+		if publishedCongestion[id] != val {
+			publishedCongestion[id] = val
+			ops = append(ops, cfgapi.PropertyOp{
+				Op: cfgapi.PropCreate,
+				Name: "@/nodes/" + nodeID + "/nics/" + id +
+					"/congestion",
+				Value: val,
+			})
+		}
+	}
+	apLock.Unlock()
+
+	if len(ops) > 0 {
+		if _, err := config.Execute(nil, ops).Wait(nil); err != nil {
+			slog.Warnf("publishing congestion: %v", err)
+		}
+	}
+}
+
+// Compute a channel plan for all of the radios in the site.  The plan is
+// applied if it is a significant improvement on the current channels, or if it
+// includes radios the planner hasn't assigned channels to yet.
+func planChannels() {
+	radios, err := chanplan.Radios(config)
+	if err != nil {
+		slog.Warnf("channel plan: %v", err)
+		return
+	}
+
+	costs := chanplan.Costs{
+		Overlap: chanplan.DefaultOverlapCost,
+		DFS:     *dfsPenalty,
+	}
+	plan := chanplan.Compute(radios, costs)
+	changes := plan.Changes()
+	if len(changes) == 0 {
+		slog.Infof("channel plan: no changes needed")
+		return
+	}
+
+	unplanned := false
+	for _, a := range changes {
+		unplanned = unplanned || !a.Radio.Planned
+	}
+
+	gain := plan.CurrentCost - plan.Cost
+	if !unplanned && (gain < *chanMinGain ||
+		gain*100 < plan.CurrentCost*(*chanHysteresis)) {
+		slog.Infof("channel plan: cost %d is not enough better than %d",
+			plan.Cost, plan.CurrentCost)
+		return
+	}
+
+	for _, a := range changes {
+		r := a.Radio
+		slog.Infof("channel plan: %v moving from %d/%dMHz to %d/%dMHz",
+			r, r.Channel, r.Width, a.Channel, a.Width)
+	}
+	if err = chanplan.Apply(config, plan); err != nil {
+		slog.Warnf("channel plan: %v", err)
+	}
+}
+
+// The planner has been disabled, so remove any channels it has assigned
+func releaseChannels() {
+	if err := chanplan.Release(config); err != nil {
+		slog.Warnf("releasing planned channels: %v", err)
+	}
+}
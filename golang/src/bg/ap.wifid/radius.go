@@ -23,6 +23,7 @@
 //
 // @/network
 //     radius_auth_secret	Password
+//     radius/		External RADIUS servers (see extradius.go)
 //
 // Secret handling uses Base 64 encoding when stored in the configuration.
 
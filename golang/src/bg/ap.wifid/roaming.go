@@ -0,0 +1,294 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Support for helping clients roam between the BSSes hosted by the gateway and
+// satellite nodes:
+//
+//   802.11r (Fast Transition): all nodes share a mobility domain per SSID, and
+//   exchange FT keys with each other using a site-wide key stored in
+//   @/network/ft_key.
+//
+//   802.11k (Radio Resource Management): each node publishes the BSSIDs it is
+//   hosting in @/nodes/<node>/nics/<nic>/bss/<vap>.  Every other node uses
+//   that inventory to build the neighbor reports it hands to clients.
+//
+//   802.11v (BSS Transition Management): the steering engine (steering.go)
+//   uses the neighbor list to suggest a better AP to clients with a weak
+//   signal.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"bg/common/cfgapi"
+	"bg/common/wifi"
+)
+
+const (
+	ftKeyProp = "@/network/ft_key"
+	ftKeySize = 32
+)
+
+// A single entry in a neighbor report
+type neighbor struct {
+	bssid   string
+	node    string
+	band    string
+	channel int
+	vht     bool
+}
+
+// If the site's FT key is already set, retrieve its value.  Otherwise generate
+// a new key and set it.  Only the gateway does this; satellites wait for the
+// key to arrive via configd.
+func establishFTKey() (string, error) {
+	if key, err := config.GetProp(ftKeyProp); err == nil {
+		return key, nil
+	}
+
+	k := make([]byte, ftKeySize)
+	if _, err := rand.Read(k); err != nil {
+		return "", fmt.Errorf("unable to generate random number: %v",
+			err)
+	}
+
+	key := hex.EncodeToString(k)
+	if err := config.CreateProp(ftKeyProp, key, nil); err != nil {
+		return "", fmt.Errorf("could not create '%s': %v", ftKeyProp,
+			err)
+	}
+
+	return key, nil
+}
+
+// All nodes hosting a given SSID need to agree on its mobility domain, so we
+// derive it from the SSID itself.
+func mobilityDomain(ssid string) string {
+	sum := sha256.Sum256([]byte(ssid))
+	return hex.EncodeToString(sum[:2])
+}
+
+// Configure the VAP to advertise 802.11k/v/r support
+func (v *vapConfig) setRoaming(vap *cfgapi.VirtualAP, ftKey string) {
+	v.RoamComment = "#"
+	v.BTMComment = "#"
+	if !vap.Roaming {
+		return
+	}
+	if ftKey == "" {
+		slog.Warnf("VAP %s: no FT key available - roaming disabled",
+			v.Name)
+		return
+	}
+
+	ft := make([]string, 0)
+	for _, mgmt := range strings.Fields(v.KeyMgmt) {
+		switch mgmt {
+		case "WPA-PSK":
+			ft = append(ft, "FT-PSK")
+		case "WPA-EAP":
+			ft = append(ft, "FT-EAP")
+		case "SAE":
+			ft = append(ft, "FT-SAE")
+		}
+	}
+	if len(ft) > 0 {
+		v.KeyMgmt += " " + strings.Join(ft, " ")
+	}
+
+	v.RoamComment = ""
+	v.BTMComment = ""
+	v.MobilityDomain = mobilityDomain(vap.SSID)
+	v.FTKey = ftKey
+	if v.logical != nil {
+		v.NasID = strings.Replace(v.logical.hwaddr, ":", "", -1)
+	}
+}
+
+// Record the BSSes being hosted on this node, so the other nodes can include
+// them in their neighbor reports.  Any prior list for a NIC is replaced.
+func publishBSSes(vaps []*vapConfig) {
+	ops := make([]cfgapi.PropertyOp, 0)
+
+	cleared := make(map[string]bool)
+	for _, v := range vaps {
+		base := "@/nodes/" + nodeID + "/nics/" +
+			plat.NicID(v.physical.name, v.physical.hwaddr) + "/bss"
+		if !cleared[base] {
+			if old, _ := config.GetProps(base); old != nil {
+				ops = append(ops, cfgapi.PropertyOp{
+					Op:   cfgapi.PropDelete,
+					Name: base,
+				})
+			}
+			cleared[base] = true
+		}
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:    cfgapi.PropCreate,
+			Name:  base + "/" + v.Name,
+			Value: v.logical.hwaddr,
+		})
+	}
+
+	if len(ops) > 0 {
+		if _, err := config.Execute(nil, ops).Wait(nil); err != nil {
+			slog.Warnf("publishing BSS list: %v", err)
+		}
+	}
+}
+
+// Find all of the BSSes on other nodes hosting the given VAP
+func findNeighbors(vapName string) []neighbor {
+	list := make([]neighbor, 0)
+
+	nodes, err := config.GetProps("@/nodes")
+	if err != nil {
+		return list
+	}
+
+	for node, n := range nodes.Children {
+		if node == nodeID {
+			continue
+		}
+		nics := n.Children["nics"]
+		if nics == nil {
+			continue
+		}
+
+		for _, nic := range nics.Children {
+			bss, err := nic.GetChild("bss")
+			if err != nil {
+				continue
+			}
+			bssid, err := bss.GetChildString(vapName)
+			if err != nil {
+				continue
+			}
+			if state, _ := nic.GetChildString("state"); state != wifi.DevOK {
+				continue
+			}
+
+			nb := neighbor{
+				bssid: bssid,
+				node:  node,
+			}
+			nb.band, _ = nic.GetChildString("active_band")
+			nb.channel, _ = nic.GetChildInt("active_channel")
+			mode, _ := nic.GetChildString("active_mode")
+			nb.vht = (mode == "ac")
+			if nb.channel != 0 {
+				list = append(list, nb)
+			}
+		}
+	}
+
+	return list
+}
+
+// Return the global operating class (802.11 Annex E, Table E-4) for a 20MHz
+// channel
+func operatingClass(band string, channel int) int {
+	if band == wifi.LoBand {
+		return 81
+	}
+
+	switch {
+	case channel >= 36 && channel <= 48:
+		return 115
+	case channel >= 52 && channel <= 64:
+		return 118
+	case channel >= 100 && channel <= 144:
+		return 121
+	default:
+		return 125
+	}
+}
+
+// Return the fields describing a neighbor, in the order used by both
+// hostapd's SET_NEIGHBOR and BSS_TM_REQ commands: the bssid, the BSSID
+// Information field, the operating class, the channel, and the PHY type.
+func (n *neighbor) fields() (net.HardwareAddr, uint32, int, int, int) {
+	mac, _ := net.ParseMAC(n.bssid)
+
+	// AP reachable, same security, same key scope, and in the same
+	// mobility domain.
+	info := uint32(0x3 | 0x4 | 0x8 | 0x400)
+
+	// PHY type 7 is HT, 9 is VHT
+	phy := 7
+	if n.vht {
+		phy = 9
+	}
+
+	return mac, info, operatingClass(n.band, n.channel), n.channel, phy
+}
+
+// Encode a neighbor as the Neighbor Report element body expected by
+// SET_NEIGHBOR
+func (n *neighbor) report() string {
+	mac, info, class, channel, phy := n.fields()
+
+	b := make([]byte, 13)
+	copy(b[0:6], mac)
+	binary.LittleEndian.PutUint32(b[6:10], info)
+	b[10] = byte(class)
+	b[11] = byte(channel)
+	b[12] = byte(phy)
+
+	return hex.EncodeToString(b)
+}
+
+// Encode a neighbor as a candidate in a BSS_TM_REQ command
+func (n *neighbor) candidate() string {
+	mac, info, class, channel, phy := n.fields()
+
+	return fmt.Sprintf("%s,%d,%d,%d,%d", mac, info, class, channel, phy)
+}
+
+// Bring this BSS's neighbor list in line with the current node inventory
+func (c *hostapdConn) updateNeighbors() {
+	vap := virtualAPs[c.vapName]
+	if vap == nil || !vap.Roaming {
+		return
+	}
+
+	current := make(map[string]neighbor)
+	for _, n := range findNeighbors(c.vapName) {
+		current[n.bssid] = n
+	}
+
+	c.Lock()
+	old := c.neighbors
+	c.neighbors = current
+	c.Unlock()
+
+	ssid := hex.EncodeToString([]byte(vap.SSID))
+	for bssid, n := range current {
+		if o, ok := old[bssid]; !ok || o != n {
+			cmd := "SET_NEIGHBOR " + bssid + " ssid=" + ssid +
+				" nr=" + n.report()
+			if _, err := c.command(cmd); err != nil {
+				slog.Warnf("%v adding neighbor %s: %v", c,
+					bssid, err)
+			}
+		}
+	}
+	for bssid := range old {
+		if _, ok := current[bssid]; !ok {
+			c.command("REMOVE_NEIGHBOR " + bssid + " ssid=" + ssid)
+		}
+	}
+}
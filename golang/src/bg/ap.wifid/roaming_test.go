@@ -0,0 +1,113 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"bg/common/wifi"
+)
+
+func roamingTestVAP(name, nic, bssid string) *vapConfig {
+	return &vapConfig{
+		Name:     name,
+		physical: &physDevice{name: nic},
+		logical:  &physDevice{hwaddr: bssid},
+	}
+}
+
+func TestPublishBSSes(t *testing.T) {
+	wifidTestSetup(t, "node1")
+	base := "@/nodes/node1/nics/"
+
+	// The first publish has no prior list to replace
+	publishBSSes([]*vapConfig{
+		roamingTestVAP("psk", "wlan0", "00:40:54:00:00:01"),
+		roamingTestVAP("eap", "wlan0", "00:40:54:00:00:02"),
+		roamingTestVAP("psk", "wlan1", "00:40:54:00:00:11"),
+	})
+	want := map[string]string{
+		base + "wlan0/bss/psk": "00:40:54:00:00:01",
+		base + "wlan0/bss/eap": "00:40:54:00:00:02",
+		base + "wlan1/bss/psk": "00:40:54:00:00:11",
+	}
+	for prop, val := range want {
+		if got, err := config.GetProp(prop); err != nil || got != val {
+			t.Errorf("%s: got %q (%v), want %q", prop, got, err,
+				val)
+		}
+	}
+
+	// A later publish replaces the prior list
+	publishBSSes([]*vapConfig{
+		roamingTestVAP("psk", "wlan0", "00:40:54:00:00:03"),
+	})
+	if got, _ := config.GetProp(base + "wlan0/bss/psk"); got !=
+		"00:40:54:00:00:03" {
+		t.Errorf("psk bss not updated: got %q", got)
+	}
+	if _, err := config.GetProp(base + "wlan0/bss/eap"); err == nil {
+		t.Errorf("stale eap bss not removed")
+	}
+}
+
+func TestFindNeighbors(t *testing.T) {
+	wifidTestSetup(t, "node1")
+
+	nic := func(node, nic, state, channel, mode, bssid string) {
+		base := "@/nodes/" + node + "/nics/" + nic + "/"
+		props := map[string]string{
+			base + "state":          state,
+			base + "active_band":    wifi.HiBand,
+			base + "active_channel": channel,
+			base + "active_mode":    mode,
+		}
+		if bssid != "" {
+			props[base+"bss/psk"] = bssid
+		}
+		if err := config.CreateProps(props, nil); err != nil {
+			t.Fatalf("creating %s: %v", base, err)
+		}
+	}
+	nic("node1", "wlan1", wifi.DevOK, "36", "ac", "00:40:54:00:00:01")
+	nic("node2", "wlan1", wifi.DevOK, "149", "ac", "00:40:54:00:00:02")
+	nic("node2", "wlan0", wifi.DevOK, "6", "n", "")
+	nic("node3", "wlan1", wifi.DevOK, "44", "n", "00:40:54:00:00:03")
+	nic("node3", "wlan2", wifi.DevOK, "0", "n", "00:40:54:00:00:04")
+	nic("node4", "wlan1", wifi.DevDisabled, "40", "ac",
+		"00:40:54:00:00:05")
+
+	// Only other nodes' active BSSes hosting the VAP are neighbors
+	got := findNeighbors("psk")
+	sort.Slice(got, func(i, j int) bool {
+		return got[i].bssid < got[j].bssid
+	})
+	want := []neighbor{
+		{"00:40:54:00:00:02", "node2", wifi.HiBand, 149, true},
+		{"00:40:54:00:00:03", "node3", wifi.HiBand, 44, false},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if got = findNeighbors("eap"); len(got) != 0 {
+		t.Errorf("unexpected eap neighbors: %v", got)
+	}
+
+	n := want[0]
+	if c := n.candidate(); c != "00:40:54:00:00:02,1039,125,149,9" {
+		t.Errorf("bad candidate: %s", c)
+	}
+	if r := n.report(); r != "0040540000020f0400007d9509" {
+		t.Errorf("bad report: %s", r)
+	}
+}
@@ -0,0 +1,324 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Detection of rogue access points.  The nearby APs found while scanning for
+// channel selection are checked for two kinds of impersonation:
+//
+//   - an evil twin, which broadcasts one of our SSIDs from a BSSID belonging to
+//     none of the site's radios.
+//   - an open network whose name differs from one of our SSIDs only in case or
+//     punctuation, hoping to catch clients whose users pick it by hand.
+//
+// We also watch for bursts of deauthentication and disassociation frames
+// received by our own BSSes.  Floods of forged frames are commonly used to push
+// clients off a legitimate AP and onto an evil twin.
+//
+// Each finding is raised as a net.exception and recorded in the config tree
+// under @/network/rogue/<bssid>.  A deauth flood is recorded under the
+// transmitter address of the frames.  The records expire if the AP isn't seen
+// again.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/apscan"
+	"bg/base_msg"
+	"bg/common/cfgapi"
+	"bg/common/wifi"
+)
+
+const (
+	rogueProp = "@/network/rogue/"
+
+	// Don't repeat an exception for the same AP more often than this
+	rogueReportFreq = time.Hour
+
+	// Findings are kept for at least this long after the AP was last seen
+	rogueMinLifetime = 2 * time.Hour
+)
+
+var (
+	deauthFloodLimit  = apcfg.Int("deauth_flood", 30, true, nil)
+	deauthFloodWindow = apcfg.Duration("deauth_flood_window",
+		10*time.Second, true, nil)
+
+	rogueReported = make(map[string]time.Time)
+	deauthCounts  = make(map[string]*deauthCount)
+	rogueLock     sync.Mutex
+)
+
+// The deauth/disassoc frames seen by a single BSS during the current window,
+// along with the number sent from each transmitter address.
+type deauthCount struct {
+	start   time.Time
+	count   int
+	sources map[string]int
+}
+
+// Reduce an SSID to its lower case letters and digits, so "Acme WiFi" and
+// "acme-wifi" are recognized as the same name.
+func normalizeSSID(ssid string) string {
+	var b strings.Builder
+
+	for _, r := range strings.ToLower(ssid) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Determine whether a nearby AP which isn't one of ours is impersonating one of
+// our VAPs.  Returns the kind of impersonation and the VAP being impersonated,
+// or empty strings if the AP appears to be harmless.
+func classifyAP(ap *apscan.ScannedAP,
+	vaps map[string]*cfgapi.VirtualAP) (string, string) {
+
+	if ap.SSID == "" {
+		return "", ""
+	}
+
+	norm := normalizeSSID(ap.SSID)
+	for name, vap := range vaps {
+		if vap.Disabled || vap.SSID == "" {
+			continue
+		}
+
+		names := []string{vap.SSID}
+		if vap.Tag5GHz {
+			names = append(names, vap.SSID+"-5ghz")
+		}
+
+		for _, ssid := range names {
+			if ap.SSID == ssid {
+				return cfgapi.RogueEvilTwin, name
+			}
+			if ap.Security == "open" && norm != "" &&
+				norm == normalizeSSID(ssid) {
+				return cfgapi.RogueOpenTwin, name
+			}
+		}
+	}
+
+	return "", ""
+}
+
+// Returns true if we haven't raised an exception for this finding recently
+func rogueShouldReport(bssid, kind string, now time.Time) bool {
+	rogueLock.Lock()
+	defer rogueLock.Unlock()
+
+	key := bssid + "/" + kind
+	if last, ok := rogueReported[key]; ok &&
+		now.Sub(last) < rogueReportFreq {
+		return false
+	}
+	rogueReported[key] = now
+	return true
+}
+
+func rogueLifetime() time.Duration {
+	// Nearby APs are only rescanned every few hours, so the record needs
+	// to outlive the gap between scans.
+	if l := 2 * *apScanFreq; l > rogueMinLifetime {
+		return l
+	}
+	return rogueMinLifetime
+}
+
+// Record a finding in the config tree, preserving the time at which it was
+// first seen.
+func rogueRecord(r *cfgapi.RogueAP) {
+	base := rogueProp + r.BSSID + "/"
+	expires := r.LastSeen.Add(rogueLifetime())
+
+	if r.FirstSeen == nil {
+		r.FirstSeen = r.LastSeen
+		if old, _ := config.GetProps(rogueProp + r.BSSID); old != nil {
+			kind := old.Children["kind"]
+			first, err := old.GetChildTime("first_seen")
+			if err == nil && kind != nil && !kind.Expired() &&
+				kind.Value == r.Kind {
+				r.FirstSeen = first
+			}
+		}
+	}
+
+	props := map[string]string{
+		"kind":       r.Kind,
+		"ssid":       r.SSID,
+		"vap":        r.VAP,
+		"node":       r.Node,
+		"band":       r.Band,
+		"first_seen": r.FirstSeen.Format(time.RFC3339),
+		"last_seen":  r.LastSeen.Format(time.RFC3339),
+	}
+	if r.Channel != 0 {
+		props["channel"] = strconv.Itoa(r.Channel)
+	}
+	if r.Signal != 0 {
+		props["signal"] = strconv.Itoa(r.Signal)
+	}
+
+	ops := make([]cfgapi.PropertyOp, 0)
+	for name, val := range props {
+		if val == "" {
+			continue
+		}
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:      cfgapi.PropCreate,
+			Name:    base + name,
+			Value:   val,
+			Expires: &expires,
+		})
+	}
+
+	if _, err := config.Execute(nil, ops).Wait(nil); err != nil {
+		slog.Warnf("recording rogue AP %s: %v", r.BSSID, err)
+	}
+}
+
+// Remove any of this node's findings which have expired
+func roguePrune() {
+	ops := make([]cfgapi.PropertyOp, 0)
+	for bssid, props := range config.GetChildren("@/network/rogue") {
+		kind := props.Children["kind"]
+		node, _ := props.GetChildString("node")
+		if node == nodeID && (kind == nil || kind.Expired()) {
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:   cfgapi.PropDelete,
+				Name: rogueProp + bssid,
+			})
+		}
+	}
+
+	if len(ops) > 0 {
+		if _, err := config.Execute(nil, ops).Wait(nil); err != nil {
+			slog.Warnf("pruning rogue APs: %v", err)
+		}
+	}
+}
+
+// Raise an exception for a finding and record it in the config tree
+func rogueFound(r *cfgapi.RogueAP, details ...string) {
+	reason := base_msg.EventNetException_ROGUE_AP
+	if r.Kind == cfgapi.RogueDeauthFlood {
+		reason = base_msg.EventNetException_DEAUTH_FLOOD
+	}
+
+	if rogueShouldReport(r.BSSID, r.Kind, *r.LastSeen) {
+		slog.Warnf("%s %s on VAP %s: %s", r.Kind, r.BSSID, r.VAP,
+			strings.Join(details, ", "))
+		sendNetException(r.BSSID, "", &r.VAP, &r.Band, &reason,
+			details...)
+	}
+
+	rogueRecord(r)
+}
+
+// Check the results of a scan for APs impersonating ours.  Any AP whose BSSID
+// belongs to one of the site's radios is skipped.
+func checkRogueAPs(aps []*apscan.ScannedAP, ours map[string]bool) {
+	vaps := config.GetVirtualAPs()
+	now := time.Now()
+
+	for _, ap := range aps {
+		if ours[strings.ToLower(ap.Mac)] {
+			continue
+		}
+
+		kind, vap := classifyAP(ap, vaps)
+		if kind == "" {
+			continue
+		}
+
+		band := wifi.LoBand
+		if ap.Channel >= 32 {
+			band = wifi.HiBand
+		}
+		seen := now.Add(-1 * ap.LastSeen)
+		r := &cfgapi.RogueAP{
+			BSSID:    strings.ToLower(ap.Mac),
+			Kind:     kind,
+			SSID:     ap.SSID,
+			VAP:      vap,
+			Node:     nodeID,
+			Band:     band,
+			Channel:  ap.Channel,
+			Signal:   ap.Strength,
+			LastSeen: &seen,
+		}
+		rogueFound(r, kind, "ssid="+ap.SSID,
+			"channel="+strconv.Itoa(ap.Channel),
+			"signal="+strconv.Itoa(ap.Strength),
+			"security="+ap.Security)
+	}
+
+	roguePrune()
+}
+
+// Count the deauth and disassoc frames received by one of our BSSes.  A few are
+// routine as clients leave, but a burst of them suggests someone is forging
+// them to knock our clients offline.  The finding is recorded under the
+// transmitter address seen in most of the frames, rather than under our own
+// BSSID.
+func (c *hostapdConn) deauthSeen(src string, now time.Time) {
+	src = strings.ToLower(src)
+
+	rogueLock.Lock()
+	d := deauthCounts[c.bssid]
+	if d == nil || now.Sub(d.start) > *deauthFloodWindow {
+		d = &deauthCount{
+			start:   now,
+			sources: make(map[string]int),
+		}
+		deauthCounts[c.bssid] = d
+	}
+	d.count++
+	d.sources[src]++
+	flood := d.count == *deauthFloodLimit
+	start := d.start
+
+	var attacker string
+	if flood {
+		for s, n := range d.sources {
+			if attacker == "" || n > d.sources[attacker] {
+				attacker = s
+			}
+		}
+	}
+	rogueLock.Unlock()
+
+	if !flood {
+		return
+	}
+
+	r := &cfgapi.RogueAP{
+		BSSID:    attacker,
+		Kind:     cfgapi.RogueDeauthFlood,
+		VAP:      c.vapName,
+		Node:     nodeID,
+		Band:     c.wifiBand,
+		LastSeen: &now,
+	}
+	if c.device != nil && c.device.wifi != nil {
+		r.Channel = c.device.wifi.activeChannel
+	}
+
+	go rogueFound(r, cfgapi.RogueDeauthFlood,
+		strconv.Itoa(*deauthFloodLimit)+" frames in "+
+			now.Sub(start).Round(time.Millisecond).String(),
+		"bss="+strings.ToLower(c.bssid))
+}
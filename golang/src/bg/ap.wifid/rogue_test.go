@@ -0,0 +1,208 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"bg/ap_common/apscan"
+	"bg/common/cfgapi"
+)
+
+func rogueTestSetup(t *testing.T) {
+	wifidTestSetup(t, "node1")
+
+	rogueLock.Lock()
+	rogueReported = make(map[string]time.Time)
+	deauthCounts = make(map[string]*deauthCount)
+	rogueLock.Unlock()
+
+	err := config.CreateProps(map[string]string{
+		"@/network/vap/psk/ssid":    "Acme WiFi",
+		"@/network/vap/psk/keymgmt": "wpa-psk",
+	}, nil)
+	if err != nil {
+		t.Fatalf("creating VAP: %v", err)
+	}
+}
+
+// Wait for a finding to be recorded by a background rogueFound()
+func rogueWait(bssid string) *cfgapi.PropertyNode {
+	for i := 0; i < 100; i++ {
+		props, _ := config.GetProps(rogueProp + bssid)
+		if props != nil {
+			return props
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestClassifyAP(t *testing.T) {
+	vaps := map[string]*cfgapi.VirtualAP{
+		"psk": {
+			SSID:    "Acme WiFi",
+			KeyMgmt: "wpa-psk",
+			Tag5GHz: true,
+		},
+		"guest": {
+			SSID:     "acme-guest",
+			KeyMgmt:  "wpa-psk",
+			Disabled: true,
+		},
+	}
+
+	testCases := []struct {
+		ssid     string
+		security string
+		kind     string
+		vap      string
+	}{
+		{"Acme WiFi", "wpa2", cfgapi.RogueEvilTwin, "psk"},
+		{"Acme WiFi", "open", cfgapi.RogueEvilTwin, "psk"},
+		{"Acme WiFi-5ghz", "wpa2", cfgapi.RogueEvilTwin, "psk"},
+		{"acme_wifi", "open", cfgapi.RogueOpenTwin, "psk"},
+		{"ACME-WIFI-5GHZ", "open", cfgapi.RogueOpenTwin, "psk"},
+		{"acme_wifi", "wpa2", "", ""},
+		{"Acme WiFi Extender", "open", "", ""},
+		{"acme-guest", "wpa2", "", ""},
+		{"--", "open", "", ""},
+		{"", "open", "", ""},
+	}
+
+	for _, tc := range testCases {
+		ap := &apscan.ScannedAP{
+			Mac:      "02:00:00:00:00:01",
+			SSID:     tc.ssid,
+			Security: tc.security,
+		}
+		kind, vap := classifyAP(ap, vaps)
+		if kind != tc.kind || vap != tc.vap {
+			t.Errorf("%q/%s: expected (%q, %q), got (%q, %q)",
+				tc.ssid, tc.security, tc.kind, tc.vap, kind, vap)
+		}
+	}
+}
+
+func TestCheckRogueAPs(t *testing.T) {
+	rogueTestSetup(t)
+
+	// One of our BSSes is hosted locally, one is on a satellite, and one
+	// is used for unenrolled clients.
+	defer func(h *hostapdHdl) { hostapd = h }(hostapd)
+	hostapd = &hostapdHdl{
+		vaps: []*vapConfig{
+			{Name: "psk", logical: &physDevice{
+				hwaddr: "00:40:54:00:00:01"}},
+		},
+		unenrolled: []*physDevice{{hwaddr: "00:40:54:00:00:03"}},
+	}
+	err := config.CreateProp("@/nodes/node2/nics/wlan0/bss/psk",
+		"00:40:54:00:00:02", nil)
+	if err != nil {
+		t.Fatalf("creating satellite BSS: %v", err)
+	}
+
+	aps := []*apscan.ScannedAP{
+		{Mac: "00:40:54:00:00:01", SSID: "Acme WiFi", Channel: 6},
+		{Mac: "00:40:54:00:00:02", SSID: "Acme WiFi", Channel: 36},
+		{Mac: "00:40:54:00:00:03", SSID: "Acme WiFi", Channel: 11},
+		{Mac: "02:00:00:00:00:01", SSID: "Acme WiFi", Channel: 6},
+		{Mac: "02:00:00:00:00:02", SSID: "acme_wifi", Channel: 149,
+			Security: "open"},
+		{Mac: "02:00:00:00:00:03", SSID: "Neighbor", Channel: 1},
+	}
+	checkRogueAPs(aps, siteRadios())
+
+	want := map[string]string{
+		"02:00:00:00:00:01": cfgapi.RogueEvilTwin,
+		"02:00:00:00:00:02": cfgapi.RogueOpenTwin,
+	}
+	found := config.GetChildren("@/network/rogue")
+	if len(found) != len(want) {
+		t.Errorf("expected %d findings, got %d", len(want), len(found))
+	}
+	for bssid, props := range found {
+		kind, _ := props.GetChildString("kind")
+		if kind != want[bssid] {
+			t.Errorf("%s: expected kind %q, got %q", bssid,
+				want[bssid], kind)
+		}
+	}
+}
+
+func TestDeauthFlood(t *testing.T) {
+	rogueTestSetup(t)
+
+	c, s := newTestConn(t, "psk")
+	defer s.close()
+	c.bssid = "00:40:54:00:00:01"
+	c.wifiBand = "5GHz"
+
+	const (
+		client   = "02:00:00:00:00:01"
+		attacker = "02:00:00:00:00:aa"
+	)
+
+	// Clients dropping off without sending us a frame aren't counted
+	for i := 0; i < 2**deauthFloodLimit; i++ {
+		c.stations[client] = &stationInfo{}
+		c.monitorStatus("AP-STA-DISCONNECTED " + client)
+	}
+	rogueLock.Lock()
+	counted := len(deauthCounts)
+	rogueLock.Unlock()
+	if counted != 0 {
+		t.Errorf("disconnects counted as deauth frames")
+	}
+
+	// A few frames from departing clients shouldn't be reported
+	for i := 0; i < 3; i++ {
+		c.monitorStatus("deauthentication: STA=" + client +
+			" reason_code=3")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if found := config.GetChildren("@/network/rogue"); len(found) != 0 {
+		t.Errorf("expected no findings, got %d", len(found))
+	}
+
+	// A burst should be recorded under the address most of the frames
+	// came from, not under our own BSSID.
+	for i := 3; i < *deauthFloodLimit; i++ {
+		c.monitorStatus("disassocation: STA=02:00:00:00:00:AA " +
+			"reason_code=8")
+	}
+	props := rogueWait(attacker)
+	if props == nil {
+		t.Fatalf("no finding recorded for %s", attacker)
+	}
+	kind, _ := props.GetChildString("kind")
+	if kind != cfgapi.RogueDeauthFlood {
+		t.Errorf("expected kind %q, got %q", cfgapi.RogueDeauthFlood,
+			kind)
+	}
+	if vap, _ := props.GetChildString("vap"); vap != "psk" {
+		t.Errorf("expected vap psk, got %q", vap)
+	}
+	if found := config.GetChildren("@/network/rogue"); len(found) != 1 {
+		t.Errorf("expected 1 finding, got %d", len(found))
+	}
+
+	// Once the window has passed, the count starts over
+	later := time.Now().Add(*deauthFloodWindow + time.Second)
+	c.deauthSeen(attacker, later)
+	rogueLock.Lock()
+	count := deauthCounts[c.bssid].count
+	rogueLock.Unlock()
+	if count != 1 {
+		t.Errorf("expected a new window with 1 frame, got %d", count)
+	}
+}
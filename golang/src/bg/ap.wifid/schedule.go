@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/base_msg"
+	"bg/common/cfgapi"
+	"bg/common/wifi"
+)
+
+var (
+	scheduleFreq = apcfg.Duration("vap_schedule_freq", 30*time.Second,
+		true, nil)
+
+	// Schedules are evaluated by the periodic loop, on config changes, and
+	// after hostapd reloads.  This keeps those from racing with each other.
+	scheduleMtx sync.Mutex
+)
+
+// Return the current time in the site's time zone
+func siteNow() time.Time {
+	now, err := apcfg.SiteNow(config)
+	if err != nil {
+		slog.Warnf("%v", err)
+	}
+	return now
+}
+
+// Determine whether a VAP's schedule allows it to be available at the given
+// time.  A VAP with no schedule is always available.
+func vapOpen(vap *cfgapi.VirtualAP, now time.Time) bool {
+	sched, err := wifi.ParseSchedule(vap.Schedule)
+	if err != nil {
+		slog.Warnf("bad schedule %q: %v", vap.Schedule, err)
+		return true
+	}
+
+	return sched.Active(now)
+}
+
+// The VAP has reached the end of its scheduled hours.  Warn about and kick off
+// any connected clients, and stop beaconing.  The other VAPs on the device are
+// unaffected.
+func (c *hostapdConn) closeVAP() {
+	reason := base_msg.EventNetException_VAP_CLOSED
+
+	c.Lock()
+	list := make([]string, 0)
+	for sta := range c.stations {
+		list = append(list, sta)
+	}
+	c.Unlock()
+
+	slog.Infof("%v closing %s with %d clients", c, c.vapName, len(list))
+	for _, sta := range list {
+		sendNetException(sta, "", &c.vapName, &c.wifiBand, &reason)
+		c.deauthSta(sta, "vap closed")
+	}
+
+	if _, err := c.command("STOP_AP"); err != nil {
+		slog.Warnf("%v failed to stop: %v", c, err)
+	}
+}
+
+// The VAP has reached the start of its scheduled hours, so resume beaconing.
+func (c *hostapdConn) openVAP() {
+	slog.Infof("%v opening %s", c, c.vapName)
+	if _, err := c.command("UPDATE_BEACON"); err != nil {
+		slog.Warnf("%v failed to start: %v", c, err)
+	}
+}
+
+// Open or close any VAPs whose scheduled state has changed.  If 'force' is set,
+// the current state is reasserted even if it hasn't changed, which is needed
+// after hostapd reloads its configuration.
+func (h *hostapdHdl) evaluateSchedules(force bool) {
+	if h == nil {
+		return
+	}
+
+	scheduleMtx.Lock()
+	defer scheduleMtx.Unlock()
+
+	now := siteNow()
+	for _, c := range h.conns {
+		open := true
+		if vap := virtualAPs[c.vapName]; vap != nil {
+			open = vapOpen(vap, now)
+		}
+
+		c.Lock()
+		changed := (open == c.closed)
+		c.closed = !open
+		c.Unlock()
+
+		if open && (changed || force) {
+			c.openVAP()
+		} else if !open && changed {
+			c.closeVAP()
+		} else if !open && force {
+			c.command("STOP_AP")
+		}
+	}
+}
+
+func scheduleLoop(wg *sync.WaitGroup, doneChan chan bool) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(*scheduleFreq)
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		select {
+		case done = <-doneChan:
+		case <-ticker.C:
+			hostapd.evaluateSchedules(false)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+
+	"go.uber.org/zap/zaptest"
+)
+
+func TestVAPOpen(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	// Monday, 9:00am
+	now := time.Date(2020, time.June, 1, 9, 0, 0, 0, time.UTC)
+
+	testData := []struct {
+		schedule string
+		open     bool
+	}{
+		{"", true},
+		{"mon-fri 08:00-18:00", true},
+		{"sat+sun 00:00-24:00", false},
+		{"daily 22:00-02:00", false},
+		{"not a schedule", true},
+	}
+
+	for _, td := range testData {
+		vap := &cfgapi.VirtualAP{Schedule: td.schedule}
+		if open := vapOpen(vap, now); open != td.open {
+			t.Errorf("%q: got open %v, want %v", td.schedule, open,
+				td.open)
+		}
+	}
+}
+
+func TestEvaluateSchedules(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+	config = cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	always, as := newTestConn(t, "always")
+	defer as.close()
+	never, ns := newTestConn(t, "never")
+	defer ns.close()
+	h := &hostapdHdl{conns: []*hostapdConn{always, never}}
+
+	virtualAPs = map[string]*cfgapi.VirtualAP{
+		"always": {},
+		"never":  {Schedule: "mon 00:00-00:01"},
+	}
+	defer func() { virtualAPs = nil }()
+	if vapOpen(virtualAPs["never"], siteNow()) {
+		t.Skip("test is running during the 'never' VAP's window")
+	}
+
+	// The schedule loop, config handler, and reload path may all evaluate
+	// at once.  The closing VAP should still only be stopped once.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			h.evaluateSchedules(false)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+
+	if cmds := as.received(); len(cmds) != 0 {
+		t.Errorf("open VAP got %v", cmds)
+	}
+	if cmds := ns.received(); !reflect.DeepEqual(cmds,
+		[]string{"STOP_AP"}) {
+		t.Errorf("closed VAP got %v, want [STOP_AP]", cmds)
+	}
+	if always.closed || !never.closed {
+		t.Errorf("closed: got %v/%v, want false/true", always.closed,
+			never.closed)
+	}
+
+	// After a reload, the current state is reasserted
+	h.evaluateSchedules(true)
+	if cmds := as.received(); !reflect.DeepEqual(cmds,
+		[]string{"UPDATE_BEACON"}) {
+		t.Errorf("open VAP got %v, want [UPDATE_BEACON]", cmds)
+	}
+	if cmds := ns.received(); !reflect.DeepEqual(cmds,
+		[]string{"STOP_AP"}) {
+		t.Errorf("closed VAP got %v, want [STOP_AP]", cmds)
+	}
+}
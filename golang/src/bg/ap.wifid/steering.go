@@ -0,0 +1,320 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// The steering engine tries to keep each client on the best BSS available to
+// it:
+//
+//   Band steering: a client we have heard on both bands is steered from 2.4GHz
+//   to 5GHz, provided its 5GHz signal is strong enough.  Clients that haven't
+//   connected yet are nudged toward 5GHz by having the 2.4GHz BSS ignore their
+//   probe requests.
+//
+//   Client steering: a client whose signal has dropped below a threshold is
+//   steered toward the same VAP on another node (see roaming.go).
+//
+// Associated clients are steered with BSS Transition Management requests.
+// Clients are free to ignore them, so every client has a holdoff between
+// attempts, and a cap on the number of attempts within a window.  The band
+// steering threshold is stronger than the weak signal threshold, so a client
+// that is steered to 5GHz won't immediately be found to be weak there.
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bg/ap_common/apcfg"
+	"bg/ap_common/aputil"
+	"bg/base_def"
+	"bg/base_msg"
+	"bg/common/network"
+	"bg/common/wifi"
+
+	"github.com/golang/protobuf/proto"
+)
+
+var (
+	steerThreshold = apcfg.Int("steer_signal", -75, true, nil)
+	bandThreshold  = apcfg.Int("band_steer_signal", -70, true, nil)
+	steerHoldoff   = apcfg.Duration("steer_holdoff", 5*time.Minute,
+		true, nil)
+	steerMaxTries = apcfg.Int("steer_max_attempts", 3, true, nil)
+	steerWindow   = apcfg.Duration("steer_window", time.Hour, true, nil)
+	steerFresh    = apcfg.Duration("steer_sample_age", 2*time.Minute,
+		true, nil)
+)
+
+// A single signal strength observation
+type rssiSample struct {
+	signal int
+	when   time.Time
+}
+
+// Everything we know about a single client's radio environment
+type steerHistory struct {
+	hiBand   bool                  // client has been heard on 5GHz
+	rssi     map[string]rssiSample // indexed by local bssid
+	attempts []time.Time           // recent steering attempts
+	lastSeen time.Time
+}
+
+var steering = struct {
+	clients   map[string]*steerHistory
+	lastPrune time.Time
+	sync.Mutex
+}{
+	clients: make(map[string]*steerHistory),
+}
+
+// Drop any clients we haven't heard from within the steering window.  Must be
+// called with the steering lock held.
+func pruneSteering(now time.Time) {
+	if now.Sub(steering.lastPrune) < time.Minute {
+		return
+	}
+
+	for mac, h := range steering.clients {
+		if now.Sub(h.lastSeen) > *steerWindow {
+			delete(steering.clients, mac)
+		}
+	}
+	steering.lastPrune = now
+}
+
+// Record a signal strength observation for a client on one of our BSSes
+func recordSignal(mac, bssid, band string, signal int) {
+	now := time.Now()
+
+	steering.Lock()
+	defer steering.Unlock()
+
+	pruneSteering(now)
+	h := steering.clients[mac]
+	if h == nil {
+		h = &steerHistory{
+			rssi:     make(map[string]rssiSample),
+			attempts: make([]time.Time, 0),
+		}
+		steering.clients[mac] = h
+	}
+	h.rssi[bssid] = rssiSample{signal: signal, when: now}
+	h.lastSeen = now
+	if band == wifi.HiBand {
+		h.hiBand = true
+	}
+}
+
+// If the client is known to be dual-band, return its most recent signal
+// strength on a local 5GHz BSS, provided it is fresh enough to be trusted.
+func hiBandSignal(mac, bssid string) (int, bool) {
+	steering.Lock()
+	defer steering.Unlock()
+
+	if h := steering.clients[mac]; h != nil && h.hiBand {
+		s, ok := h.rssi[bssid]
+		if ok && time.Since(s.when) < *steerFresh {
+			return s.signal, true
+		}
+	}
+	return 0, false
+}
+
+// Determine whether we are allowed to steer this client now.  If so, the
+// attempt is recorded.
+func steerAllowed(mac string) bool {
+	now := time.Now()
+
+	steering.Lock()
+	defer steering.Unlock()
+
+	h := steering.clients[mac]
+	if h == nil {
+		return false
+	}
+
+	recent := make([]time.Time, 0)
+	for _, t := range h.attempts {
+		if now.Sub(t) < *steerWindow {
+			recent = append(recent, t)
+		}
+	}
+	h.attempts = recent
+
+	if len(recent) >= *steerMaxTries {
+		return false
+	}
+	if len(recent) > 0 && now.Sub(recent[len(recent)-1]) < *steerHoldoff {
+		return false
+	}
+
+	h.attempts = append(h.attempts, now)
+	return true
+}
+
+// Find the connection hosting the given VAP on the given band of this node
+func (h *hostapdHdl) findConn(vapName, band string) *hostapdConn {
+	for _, c := range h.conns {
+		if c.vapName == vapName && c.wifiBand == band {
+			return c
+		}
+	}
+	return nil
+}
+
+// Describe one of our own BSSes as a steering target
+func (c *hostapdConn) neighbor() neighbor {
+	return neighbor{
+		bssid:   c.bssid,
+		node:    nodeID,
+		band:    c.wifiBand,
+		channel: c.device.wifi.activeChannel,
+		vht:     c.device.wifi.activeMode == "ac",
+	}
+}
+
+// Handle an RX-PROBE-REQUEST event.  This is called with the connection lock
+// held, so it must not issue any hostapd commands.
+func (c *hostapdConn) probeReceived(status string) {
+	var sta string
+	var signal int
+	var err error
+
+	for _, f := range strings.Fields(status) {
+		if strings.HasPrefix(f, "sa=") {
+			sta = strings.ToLower(strings.TrimPrefix(f, "sa="))
+		} else if strings.HasPrefix(f, "signal=") {
+			signal, err = strconv.Atoi(strings.TrimPrefix(f,
+				"signal="))
+		}
+	}
+
+	if sta != "" && err == nil && signal != 0 {
+		recordSignal(sta, c.bssid, c.wifiBand, signal)
+	}
+}
+
+// Choose the BSSes, if any, this client should be steered toward
+func (c *hostapdConn) steerTargets(sta string,
+	signal int) (base_msg.EventNetSteer_Reason, []neighbor) {
+
+	var reason base_msg.EventNetSteer_Reason
+
+	targets := make([]neighbor, 0)
+	vap := virtualAPs[c.vapName]
+	if vap == nil {
+		return reason, targets
+	}
+
+	if vap.BandSteering && c.wifiBand == wifi.LoBand {
+		peer := c.hostapd.findConn(c.vapName, wifi.HiBand)
+		if peer != nil {
+			hi, ok := hiBandSignal(sta, peer.bssid)
+			if ok && hi >= *bandThreshold {
+				reason = base_msg.EventNetSteer_BAND
+				targets = append(targets, peer.neighbor())
+				return reason, targets
+			}
+		}
+	}
+
+	if vap.Roaming && signal < *steerThreshold {
+		reason = base_msg.EventNetSteer_WEAK_SIGNAL
+		c.Lock()
+		for _, n := range c.neighbors {
+			targets = append(targets, n)
+		}
+		c.Unlock()
+	}
+
+	return reason, targets
+}
+
+// Evaluate a client's latest signal strength, and send it a BSS Transition
+// Management request if it would be better served elsewhere.
+func (c *hostapdConn) checkSteering(sta string, signal int) {
+	recordSignal(sta, c.bssid, c.wifiBand, signal)
+
+	reason, targets := c.steerTargets(sta, signal)
+	if len(targets) == 0 || !steerAllowed(sta) {
+		return
+	}
+
+	slog.Infof("%v steering %s (signal %d, reason %v) to one of %d BSSes",
+		c, sta, signal, reason, len(targets))
+
+	cmd := "BSS_TM_REQ " + sta + " pref=1 abridged=1"
+	for _, t := range targets {
+		cmd += " neighbor=" + t.candidate()
+	}
+	if _, err := c.command(cmd); err != nil {
+		slog.Warnf("%v steering %s: %v", c, sta, err)
+		return
+	}
+
+	sendNetSteer(sta, c, reason, signal, targets)
+}
+
+func sendNetSteer(mac string, c *hostapdConn,
+	reason base_msg.EventNetSteer_Reason, signal int, targets []neighbor) {
+
+	list := make([]string, 0)
+	for _, t := range targets {
+		list = append(list, t.bssid)
+	}
+
+	hwaddr, _ := net.ParseMAC(mac)
+	event := &base_msg.EventNetSteer{
+		Timestamp:  aputil.NowToProtobuf(),
+		Sender:     proto.String(brokerd.Name),
+		Debug:      proto.String("-"),
+		Reason:     &reason,
+		MacAddress: proto.Uint64(network.HWAddrToUint64(hwaddr)),
+		Node:       proto.String(nodeID),
+		VirtualAP:  proto.String(c.vapName),
+		Band:       proto.String(c.wifiBand),
+		Bssid:      proto.String(c.bssid),
+		Signal:     proto.Int32(int32(signal)),
+		Targets:    list,
+	}
+
+	err := brokerd.Publish(event, base_def.TOPIC_STEER)
+	if err != nil {
+		slog.Warnf("couldn't publish %s: %v", base_def.TOPIC_STEER, err)
+	}
+}
+
+// For each 2.4GHz BSS with band steering enabled, find the 5GHz BSS hosting
+// the same VAP.  hostapd will then ignore probes on 2.4GHz from clients it has
+// recently heard on 5GHz.
+func setBandSteering(vaps []*vapConfig) {
+	hi := make(map[string]*vapConfig)
+	for _, v := range vaps {
+		if v.physical.wifi.activeBand == wifi.HiBand {
+			hi[v.Name] = v
+		}
+	}
+
+	for _, v := range vaps {
+		v.SteerComment = "#"
+		if !v.vap.BandSteering {
+			continue
+		}
+		v.BTMComment = ""
+
+		peer := hi[v.Name]
+		if v.physical.wifi.activeBand == wifi.LoBand && peer != nil {
+			v.SteerComment = ""
+			v.SteerPeer = peer.logical.name
+		}
+	}
+}
@@ -0,0 +1,356 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"text/template"
+
+	"bg/ap_common/wificaps"
+	"bg/base_def"
+	"bg/common/cfgapi"
+	"bg/common/wifi"
+
+	"go.uber.org/zap/zaptest"
+)
+
+var (
+	wpa2Caps = &wificaps.WifiCapabilities{}
+	wpa3Caps = &wificaps.WifiCapabilities{
+		SupportPMF: true,
+		SupportSAE: true,
+	}
+
+	testPSKs = map[string]*cfgapi.VirtualAPPSK{
+		"iot": {Passphrase: "iotpassword", Ring: "devices"},
+	}
+
+	loDev = &physDevice{
+		name:   "wlan0",
+		hwaddr: "00:11:22:33:44:00",
+		wifi:   &wifiInfo{activeBand: wifi.LoBand},
+	}
+	hiDev = &physDevice{
+		name:   "wlan1",
+		hwaddr: "00:11:22:33:44:10",
+		wifi:   &wifiInfo{activeBand: wifi.HiBand},
+	}
+
+	VirtualAPTests = []struct {
+		keymgmt string
+		pmf     string
+		roaming bool
+		steer   bool
+		psks    map[string]*cfgapi.VirtualAPPSK
+		caps    *wificaps.WifiCapabilities
+		fail    bool
+		present []string
+		absent  []string
+	}{
+		{
+			keymgmt: "wpa-psk",
+			caps:    wpa2Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-PSK\n",
+				"wpa_pairwise=TKIP CCMP\n",
+				"ieee80211w=0\n",
+				"\nwpa_passphrase=",
+			},
+			absent: []string{
+				"\nsae_password=",
+				"\nieee8021x=1",
+				"\nwpa_psk_file=",
+				"\nmobility_domain=",
+				"\nbss_transition=",
+				"\nno_probe_resp_if_seen_on=",
+			},
+		},
+		{
+			keymgmt: "wpa-psk",
+			roaming: true,
+			caps:    wpa2Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-PSK FT-PSK\n",
+				"\nmobility_domain=9f86\n",
+				"\nr0kh=ff:ff:ff:ff:ff:ff * 0011223344\n",
+				"\nrrm_neighbor_report=1\n",
+				"\nbss_transition=1\n",
+			},
+		},
+		{
+			keymgmt: "wpa-psk",
+			steer:   true,
+			caps:    wpa2Caps,
+			present: []string{
+				"\nbss_transition=1\n",
+				"\nno_probe_resp_if_seen_on=wlan1\n",
+			},
+			absent: []string{"\nmobility_domain="},
+		},
+		{
+			keymgmt: "wpa-psk+sae",
+			roaming: true,
+			caps:    wpa3Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-PSK SAE FT-PSK FT-SAE\n",
+			},
+		},
+		{
+			keymgmt: "wpa-psk",
+			psks:    testPSKs,
+			caps:    wpa2Caps,
+			present: []string{
+				"\nwpa_passphrase=",
+				"\nwpa_psk_file=/tmp/test.psk\n",
+			},
+		},
+		{
+			// PSKs don't apply to SAE
+			keymgmt: "sae",
+			psks:    testPSKs,
+			caps:    wpa3Caps,
+			absent:  []string{"\nwpa_psk_file="},
+		},
+		{
+			keymgmt: "wpa-psk+sae",
+			psks:    testPSKs,
+			caps:    wpa3Caps,
+			present: []string{"\nwpa_psk_file=/tmp/test.psk\n"},
+		},
+		{
+			keymgmt: "wpa-psk",
+			pmf:     "optional",
+			caps:    wpa3Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-PSK\n",
+				"wpa_pairwise=CCMP\n",
+				"ieee80211w=1\n",
+			},
+		},
+		{
+			keymgmt: "wpa-eap",
+			caps:    wpa2Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-EAP\n",
+				"\nieee8021x=1\n",
+			},
+			absent: []string{"\nwpa_passphrase=", "\nsae_password="},
+		},
+		{
+			keymgmt: "sae",
+			caps:    wpa3Caps,
+			present: []string{
+				"wpa_key_mgmt=SAE\n",
+				"wpa_pairwise=CCMP\n",
+				"ieee80211w=2\n",
+				"\nsae_password=",
+			},
+			absent: []string{"\nwpa_passphrase=", "TKIP"},
+		},
+		{
+			// Key management modes aren't case-sensitive
+			keymgmt: "SAE",
+			caps:    wpa3Caps,
+			present: []string{
+				"wpa_key_mgmt=SAE\n",
+				"\nsae_password=password\n",
+			},
+		},
+		{
+			keymgmt: "sae",
+			caps:    wpa2Caps,
+			fail:    true,
+		},
+		{
+			keymgmt: "wpa-psk+sae",
+			caps:    wpa3Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-PSK SAE\n",
+				"wpa_pairwise=CCMP\n",
+				"ieee80211w=1\n",
+				"\nwpa_passphrase=",
+				"\nsae_password=",
+				"\nsae_require_mfp=1\n",
+			},
+			absent: []string{"TKIP"},
+		},
+		{
+			// Transition mode falls back to WPA2 on older devices
+			keymgmt: "wpa-psk+sae",
+			caps:    wpa2Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-PSK\n",
+				"ieee80211w=0\n",
+			},
+			absent: []string{"\nsae_password="},
+		},
+		{
+			keymgmt: "wpa3-eap",
+			caps:    wpa3Caps,
+			present: []string{
+				"wpa_key_mgmt=WPA-EAP WPA-EAP-SHA256\n",
+				"wpa_pairwise=CCMP\n",
+				"ieee80211w=2\n",
+				"\nieee8021x=1\n",
+			},
+			absent: []string{"TKIP"},
+		},
+		{
+			keymgmt: "wpa3-eap",
+			caps:    wpa2Caps,
+			fail:    true,
+		},
+		{
+			keymgmt: "wpa-psk",
+			pmf:     "required",
+			caps:    wpa2Caps,
+			fail:    true,
+		},
+		{
+			keymgmt: "wep",
+			caps:    wpa3Caps,
+			fail:    true,
+		},
+	}
+)
+
+func TestVirtualAPTemplate(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	tplt, err := template.ParseFiles("virtualap.conf.got")
+	if err != nil {
+		t.Fatalf("virtualap.conf.got template parse failed: %v\n", err)
+	}
+
+	for _, tc := range VirtualAPTests {
+		name := fmt.Sprintf("%s/%s/%d", tc.keymgmt, tc.pmf, len(tc.psks))
+		vap := &cfgapi.VirtualAP{
+			SSID:         "test",
+			KeyMgmt:      tc.keymgmt,
+			Passphrase:   "password",
+			PMF:          tc.pmf,
+			PSKs:         tc.psks,
+			Roaming:      tc.roaming,
+			BandSteering: tc.steer,
+		}
+		conf := &vapConfig{
+			Name:       "test",
+			SSID:       vap.SSID,
+			Passphrase: vap.Passphrase,
+			ConfPrefix: "/tmp/test",
+			physical:   loDev,
+			logical:    loDev,
+			vap:        vap,
+		}
+		peer := &vapConfig{
+			Name:     "test",
+			physical: hiDev,
+			logical:  hiDev,
+			vap:      vap,
+		}
+
+		err = conf.setSecurity(vap, tc.caps)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("%s: expected failure", name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: unexpected failure: %v", name, err)
+			continue
+		}
+		conf.setRoaming(vap, "0011223344")
+		setBandSteering([]*vapConfig{conf, peer})
+
+		var b bytes.Buffer
+		if err = tplt.Execute(&b, conf); err != nil {
+			t.Fatalf("%s: template execution failed: %v\n", name, err)
+		}
+		out := b.String()
+		for _, p := range tc.present {
+			if !strings.Contains(out, p) {
+				t.Errorf("%s: missing %q", name, p)
+			}
+		}
+		for _, a := range tc.absent {
+			if strings.Contains(out, a) {
+				t.Errorf("%s: unexpected %q", name, a)
+			}
+		}
+	}
+}
+
+func TestPSKConf(t *testing.T) {
+	slog = zaptest.NewLogger(t).Sugar()
+
+	dir, err := ioutil.TempDir("", "psk")
+	if err != nil {
+		t.Fatalf("creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	rings = cfgapi.RingMap{
+		"devices": {Vlan: 4, VirtualAPs: []string{"test"}},
+		"guest":   {Vlan: 6, VirtualAPs: []string{"guest"}},
+		base_def.RING_QUARANTINE: {
+			Vlan:       7,
+			VirtualAPs: []string{"test"},
+		},
+	}
+	clients = cfgapi.ClientMap{
+		"00:40:54:00:00:01": {Ring: "devices"},
+		"00:40:54:00:00:02": {Ring: base_def.RING_QUARANTINE},
+	}
+	defer func() {
+		rings = make(cfgapi.RingMap)
+		clients = make(cfgapi.ClientMap)
+	}()
+
+	vap := &cfgapi.VirtualAP{
+		PSKs: map[string]*cfgapi.VirtualAPPSK{
+			"iot":      {Passphrase: "iotpassword", Ring: "devices"},
+			"bad name": {Passphrase: "badpassword", Ring: "devices"},
+			"guest":    {Passphrase: "guestpassword", Ring: "guest"},
+			"mine": {
+				Passphrase: "minepassword",
+				Ring:       "devices",
+				Mac:        "00:40:54:00:00:01",
+			},
+		},
+	}
+	conf := &vapConfig{
+		Name:       "test",
+		ConfPrefix: filepath.Join(dir, "test"),
+		vap:        vap,
+	}
+	if err = generatePSKConf(conf); err != nil {
+		t.Fatalf("generatePSKConf failed: %v", err)
+	}
+	data, err := ioutil.ReadFile(conf.ConfPrefix + ".psk")
+	if err != nil {
+		t.Fatalf("reading psk file: %v", err)
+	}
+
+	// Invalid names and keys for rings not on the VAP are skipped.  The
+	// quarantined client may use the shared key, but without a vlanid.
+	want := "keyid=iot vlanid=4 00:00:00:00:00:00 iotpassword\n" +
+		"keyid=mine vlanid=4 00:40:54:00:00:01 minepassword\n" +
+		"keyid=iot 00:40:54:00:00:02 iotpassword\n"
+	if string(data) != want {
+		t.Errorf("got:\n%s\nexpected:\n%s", data, want)
+	}
+}
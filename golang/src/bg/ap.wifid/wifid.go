@@ -50,10 +50,13 @@ var (
 	retransmitHardLimit = apcfg.Int("retransmit_hard", 6, true, nil)
 	retransmitTimeout   = apcfg.Duration("retransmit_timeout",
 		5*time.Minute, true, nil)
-	apScanFreq   = apcfg.Duration("ap_scan_freq", 7*time.Hour, true, nil)
-	apStale      = apcfg.Duration("ap_stale", 10*time.Minute, true, nil)
-	chanEvalFreq = apcfg.Duration("chan_eval_freq", 12*time.Hour, true, nil)
-	_            = apcfg.String("log_level", "info", true,
+	apScanFreq     = apcfg.Duration("ap_scan_freq", 7*time.Hour, true, nil)
+	apStale        = apcfg.Duration("ap_stale", 10*time.Minute, true, nil)
+	chanEvalFreq   = apcfg.Duration("chan_eval_freq", 12*time.Hour, true, nil)
+	chanHysteresis = apcfg.Int("chan_hysteresis", 25, true, nil)
+	chanMinGain    = apcfg.Int("chan_min_gain", 20, true, nil)
+	dfsPenalty     = apcfg.Int("dfs_penalty", 40, true, nil)
+	_              = apcfg.String("log_level", "info", true,
 		aputil.LogSetLevel)
 
 	mcpd    *mcp.MCP
@@ -392,6 +395,11 @@ func main() {
 		if err := radiusInit(); err != nil {
 			slog.Warnf("failed to init RADIUS support: %v", err)
 		}
+		if key, err := establishFTKey(); err != nil {
+			slog.Warnf("failed to establish FT key: %v", err)
+		} else {
+			wconf.ftKey = key
+		}
 	}
 
 	mcpd.SetState(mcp.ONLINE)
@@ -401,6 +409,7 @@ func main() {
 
 	go apMonitorLoop(&cleanup.wg, addDoneChan())
 	go hostapdLoop(&cleanup.wg, addDoneChan())
+	go scheduleLoop(&cleanup.wg, addDoneChan())
 
 	go http.ListenAndServe(base_def.WIFID_DIAG_PORT, nil)
 
@@ -271,6 +271,25 @@ func GetComm(cfgHdl *cfgapi.Handle) *comms.APComm {
 	return self.comm
 }
 
+// SiteNow returns the current time in the site's time zone.  If no time zone
+// has been configured, we assume the appliance's local time matches the site's.
+// If the configured time zone can't be loaded, the appliance's local time is
+// returned along with the error.
+func SiteNow(cfgHdl *cfgapi.Handle) (time.Time, error) {
+	now := time.Now()
+
+	tz, err := cfgHdl.GetProp("@/network/timezone")
+	if err != nil {
+		return now, nil
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return now, fmt.Errorf("bad timezone %s: %v", tz, err)
+	}
+	return now.In(loc), nil
+}
+
 // Close closes the link to ap.configd.
 func (c *APConfig) Close() {
 	if c != nil {
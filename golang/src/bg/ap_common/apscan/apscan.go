@@ -29,6 +29,7 @@ type ScannedAP struct {
 	Width     int
 	Strength  int
 	LastSeen  time.Duration
+	Security  string // open, wep, wpa, or wpa2
 }
 
 var (
@@ -66,6 +67,15 @@ var (
 	// * secondary channel offset: no secondary
 	bssSecondaryRE = regexp.MustCompile(`\* secondary channel offset: ([\S]+)`)
 
+	// capability: ESS Privacy ShortSlotTime (0x0411)
+	bssPrivacyRE = regexp.MustCompile(`\scapability: .*\bPrivacy\b`)
+
+	// RSN:	 * Version: 1
+	bssRSNRE = regexp.MustCompile(`\sRSN:\s`)
+
+	// WPA:	 * Version: 1
+	bssWPARE = regexp.MustCompile(`\sWPA:\s`)
+
 	plat *platform.Platform
 )
 
@@ -133,6 +143,17 @@ func parseOneBSS(data string) *ScannedAP {
 		ap.Width = 20
 	}
 
+	// An AP advertising privacy without a WPA or RSN element is using WEP
+	if bssRSNRE.MatchString(data) {
+		ap.Security = "wpa2"
+	} else if bssWPARE.MatchString(data) {
+		ap.Security = "wpa"
+	} else if bssPrivacyRE.MatchString(data) {
+		ap.Security = "wep"
+	} else {
+		ap.Security = "open"
+	}
+
 	d := getIntRE(data, bssSeenRE)
 	ap.LastSeen = time.Duration(d) * time.Millisecond
 
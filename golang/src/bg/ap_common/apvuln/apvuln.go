@@ -30,6 +30,7 @@ type TestResult struct {
 	Tool     string                 `json:"tool"`
 	Name     string                 `json:"name"`
 	Nickname string                 `json:"nickname"`
+	CVSS     float64                `json:"cvss,omitempty"`
 	Details  map[string]interface{} `json:"details,omitempty"`
 }
 
@@ -65,6 +66,8 @@ func (tr *TestResult) DetailsSummary() string {
 			message = fmt.Sprintf("%s%s", inspectDetails(detail), message)
 		case "ap-defaultpass": // apvuln.DPvulnerability
 			message = fmt.Sprintf("%s%s", dpDetails(detail), message)
+		case "cve-match": // see cveDetail() in ap.watchd
+			message = fmt.Sprintf("%s%s", cveDetails(detail), message)
 		default:
 			log.Printf("DetailsSummary unknown tool %s", tr.Tool)
 		}
@@ -88,16 +91,32 @@ func inspectDetails(detail map[string]interface{}) string {
 		defaultStr(detail["port"], "unknown"))
 }
 
+func cveDetails(detail map[string]interface{}) string {
+	return fmt.Sprintf("CVSS: %s | Program: %#v | Version: %s | "+
+		"Service: %#v | Protocol: %s | Port: %s\n",
+		defaultStr(detail["cvss"], "unknown"),
+		defaultStr(detail["program"], "unknown"),
+		defaultStr(detail["program_ver"], ""),
+		defaultStr(detail["service"], "unknown"),
+		defaultStr(detail["protocol"], "unknown"),
+		defaultStr(detail["port"], "unknown"))
+}
+
 func dpDetails(detail map[string]interface{}) string {
 	// Password: %#v\n
 	// MUST END THE LINE SO IT CAN BE PARSED
 	// (assumes no users or passwords contain \n)
 	var creds = detail["credentials"].(map[string]interface{})
+	var auth string
+	if a := defaultStr(detail["auth"], ""); a != "" {
+		auth = "Auth: " + a + " | "
+	}
 	return fmt.Sprintf("Service: %s | Protocol: %s | Port: %s | "+
-		"User: %#v | Password: %#v\n",
+		"%sUser: %#v | Password: %#v\n",
 		defaultStr(detail["service"], "unknown"),
 		defaultStr(detail["protocol"], "unknown"),
 		defaultStr(detail["port"], "unknown"),
+		auth,
 		defaultStr(creds["username"], `""`),
 		defaultStr(creds["password"], `""`))
 }
@@ -174,7 +193,8 @@ func ParseDetailsSummary(object interface{}, details string) error {
 		ob = object.(*DPvulnerability)
 		re := regexp.MustCompile(
 			"Service: (.*?) [|] Protocol: (.*?) [|] Port: (.*?) " +
-				"[|] User: (.*?) [|] Password: (.*?)\n?$")
+				"[|] (?:Auth: (.*?) [|] )?User: (.*?) " +
+				"[|] Password: (.*?)\n?$")
 		strs := re.FindStringSubmatch(details)
 		if len(strs) < 2 {
 			return ParseDetailsError{
@@ -183,13 +203,14 @@ func ParseDetailsSummary(object interface{}, details string) error {
 		ob.Service = strs[1]
 		ob.Protocol = strs[2]
 		ob.Port = strs[3]
+		ob.Auth = strs[4]
 		var err error
-		ob.Credentials.Username, err = strconv.Unquote(strs[4])
+		ob.Credentials.Username, err = strconv.Unquote(strs[5])
 		if err != nil {
 			return ParseDetailsError{
-				fmt.Sprintf("bad username: %s", strs[4])}
+				fmt.Sprintf("bad username: %s", strs[5])}
 		}
-		ob.Credentials.Password, err = strconv.Unquote(strs[5])
+		ob.Credentials.Password, err = strconv.Unquote(strs[6])
 		if err != nil {
 			return ParseDetailsError{
 				fmt.Sprintf("bad password: %s", "<redacted>")}
@@ -233,6 +254,33 @@ type InspectVulnProbe struct {
 	Vulns      Vulnerabilities
 }
 
+// InspectVersionRange is an inclusive range of vulnerable versions.  An empty
+// Min or Max leaves that end of the range open.
+//
+type InspectVersionRange struct {
+	Min string `json:"Min,omitempty"`
+	Max string `json:"Max,omitempty"`
+}
+
+// InspectProbe describes a banner probe run by ap-inspect.  It is stored as
+// the "Probe" field of an entry in the vulnerability database.
+//
+// ap-inspect connects to each port (by default, the standard port for
+// Service), optionally sends the Send string, and reads up to Lines lines
+// (default 1) looking for one matching the Banner regular expression.  The
+// first subexpression of Banner captures the program's version, which is
+// compared against the Vulnerable ranges.
+//
+type InspectProbe struct {
+	Service    string                `json:"Service"`            // "smtp"
+	Protocol   string                `json:"Protocol,omitempty"` // "tcp"
+	Send       string                `json:"Send,omitempty"`
+	Lines      int                   `json:"Lines,omitempty"`
+	Banner     string                `json:"Banner"`
+	Program    string                `json:"Program"` // "exim"
+	Vulnerable []InspectVersionRange `json:"Vulnerable"`
+}
+
 // InspectVulnerability represents one vulnerability discovered by ap-inspect
 //
 type InspectVulnerability struct {
@@ -259,6 +307,7 @@ type DPvulnerability struct {
 	Protocol    string        `json:"protocol,omitempty"`
 	Service     string        `json:"service"` // "smtp", "ssh", etc.
 	Port        string        `json:"port"`
+	Auth        string        `json:"auth,omitempty"` // "digest", "v2c", etc.
 	Credentials DPcredentials `json:"credentials"`
 }
 
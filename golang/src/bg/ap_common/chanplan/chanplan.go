@@ -0,0 +1,473 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Package chanplan computes a joint channel assignment for all of the wireless
+// radios in a site.  Left to themselves, each node picks the least congested
+// channel it can see, which often puts the gateway and its satellites on the
+// same channel.  The planner considers all of the radios together, trading off
+// the congestion each node observes against the overlap between our own
+// radios.
+//
+// Each node provides its inputs in the config tree:
+//
+//    @/nodes/<node>/nics/<nic>/channels      supported channels
+//    @/nodes/<node>/nics/<nic>/dfs_channels  channels requiring radar detection
+//    @/nodes/<node>/nics/<nic>/modes         supported 802.11 modes
+//    @/nodes/<node>/nics/<nic>/congestion    per-channel congestion estimates
+//
+// The plan is applied by setting cfg_channel and cfg_width for each radio.  The
+// planner records the settings it chose in cfg_planned, so it can tell whether
+// a radio's channel was subsequently set by the user.  Radios with a channel
+// chosen by the user are left alone.
+package chanplan
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bg/ap_common/wificaps"
+	"bg/common/cfgapi"
+	"bg/common/wifi"
+)
+
+// Default costs used to weigh the options
+const (
+	DefaultOverlapCost = 100 // per 20MHz channel shared with another radio
+	DefaultDFSPenalty  = 40  // for a channel requiring radar detection
+
+	maxPasses = 10
+)
+
+// Radio describes a single wireless NIC and its radio environment
+type Radio struct {
+	Node       string
+	Nic        string
+	Band       string
+	Channels   map[int]bool // 20MHz channels this radio may use
+	DFS        map[int]bool // channels requiring radar detection
+	MaxWidth   int
+	Congestion map[int]int // per-20MHz channel congestion
+	Channel    int         // currently active channel
+	Width      int         // currently active width
+	Fixed      bool        // channel was configured by the user
+	Planned    bool        // channel was configured by the planner
+}
+
+// Assignment is the channel chosen for a single radio
+type Assignment struct {
+	Radio   *Radio
+	Channel int
+	Width   int
+}
+
+// Plan is a channel assignment for all of the radios in a site
+type Plan struct {
+	Assignments []Assignment
+	Cost        int // total cost of the planned assignment
+	CurrentCost int // total cost of the current assignment
+}
+
+// Costs are the weights used to choose between assignments
+type Costs struct {
+	Overlap int
+	DFS     int
+}
+
+type option struct {
+	channel int
+	width   int
+}
+
+func (r *Radio) String() string {
+	return r.Node + "/" + r.Nic
+}
+
+// Return all of the channel/width options available to this radio, from the
+// widest to the narrowest.
+func (r *Radio) options() []option {
+	var lists []string
+
+	if r.Fixed {
+		return []option{{r.Channel, r.Width}}
+	}
+
+	if r.Band == wifi.LoBand {
+		lists = []string{"loBandNoOverlap"}
+	} else {
+		lists = []string{"hiBand80MHz", "hiBand40MHz", "hiBand20MHz"}
+	}
+
+	opts := make([]option, 0)
+	for _, list := range lists {
+		width := 20
+		if strings.HasSuffix(list, "80MHz") {
+			width = 80
+		} else if strings.HasSuffix(list, "40MHz") {
+			width = 40
+		}
+		if width > r.MaxWidth {
+			continue
+		}
+
+		for _, c := range wificaps.ChannelLists[list] {
+			usable := true
+			for _, s := range wifi.SpanChannels(c, width) {
+				usable = usable && r.Channels[s]
+			}
+			if usable {
+				opts = append(opts, option{c, width})
+			}
+		}
+	}
+
+	return opts
+}
+
+// The cost of this radio using a channel, ignoring our other radios.  As in
+// ap.wifid, the congestion is normalized to a single 20MHz channel.
+func (r *Radio) cost(o option, costs Costs) int {
+	var cost, dfs int
+
+	for _, c := range wifi.SpanChannels(o.channel, o.width) {
+		cost += r.Congestion[c]
+		if r.DFS[c] {
+			dfs = costs.DFS
+		}
+	}
+
+	return cost/(o.width/20) + dfs
+}
+
+// The number of 20MHz channels used by both options
+func shared(a, b option) int {
+	var cnt int
+
+	if a.channel == 0 || b.channel == 0 {
+		return 0
+	}
+
+	bSpan := make(map[int]bool)
+	for _, c := range wifi.SpanChannels(b.channel, b.width) {
+		bSpan[c] = true
+	}
+	for _, c := range wifi.SpanChannels(a.channel, a.width) {
+		if bSpan[c] {
+			cnt++
+		}
+	}
+
+	return cnt
+}
+
+// The cost of radio 'i' using the given option, given the choices made for all
+// of the other radios
+func costOf(radios []*Radio, choice []option, i int, o option,
+	costs Costs) int {
+
+	cost := radios[i].cost(o, costs)
+	for j, r := range radios {
+		if j != i && r.Band == radios[i].Band {
+			cost += costs.Overlap * shared(o, choice[j])
+		}
+	}
+
+	return cost
+}
+
+// The total cost of a set of choices
+func totalCost(radios []*Radio, choice []option, costs Costs) int {
+	var total int
+
+	for i, r := range radios {
+		if choice[i].channel == 0 {
+			continue
+		}
+		total += r.cost(choice[i], costs)
+		for j := i + 1; j < len(radios); j++ {
+			if radios[j].Band == r.Band {
+				total += costs.Overlap * shared(choice[i],
+					choice[j])
+			}
+		}
+	}
+
+	return total
+}
+
+// Compute finds a low-cost channel assignment for the provided radios.  The
+// search starts from the current assignment and repeatedly moves each radio to
+// its best option given the others, until no radio wants to move.  Starting
+// from the current assignment means we only move radios when it helps.
+func Compute(radios []*Radio, costs Costs) *Plan {
+	sort.Slice(radios, func(i, j int) bool {
+		return radios[i].String() < radios[j].String()
+	})
+
+	current := make([]option, len(radios))
+	choice := make([]option, len(radios))
+	for i, r := range radios {
+		current[i] = option{r.Channel, r.Width}
+
+		// If the current channel isn't one we would choose, start
+		// from scratch.
+		for _, o := range r.options() {
+			if o == current[i] {
+				choice[i] = o
+			}
+		}
+	}
+
+	for pass := 0; pass < maxPasses; pass++ {
+		changed := false
+		for i, r := range radios {
+			best := choice[i]
+			bestCost := 0
+			if best.channel != 0 {
+				bestCost = costOf(radios, choice, i, best, costs)
+			}
+			for _, o := range r.options() {
+				c := costOf(radios, choice, i, o, costs)
+				if best.channel == 0 || c < bestCost {
+					best = o
+					bestCost = c
+				}
+			}
+			if best != choice[i] {
+				choice[i] = best
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+
+	plan := &Plan{
+		Assignments: make([]Assignment, 0),
+		Cost:        totalCost(radios, choice, costs),
+		CurrentCost: totalCost(radios, current, costs),
+	}
+	for i, r := range radios {
+		plan.Assignments = append(plan.Assignments, Assignment{
+			Radio:   r,
+			Channel: choice[i].channel,
+			Width:   choice[i].width,
+		})
+	}
+
+	return plan
+}
+
+// Changes returns the assignments that differ from the radios' current
+// channels.
+func (p *Plan) Changes() []Assignment {
+	changes := make([]Assignment, 0)
+	for _, a := range p.Assignments {
+		r := a.Radio
+		if a.Channel != 0 && (a.Channel != r.Channel ||
+			a.Width != r.Width || !(r.Planned || r.Fixed)) {
+			changes = append(changes, a)
+		}
+	}
+
+	return changes
+}
+
+func plannedValue(channel, width int) string {
+	return fmt.Sprintf("%d/%d", channel, width)
+}
+
+// Parse a congestion list: "36:120,40:80,..."
+func parseCongestion(val string) map[int]int {
+	cmap := make(map[int]int)
+	for _, f := range strings.Split(val, ",") {
+		pair := strings.Split(f, ":")
+		if len(pair) != 2 {
+			continue
+		}
+		c, err := strconv.Atoi(pair[0])
+		if err != nil {
+			continue
+		}
+		if v, err := strconv.Atoi(pair[1]); err == nil {
+			cmap[c] = v
+		}
+	}
+
+	return cmap
+}
+
+// FormatCongestion converts a per-channel congestion map into the format
+// stored in the config tree.
+func FormatCongestion(cmap map[int]int) string {
+	channels := make([]int, 0)
+	for c := range cmap {
+		channels = append(channels, c)
+	}
+	sort.Ints(channels)
+
+	list := make([]string, 0)
+	for _, c := range channels {
+		list = append(list, fmt.Sprintf("%d:%d", c, cmap[c]))
+	}
+
+	return strings.Join(list, ",")
+}
+
+func newRadio(node, nic string, n *cfgapi.PropertyNode, dfs bool) *Radio {
+	if kind, _ := n.GetChildString("kind"); kind != "wireless" {
+		return nil
+	}
+	if pseudo, _ := n.GetChildBool("pseudo"); pseudo {
+		return nil
+	}
+	if state, _ := n.GetChildString("state"); state != wifi.DevOK {
+		return nil
+	}
+
+	band, _ := n.GetChildString("active_band")
+	if band == "" {
+		return nil
+	}
+
+	r := &Radio{
+		Node: node,
+		Nic:  nic,
+		Band: band,
+		DFS:  make(map[int]bool),
+	}
+	r.Channel, _ = n.GetChildInt("active_channel")
+	r.Width, _ = n.GetChildInt("active_width")
+
+	r.Channels, _ = n.GetChildIntSet("channels")
+	if r.Channels == nil {
+		r.Channels = make(map[int]bool)
+	}
+	if set, _ := n.GetChildIntSet("dfs_channels"); set != nil {
+		r.DFS = set
+		if dfs {
+			for c := range set {
+				r.Channels[c] = true
+			}
+		}
+	}
+
+	modes, _ := n.GetChildStringSlice("modes")
+	r.MaxWidth = 20
+	for _, m := range modes {
+		if band == wifi.HiBand && m == "ac" {
+			r.MaxWidth = 80
+		} else if band == wifi.HiBand && m == "n" && r.MaxWidth < 40 {
+			r.MaxWidth = 40
+		}
+	}
+
+	val, _ := n.GetChildString("congestion")
+	r.Congestion = parseCongestion(val)
+
+	cfgChannel, _ := n.GetChildInt("cfg_channel")
+	cfgWidth, _ := n.GetChildInt("cfg_width")
+	planned, _ := n.GetChildString("cfg_planned")
+	if cfgChannel != 0 {
+		if planned == plannedValue(cfgChannel, cfgWidth) {
+			r.Planned = true
+		} else {
+			r.Fixed = true
+		}
+	}
+
+	return r
+}
+
+// Radios returns all of the active wireless radios in the site
+func Radios(config *cfgapi.Handle) ([]*Radio, error) {
+	nodes, err := config.GetProps("@/nodes")
+	if err != nil {
+		return nil, fmt.Errorf("fetching @/nodes: %v", err)
+	}
+	dfs, _ := config.GetPropBool("@/network/dfs")
+
+	radios := make([]*Radio, 0)
+	for node, n := range nodes.Children {
+		nics := n.Children["nics"]
+		if nics == nil {
+			continue
+		}
+		for nic, x := range nics.Children {
+			if r := newRadio(node, nic, x, dfs); r != nil {
+				radios = append(radios, r)
+			}
+		}
+	}
+
+	return radios, nil
+}
+
+func nicProp(r *Radio, prop string) string {
+	return "@/nodes/" + r.Node + "/nics/" + r.Nic + "/" + prop
+}
+
+// Apply pushes the planned channels to each of the radios that needs to change
+func Apply(config *cfgapi.Handle, plan *Plan) error {
+	ops := make([]cfgapi.PropertyOp, 0)
+	for _, a := range plan.Changes() {
+		if a.Radio.Fixed {
+			continue
+		}
+		props := map[string]string{
+			"cfg_channel": strconv.Itoa(a.Channel),
+			"cfg_width":   strconv.Itoa(a.Width),
+			"cfg_planned": plannedValue(a.Channel, a.Width),
+		}
+		for prop, val := range props {
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:    cfgapi.PropCreate,
+				Name:  nicProp(a.Radio, prop),
+				Value: val,
+			})
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+	_, err := config.Execute(nil, ops).Wait(nil)
+	return err
+}
+
+// Release returns each radio whose channel was chosen by the planner to
+// choosing its own channel.
+func Release(config *cfgapi.Handle) error {
+	radios, err := Radios(config)
+	if err != nil {
+		return err
+	}
+
+	ops := make([]cfgapi.PropertyOp, 0)
+	for _, r := range radios {
+		if !r.Planned {
+			continue
+		}
+		for _, prop := range []string{"cfg_channel", "cfg_width",
+			"cfg_planned"} {
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:   cfgapi.PropDelete,
+				Name: nicProp(r, prop),
+			})
+		}
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+	_, err = config.Execute(nil, ops).Wait(nil)
+	return err
+}
@@ -0,0 +1,146 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package chanplan
+
+import (
+	"testing"
+
+	"bg/ap_common/wificaps"
+	"bg/common/wifi"
+)
+
+var testCosts = Costs{
+	Overlap: DefaultOverlapCost,
+	DFS:     DefaultDFSPenalty,
+}
+
+func testRadio(node, band string, channel, width int) *Radio {
+	list := "loBand20MHz"
+	if band == wifi.HiBand {
+		list = "hiBand20MHz"
+	}
+
+	r := &Radio{
+		Node:       node,
+		Nic:        "wlan0",
+		Band:       band,
+		Channels:   make(map[int]bool),
+		DFS:        make(map[int]bool),
+		MaxWidth:   width,
+		Congestion: make(map[int]int),
+		Channel:    channel,
+		Width:      width,
+	}
+	for _, c := range wificaps.ChannelLists[list] {
+		r.Channels[c] = true
+	}
+
+	return r
+}
+
+func findAssignment(t *testing.T, p *Plan, node string) Assignment {
+	for _, a := range p.Assignments {
+		if a.Radio.Node == node {
+			return a
+		}
+	}
+	t.Fatalf("no assignment for %s", node)
+	return Assignment{}
+}
+
+// Two nodes on the same 2.4GHz channel should be separated
+func TestSeparate(t *testing.T) {
+	a := testRadio("gateway", wifi.LoBand, 6, 20)
+	b := testRadio("satellite", wifi.LoBand, 6, 20)
+	a.Congestion[1] = 30
+	b.Congestion[1] = 30
+
+	plan := Compute([]*Radio{a, b}, testCosts)
+	aa := findAssignment(t, plan, "gateway")
+	ba := findAssignment(t, plan, "satellite")
+	if aa.Channel == ba.Channel {
+		t.Errorf("both radios assigned channel %d", aa.Channel)
+	}
+	if aa.Channel != 6 && ba.Channel != 6 {
+		t.Errorf("neither radio stayed on channel 6")
+	}
+	if plan.Cost >= plan.CurrentCost {
+		t.Errorf("plan cost %d not better than current %d", plan.Cost,
+			plan.CurrentCost)
+	}
+}
+
+// A radio whose channel was chosen by the user must not be moved, and the
+// other radios should work around it.
+func TestFixed(t *testing.T) {
+	a := testRadio("gateway", wifi.HiBand, 36, 80)
+	b := testRadio("satellite", wifi.HiBand, 36, 80)
+	a.Fixed = true
+
+	plan := Compute([]*Radio{a, b}, testCosts)
+	if aa := findAssignment(t, plan, "gateway"); aa.Channel != 36 {
+		t.Errorf("fixed radio moved to %d", aa.Channel)
+	}
+	ba := findAssignment(t, plan, "satellite")
+	for _, c := range wifi.SpanChannels(ba.Channel, ba.Width) {
+		if c >= 36 && c <= 48 {
+			t.Errorf("satellite %d/%d overlaps fixed radio",
+				ba.Channel, ba.Width)
+		}
+	}
+	for _, c := range plan.Changes() {
+		if c.Radio.Fixed {
+			t.Errorf("change proposed for fixed radio")
+		}
+	}
+}
+
+// A lightly congested DFS channel is only chosen if it beats the penalty
+func TestDFSPenalty(t *testing.T) {
+	a := testRadio("gateway", wifi.HiBand, 36, 20)
+	a.Planned = true
+	a.DFS[52] = true
+	a.Congestion[36] = 20
+	a.Congestion[52] = 0
+	for _, c := range wificaps.ChannelLists["hiBand20MHz"] {
+		if c != 36 && c != 52 {
+			a.Congestion[c] = 100
+		}
+	}
+
+	plan := Compute([]*Radio{a}, testCosts)
+	if len(plan.Changes()) != 0 {
+		t.Errorf("moved to DFS channel %d", plan.Assignments[0].Channel)
+	}
+
+	a.Congestion[36] = 80
+	plan = Compute([]*Radio{a}, testCosts)
+	if aa := findAssignment(t, plan, "gateway"); aa.Channel != 52 {
+		t.Errorf("expected channel 52, got %d", aa.Channel)
+	}
+}
+
+func TestCongestionFormat(t *testing.T) {
+	in := map[int]int{36: 120, 1: 5, 149: 0}
+	str := FormatCongestion(in)
+	if str != "1:5,36:120,149:0" {
+		t.Errorf("bad format: %s", str)
+	}
+
+	out := parseCongestion(str)
+	if len(out) != len(in) {
+		t.Errorf("round trip mismatch: %v", out)
+	}
+	for c, v := range in {
+		if out[c] != v {
+			t.Errorf("channel %d: %d != %d", c, out[c], v)
+		}
+	}
+}
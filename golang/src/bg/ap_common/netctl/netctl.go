@@ -293,6 +293,71 @@ func RouteDel(route string) error {
 	return err
 }
 
+// RouteAddTable -> ip route add <route> dev <iface> table <table>
+func RouteAddTable(route, iface string, table int) error {
+	_, cidr, err := net.ParseCIDR(route)
+	if err != nil {
+		return fmt.Errorf("invalid route %s: %v", route, err)
+	}
+
+	x, err := getIfaceIdx(iface)
+	if err != nil {
+		return err
+	}
+
+	rt := netlink.Route{
+		LinkIndex: x,
+		Dst:       cidr,
+		Table:     table,
+	}
+	if err = netlink.RouteAdd(&rt); err != nil {
+		err = fmt.Errorf("RouteAdd(%s, %d): %v", route, table, err)
+	}
+
+	return err
+}
+
+// RuleAddMark -> ip rule add fwmark <mark> lookup <table> pref <prio>
+func RuleAddMark(mark, table, prio int) error {
+	rule := netlink.NewRule()
+	rule.Mark = mark
+	rule.Table = table
+	rule.Priority = prio
+
+	if err := netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("RuleAdd(fwmark %d): %v", mark, err)
+	}
+	return nil
+}
+
+// RuleAddSuppress -> ip rule add lookup <table> suppress_prefixlength <len>
+// pref <prio>
+func RuleAddSuppress(table, prefixLen, prio int) error {
+	rule := netlink.NewRule()
+	rule.Table = table
+	rule.SuppressPrefixlen = prefixLen
+	rule.Priority = prio
+
+	if err := netlink.RuleAdd(rule); err != nil {
+		return fmt.Errorf("RuleAdd(table %d): %v", table, err)
+	}
+	return nil
+}
+
+// RuleDel -> ip rule del pref <prio>
+func RuleDel(prio int) error {
+	rule := netlink.NewRule()
+	rule.Priority = prio
+
+	err := netlink.RuleDel(rule)
+	if err == syscall.ENOENT {
+		err = nil
+	} else if err != nil {
+		err = fmt.Errorf("RuleDel(%d): %v", prio, err)
+	}
+	return err
+}
+
 // BridgeCreate -> brctl addbr <name>
 func BridgeCreate(name string) error {
 	cstr := C.CString(name)
@@ -492,6 +492,7 @@ func init() {
 		DigCmd:       "/usr/bin/dig",
 		CurlCmd:      "/usr/bin/curl",
 		RestoreCmd:   "/usr/sbin/iptables-restore",
+		IPSetCmd:     "/usr/sbin/ipset",
 
 		probe:         mtProbe,
 		setNodeID:     mtSetNodeID,
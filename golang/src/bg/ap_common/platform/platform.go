@@ -41,6 +41,7 @@ type Platform struct {
 	DigCmd       string // ap.httpd diags
 	CurlCmd      string // ap.httpd diags
 	RestoreCmd   string
+	IPSetCmd     string
 
 	probe         func() bool
 	setNodeID     func(string) error
@@ -152,6 +152,7 @@ func init() {
 		DigCmd:       "/usr/bin/dig",
 		CurlCmd:      "/usr/bin/curl",
 		RestoreCmd:   "/sbin/iptables-restore",
+		IPSetCmd:     "/sbin/ipset",
 
 		probe:         rpiProbe,
 		setNodeID:     debianSetNodeID,
@@ -106,6 +106,7 @@ func init() {
 		CurlCmd:      "/usr/bin/curl",
 		DigCmd:       "/usr/bin/dig",
 		RestoreCmd:   "/sbin/iptables-restore",
+		IPSetCmd:     "/sbin/ipset",
 
 		probe:         x86Probe,
 		setNodeID:     debianSetNodeID,
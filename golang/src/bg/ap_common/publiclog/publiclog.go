@@ -99,6 +99,30 @@ func SendLogDeviceUnenrolled(brokerd *broker.Broker, mac string) error {
 	return sendPublicLog(brokerd, &l)
 }
 
+// SendLogGeoBlocked submits a message reporting that traffic between a
+// device and a remote host was blocked because of the remote host's country or
+// autonomous system to the public logging subsystem.
+func SendLogGeoBlocked(brokerd *broker.Broker, mac, local, remote,
+	country string, asn uint32) error {
+	l := base_msg.EventNetPublicLog{}
+
+	l.EventClassId = proto.String(base_def.CEF_GEO_BLOCKED)
+	l.CefReason = proto.String("traffic blocked by geographic policy")
+	l.CefSmac = proto.String(mac)
+	l.CefSrc = proto.String(local)
+	l.CefDst = proto.String(remote)
+	if country != "" {
+		l.CefCs1Label = proto.String("country")
+		l.CefCs1 = proto.String(country)
+	}
+	if asn != 0 {
+		l.CefCn1Label = proto.String("asn")
+		l.CefCn1 = proto.Uint64(uint64(asn))
+	}
+
+	return sendPublicLog(brokerd, &l)
+}
+
 // SendLogLoginEAPSuccess submits a message reporting successful user
 // authentication to a Wi-Fi network via EAP to the public logging
 // subsystem.
@@ -28,9 +28,13 @@ func devUp(e *wgconf.Endpoint) error {
 			e.Devname, err)
 	}
 
-	addr := e.IPAddress.IP.String()
-	if err := netctl.AddrAdd(e.Devname, addr); err != nil {
-		return fmt.Errorf("addrAdd: %v", err)
+	// A site-to-site link just forwards traffic between subnets, so it
+	// doesn't need an address of its own.
+	if e.IPAddress != nil {
+		addr := e.IPAddress.IP.String()
+		if err := netctl.AddrAdd(e.Devname, addr); err != nil {
+			return fmt.Errorf("addrAdd: %v", err)
+		}
 	}
 
 	if err := netctl.LinkUp(e.Devname); err != nil {
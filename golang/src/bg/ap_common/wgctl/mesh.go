@@ -0,0 +1,256 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgctl
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"bg/ap_common/netctl"
+	"bg/common/cfgapi"
+	"bg/common/wgconf"
+	"bg/common/wgsite"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MeshDevUp creates the site-to-site WireGuard device, and adds routes for all
+// of the remote sites' subnets.
+func MeshDevUp(m *wgconf.Mesh) error {
+	m.Subnets = m.AllSubnets()
+	return devUp(&m.Endpoint)
+}
+
+// MeshDevDown removes the routes to the remote sites, and then removes the
+// device.
+func MeshDevDown(m *wgconf.Mesh) error {
+	return devDown(&m.Endpoint)
+}
+
+func meshPeerSetting(p *wgconf.MeshPeer, prop, val string) error {
+	var err error
+
+	switch prop {
+	case "public_key":
+		err = p.SetKey(val)
+	case "preshared_key":
+		err = p.SetPresharedKey(val)
+	case "endpoint":
+		err = p.SetRemoteAddress(val)
+	case "port":
+		err = p.SetListenPort(val)
+	case "subnets":
+		err = p.SetSubnets(val)
+	case "name":
+		p.Name = val
+	default:
+		err = fmt.Errorf("unrecognized property: %s", prop)
+	}
+	return err
+}
+
+// GetMesh retrieves the site-to-site configuration from the config tree.  If
+// the site isn't part of a mesh, it returns nil.
+func GetMesh(config *cfgapi.Handle, device string) (*wgconf.Mesh, error) {
+	private, err := config.GetProp(wgsite.MeshPrivateProp)
+	if err == cfgapi.ErrNoProp {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", wgsite.MeshPrivateProp,
+			err)
+	}
+
+	m := wgconf.NewMesh(device)
+	if err = m.SetKey(private); err != nil {
+		return nil, err
+	}
+
+	port, err := config.GetProp(wgsite.MeshPortProp)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %v", wgsite.MeshPortProp,
+			err)
+	}
+	if err = m.SetListenPort(port); err != nil {
+		return nil, err
+	}
+
+	peers, _ := config.GetProps(wgsite.MeshPeersProp)
+	if peers != nil {
+		for site, node := range peers.Children {
+			p := m.GetPeer(site)
+			for prop, val := range node.Children {
+				err := meshPeerSetting(p, prop, val.Value)
+				if err != nil {
+					return nil, fmt.Errorf("peer %s: %v",
+						site, err)
+				}
+			}
+		}
+	}
+
+	if x, _ := config.GetPropBool(wgsite.MeshEnabledProp); x {
+		m.SetEnabled()
+	} else {
+		m.SetDisabled()
+	}
+
+	return m, nil
+}
+
+// MeshRoutesUpdate brings the routes through a running mesh device in line with
+// a new configuration, adding routes for any newly reachable subnets and
+// removing those for subnets which no longer are.
+func MeshRoutesUpdate(m, old *wgconf.Mesh) error {
+	var err error
+
+	m.Subnets = m.AllSubnets()
+
+	have := make(map[string]bool)
+	for _, subnet := range old.Subnets {
+		have[subnet.String()] = true
+	}
+	want := make(map[string]bool)
+	for _, subnet := range m.Subnets {
+		dst := subnet.String()
+		want[dst] = true
+		if !have[dst] {
+			if rerr := netctl.RouteAdd(dst, m.Devname); rerr != nil {
+				err = fmt.Errorf("routeAdd(%v, %s) %v", dst,
+					m.Devname, rerr)
+			}
+		}
+	}
+	for dst := range have {
+		if !want[dst] {
+			if rerr := netctl.RouteDel(dst); rerr != nil {
+				err = fmt.Errorf("routeDel(%v) %v", dst, rerr)
+			}
+		}
+	}
+
+	return err
+}
+
+// Build the WireGuard configuration for a single remote site.  Returns nil if
+// the peer's configuration is incomplete.
+func meshPeerConfig(p *wgconf.MeshPeer) *wgtypes.PeerConfig {
+	if p.Key == nil || p.IPAddress == nil || p.ListenPort == 0 {
+		return nil
+	}
+
+	keepalive := 25 * time.Second
+	return &wgtypes.PeerConfig{
+		PublicKey:    *p.Key,
+		PresharedKey: p.PresharedKey,
+		Endpoint: &net.UDPAddr{
+			IP:   p.IPAddress,
+			Port: p.ListenPort,
+		},
+		PersistentKeepaliveInterval: &keepalive,
+		ReplaceAllowedIPs:           true,
+		AllowedIPs:                  p.Subnets,
+	}
+}
+
+func meshPeerConfigs(m *wgconf.Mesh) map[string]*wgtypes.PeerConfig {
+	peers := make(map[string]*wgtypes.PeerConfig)
+
+	m.Lock()
+	for site, p := range m.Peers {
+		if peer := meshPeerConfig(p); peer != nil {
+			peers[site] = peer
+		}
+	}
+	m.Unlock()
+
+	return peers
+}
+
+func meshPeerEqual(a, b *wgtypes.PeerConfig) bool {
+	if a.PublicKey != b.PublicKey ||
+		a.Endpoint.String() != b.Endpoint.String() ||
+		(a.PresharedKey == nil) != (b.PresharedKey == nil) ||
+		(a.PresharedKey != nil && *a.PresharedKey != *b.PresharedKey) ||
+		len(a.AllowedIPs) != len(b.AllowedIPs) {
+		return false
+	}
+	for i := range a.AllowedIPs {
+		if a.AllowedIPs[i].String() != b.AllowedIPs[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// MeshConfig configures the site-to-site device with the current set of peers.
+// If old is nil, any existing configuration is overwritten.  Otherwise old must
+// be the configuration already installed on the device, and only the peers
+// which have been added, removed, or changed are updated, leaving the tunnels
+// to the other sites undisturbed.  Peers with incomplete configurations are
+// skipped.
+func MeshConfig(m, old *wgconf.Mesh) error {
+	if m.Key == nil {
+		return fmt.Errorf("mesh configuration missing private key")
+	}
+
+	peers := make([]wgtypes.PeerConfig, 0)
+	current := make(map[string]*wgtypes.PeerConfig)
+	if old != nil {
+		current = meshPeerConfigs(old)
+	}
+	for site, peer := range meshPeerConfigs(m) {
+		if was := current[site]; was != nil {
+			delete(current, site)
+			if meshPeerEqual(was, peer) {
+				continue
+			}
+			if was.PublicKey != peer.PublicKey {
+				peers = append(peers, wgtypes.PeerConfig{
+					PublicKey: was.PublicKey,
+					Remove:    true,
+				})
+			}
+		}
+		peers = append(peers, *peer)
+	}
+
+	// Anything left over is no longer part of the mesh
+	for _, was := range current {
+		peers = append(peers, wgtypes.PeerConfig{
+			PublicKey: was.PublicKey,
+			Remove:    true,
+		})
+	}
+
+	if old != nil && len(peers) == 0 {
+		return nil
+	}
+
+	c := wgtypes.Config{
+		PrivateKey:   m.Key,
+		ListenPort:   &m.ListenPort,
+		ReplacePeers: old == nil,
+		Peers:        peers,
+	}
+
+	client, err := wgctrl.New()
+	if err != nil {
+		return fmt.Errorf("creating wgctrl client: %v", err)
+	}
+	defer client.Close()
+
+	if err = client.ConfigureDevice(m.Devname, c); err != nil {
+		return fmt.Errorf("configuring %s: %v", m.Devname, err)
+	}
+
+	return nil
+}
@@ -55,8 +55,11 @@ var ChannelLists = map[string][]int{
 // useful to the Brightgate stack.
 type WifiCapabilities struct {
 	SupportVLANs    bool            // does the nic support VLANs?
+	SupportPMF      bool            // does it support management frame protection?
+	SupportSAE      bool            // can it host a WPA3-SAE network?
 	Interfaces      int             // number of APs it can support
 	Channels        map[int]bool    // channels the device claims to support
+	RadarChannels   map[int]bool    // channels requiring radar detection (DFS)
 	WifiBands       map[string]bool // frequency bands it supports
 	WifiModes       map[string]bool // 802.11[a,b,g,n,ac] modes supported
 	HTCapabilities  map[int]bool    // 802.11n capabilities supported
@@ -73,6 +76,22 @@ func getVlanSupport(w *WifiCapabilities, info string) {
 	w.SupportVLANs = (len(vlanModes) > 0)
 }
 
+// Does this device support the features needed for WPA3?
+func getSecuritySupport(w *WifiCapabilities, info string) {
+	// Protected management frames (802.11w) require the BIP cipher, which
+	// appears in the "Supported Ciphers" list:
+	//   * CMAC (00-0f-ac:6)
+	pmfRE := regexp.MustCompile(`\* CMAC \(00-0f-ac:6\)`)
+	w.SupportPMF = pmfRE.MatchString(info)
+
+	// SAE authentication is carried out by hostapd, so the driver either
+	// has to pass authentication frames up to userspace (mac80211 drivers
+	// advertise the "authenticate" command), or handle SAE itself.  In
+	// either case, WPA3 mandates PMF.
+	saeRE := regexp.MustCompile(`(\* authenticate\s|SAE_OFFLOAD_AP)`)
+	w.SupportSAE = w.SupportPMF && saeRE.MatchString(info)
+}
+
 // How many APs can this device support?
 func getInterfaces(w *WifiCapabilities, info string) {
 	// Match interface combination lines:
@@ -101,6 +120,7 @@ func getInterfaces(w *WifiCapabilities, info string) {
 func getChannels(w *WifiCapabilities, info string) {
 	w.WifiBands = make(map[string]bool)
 	w.Channels = make(map[int]bool)
+	w.RadarChannels = make(map[int]bool)
 
 	// Match channel/frequency lines:
 	//   * 2462 MHz [11] (20.0 dBm)
@@ -108,13 +128,20 @@ func getChannels(w *WifiCapabilities, info string) {
 	channels := chanRE.FindAllStringSubmatch(info, -1)
 	for _, line := range channels {
 		// Skip any channels that are unavailable for either technical
-		// or regulatory reasons
-		if strings.Contains(line[3], "disabled") ||
-			strings.Contains(line[3], "no IR") ||
-			strings.Contains(line[3], "radar detection") {
+		// or regulatory reasons.  Channels that are only available
+		// after radar detection are tracked separately, since they
+		// can't be used without DFS support.
+		channel, _ := strconv.Atoi(line[2])
+		if strings.Contains(line[3], "disabled") {
+			continue
+		}
+		if strings.Contains(line[3], "radar detection") {
+			w.RadarChannels[channel] = true
+			continue
+		}
+		if strings.Contains(line[3], "no IR") {
 			continue
 		}
-		channel, _ := strconv.Atoi(line[2])
 		w.Channels[channel] = true
 
 		frequency, _ := strconv.Atoi(line[1])
@@ -224,6 +251,8 @@ func (w *WifiCapabilities) String() string {
 	b.WriteString(fmt.Sprintf("   Supported modes: %s\n", strings.Join(modes, "/")))
 	b.WriteString(fmt.Sprintf("   Supported interfaces: %d\n", w.Interfaces))
 	b.WriteString(fmt.Sprintf("   VLAN support: %v\n", w.SupportVLANs))
+	b.WriteString(fmt.Sprintf("   PMF support: %v\n", w.SupportPMF))
+	b.WriteString(fmt.Sprintf("   SAE support: %v\n", w.SupportSAE))
 
 	b.WriteString(fmt.Sprintf("   2.4GHz Band:\n"))
 	b.WriteString(fmt.Sprintf("      20MHz: %s\n",
@@ -240,6 +269,8 @@ func (w *WifiCapabilities) String() string {
 		b.WriteString(fmt.Sprintf("      80MHz: %s\n",
 			buildChannelString(ChannelLists["hiBand80MHz"], w.Channels)))
 	}
+	b.WriteString(fmt.Sprintf("      DFS: %s\n",
+		buildChannelString(ChannelLists["hiBand20MHz"], w.RadarChannels)))
 	b.WriteString(fmt.Sprintf("   HT Capabilities: %s\n",
 		buildCapabilitiesString(htCaps, w.HTCapabilities)))
 	b.WriteString(fmt.Sprintf("   VHT Capabilities: %s\n",
@@ -267,6 +298,7 @@ func GetCapabilities(name string) (*WifiCapabilities, error) {
 	info := string(out)
 
 	getVlanSupport(&w, info)
+	getSecuritySupport(&w, info)
 	getInterfaces(&w, info)
 	getChannels(&w, info)
 	getWifiModes(&w, info)
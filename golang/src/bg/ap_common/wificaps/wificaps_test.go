@@ -0,0 +1,74 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wificaps
+
+import (
+	"testing"
+)
+
+// Fragments of 'iw phy <phy> info' output
+const (
+	ciphersWPA2 = `
+	Supported Ciphers:
+		* WEP40 (00-0f-ac:1)
+		* WEP104 (00-0f-ac:5)
+		* TKIP (00-0f-ac:2)
+		* CCMP-128 (00-0f-ac:4)
+`
+	ciphersPMF = ciphersWPA2 + `		* CMAC (00-0f-ac:6)
+`
+	commandsSoftMAC = `
+	Supported commands:
+		 * new_interface
+		 * set_interface
+		 * authenticate
+		 * associate
+		 * deauthenticate
+`
+	commandsFullMAC = `
+	Supported commands:
+		 * new_interface
+		 * set_interface
+		 * connect
+		 * disconnect
+`
+	featuresSAEOffload = `
+	Supported extended features:
+		* [ SAE_OFFLOAD_AP ]: SAE offload support in AP mode
+`
+)
+
+func TestSecuritySupport(t *testing.T) {
+	testData := []struct {
+		name string
+		info string
+		pmf  bool
+		sae  bool
+	}{
+		{"no PMF", ciphersWPA2 + commandsSoftMAC, false, false},
+		{"mac80211", ciphersPMF + commandsSoftMAC, true, true},
+		{"fullmac", ciphersPMF + commandsFullMAC, true, false},
+		{"SAE offload", ciphersPMF + commandsFullMAC +
+			featuresSAEOffload, true, true},
+		{"SAE offload without PMF", ciphersWPA2 + commandsFullMAC +
+			featuresSAEOffload, false, false},
+	}
+
+	for _, td := range testData {
+		var w WifiCapabilities
+
+		getSecuritySupport(&w, td.info)
+		if w.SupportPMF != td.pmf || w.SupportSAE != td.sae {
+			t.Errorf("%s: got PMF %v SAE %v, want PMF %v SAE %v",
+				td.name, w.SupportPMF, w.SupportSAE, td.pmf,
+				td.sae)
+		}
+	}
+}
@@ -17,13 +17,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"net"
 	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	"bg/cl_common/daemonutils"
+	"bg/common/network"
 	"bg/common/urlfetch"
 
 	"go.uber.org/zap"
@@ -46,6 +46,8 @@ const (
 	botccRules          = "botcc.rules"
 	compromisedIPsRules = "compromised-ips.txt"
 
+	spamhausPrefix = "https://www.spamhaus.org/drop/"
+
 	gcpEnv = "GOOGLE_APPLICATION_CREDENTIALS"
 )
 
@@ -86,6 +88,24 @@ var ipSources = []source{
 		url:    etPrefix + botccRules,
 		parser: parseBotnets,
 	},
+	{
+		name:   "Spamhaus DROP List",
+		file:   "spamhaus.drop.txt",
+		url:    spamhausPrefix + "drop.txt",
+		parser: parseIPList,
+	},
+	{
+		name:   "Spamhaus EDROP List",
+		file:   "spamhaus.edrop.txt",
+		url:    spamhausPrefix + "edrop.txt",
+		parser: parseIPList,
+	},
+	{
+		name:   "Spamhaus IPv6 DROP List",
+		file:   "spamhaus.dropv6.txt",
+		url:    spamhausPrefix + "dropv6.txt",
+		parser: parseIPList,
+	},
 }
 
 var dnsSources = []source{
@@ -233,9 +253,24 @@ func parseBrightgate(s *source, list blocklist, file *os.File) int {
  *
  ***************************************************************************/
 
+// Add an IP address or CIDR network to the blocklist, using a canonical form
+// so the same network from different sources is merged into a single entry.
+func addPrefix(list blocklist, prefix string, reason string) bool {
+	n, err := network.ParsePrefix(prefix)
+	if err != nil || n.IP.IsUnspecified() {
+		return false
+	}
+
+	return addBlock(list, network.PrefixString(n), reason)
+}
+
+//
+// Process a simple list of IP addresses or networks, such as Emerging Threat's
+// list of compromised IPs or Spamhaus's DROP lists.  Each line of the file
+// contains a single IPv4 or IPv6 address, or a network in CIDR notation.
+// Anything following a ';' or '#' is a comment:
 //
-// Process Emerging Threat's list of compromised IPs.  Each line of the file
-// contains just an a.b.c.d IP address
+// 1.10.16.0/20 ; SBL256894
 //
 func parseIPList(s *source, list blocklist, file *os.File) int {
 	var cnt int
@@ -243,10 +278,12 @@ func parseIPList(s *source, list blocklist, file *os.File) int {
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
-		if ip := net.ParseIP(line); ip != nil {
-			if addBlock(list, line, s.name) {
-				cnt++
-			}
+		if idx := strings.IndexAny(line, ";#"); idx >= 0 {
+			line = line[:idx]
+		}
+		line = strings.TrimSpace(line)
+		if line != "" && addPrefix(list, line, s.name) {
+			cnt++
 		}
 	}
 
@@ -274,7 +311,7 @@ func parseIPList(s *source, list blocklist, file *os.File) int {
 func parseBotnets(s *source, list blocklist, file *os.File) int {
 	var cnt int
 
-	ruleRE := regexp.MustCompile(`^alert ip.*\[((?:\d|\.|,)+)\].*sid:(\d+)`)
+	ruleRE := regexp.MustCompile(`^alert ip.*\[((?:\d|\.|,|/)+)\].*sid:(\d+)`)
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -284,7 +321,7 @@ func parseBotnets(s *source, list blocklist, file *os.File) int {
 			ips := strings.Split(m[1], ",")
 
 			for _, ip := range ips {
-				if addBlock(list, ip, reason) {
+				if addPrefix(list, ip, reason) {
 					cnt++
 				}
 			}
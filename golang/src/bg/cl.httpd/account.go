@@ -523,6 +523,13 @@ type accountWGResponseConfig struct {
 	Label            string    `json:"label"`
 	PublicKey        string    `json:"publicKey"`
 	AssignedIP       string    `json:"assignedIP"`
+
+	// Expires is nil if the key never expires.  The remaining fields
+	// describe the key's activity, as last reported by the site.
+	Expires       *time.Time `json:"expires,omitempty"`
+	LastHandshake *time.Time `json:"lastHandshake,omitempty"`
+	RxBytes       uint64     `json:"rxBytes"`
+	TxBytes       uint64     `json:"txBytes"`
 }
 
 type accountWGResponse struct {
@@ -598,6 +605,10 @@ func (a *accountHandler) getAccountWG(c echo.Context) error {
 				Mac:              wgConfig.Mac,
 				PublicKey:        wgConfig.Key.String(),
 				AssignedIP:       wgConfig.IPAddress.String(),
+				Expires:          wgConfig.Expires,
+				LastHandshake:    wgConfig.LastHandshake,
+				RxBytes:          wgConfig.RxBytes,
+				TxBytes:          wgConfig.TxBytes,
 			}
 			resp.Configs = append(resp.Configs, r)
 		}
@@ -667,8 +678,25 @@ type postAccountWGRequest struct {
 	// Local timestamp from client, so that the zip file
 	// has a sensible timestamp.
 	TZ string `json:"tz,omitempty"`
+	// Optional time at which the key stops working
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type postAccountWGRekeyRequest struct {
+	// Local timestamp from client, so that the zip file
+	// has a sensible timestamp.
+	TZ string `json:"tz,omitempty"`
+	// Optional time at which the new key stops working
+	Expires *time.Time `json:"expires,omitempty"`
+	// Number of seconds the old key continues to work.  If omitted, the
+	// default grace period applies.  If zero, the old key is removed
+	// immediately.
+	GracePeriod *int `json:"gracePeriod,omitempty"`
 }
 
+// How long a rotated key continues to work, if the caller doesn't say
+const wgRekeyGracePeriod = 24 * time.Hour
+
 // This RE is chosen from analyzing WireGuard clients on several platforms.  It
 // seems to be the most universal subset.  The purpose is to strip invalid
 // chars from e.g. a site name in order to give the user a tunnel name that
@@ -701,6 +729,67 @@ func wgConfName(name string) string {
 	return name
 }
 
+// wgConfigResponse packages a newly issued key's configuration in several forms
+// suitable for presentation or download.
+func wgConfigResponse(tgtSite *appliancedb.CustomerSite, label, tz string,
+	addRes *wgsite.AddKeyResult) (*wgNewConfigResponse, error) {
+
+	// On at least MacOS and Windows (but not on Android or some other
+	// platforms) the conf file name informs the name of the tunnel in the
+	// UI (although you can change it at any time).  Since the tunnel is a
+	// tunnel from where you are (my laptop) TO someplace (Houston Office),
+	// we choose to name the confFile after the site; we have to crunch
+	// that down to an acceptable name.
+	confName := wgConfName(tgtSite.Name)
+	confFileName := confName
+	// in case the user put ".conf" in their label name, don't double
+	// suffix it
+	if !strings.HasSuffix(confFileName, ".conf") {
+		confFileName += ".conf"
+	}
+	zipFile, err := confDataToZip(confFileName, tz, addRes.ConfData)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nuke out spaces and path separators to make the label name more palatable
+	// in the filename.
+	filenameLabel := strings.ReplaceAll(label, " ", "-")
+	filenameLabel = strings.ReplaceAll(filenameLabel, "/", "-")
+	filenameLabel = strings.ReplaceAll(filenameLabel, "\\", "-")
+	filenameLabel = strings.ReplaceAll(filenameLabel, ":", "-")
+
+	// So if we started with:
+	//   label='My Laptop' tgtSite.Name='Minn/St. Paul Office'
+	// We would get:
+	//   filenameLabel='My-Laptop' confName='Minn-St.PaulOff'
+	// And then merge those into:
+	//   zipFileName='My-Laptop-Minn-St.PaulOff-Brightgate-WireGuard.zip'
+	// Which is long but also clear.
+	zipFileName := fmt.Sprintf("%s-%s-Brightgate-WireGuard.zip", filenameLabel, confName)
+
+	resp := &wgNewConfigResponse{
+		accountWGResponseConfig: accountWGResponseConfig{
+			OrganizationUUID: tgtSite.OrganizationUUID,
+			SiteUUID:         tgtSite.UUID,
+			PublicKey:        addRes.Publickey,
+			AssignedIP:       addRes.AssignedIP,
+			Label:            addRes.Label,
+			Mac:              addRes.Mac,
+			Expires:          addRes.Expires,
+		},
+		ServerAddress:           addRes.ServerAddress,
+		ServerPort:              addRes.ServerPort,
+		ConfName:                confName,
+		ConfData:                string(addRes.ConfData),
+		DownloadConfBody:        zipFile,
+		DownloadConfName:        zipFileName,
+		DownloadConfContentType: "application/octet-stream",
+	}
+
+	return resp, nil
+}
+
 // postAccountWGNew creates a new Wireguard VPN configuration for the account,
 // storing it into the config store.  The WG configuration is returned in
 // several forms suitable for presentation or download.
@@ -727,6 +816,10 @@ func (a *accountHandler) postAccountWGNew(c echo.Context) error {
 	if len(req.Label) > 64 {
 		return newHTTPError(http.StatusBadRequest, errors.New("invalid label; too long"))
 	}
+	if req.Expires != nil && !req.Expires.After(time.Now()) {
+		return newHTTPError(http.StatusBadRequest,
+			errors.New("invalid expiration; in the past"))
+	}
 
 	hdl, err := a.getConfigHandle(tgtSiteUUID.String())
 	if err != nil && errors.Cause(err) == cfgapi.ErrNoConfig {
@@ -765,7 +858,7 @@ func (a *accountHandler) postAccountWGNew(c echo.Context) error {
 		return newHTTPError(http.StatusInternalServerError, err)
 	}
 
-	addRes, err := site.AddKey(ctx, userInfo.UID, req.Label, "")
+	addRes, err := site.AddKey(ctx, userInfo.UID, req.Label, "", req.Expires)
 	if err != nil {
 		if err == cfgapi.ErrQueued || err == cfgapi.ErrInProgress || err == cfgapi.ErrTimeout {
 			return newHTTPError(http.StatusInternalServerError,
@@ -774,65 +867,100 @@ func (a *accountHandler) postAccountWGNew(c echo.Context) error {
 		return newHTTPError(http.StatusInternalServerError, err)
 	}
 
-	// On at least MacOS and Windows (but not on Android or some other
-	// platforms) the conf file name informs the name of the tunnel in the
-	// UI (although you can change it at any time).  Since the tunnel is a
-	// tunnel from where you are (my laptop) TO someplace (Houston Office),
-	// we choose to name the confFile after the site; we have to crunch
-	// that down to an acceptable name.
-	confName := wgConfName(tgtSite.Name)
-	confFileName := confName
-	// in case the user put ".conf" in their label name, don't double
-	// suffix it
-	if !strings.HasSuffix(confFileName, ".conf") {
-		confFileName += ".conf"
+	resp, err := wgConfigResponse(tgtSite, req.Label, req.TZ, addRes)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+
+	return c.JSON(http.StatusCreated, resp)
+}
+
+// postAccountWGSiteMacRekey replaces the key for a vpn config with a newly
+// generated key carrying the same label.  The old key keeps working for a grace
+// period, giving the user time to install the new configuration.
+func (a *accountHandler) postAccountWGSiteMacRekey(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	tgtAcctUUID, err := uuid.FromString(c.Param("acct_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, errors.Wrap(err, "acct_uuid"))
 	}
-	zipFile, err := confDataToZip(confFileName, req.TZ, addRes.ConfData)
+	tgtSiteUUID, err := uuid.FromString(c.Param("site_uuid"))
 	if err != nil {
+		return newHTTPError(http.StatusBadRequest, errors.Wrap(err, "site_uuid"))
+	}
+	tgtMac, err := url.PathUnescape(c.Param("mac"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, errors.Wrap(err, "mac"))
+	}
+	tgtSite, err := a.db.CustomerSiteByUUID(ctx, tgtSiteUUID)
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	var req postAccountWGRekeyRequest
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	grace := wgRekeyGracePeriod
+	if req.GracePeriod != nil {
+		if *req.GracePeriod < 0 {
+			return newHTTPError(http.StatusBadRequest,
+				errors.New("invalid grace period"))
+		}
+		grace = time.Duration(*req.GracePeriod) * time.Second
+	}
+	if req.Expires != nil && !req.Expires.After(time.Now()) {
+		return newHTTPError(http.StatusBadRequest,
+			errors.New("invalid expiration; in the past"))
+	}
+
+	hdl, err := a.getConfigHandle(tgtSiteUUID.String())
+	if err != nil && errors.Cause(err) == cfgapi.ErrNoConfig {
+		// No config for this site; return Not found
+		return newHTTPError(http.StatusNotFound, err)
+	} else if err != nil {
 		return newHTTPError(http.StatusInternalServerError, err)
 	}
 
-	// Nuke out spaces and path separators to make the label name more palatable
-	// in the filename.
-	filenameLabel := strings.ReplaceAll(req.Label, " ", "-")
-	filenameLabel = strings.ReplaceAll(filenameLabel, "/", "-")
-	filenameLabel = strings.ReplaceAll(filenameLabel, "\\", "-")
-	filenameLabel = strings.ReplaceAll(filenameLabel, ":", "-")
+	userInfo, err := hdl.GetUserByUUID(tgtAcctUUID)
+	if err != nil {
+		if errors.Cause(err) == cfgapi.ErrNoConfig {
+			return newHTTPError(http.StatusNotFound, err)
+		}
+		if _, ok := errors.Cause(err).(cfgapi.NoSuchUserError); ok {
+			return newHTTPError(http.StatusNotFound, err)
+		}
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
 
-	// So if we started with:
-	//   req.Label='My Laptop' tgtSite.Name='Minn/St. Paul Office'
-	// We would get:
-	//   filenameLabel='My-Laptop' confName='Minn-St.PaulOff'
-	// And then merge those into:
-	//   zipFileName='My-Laptop-Minn-St.PaulOff-Brightgate-WireGuard.zip'
-	// Which is long but also clear.
-	zipFileName := fmt.Sprintf("%s-%s-Brightgate-WireGuard.zip", filenameLabel, confName)
+	site, err := wgsite.NewSite(hdl)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
 
-	resp := wgNewConfigResponse{
-		accountWGResponseConfig: accountWGResponseConfig{
-			OrganizationUUID: tgtSite.OrganizationUUID,
-			SiteUUID:         tgtSite.UUID,
-			PublicKey:        addRes.Publickey,
-			AssignedIP:       addRes.AssignedIP,
-			Label:            addRes.Label,
-			Mac:              addRes.Mac,
-		},
-		ServerAddress:           addRes.ServerAddress,
-		ServerPort:              addRes.ServerPort,
-		ConfName:                confName,
-		ConfData:                string(addRes.ConfData),
-		DownloadConfBody:        zipFile,
-		DownloadConfName:        zipFileName,
-		DownloadConfContentType: "application/octet-stream",
+	addRes, err := site.RotateKey(ctx, userInfo.UID, tgtMac, grace,
+		req.Expires)
+	if addRes == nil {
+		if err == cfgapi.ErrQueued || err == cfgapi.ErrInProgress || err == cfgapi.ErrTimeout {
+			return newHTTPError(http.StatusInternalServerError,
+				"Site was not responsive to cloud commands")
+		}
+		return newHTTPError(http.StatusInternalServerError, err)
+	} else if err != nil {
+		// The new key was issued, but the old one couldn't be
+		// scheduled for removal.  The caller still needs the new
+		// config, so we just note the problem.
+		c.Logger().Warnf("rotating %s at %s: %v", tgtMac,
+			tgtSiteUUID, err)
 	}
 
-	return c.JSON(http.StatusCreated, resp)
-}
+	resp, err := wgConfigResponse(tgtSite, addRes.Label, req.TZ, addRes)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
 
-// postAccountWGSiteMacRekey regenerates the private key for a vpn
-// config, leaving everything else the same.
-func (a *accountHandler) postAccountWGSiteMacRekey(c echo.Context) error {
-	return c.NoContent(http.StatusNotImplemented)
+	return c.JSON(http.StatusCreated, resp)
 }
 
 // deleteAccountWGSiteMac removes a Wireguard VPN configuration
@@ -509,7 +509,7 @@ func mkRouterHTTPS(log *zap.Logger, vaultClient *vault.Client, notifier *daemonu
 	}
 	_ = newSiteHandler(r, state.applianceDB, wares, getConfigClientHandle, twil)
 	_ = newAccountHandler(r, state.applianceDB, wares, state.sessionStore, avBucket, getConfigClientHandle)
-	_ = newOrgHandler(r, state.applianceDB, wares, state.sessionStore)
+	_ = newOrgHandler(r, state.applianceDB, wares, state.sessionStore, getConfigClientHandle)
 	_ = newAccessHandler(r, state.applianceDB, state.sessionStore)
 
 	// Setup /check endpoints
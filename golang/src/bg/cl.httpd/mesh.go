@@ -0,0 +1,435 @@
+//
+// Copyright 2020 Brightgate Inc.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at https://mozilla.org/MPL/2.0/.
+//
+
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"bg/base_def"
+	"bg/cloud_models/appliancedb"
+	"bg/common/cfgapi"
+	"bg/common/wgsite"
+
+	"github.com/labstack/echo"
+	"github.com/satori/uuid"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Each push of the mesh configuration to a single site gets this long before we
+// give up waiting and leave the update in the site's command queue.
+const meshPushTimeout = 10 * time.Second
+
+type apiMeshSite struct {
+	SiteUUID  uuid.UUID `json:"siteUUID"`
+	Name      string    `json:"name"`
+	PublicKey string    `json:"publicKey"`
+	Endpoint  string    `json:"endpoint"`
+	Port      int       `json:"port"`
+	Rings     []string  `json:"rings"`
+	Subnets   []string  `json:"subnets"`
+	Status    string    `json:"status,omitempty"`
+}
+
+type meshSiteRequest struct {
+	Rings []string `json:"rings"`
+}
+
+// The details of a mesh member needed to configure its peers
+type meshMember struct {
+	appliancedb.MeshSite
+	api   apiMeshSite
+	nets  []*net.IPNet
+	links []appliancedb.MeshLink
+}
+
+func subnetsOverlap(a, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// Look up the organization and site named in the request, and make sure the
+// site belongs to the organization.
+func (o *orgHandler) meshSite(c echo.Context) (uuid.UUID, uuid.UUID, error) {
+	ctx := c.Request().Context()
+
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, newHTTPError(http.StatusBadRequest)
+	}
+	siteUUID, err := uuid.FromString(c.Param("site_uuid"))
+	if err != nil {
+		return uuid.Nil, uuid.Nil, newHTTPError(http.StatusBadRequest)
+	}
+
+	site, err := o.db.CustomerSiteByUUID(ctx, siteUUID)
+	if err != nil {
+		if _, ok := err.(appliancedb.NotFoundError); ok {
+			return uuid.Nil, uuid.Nil,
+				newHTTPError(http.StatusNotFound, "No such site")
+		}
+		return uuid.Nil, uuid.Nil,
+			newHTTPError(http.StatusInternalServerError)
+	}
+	if !uuid.Equal(site.OrganizationUUID, orgUUID) {
+		return uuid.Nil, uuid.Nil,
+			newHTTPError(http.StatusNotFound, "No such site")
+	}
+
+	return orgUUID, siteUUID, nil
+}
+
+// Gather the current state of each site in the organization's mesh.  The
+// endpoints and subnets come from each site's config tree, so they reflect any
+// local changes made since the site joined the mesh.
+func (o *orgHandler) meshMembers(ctx context.Context,
+	orgUUID uuid.UUID) ([]*meshMember, error) {
+
+	sites, err := o.db.MeshSitesByOrganization(ctx, orgUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]*meshMember, 0)
+	for _, ms := range sites {
+		m := &meshMember{
+			MeshSite: ms,
+			api: apiMeshSite{
+				SiteUUID:  ms.SiteUUID,
+				PublicKey: ms.PublicKey,
+				Port:      ms.Port,
+				Rings:     make([]string, 0),
+				Subnets:   make([]string, 0),
+			},
+		}
+		members = append(members, m)
+
+		if site, err := o.db.CustomerSiteByUUID(ctx, ms.SiteUUID); err == nil {
+			m.api.Name = site.Name
+		}
+		if m.links, err = o.db.MeshLinksBySite(ctx, ms.SiteUUID); err != nil {
+			return nil, err
+		}
+
+		hdl, err := o.getClientHandle(ms.SiteUUID.String())
+		if err != nil {
+			m.api.Status = fmt.Sprintf("unable to read config: %v", err)
+			continue
+		}
+		site, err := wgsite.NewSite(hdl)
+		if err != nil {
+			hdl.Close()
+			m.api.Status = fmt.Sprintf("unable to read config: %v", err)
+			continue
+		}
+
+		m.api.Rings = site.MeshRings()
+		for _, subnet := range site.MeshSubnets() {
+			if _, ipnet, err := net.ParseCIDR(subnet); err == nil {
+				m.api.Subnets = append(m.api.Subnets, subnet)
+				m.nets = append(m.nets, ipnet)
+			}
+		}
+		if m.api.Endpoint, err = site.MeshEndpoint(); err != nil {
+			m.api.Status = err.Error()
+		}
+		hdl.Close()
+	}
+
+	return members, nil
+}
+
+// Build the list of peers for a single site.  A remote subnet that overlaps one
+// of the local subnets can't be routed, so it's left out.
+func meshPeers(m *meshMember, all map[uuid.UUID]*meshMember) ([]wgsite.MeshPeer, []string) {
+	peers := make([]wgsite.MeshPeer, 0)
+	warnings := make([]string, 0)
+
+	for _, link := range m.links {
+		p, ok := all[link.Peer(m.SiteUUID)]
+		if !ok {
+			continue
+		}
+		if p.api.Endpoint == "" {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s has no public address", p.api.Name))
+			continue
+		}
+
+		subnets := make([]string, 0)
+		for i, remote := range p.nets {
+			overlap := false
+			for _, local := range m.nets {
+				overlap = overlap || subnetsOverlap(local, remote)
+			}
+			if overlap {
+				warnings = append(warnings, fmt.Sprintf(
+					"%s subnet %s overlaps a local subnet",
+					p.api.Name, p.api.Subnets[i]))
+			} else {
+				subnets = append(subnets, p.api.Subnets[i])
+			}
+		}
+
+		peers = append(peers, wgsite.MeshPeer{
+			Site:         p.SiteUUID.String(),
+			Name:         p.api.Name,
+			PublicKey:    p.PublicKey,
+			PresharedKey: link.PresharedKey,
+			Endpoint:     p.api.Endpoint,
+			Port:         p.Port,
+			Subnets:      subnets,
+		})
+	}
+
+	return peers, warnings
+}
+
+// Push a site's mesh configuration into its config tree.  If the site is
+// offline, the update is left in its command queue.
+func (o *orgHandler) meshPush(ctx context.Context, siteUUID uuid.UUID,
+	private string, port int, peers []wgsite.MeshPeer) error {
+
+	hdl, err := o.getClientHandle(siteUUID.String())
+	if err != nil {
+		return err
+	}
+	defer hdl.Close()
+
+	site, err := wgsite.NewSite(hdl)
+	if err != nil {
+		return err
+	}
+
+	pctx, cancel := context.WithTimeout(ctx, meshPushTimeout)
+	defer cancel()
+
+	err = site.UpdateMesh(pctx, private, port, peers)
+	if err == cfgapi.ErrQueued || err == cfgapi.ErrInProgress ||
+		err == context.DeadlineExceeded {
+		err = nil
+	}
+	return err
+}
+
+// Recalculate and push the configuration for every site in the mesh
+func (o *orgHandler) meshSync(ctx context.Context,
+	orgUUID uuid.UUID) ([]apiMeshSite, error) {
+
+	members, err := o.meshMembers(ctx, orgUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	all := make(map[uuid.UUID]*meshMember)
+	for _, m := range members {
+		all[m.SiteUUID] = m
+	}
+
+	rval := make([]apiMeshSite, 0)
+	for _, m := range members {
+		peers, warnings := meshPeers(m, all)
+		err := o.meshPush(ctx, m.SiteUUID, m.PrivateKey, m.Port, peers)
+		if err != nil {
+			warnings = append(warnings,
+				fmt.Sprintf("update failed: %v", err))
+		}
+		for _, w := range warnings {
+			if m.api.Status != "" {
+				m.api.Status += "; "
+			}
+			m.api.Status += w
+		}
+		rval = append(rval, m.api)
+	}
+
+	return rval, nil
+}
+
+// getMesh implements GET /api/org/:org_uuid/mesh, which lists the sites in the
+// organization's site-to-site mesh
+func (o *orgHandler) getMesh(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+
+	members, err := o.meshMembers(ctx, orgUUID)
+	if err != nil {
+		c.Logger().Errorf("Failed to get mesh: %+v", err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	resp := make([]apiMeshSite, 0)
+	for _, m := range members {
+		resp = append(resp, m.api)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// postMeshSync implements POST /api/org/:org_uuid/mesh/sync, which pushes the
+// latest keys, endpoints, and subnets to every site in the mesh
+func (o *orgHandler) postMeshSync(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	orgUUID, err := uuid.FromString(c.Param("org_uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+
+	resp, err := o.meshSync(ctx, orgUUID)
+	if err != nil {
+		c.Logger().Errorf("Failed to sync mesh: %+v", err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Generate and escrow the keys for a site joining the mesh: the site's own
+// key pair, and a preshared key for each existing member.
+func (o *orgHandler) meshJoin(ctx context.Context, orgUUID,
+	siteUUID uuid.UUID) error {
+
+	existing, err := o.db.MeshSitesByOrganization(ctx, orgUUID)
+	if err != nil {
+		return err
+	}
+
+	private, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return fmt.Errorf("generating key: %v", err)
+	}
+
+	tx, err := o.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	ms := &appliancedb.MeshSite{
+		SiteUUID:   siteUUID,
+		PrivateKey: private.String(),
+		PublicKey:  private.PublicKey().String(),
+		Port:       base_def.WIREGUARD_MESH_PORT,
+	}
+	if err = o.db.InsertMeshSiteTx(ctx, tx, ms); err != nil {
+		return err
+	}
+
+	for _, peer := range existing {
+		psk, err := wgtypes.GenerateKey()
+		if err != nil {
+			return fmt.Errorf("generating key: %v", err)
+		}
+		link := &appliancedb.MeshLink{
+			SiteA:        siteUUID,
+			SiteB:        peer.SiteUUID,
+			PresharedKey: psk.String(),
+		}
+		if err = o.db.InsertMeshLinkTx(ctx, tx, link); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// postMeshSite implements POST /api/org/:org_uuid/mesh/:site_uuid, which adds a
+// site to the mesh if necessary, and optionally sets which of its rings are
+// reachable from the other sites.
+func (o *orgHandler) postMeshSite(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	orgUUID, siteUUID, err := o.meshSite(c)
+	if err != nil {
+		return err
+	}
+
+	var input meshSiteRequest
+	if err := c.Bind(&input); err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+
+	if input.Rings != nil {
+		hdl, err := o.getClientHandle(siteUUID.String())
+		if err != nil {
+			return newHTTPError(http.StatusBadRequest)
+		}
+		defer hdl.Close()
+
+		site, err := wgsite.NewSite(hdl)
+		if err != nil {
+			return newHTTPError(http.StatusNotImplemented, err)
+		}
+		err = site.SetMeshRings(ctx, input.Rings)
+		if err != nil && err != cfgapi.ErrQueued &&
+			err != cfgapi.ErrInProgress {
+			return newHTTPError(http.StatusBadRequest, err)
+		}
+	}
+
+	_, err = o.db.MeshSiteByUUID(ctx, siteUUID)
+	if _, ok := err.(appliancedb.NotFoundError); ok {
+		if err = o.meshJoin(ctx, orgUUID, siteUUID); err != nil {
+			c.Logger().Errorf("Failed to add %s to mesh: %+v",
+				siteUUID, err)
+			return newHTTPError(http.StatusInternalServerError)
+		}
+	} else if err != nil {
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	resp, err := o.meshSync(ctx, orgUUID)
+	if err != nil {
+		c.Logger().Errorf("Failed to sync mesh: %+v", err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// deleteMeshSite implements DELETE /api/org/:org_uuid/mesh/:site_uuid, which
+// removes a site from the mesh
+func (o *orgHandler) deleteMeshSite(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	orgUUID, siteUUID, err := o.meshSite(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err = o.db.MeshSiteByUUID(ctx, siteUUID); err != nil {
+		if _, ok := err.(appliancedb.NotFoundError); ok {
+			return newHTTPError(http.StatusNotFound, "Not in mesh")
+		}
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	if err = o.db.DeleteMeshSiteTx(ctx, nil, siteUUID); err != nil {
+		c.Logger().Errorf("Failed to remove %s from mesh: %+v",
+			siteUUID, err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+
+	if err = o.meshPush(ctx, siteUUID, "", 0, nil); err != nil {
+		c.Logger().Warnf("Failed to clear mesh config for %s: %v",
+			siteUUID, err)
+	}
+
+	resp, err := o.meshSync(ctx, orgUUID)
+	if err != nil {
+		c.Logger().Errorf("Failed to sync mesh: %+v", err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
@@ -20,8 +20,9 @@ import (
 )
 
 type orgHandler struct {
-	db           appliancedb.DataStore
-	sessionStore sessions.Store
+	db              appliancedb.DataStore
+	sessionStore    sessions.Store
+	getClientHandle getClientHandleFunc
 }
 
 type orgsResponse struct {
@@ -139,15 +140,20 @@ func (o *orgHandler) mkOrgMiddleware(allowedRoles []string) echo.MiddlewareFunc
 
 // newOrgAPIHandler creates an orgHandler for the given DataStore and session
 // Store, and routes the handler into the echo instance.
-func newOrgHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.MiddlewareFunc, sessionStore sessions.Store) *orgHandler {
-	h := &orgHandler{db, sessionStore}
+func newOrgHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.MiddlewareFunc, sessionStore sessions.Store, getClientHandle getClientHandleFunc) *orgHandler {
+	h := &orgHandler{db, sessionStore, getClientHandle}
 	r.GET("/api/org", h.getOrgs, middlewares...)
 
+	admin := h.mkOrgMiddleware([]string{"admin"})
 	user := h.mkOrgMiddleware([]string{"admin", "user"})
 
 	org := r.Group("/api/org/:org_uuid")
 	org.Use(middlewares...)
 	org.GET("/accounts", h.getOrgAccounts, user)
+	org.GET("/mesh", h.getMesh, user)
+	org.POST("/mesh/sync", h.postMeshSync, admin)
+	org.POST("/mesh/:site_uuid", h.postMeshSite, admin)
+	org.DELETE("/mesh/:site_uuid", h.deleteMeshSite, admin)
 	return h
 }
 
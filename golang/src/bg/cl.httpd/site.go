@@ -18,9 +18,11 @@ import (
 	"time"
 
 	"bg/cloud_models/appliancedb"
+	"bg/common/capture"
 	"bg/common/cfgapi"
 	"bg/common/mfg"
 	"bg/common/network"
+	"bg/common/portal"
 	"bg/common/wgsite"
 
 	"github.com/labstack/echo"
@@ -255,6 +257,7 @@ type apiVulnInfo struct {
 	Active         bool       `json:"active"`
 	Details        string     `json:"details"`
 	Repair         *bool      `json:"repair,omitempty"`
+	CVSS           float64    `json:"cvss,omitempty"`
 }
 
 // apiScanInfo describes a scan.
@@ -343,6 +346,7 @@ func buildDeviceResponse(c echo.Context, hdl *cfgapi.Handle,
 			Active:         v.Active,
 			Details:        v.Details,
 			Repair:         v.Repair,
+			CVSS:           v.CVSS,
 		}
 	}
 
@@ -562,8 +566,10 @@ func (a *siteHandler) postEnrollGuest(c echo.Context) error {
 }
 
 type siteHealth struct {
-	HeartbeatProblem bool `json:"heartbeatProblem"`
-	ConfigProblem    bool `json:"configProblem"`
+	HeartbeatProblem bool              `json:"heartbeatProblem"`
+	ConfigProblem    bool              `json:"configProblem"`
+	RogueAPProblem   bool              `json:"rogueAPProblem"`
+	RogueAPs         []*cfgapi.RogueAP `json:"rogueAPs"`
 }
 
 // getHealth implements /api/sites/:uuid/health
@@ -598,6 +604,9 @@ func (a *siteHandler) getHealth(c echo.Context) error {
 		response.ConfigProblem = true
 	}
 
+	response.RogueAPs = hdl.GetRogueAPs()
+	response.RogueAPProblem = len(response.RogueAPs) > 0
+
 	return c.JSON(http.StatusOK, response)
 }
 
@@ -645,6 +654,9 @@ func (a *siteHandler) getNetworkVAPName(c echo.Context) error {
 	// Remove sensitive material for non-admins
 	if c.Param("vapname") != "guest" && !roles["admin"] {
 		vap.Passphrase = ""
+		for _, psk := range vap.PSKs {
+			psk.Passphrase = ""
+		}
 	}
 	if !ok {
 		return newHTTPError(http.StatusNotFound)
@@ -655,6 +667,9 @@ func (a *siteHandler) getNetworkVAPName(c echo.Context) error {
 type apiVAPUpdate struct {
 	SSID       string `json:"ssid"`
 	Passphrase string `json:"passphrase"`
+
+	// Additional per-ring PSKs to add, replace, or (if null) remove
+	PSKs map[string]*cfgapi.VirtualAPPSK `json:"psks"`
 }
 
 // postNetworkVAPName implements POST /api/sites/:uuid/network/vap/:name,
@@ -690,12 +705,319 @@ func (a *siteHandler) postNetworkVAPName(c echo.Context) error {
 			Value: av.Passphrase,
 		})
 	}
+	for name, psk := range av.PSKs {
+		pskOps, err := vapPSKOps(c.Param("vapname"), vap, name, psk)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, pskOps...)
+	}
 	if len(ops) == 0 {
 		return nil
 	}
 	return executePropChange(c, hdl, ops)
 }
 
+// Build the property ops needed to replace or remove a single PSK
+func vapPSKOps(vapName string, vap *cfgapi.VirtualAP, name string,
+	psk *cfgapi.VirtualAPPSK) ([]cfgapi.PropertyOp, error) {
+
+	if !cfgapi.ValidPSKName(name) {
+		return nil, newHTTPError(http.StatusBadRequest, "bad psk name")
+	}
+
+	base := fmt.Sprintf("@/network/vap/%s/psk/%s", vapName, name)
+	if psk == nil {
+		if _, ok := vap.PSKs[name]; !ok {
+			return nil, nil
+		}
+		op := cfgapi.PropertyOp{
+			Op:   cfgapi.PropDelete,
+			Name: base,
+		}
+		return []cfgapi.PropertyOp{op}, nil
+	}
+
+	if !cfgapi.KeyMgmtUsesPSK(vap.KeyMgmt) {
+		return nil, newHTTPError(http.StatusBadRequest,
+			"vap does not use pre-shared keys")
+	}
+	if psk.Passphrase == "" {
+		return nil, newHTTPError(http.StatusBadRequest,
+			"missing passphrase for psk "+name)
+	}
+	onVap := false
+	for _, r := range vap.Rings {
+		onVap = onVap || (r == psk.Ring)
+	}
+	if !onVap {
+		return nil, newHTTPError(http.StatusBadRequest,
+			"ring "+psk.Ring+" is not on this vap")
+	}
+
+	// Replace the whole key, so a stale mac binding doesn't linger
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropDelete,
+			Name: base,
+		},
+		{
+			Op:    cfgapi.PropCreate,
+			Name:  base + "/passphrase",
+			Value: psk.Passphrase,
+		},
+		{
+			Op:    cfgapi.PropCreate,
+			Name:  base + "/ring",
+			Value: psk.Ring,
+		},
+	}
+	if _, ok := vap.PSKs[name]; !ok {
+		ops = ops[1:]
+	}
+	if psk.Mac != "" {
+		hwaddr, err := net.ParseMAC(psk.Mac)
+		if err != nil {
+			return nil, newHTTPError(http.StatusBadRequest,
+				"bad mac address for psk "+name)
+		}
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:    cfgapi.PropCreate,
+			Name:  base + "/mac",
+			Value: hwaddr.String(),
+		})
+	}
+
+	return ops, nil
+}
+
+type apiPortalRequest struct {
+	MacAddress string `json:"macAddress"`
+	Name       string `json:"name"`
+	IPAddress  string `json:"ipAddress,omitempty"`
+}
+
+// getNetworkPortalPending implements GET
+// /api/sites/:uuid/network/portal/pending, returning the guests awaiting a
+// sponsor's approval on the captive portal.
+func (a *siteHandler) getNetworkPortalPending(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	clients := hdl.GetClients()
+	resp := make([]apiPortalRequest, 0)
+	for mac, name := range portal.Pending(hdl) {
+		req := apiPortalRequest{
+			MacAddress: mac,
+			Name:       name,
+		}
+		if client := clients[mac]; client != nil && client.IPv4 != nil {
+			req.IPAddress = client.IPv4.String()
+		}
+		resp = append(resp, req)
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// postNetworkPortalPendingMac implements POST
+// /api/sites/:uuid/network/portal/pending/:mac, approving a guest's request for
+// access.
+func (a *siteHandler) postNetworkPortalPendingMac(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	mac, err := net.ParseMAC(c.Param("mac"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad mac address")
+	}
+	if !portal.IsPending(hdl, mac) {
+		return newHTTPError(http.StatusNotFound, "no such request")
+	}
+
+	cfg := portal.GetConfig(hdl)
+	err = portal.Authorize(c.Request().Context(), hdl, mac,
+		portal.ModeSponsor, cfg.Duration)
+	if err != nil {
+		c.Logger().Warnf("approving %s: %v", mac, err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	c.Logger().Infof("%s approved for guest access at site %v", mac,
+		c.Param("uuid"))
+	return nil
+}
+
+// deleteNetworkPortalPendingMac implements DELETE
+// /api/sites/:uuid/network/portal/pending/:mac, rejecting a guest's request
+// for access.
+func (a *siteHandler) deleteNetworkPortalPendingMac(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	mac, err := net.ParseMAC(c.Param("mac"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest, "bad mac address")
+	}
+
+	if err = portal.Deny(c.Request().Context(), hdl, mac); err != nil {
+		if err == cfgapi.ErrNoProp {
+			return newHTTPError(http.StatusNotFound, "no such request")
+		}
+		c.Logger().Warnf("denying %s: %v", mac, err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	c.Logger().Infof("%s denied guest access at site %v", mac,
+		c.Param("uuid"))
+	return nil
+}
+
+type apiCapture struct {
+	Name   string     `json:"name"`
+	Active bool       `json:"active"`
+	Until  *time.Time `json:"until,omitempty"`
+	Mac    string     `json:"mac,omitempty"`
+	Ring   string     `json:"ring,omitempty"`
+	Filter string     `json:"filter,omitempty"`
+	Rules  bool       `json:"rules"`
+	Upload bool       `json:"upload"`
+	// File limits; zero values leave the site's defaults in place
+	FileSize   int `json:"fileSize,omitempty"`   // MB
+	FilePeriod int `json:"filePeriod,omitempty"` // seconds
+	MaxFiles   int `json:"maxFiles,omitempty"`
+}
+
+// The capture's name is taken from the URL, and its state from the request
+// itself, so the Name, Active, and Until fields are ignored.
+type apiCaptureRequest struct {
+	apiCapture
+	// Number of seconds the capture runs.  If omitted or zero, it runs
+	// until stopped.
+	Duration int `json:"duration,omitempty"`
+}
+
+// getCapture implements GET /api/sites/:uuid/capture, returning the packet
+// captures configured at the site.
+func (a *siteHandler) getCapture(c echo.Context) error {
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	all, err := capture.GetAll(hdl)
+	if err != nil {
+		return newHTTPError(http.StatusInternalServerError, err)
+	}
+
+	resp := make([]apiCapture, 0)
+	for _, spec := range all {
+		resp = append(resp, apiCapture{
+			Name:       spec.Name,
+			Active:     spec.Active,
+			Until:      spec.Until,
+			Mac:        spec.Mac,
+			Ring:       spec.Ring,
+			Filter:     spec.Filter,
+			Rules:      spec.Rules,
+			Upload:     spec.Upload,
+			FileSize:   spec.FileSize,
+			FilePeriod: int(spec.FilePeriod / time.Second),
+			MaxFiles:   spec.MaxFiles,
+		})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// postCaptureName implements POST /api/sites/:uuid/capture/:name, starting a
+// packet capture.  Any earlier capture with the same name is replaced.
+func (a *siteHandler) postCaptureName(c echo.Context) error {
+	name := c.Param("name")
+	if !capture.ValidName(name) {
+		return newHTTPError(http.StatusBadRequest, "bad capture name")
+	}
+
+	var req apiCaptureRequest
+	if err := c.Bind(&req); err != nil {
+		return newHTTPError(http.StatusBadRequest, err)
+	}
+	if req.Mac != "" {
+		if _, err := net.ParseMAC(req.Mac); err != nil {
+			return newHTTPError(http.StatusBadRequest,
+				"bad mac address")
+		}
+	}
+	if req.Ring != "" && !cfgapi.ValidRings[req.Ring] {
+		return newHTTPError(http.StatusBadRequest, "bad ring")
+	}
+	if req.Duration < 0 || req.FileSize < 0 || req.FilePeriod < 0 ||
+		req.MaxFiles < 0 {
+		return newHTTPError(http.StatusBadRequest, "bad capture limits")
+	}
+
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	spec := &capture.Spec{
+		Name:       name,
+		Mac:        req.Mac,
+		Ring:       req.Ring,
+		Filter:     req.Filter,
+		Rules:      req.Rules,
+		Upload:     req.Upload,
+		FileSize:   req.FileSize,
+		FilePeriod: time.Duration(req.FilePeriod) * time.Second,
+		MaxFiles:   req.MaxFiles,
+	}
+	d := time.Duration(req.Duration) * time.Second
+	err = capture.Start(c.Request().Context(), hdl, spec, d)
+	if err != nil {
+		c.Logger().Warnf("starting capture %s: %v", name, err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	c.Logger().Infof("capture %s started at site %v", name,
+		c.Param("uuid"))
+	return nil
+}
+
+// deleteCaptureName implements DELETE /api/sites/:uuid/capture/:name, stopping
+// a packet capture and removing its configuration.  Files it has already
+// completed are unaffected.
+func (a *siteHandler) deleteCaptureName(c echo.Context) error {
+	name := c.Param("name")
+	if !capture.ValidName(name) {
+		return newHTTPError(http.StatusBadRequest, "bad capture name")
+	}
+
+	hdl, err := a.getClientHandle(c.Param("uuid"))
+	if err != nil {
+		return newHTTPError(http.StatusBadRequest)
+	}
+	defer hdl.Close()
+
+	if err = capture.Delete(c.Request().Context(), hdl, name); err != nil {
+		if err == cfgapi.ErrNoProp {
+			return newHTTPError(http.StatusNotFound,
+				"no such capture")
+		}
+		c.Logger().Warnf("deleting capture %s: %v", name, err)
+		return newHTTPError(http.StatusInternalServerError)
+	}
+	c.Logger().Infof("capture %s removed at site %v", name,
+		c.Param("uuid"))
+	return nil
+}
+
 // getNetworkWan implements GET /api/sites/:uuid/network/wan
 // returning information about the Wan link
 func (a *siteHandler) getNetworkWan(c echo.Context) error {
@@ -1320,6 +1642,9 @@ func newSiteHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.M
 
 	siteU := r.Group("/api/sites/:uuid", mw...)
 	siteU.GET("", h.getSitesUUID, user)
+	siteU.GET("/capture", h.getCapture, admin)
+	siteU.POST("/capture/:name", h.postCaptureName, admin)
+	siteU.DELETE("/capture/:name", h.deleteCaptureName, admin)
 	siteU.GET("/config", h.getConfig, admin)
 	siteU.POST("/config", h.postConfig, admin)
 	siteU.GET("/configtree", h.getConfigTree, admin)
@@ -1333,6 +1658,9 @@ func newSiteHandler(r *echo.Echo, db appliancedb.DataStore, middlewares []echo.M
 	siteU.GET("/network/dns", h.getNetworkDNS, user)
 	siteU.GET("/network/vap/:vapname", h.getNetworkVAPName, user)
 	siteU.POST("/network/vap/:vapname", h.postNetworkVAPName, admin)
+	siteU.GET("/network/portal/pending", h.getNetworkPortalPending, user)
+	siteU.POST("/network/portal/pending/:mac", h.postNetworkPortalPendingMac, user)
+	siteU.DELETE("/network/portal/pending/:mac", h.deleteNetworkPortalPendingMac, user)
 	siteU.GET("/network/wan", h.getNetworkWan, admin)
 	siteU.GET("/network/wg", h.getNetworkWG, user)
 	siteU.POST("/network/wg", h.postNetworkWG, admin)
@@ -172,6 +172,10 @@ func (cs *cloudStorageServer) GenerateURL(ctx context.Context, req *cloud_rpc.Ge
 		} else if ct != archive.StatContentType && ct != archive.StatBinaryType {
 			errmsg = "bad content-type for stats: " + ct
 		}
+	} else if req.Prefix == "captures" {
+		if ct != archive.CaptureContentType {
+			errmsg = "bad content-type for captures: " + ct
+		}
 	} else if req.Prefix == "" {
 		errmsg = "missing prefix"
 	}
@@ -198,6 +202,13 @@ func (cs *cloudStorageServer) GenerateURL(ctx context.Context, req *cloud_rpc.Ge
 					"invalid object timestamp")
 			}
 			fullName = req.Prefix + "/" + t.UTC().Format(time.RFC3339) + suffix
+		} else if req.Prefix == "captures" {
+			if filepath.Ext(obj) != ".pcapng" || filepath.Base(obj) != obj {
+				slog.Warnf("GenerateURL: invalid capture object %v", obj)
+				return nil, status.Errorf(codes.FailedPrecondition,
+					"invalid capture object")
+			}
+			fullName = req.Prefix + "/" + obj
 		} else {
 			fullName = req.Prefix + "/" + obj
 		}
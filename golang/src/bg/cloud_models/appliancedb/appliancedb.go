@@ -104,6 +104,9 @@ type DataStore interface {
 	// Methods related to software releases
 	releaseManager
 
+	// Methods related to the site-to-site VPN mesh
+	meshManager
+
 	Ping() error
 	PingContext(context.Context) error
 	Close() error
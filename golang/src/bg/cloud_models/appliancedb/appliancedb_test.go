@@ -1552,6 +1552,112 @@ func testCommandQueue(t *testing.T, ds DataStore, logger *zap.Logger, slogger *z
 	assert.Len(cmds, 0)
 }
 
+// Test the site-to-site mesh tables.  subtest of TestDatabaseModel
+func testMesh(t *testing.T, ds DataStore, logger *zap.Logger, slogger *zap.SugaredLogger) {
+	var err error
+	ctx := context.Background()
+	assert := require.New(t)
+
+	ds.AccountSecretsSetPassphrase([]byte("I LIKE COCONUTS"))
+	mkOrgSiteApp(t, ds, &testOrg1, &testSite1, &testID1)
+	mkOrgSiteApp(t, ds, &testOrg2, &testSite2, &testID2)
+	testSite3 := CustomerSite{
+		UUID:             uuid.NewV4(),
+		OrganizationUUID: testOrg1.UUID,
+		Name:             "site3",
+	}
+	mkOrgSiteApp(t, ds, nil, &testSite3, nil)
+
+	_, err = ds.MeshSiteByUUID(ctx, testSite1.UUID)
+	assert.Error(err)
+	assert.IsType(NotFoundError{}, err)
+
+	ms1 := MeshSite{
+		SiteUUID:   testSite1.UUID,
+		PrivateKey: "site1-private",
+		PublicKey:  "site1-public",
+		Port:       51820,
+	}
+	ms3 := MeshSite{
+		SiteUUID:   testSite3.UUID,
+		PrivateKey: "site3-private",
+		PublicKey:  "site3-public",
+		Port:       51821,
+	}
+	ms2 := MeshSite{
+		SiteUUID:   testSite2.UUID,
+		PrivateKey: "site2-private",
+		PublicKey:  "site2-public",
+		Port:       51822,
+	}
+	for _, ms := range []*MeshSite{&ms1, &ms3, &ms2} {
+		err = ds.InsertMeshSiteTx(ctx, nil, ms)
+		assert.NoError(err)
+	}
+
+	// The private key is stored encrypted, but handed back in the clear
+	m, err := ds.MeshSiteByUUID(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal("site1-private", m.PrivateKey)
+	assert.Equal("site1-public", m.PublicKey)
+	assert.Equal(51820, m.Port)
+
+	// Only the sites in the organization are part of its mesh
+	sites, err := ds.MeshSitesByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(sites, 2)
+	for _, s := range sites {
+		assert.NotEqual(testSite2.UUID, s.SiteUUID)
+	}
+
+	// A site can't be linked to itself
+	err = ds.InsertMeshLinkTx(ctx, nil, &MeshLink{
+		SiteA:        testSite1.UUID,
+		SiteB:        testSite1.UUID,
+		PresharedKey: "self",
+	})
+	assert.Error(err)
+
+	// Links are stored in canonical order, so can be inserted either way
+	// around, but only once
+	link := MeshLink{
+		SiteA:        testSite3.UUID,
+		SiteB:        testSite1.UUID,
+		PresharedKey: "site1-site3",
+	}
+	if link.SiteA.String() < link.SiteB.String() {
+		link.SiteA, link.SiteB = link.SiteB, link.SiteA
+	}
+	err = ds.InsertMeshLinkTx(ctx, nil, &link)
+	assert.NoError(err)
+	link.SiteA, link.SiteB = link.SiteB, link.SiteA
+	err = ds.InsertMeshLinkTx(ctx, nil, &link)
+	assert.Error(err)
+
+	for _, site := range []uuid.UUID{testSite1.UUID, testSite3.UUID} {
+		links, err := ds.MeshLinksBySite(ctx, site)
+		assert.NoError(err)
+		assert.Len(links, 1)
+		assert.Equal("site1-site3", links[0].PresharedKey)
+		assert.True(links[0].SiteA.String() < links[0].SiteB.String())
+	}
+	links, err := ds.MeshLinksBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Equal(testSite3.UUID, links[0].Peer(testSite1.UUID))
+	assert.Equal(testSite1.UUID, links[0].Peer(testSite3.UUID))
+
+	// Removing a site from the mesh removes its links
+	err = ds.DeleteMeshSiteTx(ctx, nil, testSite3.UUID)
+	assert.NoError(err)
+	links, err = ds.MeshLinksBySite(ctx, testSite1.UUID)
+	assert.NoError(err)
+	assert.Len(links, 0)
+	sites, err = ds.MeshSitesByOrganization(ctx, testOrg1.UUID)
+	assert.NoError(err)
+	assert.Len(sites, 1)
+	assert.Equal(testSite1.UUID, sites[0].SiteUUID)
+}
+
 // make a template database, loaded with the schema.  Subsequently
 // we can knock out copies.
 func mkTemplate(ctx context.Context) error {
@@ -1615,6 +1721,8 @@ func TestDatabaseModel(t *testing.T) {
 		{"testReleaseArtifacts", testReleaseArtifacts},
 		{"testReleaseStatus", testReleaseStatus},
 		{"testReleases", testReleases},
+
+		{"testMesh", testMesh},
 	}
 
 	for _, tc := range testCases {
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package appliancedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/satori/uuid"
+)
+
+type meshManager interface {
+	MeshSitesByOrganization(context.Context, uuid.UUID) ([]MeshSite, error)
+	MeshSiteByUUID(context.Context, uuid.UUID) (*MeshSite, error)
+	InsertMeshSiteTx(context.Context, DBX, *MeshSite) error
+	DeleteMeshSiteTx(context.Context, DBX, uuid.UUID) error
+	MeshLinksBySite(context.Context, uuid.UUID) ([]MeshLink, error)
+	InsertMeshLinkTx(context.Context, DBX, *MeshLink) error
+}
+
+// MeshSite represents a row in the site_mesh table: a site participating in
+// its organization's site-to-site VPN mesh, along with its escrowed WireGuard
+// keys.
+type MeshSite struct {
+	SiteUUID   uuid.UUID `db:"site_uuid"`
+	PrivateKey string    `db:"private_key"`
+	PublicKey  string    `db:"public_key"`
+	Port       int       `db:"port"`
+	Created    time.Time `db:"created_ts"`
+}
+
+// MeshLink represents a row in the site_mesh_link table.  Each pair of sites in
+// a mesh shares a preshared key.  SiteA is always the lesser of the two UUIDs.
+type MeshLink struct {
+	SiteA        uuid.UUID `db:"site_a"`
+	SiteB        uuid.UUID `db:"site_b"`
+	PresharedKey string    `db:"preshared_key"`
+	Created      time.Time `db:"created_ts"`
+}
+
+// Peer returns the site on the other end of the link
+func (l *MeshLink) Peer(site uuid.UUID) uuid.UUID {
+	if uuid.Equal(l.SiteA, site) {
+		return l.SiteB
+	}
+	return l.SiteA
+}
+
+func (db *ApplianceDB) decryptMeshSite(ms *MeshSite) error {
+	key, err := pgpSymDecrypt([]byte(ms.PrivateKey), db.accountSecretsPassphrase)
+	if err != nil {
+		return errors.Wrapf(err, "Couldn't decrypt mesh key for %s",
+			ms.SiteUUID)
+	}
+	ms.PrivateKey = key
+	return nil
+}
+
+// MeshSitesByOrganization returns all of the sites in an organization which
+// are part of its mesh
+func (db *ApplianceDB) MeshSitesByOrganization(ctx context.Context,
+	orgUUID uuid.UUID) ([]MeshSite, error) {
+
+	var sites []MeshSite
+	err := db.SelectContext(ctx, &sites, `
+	    SELECT m.*
+	    FROM site_mesh m, customer_site s
+	    WHERE m.site_uuid = s.uuid AND s.organization_uuid = $1
+	    ORDER BY m.created_ts`, orgUUID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sites {
+		if err = db.decryptMeshSite(&sites[i]); err != nil {
+			return nil, err
+		}
+	}
+	return sites, nil
+}
+
+// MeshSiteByUUID returns the mesh details for a single site
+func (db *ApplianceDB) MeshSiteByUUID(ctx context.Context,
+	siteUUID uuid.UUID) (*MeshSite, error) {
+
+	var ms MeshSite
+	err := db.GetContext(ctx, &ms,
+		"SELECT * FROM site_mesh WHERE site_uuid=$1", siteUUID)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, NotFoundError{fmt.Sprintf(
+			"MeshSiteByUUID: Couldn't find %s", siteUUID)}
+	case nil:
+		break
+	default:
+		panic(err)
+	}
+	if err = db.decryptMeshSite(&ms); err != nil {
+		return nil, err
+	}
+	return &ms, nil
+}
+
+// InsertMeshSiteTx adds a site to its organization's mesh, possibly inside a
+// transaction.
+func (db *ApplianceDB) InsertMeshSiteTx(ctx context.Context, dbx DBX,
+	ms *MeshSite) error {
+
+	crypted := *ms
+	key, err := pgpSymEncrypt(ms.PrivateKey, db.accountSecretsPassphrase)
+	if err != nil {
+		return err
+	}
+	crypted.PrivateKey = key
+
+	if dbx == nil {
+		dbx = db
+	}
+	_, err = dbx.NamedExecContext(ctx,
+		`INSERT INTO site_mesh
+		 (site_uuid, private_key, public_key, port)
+		 VALUES (:site_uuid, :private_key, :public_key, :port)`,
+		&crypted)
+	return err
+}
+
+// DeleteMeshSiteTx removes a site, and all of its links, from the mesh
+func (db *ApplianceDB) DeleteMeshSiteTx(ctx context.Context, dbx DBX,
+	siteUUID uuid.UUID) error {
+
+	if dbx == nil {
+		dbx = db
+	}
+	_, err := dbx.ExecContext(ctx,
+		"DELETE FROM site_mesh WHERE site_uuid=$1", siteUUID)
+	return err
+}
+
+// MeshLinksBySite returns all of the links connecting a site to the rest of the
+// mesh
+func (db *ApplianceDB) MeshLinksBySite(ctx context.Context,
+	siteUUID uuid.UUID) ([]MeshLink, error) {
+
+	var links []MeshLink
+	err := db.SelectContext(ctx, &links, `
+	    SELECT *
+	    FROM site_mesh_link
+	    WHERE site_a = $1 OR site_b = $1`, siteUUID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range links {
+		l := &links[i]
+		key, err := pgpSymDecrypt([]byte(l.PresharedKey),
+			db.accountSecretsPassphrase)
+		if err != nil {
+			return nil, errors.Wrapf(err,
+				"Couldn't decrypt mesh key for %s/%s",
+				l.SiteA, l.SiteB)
+		}
+		l.PresharedKey = key
+	}
+	return links, nil
+}
+
+// InsertMeshLinkTx adds a link between two sites, possibly inside a
+// transaction.  The sites are reordered if necessary.
+func (db *ApplianceDB) InsertMeshLinkTx(ctx context.Context, dbx DBX,
+	link *MeshLink) error {
+
+	crypted := *link
+	if uuid.Equal(link.SiteA, link.SiteB) {
+		return fmt.Errorf("cannot link %s to itself", link.SiteA)
+	}
+	if link.SiteA.String() > link.SiteB.String() {
+		crypted.SiteA, crypted.SiteB = link.SiteB, link.SiteA
+	}
+
+	key, err := pgpSymEncrypt(link.PresharedKey, db.accountSecretsPassphrase)
+	if err != nil {
+		return err
+	}
+	crypted.PresharedKey = key
+
+	if dbx == nil {
+		dbx = db
+	}
+	_, err = dbx.NamedExecContext(ctx,
+		`INSERT INTO site_mesh_link
+		 (site_a, site_b, preshared_key)
+		 VALUES (:site_a, :site_b, :preshared_key)`,
+		&crypted)
+	return err
+}
@@ -0,0 +1,43 @@
+--
+-- Copyright 2020 Brightgate Inc.
+--
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at https://mozilla.org/MPL/2.0/.
+--
+
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS site_mesh (
+	site_uuid uuid REFERENCES customer_site(uuid) PRIMARY KEY NOT NULL,
+	private_key text NOT NULL,
+	public_key text NOT NULL,
+	port integer NOT NULL,
+	created_ts timestamp with time zone NOT NULL DEFAULT now()
+);
+
+COMMENT ON TABLE site_mesh IS 'Sites participating in their organization''s site-to-site VPN mesh';
+COMMENT ON COLUMN site_mesh.private_key IS 'WireGuard private key; client supplies encryption';
+COMMENT ON COLUMN site_mesh.public_key IS 'WireGuard public key';
+COMMENT ON COLUMN site_mesh.port IS 'UDP port on which the site accepts mesh traffic';
+
+CREATE TABLE IF NOT EXISTS site_mesh_link (
+	site_a uuid REFERENCES site_mesh(site_uuid) ON DELETE CASCADE NOT NULL,
+	site_b uuid REFERENCES site_mesh(site_uuid) ON DELETE CASCADE NOT NULL,
+	preshared_key text NOT NULL,
+	created_ts timestamp with time zone NOT NULL DEFAULT now(),
+	PRIMARY KEY (site_a, site_b),
+	CHECK (site_a < site_b)
+);
+
+CREATE INDEX ON site_mesh_link (site_b);
+
+COMMENT ON TABLE site_mesh_link IS 'A WireGuard link between two sites in a mesh';
+COMMENT ON COLUMN site_mesh_link.preshared_key IS 'WireGuard preshared key unique to this pair of sites; client supplies encryption';
+
+GRANT DELETE, INSERT, SELECT, UPDATE
+    ON TABLE site_mesh, site_mesh_link
+    TO httpd_group;
+
+COMMIT;
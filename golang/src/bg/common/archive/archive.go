@@ -21,6 +21,9 @@ const (
 	StatContentType = "application/vnd.b10e.stat-archive+json"
 	DropBinaryType  = "application/vnd.b10e.drop-archive+gob"
 	StatBinaryType  = "application/vnd.b10e.stat-archive+gob"
+
+	// Packet captures are stored in their native format
+	CaptureContentType = "application/x-pcapng"
 )
 
 // DropRecord contains information about a single packet blocked by the firewall
@@ -32,6 +35,10 @@ type DropRecord struct {
 	Smac  string `json:",omitempty"`
 	Proto string
 
+	// Location of the remote endpoint, if known
+	Country string `json:",omitempty"`
+	ASN     uint32 `json:",omitempty"`
+
 	// Used in-core, but not persisted
 	SrcIP   net.IP `json:"-"`
 	DstIP   net.IP `json:"-"`
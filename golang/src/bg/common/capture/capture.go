@@ -0,0 +1,192 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Package capture manages the config state for the on-demand packet captures
+// run by ap.watchd.  Each capture is described by a subtree of the config tree,
+// and runs while its 'active' property is true and unexpired:
+//
+//    @/capture/<name>/active       capture runs while true and unexpired
+//    @/capture/<name>/mac          only capture packets to/from this client
+//    @/capture/<name>/ring         only capture packets on this ring
+//    @/capture/<name>/filter       additional BPF expression
+//    @/capture/<name>/rules        capture on rings with CAPTURE rules
+//    @/capture/<name>/file_size    rotate files after <n> MB
+//    @/capture/<name>/file_period  rotate files after this duration
+//    @/capture/<name>/max_files    number of completed files to retain
+//    @/capture/<name>/upload       upload completed files to the cloud
+package capture
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bg/common/cfgapi"
+)
+
+// Root is the config subtree holding all of the captures
+const Root = "@/capture"
+
+// Spec describes a single capture.  Zero-valued limits leave ap.watchd's
+// defaults in place.
+type Spec struct {
+	Name       string
+	Active     bool
+	Until      *time.Time // nil if the capture runs until stopped
+	Mac        string
+	Ring       string
+	Filter     string
+	Rules      bool
+	Upload     bool
+	FileSize   int // MB
+	FilePeriod time.Duration
+	MaxFiles   int
+}
+
+// ValidName returns true if the string can be used to name a capture
+func ValidName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/ ")
+}
+
+func specFromNode(name string, node *cfgapi.PropertyNode) *Spec {
+	s := &Spec{Name: name}
+
+	if a, _ := node.GetChild("active"); a != nil && !a.Expired() {
+		if s.Active, _ = a.GetBool(); s.Active {
+			s.Until = a.Expires
+		}
+	}
+	s.Mac, _ = node.GetChildString("mac")
+	s.Ring, _ = node.GetChildString("ring")
+	s.Filter, _ = node.GetChildString("filter")
+	s.Rules, _ = node.GetChildBool("rules")
+	s.Upload, _ = node.GetChildBool("upload")
+	s.FileSize, _ = node.GetChildInt("file_size")
+	s.MaxFiles, _ = node.GetChildInt("max_files")
+	if x, _ := node.GetChildString("file_period"); x != "" {
+		s.FilePeriod, _ = time.ParseDuration(x)
+	}
+
+	return s
+}
+
+// GetAll returns all of the captures configured at a site, indexed by name
+func GetAll(config *cfgapi.Handle) (map[string]*Spec, error) {
+	all := make(map[string]*Spec)
+
+	props, err := config.GetProps(Root)
+	if err == cfgapi.ErrNoProp {
+		return all, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for name, node := range props.Children {
+		all[name] = specFromNode(name, node)
+	}
+	return all, nil
+}
+
+// Start configures and starts a capture, replacing any earlier capture with the
+// same name.  If the duration is non-zero, the capture stops after that long.
+func Start(ctx context.Context, config *cfgapi.Handle, spec *Spec,
+	d time.Duration) error {
+
+	if !ValidName(spec.Name) {
+		return fmt.Errorf("invalid capture name: %s", spec.Name)
+	}
+
+	base := Root + "/" + spec.Name
+	ops := make([]cfgapi.PropertyOp, 0)
+	if old, _ := config.GetProps(base); old != nil {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:   cfgapi.PropDelete,
+			Name: base,
+		})
+	}
+
+	props := map[string]string{
+		"mac":    spec.Mac,
+		"ring":   spec.Ring,
+		"filter": spec.Filter,
+		"rules":  strconv.FormatBool(spec.Rules),
+		"upload": strconv.FormatBool(spec.Upload),
+	}
+	if spec.FileSize > 0 {
+		props["file_size"] = strconv.Itoa(spec.FileSize)
+	}
+	if spec.MaxFiles > 0 {
+		props["max_files"] = strconv.Itoa(spec.MaxFiles)
+	}
+	if spec.FilePeriod > 0 {
+		props["file_period"] = spec.FilePeriod.String()
+	}
+	for prop, val := range props {
+		if val != "" {
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:    cfgapi.PropCreate,
+				Name:  base + "/" + prop,
+				Value: val,
+			})
+		}
+	}
+
+	// The 'active' property is created last, so the capture is started
+	// with its full configuration in place.
+	var expires *time.Time
+	if d > 0 {
+		t := time.Now().Add(d)
+		expires = &t
+	}
+	ops = append(ops, cfgapi.PropertyOp{
+		Op:      cfgapi.PropCreate,
+		Name:    base + "/active",
+		Value:   "true",
+		Expires: expires,
+	})
+
+	if _, err := config.Execute(ctx, ops).Wait(ctx); err != nil {
+		return fmt.Errorf("starting capture %s: %v", spec.Name, err)
+	}
+	return nil
+}
+
+// Stop ends a capture, leaving its configuration in place.  Returns
+// cfgapi.ErrNoProp if there is no such capture.
+func Stop(ctx context.Context, config *cfgapi.Handle, name string) error {
+	base := Root + "/" + name
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropTest,
+			Name: base,
+		},
+		{
+			Op:    cfgapi.PropSet,
+			Name:  base + "/active",
+			Value: "false",
+		},
+	}
+	_, err := config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
+
+// Delete stops a capture and removes its configuration.  Returns
+// cfgapi.ErrNoProp if there is no such capture.
+func Delete(ctx context.Context, config *cfgapi.Handle, name string) error {
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropDelete,
+			Name: Root + "/" + name,
+		},
+	}
+	_, err := config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package capture
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+)
+
+func TestCaptureLifecycle(t *testing.T) {
+	ctx := context.Background()
+	config := cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+
+	if all, err := GetAll(config); err != nil || len(all) != 0 {
+		t.Fatalf("empty tree: got %v (%v), expected no captures", all,
+			err)
+	}
+
+	spec := &Spec{
+		Name:       "laptop",
+		Mac:        "00:11:22:33:44:55",
+		Filter:     "port 53",
+		Upload:     true,
+		FilePeriod: 5 * time.Minute,
+	}
+	if err := Start(ctx, config, spec, time.Hour); err != nil {
+		t.Fatalf("starting capture: %v", err)
+	}
+
+	all, err := GetAll(config)
+	if err != nil {
+		t.Fatalf("fetching captures: %v", err)
+	}
+	got := all["laptop"]
+	if got == nil || !got.Active || got.Until == nil {
+		t.Fatalf("capture not active with a stop time: %+v", got)
+	}
+	if got.Mac != spec.Mac || got.Filter != spec.Filter ||
+		!got.Upload || got.Rules || got.FilePeriod != spec.FilePeriod {
+		t.Errorf("got %+v, expected %+v", got, spec)
+	}
+
+	// Restarting a capture replaces its old configuration
+	spec = &Spec{Name: "laptop", Ring: "standard", MaxFiles: 4}
+	if err = Start(ctx, config, spec, 0); err != nil {
+		t.Fatalf("restarting capture: %v", err)
+	}
+	all, _ = GetAll(config)
+	got = all["laptop"]
+	if got.Mac != "" || got.Ring != "standard" || got.MaxFiles != 4 {
+		t.Errorf("restart: got %+v, expected %+v", got, spec)
+	}
+	if !got.Active || got.Until != nil {
+		t.Errorf("restart: capture should run until stopped: %+v", got)
+	}
+
+	if err = Stop(ctx, config, "laptop"); err != nil {
+		t.Fatalf("stopping capture: %v", err)
+	}
+	all, _ = GetAll(config)
+	if got = all["laptop"]; got == nil || got.Active {
+		t.Errorf("stopped capture: got %+v", got)
+	}
+
+	if err = Delete(ctx, config, "laptop"); err != nil {
+		t.Fatalf("deleting capture: %v", err)
+	}
+	if all, _ = GetAll(config); len(all) != 0 {
+		t.Errorf("captures remain after delete: %v", all)
+	}
+
+	if err = Stop(ctx, config, "laptop"); err != cfgapi.ErrNoProp {
+		t.Errorf("stopping missing capture: got %v", err)
+	}
+	if err = Delete(ctx, config, "laptop"); err != cfgapi.ErrNoProp {
+		t.Errorf("deleting missing capture: got %v", err)
+	}
+	if err = Start(ctx, config, &Spec{Name: "a/b"}, 0); err == nil {
+		t.Errorf("started a capture with an invalid name")
+	}
+}
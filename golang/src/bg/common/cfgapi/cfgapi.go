@@ -18,6 +18,7 @@ import (
 	"log"
 	"math/bits"
 	"net"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -170,13 +171,32 @@ type RingConfig struct {
 
 // VirtualAP captures the configuration information of a virtual access point
 type VirtualAP struct {
-	SSID        string   `json:"ssid"`
-	Tag5GHz     bool     `json:"tag5GHz"`
-	KeyMgmt     string   `json:"keyMgmt"`
-	Passphrase  string   `json:"passphrase,omitempty"`
-	DefaultRing string   `json:"defaultRing"`
-	Rings       []string `json:"rings"`
-	Disabled    bool     `json:"disabled"`
+	SSID         string   `json:"ssid"`
+	Tag5GHz      bool     `json:"tag5GHz"`
+	KeyMgmt      string   `json:"keyMgmt"`
+	Passphrase   string   `json:"passphrase,omitempty"`
+	PMF          string   `json:"pmf,omitempty"`
+	DefaultRing  string   `json:"defaultRing"`
+	Rings        []string `json:"rings"`
+	Disabled     bool     `json:"disabled"`
+	Schedule     string   `json:"schedule,omitempty"`
+	Roaming      bool     `json:"roaming"`
+	BandSteering bool     `json:"bandSteering"`
+
+	// wpa-eap clients are authenticated by the site's external RADIUS
+	// servers rather than the local user database.
+	ExternalRADIUS bool `json:"externalRADIUS"`
+
+	PSKs map[string]*VirtualAPPSK `json:"psks,omitempty"`
+}
+
+// VirtualAPPSK describes one of the additional pre-shared keys accepted by a
+// wpa-psk VirtualAP.  A client connecting with the key is placed on the key's
+// ring.  If a mac address is specified, only that client may use the key.
+type VirtualAPPSK struct {
+	Passphrase string `json:"passphrase,omitempty"`
+	Ring       string `json:"ring"`
+	Mac        string `json:"mac,omitempty"`
 }
 
 // WifiInfo contains both the configured and actual band, channel, and channel
@@ -259,6 +279,8 @@ type VulnInfo struct {
 	Active         bool       // vuln was present on last scan
 	Details        string     // Additional details from the scanner
 	Repair         *bool      // Null: no info T: watcher listen>repair; F: repair failed
+	Source         string     // The tool which found the vuln
+	CVSS           float64    // CVSS base score, if known
 }
 
 // ScanInfo represents a record of scanning activity for a single client.
@@ -267,6 +289,29 @@ type ScanInfo struct {
 	Finish *time.Time // When the scan completed
 }
 
+// RogueAP represents a finding by a node's rogue AP detector: a nearby AP
+// impersonating one of our VAPs, or a flood of deauthentication frames aimed
+// at one of our BSSes.
+type RogueAP struct {
+	BSSID     string     `json:"bssid"`
+	Kind      string     `json:"kind"`
+	SSID      string     `json:"ssid,omitempty"`
+	VAP       string     `json:"vap,omitempty"`  // VAP being impersonated
+	Node      string     `json:"node,omitempty"` // node which saw it
+	Band      string     `json:"band,omitempty"`
+	Channel   int        `json:"channel,omitempty"`
+	Signal    int        `json:"signal,omitempty"`
+	FirstSeen *time.Time `json:"firstSeen,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+}
+
+// The kinds of RogueAP findings
+const (
+	RogueEvilTwin    = "evil_twin"          // our SSID on a BSSID we don't own
+	RogueOpenTwin    = "open_impersonation" // open network named like ours
+	RogueDeauthFlood = "deauth_flood"       // deauth frames flooding our BSS
+)
+
 // RingMap maps ring names to the configuration information
 type RingMap map[string]*RingConfig
 
@@ -895,8 +940,32 @@ func (c *Handle) GetRings() RingMap {
 	return set
 }
 
+// KeyMgmtUsesPSK returns true if the key management mode authenticates clients
+// with a shared passphrase
+func KeyMgmtUsesPSK(keymgmt string) bool {
+	keymgmt = strings.ToLower(keymgmt)
+	return keymgmt == "wpa-psk" || keymgmt == "sae" || keymgmt == "wpa-psk+sae"
+}
+
+// Each PSK name is written to hostapd's wpa_psk file as 'keyid=<name>', so it
+// may not contain whitespace, '=', or anything else that file can't carry.
+var pskNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidPSKName returns true if the name may be used for one of a VirtualAP's
+// additional pre-shared keys
+func ValidPSKName(name string) bool {
+	return pskNameRE.MatchString(name)
+}
+
+// KeyMgmtUsesEAP returns true if the key management mode authenticates clients
+// with 802.1x/RADIUS
+func KeyMgmtUsesEAP(keymgmt string) bool {
+	keymgmt = strings.ToLower(keymgmt)
+	return keymgmt == "wpa-eap" || keymgmt == "wpa3-eap"
+}
+
 func newVAP(name string, root *PropertyNode) *VirtualAP {
-	var ssid, keymgmt, pass, defaultRing string
+	var ssid, keymgmt, pass, pmf, schedule, defaultRing string
 
 	if x := root.Children["ssid"]; x != nil {
 		ssid = x.Value
@@ -910,11 +979,35 @@ func newVAP(name string, root *PropertyNode) *VirtualAP {
 		log.Printf("vap %s: missing keymgmt", name)
 	}
 
-	if keymgmt == "wpa-psk" {
+	if KeyMgmtUsesPSK(keymgmt) {
 		if node, ok := root.Children["passphrase"]; ok {
 			pass = node.Value
 		} else {
-			log.Printf("vap %s: missing WPA-PSK passphrase", name)
+			log.Printf("vap %s: missing %s passphrase", name, keymgmt)
+		}
+	}
+
+	if x := root.Children["pmf"]; x != nil {
+		pmf = x.Value
+	}
+
+	if x := root.Children["schedule"]; x != nil {
+		schedule = x.Value
+	}
+
+	psks := make(map[string]*VirtualAPPSK)
+	if x := root.Children["psk"]; x != nil {
+		for keyName, key := range x.Children {
+			psk := &VirtualAPPSK{}
+			psk.Passphrase, _ = key.GetChildString("passphrase")
+			psk.Ring, _ = key.GetChildString("ring")
+			psk.Mac, _ = key.GetChildString("mac")
+			if psk.Passphrase == "" || psk.Ring == "" {
+				log.Printf("vap %s: incomplete psk %s", name,
+					keyName)
+				continue
+			}
+			psks[keyName] = psk
 		}
 	}
 
@@ -928,6 +1021,21 @@ func newVAP(name string, root *PropertyNode) *VirtualAP {
 		log.Printf("vap %s: %v", name, err)
 	}
 
+	roaming, err := root.GetChildBool("roaming")
+	if err != nil && err != ErrNoProp {
+		log.Printf("vap %s: %v", name, err)
+	}
+
+	steering, err := root.GetChildBool("band_steering")
+	if err != nil && err != ErrNoProp {
+		log.Printf("vap %s: %v", name, err)
+	}
+
+	external, err := root.GetChildBool("external_radius")
+	if err != nil && err != ErrNoProp {
+		log.Printf("vap %s: %v", name, err)
+	}
+
 	if x := root.Children["default_ring"]; x != nil {
 		defaultRing = x.Value
 	} else {
@@ -935,13 +1043,20 @@ func newVAP(name string, root *PropertyNode) *VirtualAP {
 	}
 
 	return &VirtualAP{
-		SSID:        ssid,
-		KeyMgmt:     keymgmt,
-		Passphrase:  pass,
-		Tag5GHz:     tag,
-		Rings:       make([]string, 0),
-		DefaultRing: defaultRing,
-		Disabled:    disabled,
+		SSID:         ssid,
+		KeyMgmt:      keymgmt,
+		Passphrase:   pass,
+		PMF:          pmf,
+		PSKs:         psks,
+		Tag5GHz:      tag,
+		Rings:        make([]string, 0),
+		DefaultRing:  defaultRing,
+		Disabled:     disabled,
+		Schedule:     schedule,
+		Roaming:      roaming,
+		BandSteering: steering,
+
+		ExternalRADIUS: external,
 	}
 }
 
@@ -1146,6 +1261,8 @@ func (c *Handle) GetVulnerabilities(macaddr string) VulnMap {
 		v.Ignore, _ = props.GetChildBool("ignore")
 		v.Active, _ = props.GetChildBool("active")
 		v.Details, _ = props.GetChildString("details")
+		v.Source, _ = props.GetChildString("source")
+		v.CVSS, _ = props.GetChildFloat64("cvss")
 		// Repair may be absent and the distinction is important
 		if val, err := props.GetChildBool("repair"); err == nil {
 			v.Repair = &val
@@ -1171,6 +1288,38 @@ func (c *Handle) GetClientScans(macaddr string) ScanMap {
 	return scanMap
 }
 
+// GetRogueAPs fetches the rogue AP findings which haven't yet expired, ordered
+// by BSSID.
+func (c *Handle) GetRogueAPs() []*RogueAP {
+	list := make([]*RogueAP, 0)
+
+	for bssid, props := range c.GetChildren("@/network/rogue") {
+		kind := props.Children["kind"]
+		if kind == nil || kind.Expired() {
+			continue
+		}
+
+		r := RogueAP{
+			BSSID: bssid,
+			Kind:  kind.Value,
+		}
+		r.SSID, _ = props.GetChildString("ssid")
+		r.VAP, _ = props.GetChildString("vap")
+		r.Node, _ = props.GetChildString("node")
+		r.Band, _ = props.GetChildString("band")
+		r.Channel, _ = props.GetChildInt("channel")
+		r.Signal, _ = props.GetChildInt("signal")
+		r.FirstSeen, _ = props.GetChildTime("first_seen")
+		r.LastSeen, _ = props.GetChildTime("last_seen")
+		list = append(list, &r)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].BSSID < list[j].BSSID
+	})
+
+	return list
+}
+
 // GetClient fetches a single client from ap.configd and converts the json
 // result into a ClientInfo structure
 func (c *Handle) GetClient(macaddr string) *ClientInfo {
@@ -1429,14 +1578,34 @@ func (c *Handle) GetNodes() ([]NodeInfo, error) {
 	return nodes, nil
 }
 
-// GetActiveBlocks builds a slice of all the IP addresses that were being
-// actively blocked at the time of the call.
-func (c *Handle) GetActiveBlocks() []string {
-	list := make([]string, 0)
+// BlockedProp returns the name of the property used to block traffic to and
+// from a network.  Since '/' is the path separator, the prefix length is
+// separated from the address by '_', as in @/firewall/blocked/192.0.2.0_24.  A
+// single host is named by its address alone.
+func BlockedProp(n *net.IPNet) string {
+	name := strings.Replace(network.PrefixString(n), "/", "_", 1)
+	return "@/firewall/blocked/" + name
+}
+
+// ParseBlockedName translates the final component of a @/firewall/blocked
+// property back into the network it names.
+func ParseBlockedName(name string) (*net.IPNet, error) {
+	if strings.Contains(name, "/") {
+		return nil, fmt.Errorf("invalid blocked network: %s", name)
+	}
+	return network.ParsePrefix(strings.Replace(name, "_", "/", 1))
+}
+
+// GetActiveBlocks builds a slice of all the networks that were being actively
+// blocked at the time of the call.
+func (c *Handle) GetActiveBlocks() []*net.IPNet {
+	list := make([]*net.IPNet, 0)
 
 	for name, node := range c.GetChildren("@/firewall/blocked") {
 		if !node.Expired() {
-			list = append(list, name)
+			if n, err := ParseBlockedName(name); err == nil {
+				list = append(list, n)
+			}
 		}
 	}
 
@@ -55,7 +55,7 @@ type UserInfo struct {
 }
 
 func wgConfig(user, mac string, root *PropertyNode) (*wgconf.UserConf, error) {
-	var key, addr string
+	var addr string
 	var err error
 
 	c := &wgconf.UserConf{
@@ -66,11 +66,19 @@ func wgConfig(user, mac string, root *PropertyNode) (*wgconf.UserConf, error) {
 	c.Label, _ = root.GetChildString("label")
 	c.ServerKey, _ = root.GetChildString("server_key")
 
-	if key, _ = root.GetChildString("public_key"); key == "" {
+	// An expired key is no longer usable, and will be removed by the VPN
+	// server.
+	node, err := root.GetChild("public_key")
+	if err == ErrExpired {
+		return nil, nil
+	}
+	if node == nil || node.Value == "" {
 		return nil, fmt.Errorf("missing public key")
-	} else if err = c.SetKey(key); err != nil {
+	}
+	if err = c.SetKey(node.Value); err != nil {
 		return nil, err
 	}
+	c.Expires = node.Expires
 
 	if addr, _ = root.GetChildString("assigned_ip"); addr == "" {
 		return nil, fmt.Errorf("missing ip address")
@@ -78,6 +86,10 @@ func wgConfig(user, mac string, root *PropertyNode) (*wgconf.UserConf, error) {
 		return nil, err
 	}
 
+	c.LastHandshake, _ = root.GetChildTime("last_handshake")
+	c.RxBytes, _ = root.GetChildUint("rx_bytes")
+	c.TxBytes, _ = root.GetChildUint("tx_bytes")
+
 	if subnets, _ := root.GetChildString("allowed_ips"); subnets != "" {
 		if err = c.SetSubnets(subnets); err != nil {
 			return nil, err
@@ -97,7 +109,7 @@ func wgConfigs(user *UserInfo, root *PropertyNode) []*wgconf.UserConf {
 			if err != nil {
 				log.Printf("bad vpn key %s/%s: %v",
 					user.UID, mac, err)
-			} else {
+			} else if c != nil {
 				s = append(s, c)
 			}
 		}
@@ -0,0 +1,251 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Package geoip maps IP addresses to their country and autonomous system,
+// using offline databases in the MaxMind DB format.
+package geoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bg/common/cfgapi"
+)
+
+// Names of the databases we look for in the GeoIP data directory.  Either may
+// be missing.
+const (
+	CountryDB = "GeoLite2-Country.mmdb"
+	ASNDB     = "GeoLite2-ASN.mmdb"
+)
+
+// Config properties controlling the site's GeoIP blocking policy
+const (
+	PolicyCountries = "@/policy/site/geoblock/countries"
+	PolicyASNs      = "@/policy/site/geoblock/asns"
+)
+
+// Record contains all of the information we have about a single address
+type Record struct {
+	Country string // ISO 3166-1 alpha-2 code
+	ASN     uint32
+	Org     string // name of the organization owning the ASN
+}
+
+// DB is a collection of one or more MaxMind databases, whose results are
+// merged to build each Record.
+type DB struct {
+	dbs []*database
+}
+
+// Policy describes the countries and autonomous systems blocked at a site
+type Policy struct {
+	Countries map[string]bool
+	ASNs      map[uint32]bool
+}
+
+func (r *Record) String() string {
+	var s []string
+
+	if r.Country != "" {
+		s = append(s, r.Country)
+	}
+	if r.ASN != 0 {
+		as := "AS" + strconv.FormatUint(uint64(r.ASN), 10)
+		if r.Org != "" {
+			as += " (" + r.Org + ")"
+		}
+		s = append(s, as)
+	}
+	return strings.Join(s, " ")
+}
+
+func getMapString(m map[string]interface{}, keys ...string) string {
+	for i, k := range keys {
+		if i == len(keys)-1 {
+			s, _ := m[k].(string)
+			return s
+		}
+		if m, _ = m[k].(map[string]interface{}); m == nil {
+			break
+		}
+	}
+	return ""
+}
+
+func (r *Record) merge(raw interface{}) {
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if r.Country == "" {
+		r.Country = getMapString(m, "country", "iso_code")
+	}
+	if r.Country == "" {
+		r.Country = getMapString(m, "registered_country", "iso_code")
+	}
+	if r.ASN == 0 {
+		if asn, ok := m["autonomous_system_number"].(uint64); ok {
+			r.ASN = uint32(asn)
+		}
+	}
+	if r.Org == "" {
+		r.Org, _ = m["autonomous_system_organization"].(string)
+	}
+}
+
+// Open loads each of the named database files.  Files that don't exist are
+// skipped, but it is an error for none of them to be usable.
+func Open(files ...string) (*DB, error) {
+	var errs []string
+
+	g := &DB{}
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(file)
+		if err == nil {
+			var d *database
+
+			if d, err = newDatabase(buf); err == nil {
+				g.dbs = append(g.dbs, d)
+				continue
+			}
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", file, err))
+	}
+
+	if len(g.dbs) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no GeoIP databases specified")
+		}
+		return nil, fmt.Errorf("no usable GeoIP databases: %s",
+			strings.Join(errs, ", "))
+	}
+
+	return g, nil
+}
+
+// Lookup returns whatever information the databases have about an address.  If
+// the address isn't found in any database, it returns nil.
+func (g *DB) Lookup(ip net.IP) *Record {
+	var rec *Record
+
+	for _, d := range g.dbs {
+		offset, found, err := d.lookup(ip)
+		if err != nil || !found {
+			continue
+		}
+		raw, _, err := d.decode(d.data, offset)
+		if err != nil {
+			continue
+		}
+		if rec == nil {
+			rec = &Record{}
+		}
+		rec.merge(raw)
+	}
+
+	return rec
+}
+
+// Networks returns all of the IPv4 networks for which the match function
+// returns true.  Each database is evaluated independently, so a match function
+// should look for either a country or an ASN rather than a combination.
+func (g *DB) Networks(match func(*Record) bool) ([]*net.IPNet, error) {
+	all := make([]*net.IPNet, 0)
+
+	for _, d := range g.dbs {
+		// Many networks share a single record in the data section, so
+		// we only evaluate each record once.
+		matches := make(map[uint]bool)
+
+		err := d.walk(d.ipv4Start, 0, 0,
+			func(n *net.IPNet, offset uint) error {
+				matched, ok := matches[offset]
+				if !ok {
+					raw, _, err := d.decode(d.data, offset)
+					if err != nil {
+						return err
+					}
+					rec := &Record{}
+					rec.merge(raw)
+					matched = match(rec)
+					matches[offset] = matched
+				}
+				if matched {
+					all = append(all, n)
+				}
+				return nil
+			})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return all, nil
+}
+
+// Blocked returns true if the record matches one of the blocked countries or
+// ASNs
+func (p *Policy) Blocked(r *Record) bool {
+	if r == nil {
+		return false
+	}
+	return (r.Country != "" && p.Countries[r.Country]) ||
+		(r.ASN != 0 && p.ASNs[r.ASN])
+}
+
+// Empty returns true if the policy doesn't block anything
+func (p *Policy) Empty() bool {
+	return len(p.Countries) == 0 && len(p.ASNs) == 0
+}
+
+func (p *Policy) String() string {
+	var s []string
+
+	for c := range p.Countries {
+		s = append(s, c)
+	}
+	for a := range p.ASNs {
+		s = append(s, "AS"+strconv.FormatUint(uint64(a), 10))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// GetPolicy retrieves the site's GeoIP blocking policy from the config tree
+func GetPolicy(config *cfgapi.Handle) *Policy {
+	p := &Policy{
+		Countries: make(map[string]bool),
+		ASNs:      make(map[uint32]bool),
+	}
+
+	if list, err := config.GetProp(PolicyCountries); err == nil {
+		for _, c := range strings.Split(list, ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				p.Countries[strings.ToUpper(c)] = true
+			}
+		}
+	}
+
+	if list, err := config.GetProp(PolicyASNs); err == nil {
+		for _, a := range strings.Split(list, ",") {
+			a = strings.TrimPrefix(strings.TrimSpace(a), "AS")
+			if asn, err := strconv.ParseUint(a, 10, 32); err == nil {
+				p.ASNs[uint32(asn)] = true
+			}
+		}
+	}
+
+	return p
+}
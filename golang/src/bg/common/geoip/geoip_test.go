@@ -0,0 +1,276 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package geoip
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// A pointer into the data section, used to exercise pointer decoding
+type testPointer uint
+
+func encodeHeader(typ, size int) []byte {
+	var b, ext []byte
+
+	if size >= 29 {
+		ext = []byte{byte(size - 29)}
+		size = 29
+	}
+	if typ <= typeMap {
+		b = []byte{byte(typ<<5 | size)}
+	} else {
+		b = []byte{byte(size), byte(typ - 7)}
+	}
+	return append(b, ext...)
+}
+
+func encodeUint(typ int, v uint64) []byte {
+	var b []byte
+
+	for ; v != 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	return append(encodeHeader(typ, len(b)), b...)
+}
+
+func encode(v interface{}) []byte {
+	switch x := v.(type) {
+	case string:
+		return append(encodeHeader(typeString, len(x)), x...)
+	case uint16:
+		return encodeUint(typeUint16, uint64(x))
+	case uint32:
+		return encodeUint(typeUint32, uint64(x))
+	case testPointer:
+		return []byte{byte(typePointer<<5 | int(x>>8)), byte(x)}
+	case map[string]interface{}:
+		keys := make([]string, 0)
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b := encodeHeader(typeMap, len(x))
+		for _, k := range keys {
+			b = append(b, encode(k)...)
+			b = append(b, encode(x[k])...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+type testNode struct {
+	child [2]*testNode
+	data  int
+	id    int
+}
+
+// Build a minimal IPv4 database with 24-bit records.  Each network is mapped
+// to the record at the same index in the data list.
+func buildDB(nets []string, data []interface{}) []byte {
+	root := &testNode{data: -1}
+	for i, n := range nets {
+		_, ipnet, _ := net.ParseCIDR(n)
+		ones, _ := ipnet.Mask.Size()
+
+		node := root
+		for b := 0; b < ones; b++ {
+			bit := (ipnet.IP.To4()[b/8] >> uint(7-b%8)) & 1
+			if node.child[bit] == nil {
+				node.child[bit] = &testNode{data: -1}
+			}
+			node = node.child[bit]
+		}
+		node.data = i
+	}
+
+	// Number the internal nodes in breadth-first order
+	internal := make([]*testNode, 0)
+	queue := []*testNode{root}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if n.data < 0 {
+			n.id = len(internal)
+			internal = append(internal, n)
+			for _, c := range n.child {
+				if c != nil {
+					queue = append(queue, c)
+				}
+			}
+		}
+	}
+
+	var section []byte
+	offsets := make([]int, len(data))
+	for i, d := range data {
+		offsets[i] = len(section)
+		section = append(section, encode(d)...)
+	}
+
+	count := len(internal)
+	record := func(n *testNode) int {
+		if n == nil {
+			return count
+		} else if n.data >= 0 {
+			return count + 16 + offsets[n.data]
+		}
+		return n.id
+	}
+
+	var buf []byte
+	for _, n := range internal {
+		for _, c := range n.child {
+			r := record(c)
+			buf = append(buf, byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, section...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encode(map[string]interface{}{
+		"node_count":    uint32(count),
+		"record_size":   uint16(24),
+		"ip_version":    uint16(4),
+		"database_type": "Test",
+	})...)
+
+	return buf
+}
+
+func testDB(t *testing.T) *DB {
+	france := map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "FR"},
+	}
+	google := map[string]interface{}{
+		"autonomous_system_number":       uint32(15169),
+		"autonomous_system_organization": "GOOGLE",
+	}
+	// Shares the country data of the first record
+	pointer := map[string]interface{}{
+		"registered_country": testPointer(len(encodeHeader(typeMap, 1)) +
+			len(encode("country"))),
+	}
+
+	buf := buildDB(
+		[]string{"1.2.0.0/16", "8.8.8.0/24", "5.0.0.0/8"},
+		[]interface{}{france, google, pointer})
+
+	dir, err := ioutil.TempDir("", "geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.mmdb")
+	if err = ioutil.WriteFile(file, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Open(file, filepath.Join(dir, "missing.mmdb"))
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	return g
+}
+
+func TestLookup(t *testing.T) {
+	g := testDB(t)
+
+	tests := []struct {
+		addr    string
+		country string
+		asn     uint32
+		found   bool
+	}{
+		{"1.2.3.4", "FR", 0, true},
+		{"1.2.255.255", "FR", 0, true},
+		{"1.3.0.0", "", 0, false},
+		{"8.8.8.8", "", 15169, true},
+		{"5.6.7.8", "FR", 0, true},
+		{"192.168.1.1", "", 0, false},
+		{"2001:db8::1", "", 0, false},
+	}
+
+	for _, test := range tests {
+		rec := g.Lookup(net.ParseIP(test.addr))
+		if (rec != nil) != test.found {
+			t.Errorf("%s: expected found=%v, got %v", test.addr,
+				test.found, rec)
+			continue
+		}
+		if rec == nil {
+			continue
+		}
+		if rec.Country != test.country || rec.ASN != test.asn {
+			t.Errorf("%s: expected %s/%d, got %s/%d", test.addr,
+				test.country, test.asn, rec.Country, rec.ASN)
+		}
+	}
+
+	if rec := g.Lookup(net.ParseIP("8.8.4.4")); rec != nil {
+		t.Errorf("8.8.4.4: unexpected record %v", rec)
+	}
+	if rec := g.Lookup(net.ParseIP("8.8.8.8")); rec.Org != "GOOGLE" {
+		t.Errorf("8.8.8.8: expected GOOGLE, got '%s'", rec.Org)
+	}
+}
+
+func TestNetworks(t *testing.T) {
+	g := testDB(t)
+
+	p := &Policy{
+		Countries: map[string]bool{"FR": true},
+		ASNs:      map[uint32]bool{15169: true},
+	}
+
+	nets, err := g.Networks(p.Blocked)
+	if err != nil {
+		t.Fatalf("Networks() failed: %v", err)
+	}
+
+	got := make([]string, 0)
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	sort.Strings(got)
+
+	expected := []string{"1.2.0.0/16", "5.0.0.0/8", "8.8.8.0/24"}
+	if len(got) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, got)
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	}
+
+	delete(p.Countries, "FR")
+	if nets, _ = g.Networks(p.Blocked); len(nets) != 1 {
+		t.Errorf("expected just 8.8.8.0/24, got %v", nets)
+	}
+}
+
+func TestBadDB(t *testing.T) {
+	if _, err := newDatabase([]byte("not a database")); err == nil {
+		t.Errorf("garbage accepted as a database")
+	}
+
+	buf := buildDB([]string{"1.2.0.0/16"}, []interface{}{"x"})
+	if _, err := newDatabase(buf[:len(buf)-3]); err == nil {
+		t.Errorf("truncated database accepted")
+	}
+}
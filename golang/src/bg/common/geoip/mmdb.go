@@ -0,0 +1,383 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package geoip
+
+// A minimal reader for databases in the MaxMind DB format, as described at
+// https://maxmind.github.io/MaxMind-DB/.  The file consists of a binary search
+// tree indexed by the bits of an IP address, a data section containing the
+// records the tree's leaves point at, and a metadata section describing the
+// layout of the tree.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+)
+
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data types found in the data and metadata sections
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+type database struct {
+	buf  []byte
+	data []byte
+
+	dbType     string
+	nodeCount  uint
+	recordSize uint
+	nodeBytes  uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+func errCorrupt(what string) error {
+	return fmt.Errorf("corrupt MaxMind DB: %s", what)
+}
+
+func metaUint(meta map[string]interface{}, key string) (uint, error) {
+	v, ok := meta[key].(uint64)
+	if !ok {
+		return 0, errCorrupt("missing metadata field " + key)
+	}
+	return uint(v), nil
+}
+
+func newDatabase(buf []byte) (*database, error) {
+	var err error
+
+	idx := bytes.LastIndex(buf, metadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("not a MaxMind DB: missing metadata")
+	}
+
+	d := &database{buf: buf}
+	raw, _, err := d.decode(buf[idx+len(metadataMarker):], 0)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errCorrupt("bad metadata")
+	}
+
+	if d.nodeCount, err = metaUint(meta, "node_count"); err != nil {
+		return nil, err
+	}
+	if d.recordSize, err = metaUint(meta, "record_size"); err != nil {
+		return nil, err
+	}
+	if d.ipVersion, err = metaUint(meta, "ip_version"); err != nil {
+		return nil, err
+	}
+	d.dbType, _ = meta["database_type"].(string)
+
+	if d.recordSize != 24 && d.recordSize != 28 && d.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size: %d",
+			d.recordSize)
+	}
+	if d.ipVersion != 4 && d.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version: %d",
+			d.ipVersion)
+	}
+
+	// The search tree is followed by 16 bytes of zeroes, and then the data
+	// section, which runs up to the metadata marker.
+	d.nodeBytes = d.recordSize / 4
+	treeSize := d.nodeCount * d.nodeBytes
+	if treeSize+16 > uint(idx) {
+		return nil, errCorrupt("search tree overlaps metadata")
+	}
+	d.data = buf[treeSize+16 : idx]
+
+	// In an IPv6 database, the IPv4 address space lives under ::/96
+	if d.ipVersion == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < d.nodeCount; i++ {
+			node = d.readNode(node, 0)
+		}
+		d.ipv4Start = node
+	}
+
+	return d, nil
+}
+
+// Each node contains two records: the left record is followed when the next
+// bit of the address is 0, and the right record when it's 1.
+func (d *database) readNode(node, bit uint) uint {
+	b := d.buf[node*d.nodeBytes : (node+1)*d.nodeBytes]
+
+	switch d.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 |
+				uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 |
+			uint(b[5])<<8 | uint(b[6])
+
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// Walk the search tree, returning the offset of the address's record within
+// the data section.  If the address isn't in the database, found is false.
+func (d *database) lookup(ip net.IP) (offset uint, found bool, err error) {
+	var addr net.IP
+	var node uint
+
+	if addr = ip.To4(); addr != nil {
+		node = d.ipv4Start
+	} else if d.ipVersion == 6 {
+		addr = ip.To16()
+	}
+	if addr == nil {
+		return 0, false, nil
+	}
+
+	bits := len(addr) * 8
+	for i := 0; i < bits && node < d.nodeCount; i++ {
+		bit := uint(addr[i>>3]>>(7-uint(i&7))) & 1
+		node = d.readNode(node, bit)
+	}
+
+	return d.resolve(node)
+}
+
+// Translate a record value into an offset within the data section
+func (d *database) resolve(node uint) (uint, bool, error) {
+	if node == d.nodeCount {
+		return 0, false, nil
+	}
+	if node < d.nodeCount {
+		return 0, false, errCorrupt("search tree too deep")
+	}
+
+	offset := node - d.nodeCount - 16
+	if offset >= uint(len(d.data)) {
+		return 0, false, errCorrupt("record pointer out of range")
+	}
+	return offset, true, nil
+}
+
+// Walk the IPv4 portion of the search tree, calling fn for each network with a
+// record in the data section.
+func (d *database) walk(node uint, prefix uint32, depth int,
+	fn func(*net.IPNet, uint) error) error {
+
+	if node >= d.nodeCount {
+		offset, found, err := d.resolve(node)
+		if err != nil || !found {
+			return err
+		}
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, prefix)
+		return fn(&net.IPNet{IP: ip, Mask: net.CIDRMask(depth, 32)},
+			offset)
+	}
+	if depth == 32 {
+		return errCorrupt("search tree too deep")
+	}
+
+	err := d.walk(d.readNode(node, 0), prefix, depth+1, fn)
+	if err == nil {
+		err = d.walk(d.readNode(node, 1),
+			prefix|(1<<uint(31-depth)), depth+1, fn)
+	}
+	return err
+}
+
+func (d *database) decodePointer(sec []byte, ctrl byte, off uint) (uint, uint, error) {
+	size := uint(ctrl>>3)&0x3 + 1
+	if off+size > uint(len(sec)) {
+		return 0, 0, errCorrupt("truncated pointer")
+	}
+
+	v := uint(0)
+	for i := uint(0); i < size; i++ {
+		v = v<<8 | uint(sec[off+i])
+	}
+	high := uint(ctrl & 0x7)
+
+	var ptr uint
+	switch size {
+	case 1:
+		ptr = high<<8 | v
+	case 2:
+		ptr = (high<<16 | v) + 2048
+	case 3:
+		ptr = (high<<24 | v) + 526336
+	case 4:
+		ptr = v
+	}
+
+	return ptr, off + size, nil
+}
+
+// Decode a single value at the given offset within a section, returning the
+// value and the offset of the next field.
+func (d *database) decode(sec []byte, off uint) (interface{}, uint, error) {
+	if off >= uint(len(sec)) {
+		return nil, 0, errCorrupt("field out of range")
+	}
+
+	ctrl := sec[off]
+	off++
+
+	typ := uint(ctrl >> 5)
+	if typ == typePointer {
+		ptr, next, err := d.decodePointer(sec, ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		val, _, err := d.decode(d.data, ptr)
+		return val, next, err
+	}
+
+	if typ == typeExtended {
+		if off >= uint(len(sec)) {
+			return nil, 0, errCorrupt("truncated type")
+		}
+		typ = 7 + uint(sec[off])
+		off++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint(len(sec)) {
+			return nil, 0, errCorrupt("truncated size")
+		}
+		v := uint(0)
+		for i := uint(0); i < n; i++ {
+			v = v<<8 | uint(sec[off+i])
+		}
+		off += n
+
+		switch n {
+		case 1:
+			size = 29 + v
+		case 2:
+			size = 285 + v
+		case 3:
+			size = 65821 + v
+		}
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var key, val interface{}
+			var err error
+
+			if key, off, err = d.decode(sec, off); err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errCorrupt("non-string map key")
+			}
+			if val, off, err = d.decode(sec, off); err != nil {
+				return nil, 0, err
+			}
+			m[k] = val
+		}
+		return m, off, nil
+
+	case typeArray:
+		a := make([]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			var err error
+
+			if a[i], off, err = d.decode(sec, off); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+
+	case typeBool:
+		return size != 0, off, nil
+	}
+
+	if off+size > uint(len(sec)) {
+		return nil, 0, errCorrupt("truncated field")
+	}
+	b := sec[off : off+size]
+	off += size
+
+	switch typ {
+	case typeString:
+		return string(b), off, nil
+
+	case typeBytes:
+		return append([]byte{}, b...), off, nil
+
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt("bad double")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt("bad float")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), off, nil
+
+	case typeUint16, typeUint32, typeUint64, typeInt32:
+		if size > 8 {
+			return nil, 0, errCorrupt("bad integer")
+		}
+		v := uint64(0)
+		for _, x := range b {
+			v = v<<8 | uint64(x)
+		}
+		if typ == typeInt32 {
+			return int64(int32(uint32(v))), off, nil
+		}
+		return v, off, nil
+
+	case typeUint128:
+		return new(big.Int).SetBytes(b), off, nil
+	}
+
+	return nil, 0, errCorrupt(fmt.Sprintf("unsupported type %d", typ))
+}
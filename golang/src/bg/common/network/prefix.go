@@ -0,0 +1,264 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package network
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"strings"
+)
+
+// PrefixTrie is a set of IPv4 and IPv6 network prefixes, stored as a
+// path-compressed binary trie.  Each node covers a run of address bits, so a
+// trie holding N prefixes never has more than 2N-1 nodes per address family.
+// Because the set is only used to answer "is this address covered?", a prefix
+// that falls within one already in the set is discarded, and inserting a prefix
+// discards any narrower prefixes it covers.
+//
+// The nodes live in a single slice and refer to each other by index, which
+// keeps a large list (e.g., a few hundred thousand entries) from becoming
+// hundreds of thousands of separate heap allocations.
+type PrefixTrie struct {
+	nodes []trieNode
+	roots [2]int32 // IPv4 and IPv6
+	count int
+}
+
+// An address is stored as a 128-bit key.  IPv4 addresses occupy the top 32 bits
+// of hi.
+type trieKey struct {
+	hi, lo uint64
+}
+
+type trieNode struct {
+	key   trieKey
+	plen  uint8
+	term  bool     // the node's prefix is in the set
+	child [2]int32 // 0 means no child
+}
+
+// NewPrefixTrie returns an empty PrefixTrie
+func NewPrefixTrie() *PrefixTrie {
+	// Index 0 is reserved, so it can be used to indicate a missing child
+	return &PrefixTrie{
+		nodes: make([]trieNode, 1),
+	}
+}
+
+// Convert an address into a trie key and address family
+func ipToKey(ip net.IP) (trieKey, int, bool) {
+	var k trieKey
+
+	if a := ip.To4(); a != nil {
+		k.hi = uint64(binary.BigEndian.Uint32(a)) << 32
+		return k, 0, true
+	}
+	if a := ip.To16(); a != nil {
+		k.hi = binary.BigEndian.Uint64(a[0:8])
+		k.lo = binary.BigEndian.Uint64(a[8:16])
+		return k, 1, true
+	}
+	return k, 0, false
+}
+
+func (k trieKey) bit(i uint8) int {
+	if i < 64 {
+		return int(k.hi>>(63-i)) & 1
+	}
+	return int(k.lo>>(127-i)) & 1
+}
+
+// Zero all but the first n bits of the key
+func (k trieKey) mask(n uint8) trieKey {
+	switch {
+	case n == 0:
+		return trieKey{}
+	case n < 64:
+		return trieKey{hi: k.hi &^ (^uint64(0) >> n)}
+	case n == 64:
+		return trieKey{hi: k.hi}
+	case n < 128:
+		return trieKey{hi: k.hi, lo: k.lo &^ (^uint64(0) >> (n - 64))}
+	}
+	return k
+}
+
+// Count the leading bits two keys have in common, up to a maximum of n
+func (k trieKey) common(o trieKey, n uint8) uint8 {
+	var c int
+
+	if x := k.hi ^ o.hi; x != 0 {
+		c = bits.LeadingZeros64(x)
+	} else {
+		c = 64 + bits.LeadingZeros64(k.lo^o.lo)
+	}
+	if c > int(n) {
+		c = int(n)
+	}
+	return uint8(c)
+}
+
+func (t *PrefixTrie) newNode(k trieKey, plen uint8) int32 {
+	t.nodes = append(t.nodes, trieNode{key: k, plen: plen, term: true})
+	return int32(len(t.nodes) - 1)
+}
+
+// Insert adds a network to the set.  It returns false if the network was
+// already covered by the set.
+func (t *PrefixTrie) Insert(n *net.IPNet) bool {
+	key, family, ok := ipToKey(n.IP)
+	if !ok {
+		return false
+	}
+	ones, size := n.Mask.Size()
+	if size == 0 || (size == 32) != (family == 0) {
+		return false
+	}
+	plen := uint8(ones)
+	key = key.mask(plen)
+
+	// 'link' points at the index of the node we're currently examining.
+	// Because t.nodes may be reallocated as we add nodes, we track it as
+	// (parent, branch) rather than as a pointer.
+	parent, branch := int32(-1), 0
+	link := func() *int32 {
+		if parent < 0 {
+			return &t.roots[family]
+		}
+		return &t.nodes[parent].child[branch]
+	}
+
+	for {
+		idx := *link()
+		if idx == 0 {
+			idx = t.newNode(key, plen)
+			*link() = idx
+			t.count++
+			return true
+		}
+
+		node := &t.nodes[idx]
+		c := key.common(node.key, node.plen)
+		if c > plen {
+			c = plen
+		}
+
+		if c == node.plen {
+			if node.term {
+				// Already covered by a wider prefix
+				return false
+			}
+			if plen == node.plen {
+				// This prefix covers everything below it
+				node.term = true
+				node.child = [2]int32{}
+				t.count++
+				return true
+			}
+			parent, branch = idx, key.bit(node.plen)
+			continue
+		}
+
+		if c == plen {
+			// The new prefix covers this node and everything below
+			// it, so we can reuse the node.
+			*node = trieNode{key: key, plen: plen, term: true}
+			t.count++
+			return true
+		}
+
+		// The new prefix diverges from this node partway through the
+		// node's bits, so we need a new branch point.
+		oldBit := node.key.bit(c)
+		leaf := t.newNode(key, plen)
+		split := t.newNode(key.mask(c), c)
+		t.nodes[split].term = false
+		t.nodes[split].child[oldBit] = idx
+		t.nodes[split].child[1-oldBit] = leaf
+		*link() = split
+		t.count++
+		return true
+	}
+}
+
+// Match returns the network in the set containing the address, or nil if the
+// address isn't covered.
+func (t *PrefixTrie) Match(ip net.IP) *net.IPNet {
+	key, family, ok := ipToKey(ip)
+	if !ok {
+		return nil
+	}
+
+	idx := t.roots[family]
+	for idx != 0 {
+		node := &t.nodes[idx]
+		if key.common(node.key, node.plen) < node.plen {
+			break
+		}
+		if node.term {
+			return node.network(family)
+		}
+		idx = node.child[key.bit(node.plen)]
+	}
+	return nil
+}
+
+// Contains returns true if the address is covered by the set
+func (t *PrefixTrie) Contains(ip net.IP) bool {
+	return t.Match(ip) != nil
+}
+
+// Len returns the number of prefixes that have been added to the set.  This
+// includes those that were later subsumed by a wider prefix.
+func (t *PrefixTrie) Len() int {
+	return t.count
+}
+
+func (n *trieNode) network(family int) *net.IPNet {
+	if family == 0 {
+		ip := make(net.IP, 4)
+		binary.BigEndian.PutUint32(ip, uint32(n.key.hi>>32))
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(int(n.plen), 32)}
+	}
+
+	ip := make(net.IP, 16)
+	binary.BigEndian.PutUint64(ip[0:8], n.key.hi)
+	binary.BigEndian.PutUint64(ip[8:16], n.key.lo)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(int(n.plen), 128)}
+}
+
+// ParsePrefix parses either a network in CIDR notation or a single IP address,
+// which is treated as a /32 (or /128) network.
+func ParsePrefix(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", s)
+	}
+	if a := ip.To4(); a != nil {
+		return &net.IPNet{IP: a, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// PrefixString returns a network in CIDR notation, or as a bare address if it
+// contains only a single host.
+func PrefixString(n *net.IPNet) string {
+	if ones, bits := n.Mask.Size(); ones == bits {
+		return n.IP.String()
+	}
+	return n.String()
+}
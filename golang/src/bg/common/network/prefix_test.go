@@ -0,0 +1,123 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func buildTrie(t *testing.T, prefixes ...string) *PrefixTrie {
+	trie := NewPrefixTrie()
+	for _, p := range prefixes {
+		n, err := ParsePrefix(p)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %v", p, err)
+		}
+		trie.Insert(n)
+	}
+	return trie
+}
+
+func TestPrefixTrieMatch(t *testing.T) {
+	trie := buildTrie(t,
+		"192.0.2.1",
+		"198.51.100.0/24",
+		"10.0.0.0/8",
+		"10.1.2.0/24", // covered by 10.0.0.0/8
+		"203.0.113.128/25",
+		"203.0.113.0/25",
+		"2001:db8::/32",
+		"2001:db8:1::1",
+		"fd00::1")
+
+	tests := []struct {
+		addr  string
+		match string
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{"192.0.2.2", ""},
+		{"192.0.3.1", ""},
+		{"198.51.100.77", "198.51.100.0/24"},
+		{"198.51.101.1", ""},
+		{"10.1.2.3", "10.0.0.0/8"},
+		{"11.0.0.1", ""},
+		{"203.0.113.200", "203.0.113.128/25"},
+		{"203.0.113.5", "203.0.113.0/25"},
+		{"203.0.114.5", ""},
+		{"2001:db8:1::1", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		{"fd00::1", "fd00::1/128"},
+		{"fd00::2", ""},
+		{"::ffff:198.51.100.1", "198.51.100.0/24"},
+	}
+
+	for _, test := range tests {
+		n := trie.Match(net.ParseIP(test.addr))
+		got := ""
+		if n != nil {
+			got = n.String()
+		}
+		if got != test.match {
+			t.Errorf("%s: expected '%s', got '%s'", test.addr,
+				test.match, got)
+		}
+	}
+}
+
+func TestPrefixTrieCovered(t *testing.T) {
+	trie := buildTrie(t, "10.1.2.0/24", "10.1.3.0/24", "10.2.0.1")
+
+	wide, _ := ParsePrefix("10.0.0.0/8")
+	if !trie.Insert(wide) {
+		t.Errorf("inserting %v failed", wide)
+	}
+	if trie.Insert(wide) {
+		t.Errorf("%v inserted twice", wide)
+	}
+
+	narrow, _ := ParsePrefix("10.5.0.0/16")
+	if trie.Insert(narrow) {
+		t.Errorf("%v inserted despite being covered", narrow)
+	}
+
+	if n := trie.Match(net.ParseIP("10.1.2.3")); n == nil ||
+		n.String() != "10.0.0.0/8" {
+		t.Errorf("expected 10.0.0.0/8, got %v", n)
+	}
+	if n := trie.Match(net.ParseIP("10.200.0.1")); n == nil {
+		t.Errorf("10.200.0.1 not matched")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	good := map[string]string{
+		"192.0.2.1":       "192.0.2.1",
+		"192.0.2.1/24":    "192.0.2.0/24",
+		"192.0.2.0/32":    "192.0.2.0",
+		"2001:db8::1":     "2001:db8::1",
+		"2001:db8::1/128": "2001:db8::1",
+		"2001:db8::/32":   "2001:db8::/32",
+	}
+	for in, out := range good {
+		n, err := ParsePrefix(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+		} else if s := PrefixString(n); s != out {
+			t.Errorf("%s: expected %s, got %s", in, out, s)
+		}
+	}
+
+	for _, in := range []string{"", "foo", "192.0.2", "192.0.2.0/33"} {
+		if _, err := ParsePrefix(in); err == nil {
+			t.Errorf("%s: accepted", in)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+// Package portal manages the config state for the guest ring's captive portal.
+// While the portal is enabled, ap.networkd redirects all http traffic from
+// unauthorized guest clients to the portal page served by ap.httpd, and drops
+// everything else.  A client is authorized by accepting the site's terms,
+// redeeming a voucher, or being approved by a sponsor.  Each authorization is
+// an expiring property, so the client's access ends when it expires:
+//
+//    @/network/portal/authorized/<mac>   how the client was authorized
+//    @/network/portal/vouchers/<code>    duration of access, or empty
+//    @/network/portal/pending/<mac>      name supplied by the guest
+package portal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"bg/base_def"
+	"bg/common/cfgapi"
+)
+
+// Portal-related properties
+const (
+	configStub     = "@/network/portal/"
+	EnabledProp    = configStub + "enabled"
+	ModeProp       = configStub + "mode"
+	DurationProp   = configStub + "duration"
+	TermsProp      = configStub + "terms"
+	VouchersProp   = configStub + "vouchers"
+	PendingProp    = configStub + "pending"
+	AuthorizedProp = configStub + "authorized"
+)
+
+// The ways in which a guest may be authorized
+const (
+	ModeTerms   = "terms"
+	ModeVoucher = "voucher"
+	ModeSponsor = "sponsor"
+)
+
+// The portal is only offered on the guest ring
+const Ring = base_def.RING_GUEST
+
+const (
+	// DefaultDuration is how long a client remains authorized if the site
+	// doesn't specify a duration.
+	DefaultDuration = 24 * time.Hour
+
+	// A sponsor request is abandoned if it isn't approved in time
+	pendingLifetime = time.Hour
+)
+
+// ErrBadVoucher is returned when a voucher code doesn't match any valid voucher
+var ErrBadVoucher = fmt.Errorf("invalid voucher")
+
+// Config describes the portal's behavior
+type Config struct {
+	Enabled  bool
+	Mode     string
+	Duration time.Duration
+	Terms    string
+}
+
+// ValidMode returns true if the string is a supported authorization mode
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeTerms, ModeVoucher, ModeSponsor:
+		return true
+	}
+	return false
+}
+
+// GetConfig retrieves the current portal configuration
+func GetConfig(config *cfgapi.Handle) *Config {
+	c := &Config{
+		Mode:     ModeTerms,
+		Duration: DefaultDuration,
+	}
+
+	props, _ := config.GetProps(strings.TrimSuffix(configStub, "/"))
+	if props == nil {
+		return c
+	}
+
+	c.Enabled, _ = props.GetChildBool("enabled")
+	if mode, _ := props.GetChildString("mode"); ValidMode(mode) {
+		c.Mode = mode
+	}
+	if x, _ := props.GetChildString("duration"); x != "" {
+		if d, err := time.ParseDuration(x); err == nil && d > 0 {
+			c.Duration = d
+		}
+	}
+	c.Terms, _ = props.GetChildString("terms")
+
+	return c
+}
+
+func macProp(root string, mac net.HardwareAddr) string {
+	return root + "/" + mac.String()
+}
+
+// Authorized returns the clients currently authorized to use the guest ring,
+// along with the time at which each authorization expires.
+func Authorized(config *cfgapi.Handle) map[string]*time.Time {
+	auth := make(map[string]*time.Time)
+
+	props, _ := config.GetProps(AuthorizedProp)
+	if props == nil {
+		return auth
+	}
+
+	for name, node := range props.Children {
+		mac, err := net.ParseMAC(name)
+		if err == nil && !node.Expired() {
+			auth[mac.String()] = node.Expires
+		}
+	}
+	return auth
+}
+
+// IsAuthorized returns true if the client is currently authorized
+func IsAuthorized(config *cfgapi.Handle, mac net.HardwareAddr) bool {
+	_, ok := Authorized(config)[mac.String()]
+	return ok
+}
+
+// Authorize grants a client access to the guest ring for the given duration.
+func Authorize(ctx context.Context, config *cfgapi.Handle,
+	mac net.HardwareAddr, how string, d time.Duration) error {
+
+	expires := time.Now().Add(d)
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:      cfgapi.PropCreate,
+			Name:    macProp(AuthorizedProp, mac),
+			Value:   how,
+			Expires: &expires,
+		},
+	}
+	if _, err := config.Execute(ctx, ops).Wait(ctx); err != nil {
+		return fmt.Errorf("authorizing %s: %v", mac, err)
+	}
+
+	// Clean up any outstanding sponsor request.  It doesn't matter
+	// whether there was one or not.
+	ops = []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropDelete,
+			Name: macProp(PendingProp, mac),
+		},
+	}
+	config.Execute(ctx, ops).Wait(ctx)
+
+	return nil
+}
+
+// Revoke ends a client's access to the guest ring
+func Revoke(ctx context.Context, config *cfgapi.Handle,
+	mac net.HardwareAddr) error {
+
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropDelete,
+			Name: macProp(AuthorizedProp, mac),
+		},
+	}
+	_, err := config.Execute(ctx, ops).Wait(ctx)
+	if err == cfgapi.ErrNoProp {
+		err = nil
+	}
+	return err
+}
+
+// RedeemVoucher consumes a voucher, returning the duration of access it grants.
+// Each voucher may only be used once.
+func RedeemVoucher(ctx context.Context, config *cfgapi.Handle,
+	code string, def time.Duration) (time.Duration, error) {
+
+	code = strings.TrimSpace(code)
+	if code == "" || strings.ContainsAny(code, "/@") {
+		return 0, ErrBadVoucher
+	}
+
+	prop := VouchersProp + "/" + code
+	props, _ := config.GetProps(prop)
+	if props == nil || props.Expired() {
+		return 0, ErrBadVoucher
+	}
+
+	// The voucher may specify its own duration
+	d := def
+	if x, err := time.ParseDuration(props.Value); err == nil && x > 0 {
+		d = x
+	}
+
+	// Only the first request to delete the voucher will succeed, which
+	// prevents it from being redeemed twice.
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropDelete,
+			Name: prop,
+		},
+	}
+	if _, err := config.Execute(ctx, ops).Wait(ctx); err != nil {
+		return 0, ErrBadVoucher
+	}
+
+	return d, nil
+}
+
+// Request records a guest's request for access, to be approved by a sponsor.
+func Request(ctx context.Context, config *cfgapi.Handle,
+	mac net.HardwareAddr, name string) error {
+
+	expires := time.Now().Add(pendingLifetime)
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:      cfgapi.PropCreate,
+			Name:    macProp(PendingProp, mac),
+			Value:   name,
+			Expires: &expires,
+		},
+	}
+	_, err := config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
+
+// Pending returns the outstanding sponsor requests, mapping each client's mac
+// address to the name the guest provided.
+func Pending(config *cfgapi.Handle) map[string]string {
+	pending := make(map[string]string)
+
+	props, _ := config.GetProps(PendingProp)
+	if props == nil {
+		return pending
+	}
+
+	for name, node := range props.Children {
+		mac, err := net.ParseMAC(name)
+		if err == nil && !node.Expired() {
+			pending[mac.String()] = node.Value
+		}
+	}
+	return pending
+}
+
+// IsPending returns true if the client is awaiting a sponsor's approval
+func IsPending(config *cfgapi.Handle, mac net.HardwareAddr) bool {
+	_, ok := Pending(config)[mac.String()]
+	return ok
+}
+
+// Deny rejects a guest's pending request for access
+func Deny(ctx context.Context, config *cfgapi.Handle,
+	mac net.HardwareAddr) error {
+
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:   cfgapi.PropDelete,
+			Name: macProp(PendingProp, mac),
+		},
+	}
+	_, err := config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+	"time"
 
 	"bg/common/cfgapi"
 	"bg/common/wgconf"
@@ -35,6 +36,7 @@ func addKey(cmd *cobra.Command, args []string) error {
 	label, _ := cmd.Flags().GetString("label")
 	ipaddr, _ := cmd.Flags().GetString("ip")
 	file, _ := cmd.Flags().GetString("file")
+	lifetime, _ := cmd.Flags().GetDuration("expires")
 
 	ctx := context.Background()
 
@@ -42,18 +44,116 @@ func addKey(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("must specify a user name")
 	}
 
-	res, err := siteHdl.AddKey(ctx, user, label, ipaddr)
+	res, err := siteHdl.AddKey(ctx, user, label, ipaddr,
+		expiration(lifetime))
 	if err == nil {
-		if file == "" {
-			fmt.Printf(string(res.ConfData))
-		} else {
-			err = ioutil.WriteFile(file, res.ConfData, 0644)
+		err = writeConf(file, res.ConfData)
+	}
+
+	return err
+}
+
+// Convert a key lifetime into an expiration time.  A zero lifetime means the key
+// never expires.
+func expiration(lifetime time.Duration) *time.Time {
+	var rval *time.Time
+
+	if lifetime > 0 {
+		t := time.Now().Add(lifetime)
+		rval = &t
+	}
+	return rval
+}
+
+func writeConf(file string, data []byte) error {
+	var err error
+
+	if file == "" {
+		fmt.Printf(string(data))
+	} else {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	return err
+}
+
+// Find the single key identified by the command's --id, --mac, --label, or
+// --public flags.
+func selectKey(cmd *cobra.Command, user string) (*wgconf.UserConf, error) {
+	var found *wgconf.UserConf
+
+	id, _ := cmd.Flags().GetInt("id")
+	mac, _ := cmd.Flags().GetString("mac")
+	label, _ := cmd.Flags().GetString("label")
+	public, _ := cmd.Flags().GetString("public")
+	if id < 0 && mac == "" && label == "" && public == "" {
+		return nil, fmt.Errorf("must specify at least one of " +
+			"--label, --id, --mac, or --public")
+	}
+
+	conf, err := config.GetUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range conf.WGConfig {
+		if matches(key, id, mac, label, public) {
+			if found != nil {
+				return nil, fmt.Errorf("multiple matching keys")
+			}
+			found = key
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no matching key found")
+	}
+
+	return found, nil
+}
+
+// Replace one of a user's keys with a new key, and print the new config file to
+// stdout.  The old key continues to work for the grace period.
+func rotateKey(cmd *cobra.Command, args []string) error {
+	user, _ := cmd.Flags().GetString("user")
+	file, _ := cmd.Flags().GetString("file")
+	grace, _ := cmd.Flags().GetDuration("grace")
+	lifetime, _ := cmd.Flags().GetDuration("expires")
+
+	if user == "" {
+		return fmt.Errorf("must specify a user name")
+	}
+	key, err := selectKey(cmd, user)
+	if err != nil {
+		return err
+	}
+
+	res, err := siteHdl.RotateKey(context.Background(), user, key.Mac,
+		grace, expiration(lifetime))
+	if res != nil && res.ConfData != nil {
+		if werr := writeConf(file, res.ConfData); err == nil {
+			err = werr
 		}
 	}
 
 	return err
 }
 
+// Set or clear the expiration time of one of a user's keys
+func expireKey(cmd *cobra.Command, args []string) error {
+	user, _ := cmd.Flags().GetString("user")
+	lifetime, _ := cmd.Flags().GetDuration("in")
+
+	if user == "" {
+		return fmt.Errorf("must specify a user name")
+	}
+	key, err := selectKey(cmd, user)
+	if err != nil {
+		return err
+	}
+
+	return siteHdl.SetKeyExpiration(context.Background(), user, key.Mac,
+		expiration(lifetime))
+}
+
 func matches(key *wgconf.UserConf, id int, mac, label, public string) bool {
 	match := true
 
@@ -155,19 +255,27 @@ func listKeys(cmd *cobra.Command, args []string) error {
 	uhdr := fmt.Sprintf("%%%ds", ulen)
 	lhdr := fmt.Sprintf("%%%ds", llen)
 
-	fmt.Printf(uhdr+"  %4s  "+lhdr+"  %18s  %17s  %s\n",
+	fmt.Printf(uhdr+"  %4s  "+lhdr+"  %18s  %17s  %15s  %15s  %s\n",
 		"username", "ID", "label", "assigned IP", "accounting mac",
-		"public key")
+		"expires", "last handshake", "public key")
 
 	for _, key := range keys {
-		fmt.Printf(uhdr+"  %4d  "+lhdr+"  %18s  %17s  %v\n",
+		fmt.Printf(uhdr+"  %4d  "+lhdr+"  %18s  %17s  %15s  %15s  %v\n",
 			key.User, key.ID, key.Label, key.IPAddress,
-			key.Mac, key.Key)
+			key.Mac, timeString(key.Expires, "never"),
+			timeString(key.LastHandshake, "never"), key.Key)
 	}
 
 	return nil
 }
 
+func timeString(t *time.Time, def string) string {
+	if t == nil {
+		return def
+	}
+	return t.Format(time.Stamp)
+}
+
 func checkServer(cmd *cobra.Command, args []string) error {
 	warnings := siteHdl.SanityCheck(keyFilePath)
 	if len(warnings) == 0 {
@@ -212,8 +320,43 @@ func Exec(ctx context.Context, p string, hdl *cfgapi.Handle, args []string) erro
 	addCmd.Flags().String("ip", "", "assigned ip address")
 	addCmd.Flags().StringP("label", "l", "", "user-friendly label")
 	addCmd.Flags().StringP("file", "f", "", "file to write config into")
+	addCmd.Flags().Duration("expires", 0, "lifetime of the key")
 	rootCmd.AddCommand(addCmd)
 
+	rotateCmd := &cobra.Command{
+		Use:           "rotate",
+		Short:         "replace a user's vpn key",
+		RunE:          rotateKey,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	rotateCmd.Flags().StringP("user", "u", "", "user")
+	rotateCmd.Flags().IntP("id", "i", -1, "rotate a user's key by index number")
+	rotateCmd.Flags().StringP("label", "l", "", "rotate a user's key by label")
+	rotateCmd.Flags().StringP("mac", "m", "", "mac address")
+	rotateCmd.Flags().StringP("public", "p", "", "public key")
+	rotateCmd.Flags().StringP("file", "f", "", "file to write new config into")
+	rotateCmd.Flags().Duration("grace", 24*time.Hour,
+		"how long the old key remains valid")
+	rotateCmd.Flags().Duration("expires", 0, "lifetime of the new key")
+	rootCmd.AddCommand(rotateCmd)
+
+	expireCmd := &cobra.Command{
+		Use:           "expire",
+		Short:         "set the expiration time of a user's vpn key",
+		RunE:          expireKey,
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	expireCmd.Flags().StringP("user", "u", "", "user")
+	expireCmd.Flags().IntP("id", "i", -1, "select a user's key by index number")
+	expireCmd.Flags().StringP("label", "l", "", "select a user's key by label")
+	expireCmd.Flags().StringP("mac", "m", "", "mac address")
+	expireCmd.Flags().StringP("public", "p", "", "public key")
+	expireCmd.Flags().Duration("in", 0,
+		"time until the key expires (0 to never expire)")
+	rootCmd.AddCommand(expireCmd)
+
 	removeCmd := &cobra.Command{
 		Use:           "remove",
 		Short:         "remove a user's vpn key(s)",
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgconf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// MeshPeer contains the information needed to connect to a single remote site
+// in a site-to-site mesh, and to route traffic for its subnets.
+type MeshPeer struct {
+	Site         string // UUID of the remote site
+	Name         string
+	Address      string // Publicly reachable hostname or IP address
+	IPAddress    net.IP
+	ListenPort   int
+	PresharedKey *wgtypes.Key
+
+	Endpoint
+}
+
+// Mesh contains the local half of a site-to-site mesh: a single WireGuard
+// device with one peer for each remote site.
+type Mesh struct {
+	ListenPort int
+	Peers      map[string]*MeshPeer
+
+	Endpoint
+
+	sync.Mutex
+}
+
+// NewMesh returns a Mesh structure with an empty list of peers
+func NewMesh(device string) *Mesh {
+	m := &Mesh{
+		Peers: make(map[string]*MeshPeer),
+	}
+	m.Devname = device
+	return m
+}
+
+// SetListenPort verifies that the string represents a valid port number and
+// uses it to update the ListenPort field.
+func (m *Mesh) SetListenPort(port string) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.ListenPort = 0
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p >= 65536 {
+		return fmt.Errorf("invalid port number: '%s'", port)
+	}
+	m.ListenPort = p
+	return nil
+}
+
+// GetPeer returns the peer for the given site, creating it if necessary
+func (m *Mesh) GetPeer(site string) *MeshPeer {
+	m.Lock()
+	defer m.Unlock()
+
+	p := m.Peers[site]
+	if p == nil {
+		p = &MeshPeer{Site: site}
+		m.Peers[site] = p
+	}
+	return p
+}
+
+// AllSubnets returns the subnets reachable through all of the peers
+func (m *Mesh) AllSubnets() []net.IPNet {
+	m.Lock()
+	defer m.Unlock()
+
+	all := make([]net.IPNet, 0)
+	for _, p := range m.Peers {
+		all = append(all, p.Subnets...)
+	}
+	return all
+}
+
+// SetRemoteAddress records the remote site's hostname or IP address, and
+// attempts to resolve it.
+func (p *MeshPeer) SetRemoteAddress(addr string) error {
+	p.Address = addr
+	p.IPAddress = net.ParseIP(addr)
+	if p.IPAddress == nil {
+		addrs, err := net.LookupHost(addr)
+		if err == nil && len(addrs) > 0 {
+			p.IPAddress = net.ParseIP(addrs[0])
+		}
+	}
+
+	if p.IPAddress == nil {
+		return fmt.Errorf("bad peer address: '%s'", addr)
+	}
+	return nil
+}
+
+// SetListenPort verifies that the string represents a valid port number and
+// uses it to update the peer's ListenPort field.
+func (p *MeshPeer) SetListenPort(port string) error {
+	p.ListenPort = 0
+	x, err := strconv.Atoi(port)
+	if err != nil || x <= 0 || x >= 65536 {
+		return fmt.Errorf("invalid port number: '%s'", port)
+	}
+	p.ListenPort = x
+	return nil
+}
+
+// SetPresharedKey verifies that the string represents a valid key, and uses it
+// as the symmetric key shared by this pair of sites.
+func (p *MeshPeer) SetPresharedKey(text string) error {
+	key, err := keyParse(text)
+	p.PresharedKey = key
+	return err
+}
@@ -14,6 +14,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"time"
 
 	"bg/base_def"
 )
@@ -28,6 +29,11 @@ type UserConf struct {
 	ServerKey string // Public key of server when key was created
 	IsStale   bool   // was key generated with a different server public key
 
+	Expires       *time.Time // When the key stops being accepted
+	LastHandshake *time.Time // Most recent handshake seen by the server
+	RxBytes       uint64     // Bytes received from this client
+	TxBytes       uint64     // Bytes sent to this client
+
 	Endpoint
 }
 
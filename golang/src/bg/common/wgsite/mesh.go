@@ -0,0 +1,186 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgsite
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bg/base_def"
+	"bg/common/cfgapi"
+)
+
+// The site-to-site mesh links all of the participating sites in an
+// organization.  The cloud generates the keys for each site and each pair of
+// sites, and pushes the details of every remote site into the local config
+// tree.  Each site decides which of its own rings are reachable across the
+// mesh.
+const (
+	meshStub        = "@/network/vpn/mesh/"
+	MeshPrivateProp = meshStub + "private_key"
+	MeshPortProp    = meshStub + "port"
+	MeshPeersProp   = meshStub + "peers"
+
+	MeshEnabledProp = "@/policy/site/vpn/mesh/enabled"
+)
+
+// MeshPeer describes a remote site in the mesh
+type MeshPeer struct {
+	Site         string   `json:"site"`
+	Name         string   `json:"name"`
+	PublicKey    string   `json:"publicKey"`
+	PresharedKey string   `json:"-"`
+	Endpoint     string   `json:"endpoint"`
+	Port         int      `json:"port"`
+	Subnets      []string `json:"subnets"`
+}
+
+// MeshAllowedProp returns the property indicating whether a ring is reachable
+// across the site-to-site mesh
+func MeshAllowedProp(ring string) string {
+	return "@/policy/rings/" + ring + "/vpn/mesh/allowed"
+}
+
+// MeshPeerProp returns the root of the properties describing a single remote
+// site
+func MeshPeerProp(site string) string {
+	return MeshPeersProp + "/" + site
+}
+
+// MeshRings returns the rings at this site that are reachable across the mesh
+func (s *Site) MeshRings() []string {
+	rings := make([]string, 0)
+	for ring := range s.subnets {
+		if ring == base_def.RING_WAN || ring == base_def.RING_INTERNAL {
+			continue
+		}
+		if ok, _ := s.config.GetPropBool(MeshAllowedProp(ring)); ok {
+			rings = append(rings, ring)
+		}
+	}
+	sort.Strings(rings)
+	return rings
+}
+
+// MeshSubnets returns the subnets that remote sites should route to this site
+func (s *Site) MeshSubnets() []string {
+	subnets := make([]string, 0)
+	for _, ring := range s.MeshRings() {
+		subnets = append(subnets, s.subnets[ring])
+	}
+	return subnets
+}
+
+// MeshEndpoint returns the address at which other sites can reach this one.
+// If the VPN server has been given a public name, we use that.  Otherwise we
+// fall back to the current WAN address.
+func (s *Site) MeshEndpoint() (string, error) {
+	if addr, _ := s.config.GetProp(AddressProp); addr != "" {
+		return addr, nil
+	}
+
+	if wan := s.config.GetWanInfo(); wan != nil && wan.CurrentAddress != "" {
+		ip, _, err := net.ParseCIDR(wan.CurrentAddress)
+		if err == nil {
+			return ip.String(), nil
+		}
+	}
+
+	return "", fmt.Errorf("no public address available")
+}
+
+// SetMeshRings updates the set of rings reachable across the mesh
+func (s *Site) SetMeshRings(ctx context.Context, rings []string) error {
+	allowed := make(map[string]bool)
+	for _, ring := range rings {
+		if _, ok := s.subnets[ring]; !ok || ring == base_def.RING_WAN ||
+			ring == base_def.RING_INTERNAL {
+			return fmt.Errorf("invalid ring: %s", ring)
+		}
+		allowed[ring] = true
+	}
+
+	ops := make([]cfgapi.PropertyOp, 0)
+	for ring := range s.subnets {
+		if ring == base_def.RING_WAN || ring == base_def.RING_INTERNAL {
+			continue
+		}
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:    cfgapi.PropCreate,
+			Name:  MeshAllowedProp(ring),
+			Value: strconv.FormatBool(allowed[ring]),
+		})
+	}
+
+	_, err := s.config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
+
+// UpdateMesh replaces the site's mesh configuration with the provided key and
+// list of peers.  If the list of peers is empty, the site is removed from the
+// mesh.  The mesh is enabled when the site first joins, but an administrator's
+// setting of MeshEnabledProp is never overridden.
+func (s *Site) UpdateMesh(ctx context.Context, private string, port int,
+	peers []MeshPeer) error {
+
+	ops := make([]cfgapi.PropertyOp, 0)
+	if _, err := s.config.GetProps(MeshPeersProp); err == nil {
+		ops = append(ops, cfgapi.PropertyOp{
+			Op:   cfgapi.PropDelete,
+			Name: MeshPeersProp,
+		})
+	}
+
+	if len(peers) == 0 {
+		for _, prop := range []string{MeshPrivateProp, MeshPortProp} {
+			if _, err := s.config.GetProp(prop); err == nil {
+				ops = append(ops, cfgapi.PropertyOp{
+					Op:   cfgapi.PropDelete,
+					Name: prop,
+				})
+			}
+		}
+
+	} else {
+		props := map[string]string{
+			MeshPrivateProp: private,
+			MeshPortProp:    strconv.Itoa(port),
+		}
+		_, err := s.config.GetProp(MeshEnabledProp)
+		if err == cfgapi.ErrNoProp {
+			props[MeshEnabledProp] = "true"
+		}
+		for _, p := range peers {
+			root := MeshPeerProp(p.Site) + "/"
+			props[root+"name"] = p.Name
+			props[root+"public_key"] = p.PublicKey
+			props[root+"preshared_key"] = p.PresharedKey
+			props[root+"endpoint"] = p.Endpoint
+			props[root+"port"] = strconv.Itoa(p.Port)
+			if len(p.Subnets) > 0 {
+				props[root+"subnets"] = strings.Join(p.Subnets, ",")
+			}
+		}
+		for prop, val := range props {
+			ops = append(ops, cfgapi.PropertyOp{
+				Op:    cfgapi.PropCreate,
+				Name:  prop,
+				Value: val,
+			})
+		}
+	}
+
+	_, err := s.config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
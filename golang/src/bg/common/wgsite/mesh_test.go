@@ -0,0 +1,104 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgsite
+
+import (
+	"context"
+	"testing"
+)
+
+const (
+	testMeshKey  = "aGFja2VyLWtleS1mb3ItdGVzdGluZy1vbmx5LTEyMzQ="
+	testMeshSite = "5ab3a3c1-0a4a-4d1b-9a62-0c1d3a9f8e01"
+)
+
+var testMeshPeer = MeshPeer{
+	Site:         testMeshSite,
+	Name:         "branch",
+	PublicKey:    "YnJhbmNoLXB1YmxpYy1rZXktZm9yLXRlc3RpbmcxMjM=",
+	PresharedKey: "YnJhbmNoLXByZXNoYXJlZC1rZXktdGVzdGluZzEyMzQ=",
+	Endpoint:     "198.51.100.7",
+	Port:         51821,
+	Subnets:      []string{"192.168.10.0/24", "192.168.11.0/24"},
+}
+
+func checkMeshProp(t *testing.T, s *Site, prop, want string) {
+	t.Helper()
+
+	got, err := s.config.GetProp(prop)
+	if want == "" {
+		if err == nil {
+			t.Errorf("%s: expected no property, got %q", prop, got)
+		}
+	} else if got != want {
+		t.Errorf("%s: got %q (%v), want %q", prop, got, err, want)
+	}
+}
+
+func TestUpdateMesh(t *testing.T) {
+	ctx := context.Background()
+	root := MeshPeerProp(testMeshSite) + "/"
+
+	// Joining the mesh installs the peer and enables the mesh
+	s := &Site{config: testPolicyConfig(t, map[string]string{})}
+	err := s.UpdateMesh(ctx, testMeshKey, 51820, []MeshPeer{testMeshPeer})
+	if err != nil {
+		t.Fatalf("adding peer: %v", err)
+	}
+	checkMeshProp(t, s, MeshPrivateProp, testMeshKey)
+	checkMeshProp(t, s, MeshPortProp, "51820")
+	checkMeshProp(t, s, MeshEnabledProp, "true")
+	checkMeshProp(t, s, root+"name", "branch")
+	checkMeshProp(t, s, root+"public_key", testMeshPeer.PublicKey)
+	checkMeshProp(t, s, root+"preshared_key", testMeshPeer.PresharedKey)
+	checkMeshProp(t, s, root+"endpoint", "198.51.100.7")
+	checkMeshProp(t, s, root+"port", "51821")
+	checkMeshProp(t, s, root+"subnets", "192.168.10.0/24,192.168.11.0/24")
+
+	// A later update replaces the list of peers
+	other := testMeshPeer
+	other.Site = "0c6f1ab2-77c1-4c52-8a0d-3f6b4e2d9a10"
+	other.Subnets = nil
+	err = s.UpdateMesh(ctx, testMeshKey, 51820, []MeshPeer{other})
+	if err != nil {
+		t.Fatalf("replacing peer: %v", err)
+	}
+	checkMeshProp(t, s, root+"name", "")
+	checkMeshProp(t, s, MeshPeerProp(other.Site)+"/name", "branch")
+	checkMeshProp(t, s, MeshPeerProp(other.Site)+"/subnets", "")
+
+	// Removing the last peer takes the site out of the mesh, but leaves the
+	// enabled setting alone for when it rejoins.
+	if err = s.UpdateMesh(ctx, "", 0, nil); err != nil {
+		t.Fatalf("removing last peer: %v", err)
+	}
+	checkMeshProp(t, s, MeshPrivateProp, "")
+	checkMeshProp(t, s, MeshPortProp, "")
+	if props, _ := s.config.GetProps(MeshPeersProp); props != nil {
+		t.Errorf("peers remain after removing the last one")
+	}
+	checkMeshProp(t, s, MeshEnabledProp, "true")
+
+	// Leaving a mesh the site was never in is harmless
+	if err = s.UpdateMesh(ctx, "", 0, nil); err != nil {
+		t.Fatalf("removing peers again: %v", err)
+	}
+
+	// An administrator's decision to disable the mesh is preserved
+	s = &Site{config: testPolicyConfig(t, map[string]string{
+		MeshEnabledProp: "false",
+	})}
+	err = s.UpdateMesh(ctx, testMeshKey, 51820, []MeshPeer{testMeshPeer})
+	if err != nil {
+		t.Fatalf("adding peer with mesh disabled: %v", err)
+	}
+	checkMeshProp(t, s, root+"name", "branch")
+	checkMeshProp(t, s, MeshEnabledProp, "false")
+}
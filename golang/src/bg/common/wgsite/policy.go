@@ -0,0 +1,141 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgsite
+
+import (
+	"strings"
+
+	"bg/common/cfgapi"
+)
+
+// The destinations a VPN client may reach can be limited at several levels:
+//
+//    @/policy/site/vpn/server/0/<setting>
+//    @/policy/groups/<group>/vpn/server/0/<setting>
+//    @/policy/users/<user>/vpn/server/0/<setting>
+//    @/policy/clients/<mac>/vpn/server/0/<setting>
+//
+// Each setting is taken from the most specific level at which it is defined.  A
+// user's groups are listed in @/users/<user>/groups.  If a user belongs to
+// several groups that define the same setting, the group settings are merged.
+
+// Per-policy settings
+const (
+	PolicyRings   = "rings"
+	PolicySubnets = "subnets"
+	PolicyPorts   = "ports"
+)
+
+// Policy describes the destinations a single VPN key may reach.  A nil field
+// means the setting wasn't defined at any level, which is distinct from a
+// setting defined to be empty.
+type Policy struct {
+	Rings   []string // Rings the client may reach
+	Subnets []string // Additional CIDRs the client may reach
+	Ports   []string // If non-empty, the only TCP/UDP ports allowed
+}
+
+// UserGroupsProp returns the property listing the groups a user belongs to
+func UserGroupsProp(user string) string {
+	return "@/users/" + user + "/groups"
+}
+
+func policyRoot(scope string) string {
+	return "@/policy/" + scope + "/vpn/" + serverStub
+}
+
+// Split a comma-separated list, dropping any empty fields
+func policyList(val string) []string {
+	list := make([]string, 0)
+	for _, f := range strings.Split(val, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// Return the value of a setting at a single level, or nil if undefined
+func policySetting(node *cfgapi.PropertyNode, setting string) []string {
+	val, err := node.GetChildString(setting)
+	if err != nil {
+		return nil
+	}
+	return policyList(val)
+}
+
+// Merge a setting from each of the user's groups
+func groupSetting(groups []*cfgapi.PropertyNode, setting string) []string {
+	var merged []string
+
+	seen := make(map[string]bool)
+	for _, g := range groups {
+		list := policySetting(g, setting)
+		if list == nil {
+			continue
+		}
+		if merged == nil {
+			merged = make([]string, 0)
+		}
+		for _, v := range list {
+			if !seen[v] {
+				merged = append(merged, v)
+				seen[v] = true
+			}
+		}
+	}
+
+	return merged
+}
+
+// GetPolicy returns the effective access policy for a single VPN key, combining
+// the site, group, user, and client settings.  The mac address may be empty if
+// the key hasn't been created yet.
+func GetPolicy(config *cfgapi.Handle, user, mac string) *Policy {
+	var client, usr, site *cfgapi.PropertyNode
+
+	if mac != "" {
+		client, _ = config.GetProps(policyRoot("clients/" + mac))
+	}
+	if user != "" {
+		usr, _ = config.GetProps(policyRoot("users/" + user))
+	}
+	site, _ = config.GetProps(policyRoot("site"))
+
+	groups := make([]*cfgapi.PropertyNode, 0)
+	if user != "" {
+		list, _ := config.GetProp(UserGroupsProp(user))
+		for _, g := range policyList(list) {
+			node, _ := config.GetProps(policyRoot("groups/" + g))
+			if node != nil {
+				groups = append(groups, node)
+			}
+		}
+	}
+
+	resolve := func(setting string) []string {
+		if v := policySetting(client, setting); v != nil {
+			return v
+		}
+		if v := policySetting(usr, setting); v != nil {
+			return v
+		}
+		if v := groupSetting(groups, setting); v != nil {
+			return v
+		}
+		return policySetting(site, setting)
+	}
+
+	return &Policy{
+		Rings:   resolve(PolicyRings),
+		Subnets: resolve(PolicySubnets),
+		Ports:   resolve(PolicyPorts),
+	}
+}
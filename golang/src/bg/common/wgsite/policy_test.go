@@ -0,0 +1,110 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgsite
+
+import (
+	"reflect"
+	"testing"
+
+	"bg/common/cfgapi"
+	"bg/common/mockcfg"
+)
+
+const (
+	testUser = "alice"
+	testMac  = "00:40:54:00:00:01"
+)
+
+func testPolicyConfig(t *testing.T, props map[string]string) *cfgapi.Handle {
+	config := cfgapi.NewHandle(mockcfg.NewMockExecEmptyTree())
+	if err := config.CreateProps(props, nil); err != nil {
+		t.Fatalf("creating props: %v", err)
+	}
+	return config
+}
+
+func TestPolicyPrecedence(t *testing.T) {
+	site := policyRoot("site") + "/"
+	client := policyRoot("clients/"+testMac) + "/"
+	user := policyRoot("users/"+testUser) + "/"
+	staff := policyRoot("groups/staff") + "/"
+	eng := policyRoot("groups/eng") + "/"
+
+	config := testPolicyConfig(t, map[string]string{
+		site + PolicyRings:   "standard,devices",
+		site + PolicySubnets: "10.1.0.0/16",
+		site + PolicyPorts:   "443",
+	})
+
+	// With nothing more specific, the site defaults apply
+	got := GetPolicy(config, testUser, testMac)
+	want := &Policy{
+		Rings:   []string{"standard", "devices"},
+		Subnets: []string{"10.1.0.0/16"},
+		Ports:   []string{"443"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("site: got %+v, want %+v", got, want)
+	}
+
+	// Group settings override the site's, and are merged with each other
+	config = testPolicyConfig(t, map[string]string{
+		site + PolicyRings:       "standard,devices",
+		site + PolicyPorts:       "443",
+		UserGroupsProp(testUser): "staff,eng",
+		staff + PolicyRings:      "core",
+		eng + PolicyRings:        "core,devices",
+		user + PolicySubnets:     "",
+		client + PolicyPorts:     "22,443",
+	})
+	got = GetPolicy(config, testUser, testMac)
+	want = &Policy{
+		Rings:   []string{"core", "devices"},
+		Subnets: []string{},
+		Ports:   []string{"22", "443"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("key: got %+v, want %+v", got, want)
+	}
+
+	// Another key belonging to the same user gets the user's settings, but
+	// not the first key's
+	got = GetPolicy(config, testUser, "00:40:54:00:00:02")
+	if !reflect.DeepEqual(got.Ports, []string{"443"}) {
+		t.Errorf("other key: got ports %v, want site's", got.Ports)
+	}
+}
+
+func TestRoutedSubnets(t *testing.T) {
+	s := &Site{
+		subnets: map[string]string{
+			"standard": "192.168.2.0/24",
+			"devices":  "192.168.3.0/24",
+			"vpn":      "192.168.4.0/24",
+		},
+	}
+
+	rings := make([]string, 1, 4)
+	rings[0] = "standard"
+	policy := &Policy{Rings: rings}
+
+	got, err := s.chooseRoutedSubnets(policy)
+	if err != nil {
+		t.Fatalf("chooseRoutedSubnets failed: %v", err)
+	}
+	if got != "192.168.2.0/24,192.168.4.0/24" {
+		t.Errorf("got %q", got)
+	}
+
+	// The policy's own list must not be extended
+	if len(policy.Rings) != 1 || rings[:2][1] != "" {
+		t.Errorf("policy rings modified: %v", rings[:2])
+	}
+}
@@ -48,6 +48,16 @@ const (
 
 var errIncomplete = fmt.Errorf("configuration incomplete")
 
+// A key can't be issued or extended with an expiration time that has already
+// passed.
+func checkExpiration(expires *time.Time) error {
+	if expires != nil && !expires.After(time.Now()) {
+		return fmt.Errorf("expiration time %s is in the past",
+			expires.Format(time.RFC3339))
+	}
+	return nil
+}
+
 // Site is an opaque handle which is used to perform wireguard-related config
 // operations for a single site.
 type Site struct {
@@ -195,20 +205,16 @@ func (s *Site) chooseIPAddr(users cfgapi.UserMap) (string, error) {
 	return "", fmt.Errorf("no addresses available")
 }
 
-// Using the configured rings and subnets a vpn client is allowed to access,
-// return a list of the subnets to include in its route table.
-func (s *Site) chooseRoutedSubnets() (string, error) {
+// Using the rings and subnets a vpn client is allowed to access, return a list
+// of the subnets to include in its route table.
+func (s *Site) chooseRoutedSubnets(policy *Policy) (string, error) {
 	subnets := make([]string, 0)      // list of subnets to include
 	included := make(map[string]bool) // used to avoid duplicates
 
-	ringProp, _ := s.config.GetProp(RingsProp)
-	ringList := strings.Split(ringProp, ",")
+	ringList := make([]string, 0, len(policy.Rings)+1)
+	ringList = append(ringList, policy.Rings...)
 	ringList = append(ringList, "vpn")
-
 	for _, ring := range ringList {
-		if len(ring) == 0 {
-			continue
-		}
 		if subnet, ok := s.subnets[ring]; ok {
 			if !included[subnet] {
 				subnets = append(subnets, subnet)
@@ -219,19 +225,12 @@ func (s *Site) chooseRoutedSubnets() (string, error) {
 		}
 	}
 
-	subnetProp, _ := s.config.GetProp(SubnetsProp)
-	subnetList := strings.Split(subnetProp, ",")
-	if len(subnetList) > 0 {
-		for _, subnet := range subnetList {
-			if len(subnet) == 0 {
-				continue
-			}
-			if _, _, err := net.ParseCIDR(subnet); err != nil {
-				return "", fmt.Errorf("invalid subnet: %s", subnet)
-			} else if !included[subnet] {
-				subnets = append(subnets, subnet)
-				included[subnet] = true
-			}
+	for _, subnet := range policy.Subnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return "", fmt.Errorf("invalid subnet: %s", subnet)
+		} else if !included[subnet] {
+			subnets = append(subnets, subnet)
+			included[subnet] = true
 		}
 	}
 
@@ -250,7 +249,8 @@ func chooseIndex(user *cfgapi.UserInfo) string {
 	return strconv.Itoa(next)
 }
 
-func (s *Site) updateConfig(ctx context.Context, lastMac string, props map[string]string) error {
+func (s *Site) updateConfig(ctx context.Context, lastMac string,
+	props map[string]string, expires map[string]*time.Time) error {
 
 	ops := make([]cfgapi.PropertyOp, 0)
 
@@ -266,9 +266,10 @@ func (s *Site) updateConfig(ctx context.Context, lastMac string, props map[strin
 	}
 	for prop, val := range props {
 		op := cfgapi.PropertyOp{
-			Op:    cfgapi.PropCreate,
-			Name:  prop,
-			Value: val,
+			Op:      cfgapi.PropCreate,
+			Name:    prop,
+			Value:   val,
+			Expires: expires[prop],
 		}
 		ops = append(ops, op)
 	}
@@ -286,6 +287,7 @@ type AddKeyResult struct {
 	Publickey     string
 	ServerAddress string
 	ServerPort    int
+	Expires       *time.Time
 }
 
 // AddKey generates a new client wireguard key, inserts the related properties
@@ -294,11 +296,17 @@ type AddKeyResult struct {
 // file, and other related information.
 //
 // The caller can optionally identify a label that should be associated with the
-// key, and the IP address the connecting client should be assigned.
-func (s *Site) AddKey(ctx context.Context, name, label, ipaddr string) (*AddKeyResult, error) {
+// key, the IP address the connecting client should be assigned, and the time at
+// which the key should stop being accepted.  That time must be in the future.
+func (s *Site) AddKey(ctx context.Context, name, label, ipaddr string,
+	expires *time.Time) (*AddKeyResult, error) {
 	var err error
 	var includeServerKey bool
 
+	if err = checkExpiration(expires); err != nil {
+		return nil, err
+	}
+
 	if f, err := s.config.GetFeatures(); err == nil {
 		includeServerKey = f[cfgapi.FeatureUserServerKey]
 	}
@@ -324,7 +332,9 @@ Retry:
 		return nil, fmt.Errorf("no such user")
 	}
 
-	subnets, err := s.chooseRoutedSubnets()
+	// The key doesn't exist yet, so only the user, group, and site
+	// policies apply.
+	subnets, err := s.chooseRoutedSubnets(GetPolicy(s.config, name, ""))
 	if err != nil {
 		return nil, err
 	}
@@ -367,8 +377,15 @@ Retry:
 		props[base+"server_key"] = conf.ServerPublicKey
 	}
 
+	// The key's lifetime is tied to its public key.  When that expires,
+	// the VPN server stops accepting it and removes the rest of the key's
+	// properties.
+	exp := map[string]*time.Time{
+		base + "public_key": expires,
+	}
+
 	var confData []byte
-	err = s.updateConfig(ctx, lastMac, props)
+	err = s.updateConfig(ctx, lastMac, props, exp)
 	if err == nil {
 		confData, err = genConfig(conf)
 	} else if err == cfgapi.ErrNotEqual {
@@ -390,6 +407,7 @@ Retry:
 	}
 
 	result := AddKeyResult{
+		Expires:       expires,
 		Mac:           newMac,
 		Label:         label,
 		ConfData:      confData,
@@ -427,6 +445,79 @@ func (s *Site) RemoveKey(ctx context.Context, name, mac, public string) error {
 	return err
 }
 
+// SetKeyExpiration changes the time at which a single wireguard key will stop
+// being accepted.  A nil expiration time means the key will never expire.  A key
+// can't be given an expiration time which has already passed; RemoveKey revokes
+// a key immediately.
+func (s *Site) SetKeyExpiration(ctx context.Context, name, mac string,
+	expires *time.Time) error {
+
+	if err := checkExpiration(expires); err != nil {
+		return err
+	}
+
+	prop := "@/users/" + name + "/vpn/" + mac + "/public_key"
+	public, err := s.config.GetProp(prop)
+	if err != nil {
+		return fmt.Errorf("fetching %s: %v", prop, err)
+	}
+
+	// Test that the key is unchanged, so we don't accidentally resurrect a
+	// key that was deleted or replaced after we looked it up.
+	ops := []cfgapi.PropertyOp{
+		{
+			Op:    cfgapi.PropTestEq,
+			Name:  prop,
+			Value: public,
+		},
+		{
+			Op:      cfgapi.PropSet,
+			Name:    prop,
+			Value:   public,
+			Expires: expires,
+		},
+	}
+	_, err = s.config.Execute(ctx, ops).Wait(ctx)
+	return err
+}
+
+// RotateKey issues a replacement for an existing wireguard key.  The new key
+// inherits the old key's label, and expires at the provided time.  The old key
+// continues to work for the grace period, giving the user time to install the
+// new configuration, after which it expires.  With no grace period, the old
+// key is removed immediately.
+func (s *Site) RotateKey(ctx context.Context, name, mac string,
+	grace time.Duration, expires *time.Time) (*AddKeyResult, error) {
+
+	keys, err := s.GetKeys(name)
+	if err != nil {
+		return nil, err
+	}
+	old := keys[mac]
+	if old == nil {
+		return nil, fmt.Errorf("no such key: %s", mac)
+	}
+
+	res, err := s.AddKey(ctx, name, old.Label, "", expires)
+	if err != nil {
+		return nil, err
+	}
+
+	if grace <= 0 {
+		err = s.RemoveKey(ctx, name, mac, old.Key.String())
+	} else {
+		revoke := time.Now().Add(grace)
+		if old.Expires == nil || old.Expires.After(revoke) {
+			err = s.SetKeyExpiration(ctx, name, mac, &revoke)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("revoking old key %s: %v", mac, err)
+	}
+
+	return res, err
+}
+
 // IsEnabled checks whether the VPN functionality has been enabled for this site
 func (s *Site) IsEnabled() bool {
 	enabled, _ := s.config.GetPropBool(EnabledProp)
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wgsite
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+const testServerKey = "c2VydmVyLXB1YmxpYy1rZXktZm9yLXRlc3RpbmcxMjM="
+
+// Build a site with a complete server configuration and a single user, but
+// no keys.
+func testKeySite(t *testing.T) *Site {
+	config := testPolicyConfig(t, map[string]string{
+		"@/users/" + testUser + "/uid": testUser,
+		PublicProp:                     testServerKey,
+		AddressProp:                    "vpn.example.com",
+		PortProp:                       "51820",
+		LastMacProp:                    "00:40:54:00:00:00",
+	})
+
+	start := net.ParseIP("192.168.151.0")
+	return &Site{
+		config: config,
+		subnets: map[string]string{
+			"standard": "192.168.131.0/24",
+			"devices":  "192.168.141.0/24",
+			"vpn":      "192.168.151.0/24",
+		},
+		vpnStart:  start,
+		vpnSpan:   253,
+		vpnRouter: net.ParseIP("192.168.151.1"),
+	}
+}
+
+func TestSetKeyExpiration(t *testing.T) {
+	ctx := context.Background()
+	s := testKeySite(t)
+
+	res, err := s.AddKey(ctx, testUser, "laptop", "", nil)
+	if err != nil {
+		t.Fatalf("adding key: %v", err)
+	}
+
+	getExpires := func() *time.Time {
+		keys, err := s.GetKeys(testUser)
+		if err != nil || keys[res.Mac] == nil {
+			t.Fatalf("fetching key %s: %v", res.Mac, err)
+		}
+		return keys[res.Mac].Expires
+	}
+	if exp := getExpires(); exp != nil {
+		t.Errorf("new key expires at %v, expected never", exp)
+	}
+
+	when := time.Now().Add(time.Hour).Truncate(time.Second)
+	if err = s.SetKeyExpiration(ctx, testUser, res.Mac, &when); err != nil {
+		t.Fatalf("setting expiration: %v", err)
+	}
+	if exp := getExpires(); exp == nil || !exp.Equal(when) {
+		t.Errorf("key expires at %v, expected %v", exp, when)
+	}
+
+	// An expiration time in the past is rejected, leaving the key alone
+	past := time.Now().Add(-time.Hour)
+	if err = s.SetKeyExpiration(ctx, testUser, res.Mac, &past); err == nil {
+		t.Errorf("set an expiration time in the past")
+	}
+	if exp := getExpires(); exp == nil || !exp.Equal(when) {
+		t.Errorf("key expires at %v, expected %v", exp, when)
+	}
+
+	// Clearing the expiration means the key lasts forever
+	if err = s.SetKeyExpiration(ctx, testUser, res.Mac, nil); err != nil {
+		t.Fatalf("clearing expiration: %v", err)
+	}
+	if exp := getExpires(); exp != nil {
+		t.Errorf("key expires at %v, expected never", exp)
+	}
+
+	if err = s.SetKeyExpiration(ctx, testUser, "00:40:54:00:00:99",
+		&when); err == nil {
+		t.Errorf("set the expiration time of a missing key")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	ctx := context.Background()
+	s := testKeySite(t)
+
+	if _, err := s.AddKey(ctx, testUser, "", "",
+		&time.Time{}); err == nil {
+		t.Errorf("added a key which has already expired")
+	}
+
+	old, err := s.AddKey(ctx, testUser, "laptop", "", nil)
+	if err != nil {
+		t.Fatalf("adding key: %v", err)
+	}
+
+	// The replacement inherits the label, and the old key stays usable
+	// for the grace period.
+	when := time.Now().Add(30 * 24 * time.Hour)
+	res, err := s.RotateKey(ctx, testUser, old.Mac, time.Hour, &when)
+	if err != nil {
+		t.Fatalf("rotating key: %v", err)
+	}
+	if res.Mac == old.Mac || res.Publickey == old.Publickey {
+		t.Errorf("rotation reused the old key")
+	}
+	if res.Label != "laptop" {
+		t.Errorf("new key has label %q, expected %q", res.Label,
+			"laptop")
+	}
+	if res.Expires == nil || !res.Expires.Equal(when) {
+		t.Errorf("new key expires at %v, expected %v", res.Expires,
+			when)
+	}
+
+	keys, err := s.GetKeys(testUser)
+	if err != nil {
+		t.Fatalf("fetching keys: %v", err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("found %d keys after rotation, expected 2", len(keys))
+	}
+	revoke := keys[old.Mac].Expires
+	if revoke == nil || revoke.After(time.Now().Add(time.Hour)) {
+		t.Errorf("old key expires at %v, expected within the hour",
+			revoke)
+	}
+
+	// A replacement which would already have expired is rejected
+	past := time.Now().Add(-time.Hour)
+	if _, err = s.RotateKey(ctx, testUser, res.Mac, 0, &past); err == nil {
+		t.Errorf("rotated to a key which has already expired")
+	}
+
+	// With no grace period, the old key is removed immediately
+	if _, err = s.RotateKey(ctx, testUser, res.Mac, 0, nil); err != nil {
+		t.Fatalf("rotating key without grace: %v", err)
+	}
+	keys, _ = s.GetKeys(testUser)
+	if keys[res.Mac] != nil {
+		t.Errorf("old key survived rotation without grace")
+	}
+	if len(keys) != 2 {
+		t.Errorf("found %d keys after second rotation, expected 2",
+			len(keys))
+	}
+
+	if _, err = s.RotateKey(ctx, testUser, "00:40:54:00:00:99", 0,
+		nil); err == nil {
+		t.Errorf("rotated a missing key")
+	}
+}
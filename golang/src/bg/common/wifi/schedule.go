@@ -0,0 +1,198 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wifi
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule describes the weekly windows during which a virtual AP should be
+// available.  It is written as a comma-separated list of windows, each of which
+// is a set of days and a time range in the site's local time:
+//
+//    mon-fri 08:00-18:00, sat 10:00-14:00
+//    daily 22:00-02:00
+//    sat+sun 00:00-24:00
+//
+// A window whose end precedes its start runs past midnight into the following
+// day.
+type Schedule []ScheduleWindow
+
+// ScheduleWindow is a single recurring window in a Schedule
+type ScheduleWindow struct {
+	Days  [7]bool       // indexed by time.Weekday
+	Start time.Duration // offset from midnight
+	End   time.Duration // offset from midnight
+}
+
+var dayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseDay(name string) (time.Weekday, error) {
+	name = strings.ToLower(name)
+	if len(name) > 3 {
+		name = name[:3]
+	}
+	if d, ok := dayNames[name]; ok {
+		return d, nil
+	}
+	return 0, fmt.Errorf("invalid day: %s", name)
+}
+
+// Parse a day specification: "daily", a single day, a range of days, or a
+// '+'-separated list of either.
+func parseDays(spec string) ([7]bool, error) {
+	var days [7]bool
+
+	if strings.EqualFold(spec, "daily") || spec == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, field := range strings.Split(spec, "+") {
+		f := strings.Split(field, "-")
+		if len(f) > 2 {
+			return days, fmt.Errorf("invalid day range: %s", field)
+		}
+
+		first, err := parseDay(f[0])
+		if err != nil {
+			return days, err
+		}
+		last := first
+		if len(f) == 2 {
+			if last, err = parseDay(f[1]); err != nil {
+				return days, err
+			}
+		}
+
+		// Ranges may wrap around the end of the week (e.g., fri-mon)
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// Parse a time of day in HH:MM format.  24:00 is allowed as the end of a day.
+func parseTimeOfDay(val string) (time.Duration, error) {
+	f := strings.Split(val, ":")
+	if len(f) != 2 || len(f[1]) != 2 {
+		return 0, fmt.Errorf("invalid time: %s", val)
+	}
+
+	hour, err := strconv.Atoi(f[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", val)
+	}
+	min, err := strconv.Atoi(f[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", val)
+	}
+	if hour < 0 || min < 0 || min > 59 || hour > 24 ||
+		(hour == 24 && min != 0) {
+		return 0, fmt.Errorf("invalid time: %s", val)
+	}
+
+	return time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute,
+		nil
+}
+
+// ParseSchedule converts a schedule string into a Schedule.  An empty string
+// results in an empty Schedule, which is always active.
+func ParseSchedule(spec string) (Schedule, error) {
+	sched := make(Schedule, 0)
+
+	for _, w := range strings.Split(spec, ",") {
+		var err error
+
+		w = strings.TrimSpace(w)
+		if w == "" {
+			continue
+		}
+
+		f := strings.Fields(w)
+		if len(f) != 2 {
+			return nil, fmt.Errorf("invalid window: %s", w)
+		}
+
+		window := ScheduleWindow{}
+		if window.Days, err = parseDays(f[0]); err != nil {
+			return nil, err
+		}
+
+		times := strings.Split(f[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid time range: %s", f[1])
+		}
+		if window.Start, err = parseTimeOfDay(times[0]); err != nil {
+			return nil, err
+		}
+		if window.End, err = parseTimeOfDay(times[1]); err != nil {
+			return nil, err
+		}
+		if window.Start == window.End {
+			return nil, fmt.Errorf("empty time range: %s", f[1])
+		}
+
+		sched = append(sched, window)
+	}
+
+	return sched, nil
+}
+
+// Active returns true if the provided time falls within one of the schedule's
+// windows.  The caller is responsible for converting the time into the site's
+// local time zone.
+func (s Schedule) Active(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	tod := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+
+	for _, w := range s {
+		if w.Start < w.End {
+			if w.Days[day] && tod >= w.Start && tod < w.End {
+				return true
+			}
+		} else {
+			// The window runs past midnight into the following day
+			if w.Days[day] && tod >= w.Start {
+				return true
+			}
+			if w.Days[yesterday] && tod < w.End {
+				return true
+			}
+		}
+	}
+
+	return false
+}
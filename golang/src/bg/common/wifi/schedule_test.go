@@ -0,0 +1,87 @@
+/*
+ * Copyright 2020 Brightgate Inc.
+ *
+ * This Source Code Form is subject to the terms of the Mozilla Public
+ * License, v. 2.0. If a copy of the MPL was not distributed with this
+ * file, You can obtain one at https://mozilla.org/MPL/2.0/.
+ */
+
+
+package wifi
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	good := []string{
+		"",
+		"mon-fri 08:00-18:00",
+		"mon-fri 08:00-18:00, sat 10:00-14:00",
+		"daily 22:00-02:00",
+		"sat+sun 00:00-24:00",
+		"Friday-Monday 17:30-09:00",
+	}
+	bad := []string{
+		"mon-fri",
+		"mon-fri 08:00",
+		"mon-fri 8-18",
+		"funday 08:00-18:00",
+		"mon-fri 08:00-25:00",
+		"mon-fri 08:60-18:00",
+		"mon 08:00-08:00",
+		"mon-tue-wed 08:00-18:00",
+	}
+
+	for _, s := range good {
+		if _, err := ParseSchedule(s); err != nil {
+			t.Errorf("%q: unexpected error: %v", s, err)
+		}
+	}
+	for _, s := range bad {
+		if _, err := ParseSchedule(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	// 2020-06-01 is a Monday
+	at := func(day int, hour, min int) time.Time {
+		return time.Date(2020, 6, day, hour, min, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		sched  string
+		when   time.Time
+		active bool
+	}{
+		{"", at(1, 3, 0), true},
+		{"mon-fri 08:00-18:00", at(1, 8, 0), true},
+		{"mon-fri 08:00-18:00", at(1, 17, 59), true},
+		{"mon-fri 08:00-18:00", at(1, 18, 0), false},
+		{"mon-fri 08:00-18:00", at(1, 7, 59), false},
+		{"mon-fri 08:00-18:00", at(6, 12, 0), false},
+		{"mon-fri 08:00-18:00, sat 10:00-14:00", at(6, 12, 0), true},
+		{"sat+sun 00:00-24:00", at(7, 23, 59), true},
+		{"sat+sun 00:00-24:00", at(8, 0, 0), false},
+		{"fri 22:00-02:00", at(5, 23, 0), true},
+		{"fri 22:00-02:00", at(6, 1, 59), true},
+		{"fri 22:00-02:00", at(6, 2, 0), false},
+		{"fri 22:00-02:00", at(4, 1, 0), false},
+		{"sat-mon 10:00-11:00", at(7, 10, 30), true},
+		{"sat-mon 10:00-11:00", at(2, 10, 30), false},
+	}
+
+	for _, tc := range tests {
+		sched, err := ParseSchedule(tc.sched)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", tc.sched, err)
+		}
+		if a := sched.Active(tc.when); a != tc.active {
+			t.Errorf("%q at %s: got %v, expected %v", tc.sched,
+				tc.when.Format(time.RFC1123), a, tc.active)
+		}
+	}
+}
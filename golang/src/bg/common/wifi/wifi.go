@@ -84,3 +84,35 @@ func ExpandChannels(primary, secondary, width int) []int {
 	return c
 }
 
+// In 802.11n, a 40MHz channel is constructed from two 20MHz channels.  These
+// tables list the 5GHz primary channels whose secondary channel lies above
+// ([HT40+] in hostapd's ht_capab) or below ([HT40-]) them.  The 2.4GHz band is
+// too crowded for bonded channels, so none of its channels are included.
+var (
+	HT40Above = map[int]bool{
+		36: true, 44: true, 52: true, 60: true, 100: true, 108: true,
+		116: true, 124: true, 132: true, 140: true, 149: true, 157: true,
+	}
+	HT40Below = map[int]bool{
+		40: true, 48: true, 56: true, 64: true, 104: true, 112: true,
+		120: true, 128: true, 136: true, 144: true, 153: true, 161: true,
+	}
+)
+
+// SpanChannels returns the 20MHz channels covered by a channel of the given
+// width, identified as hostapd does: by its primary 20MHz channel for 40MHz
+// channels, and by its lowest 20MHz channel for 80MHz channels.
+func SpanChannels(channel, width int) []int {
+	switch width {
+	case 40:
+		if HT40Above[channel] {
+			return []int{channel, channel + 4}
+		}
+		return []int{channel - 4, channel}
+	case 80:
+		return ExpandChannels(channel, 0, width)
+	default:
+		return []int{channel}
+	}
+}
+